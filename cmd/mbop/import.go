@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/redhatinsights/mbop/internal/handlers"
+	"github.com/redhatinsights/mbop/internal/store"
+)
+
+/*
+runImport is the `mbop import` subcommand, it does the same as the admin
+import endpoint but straight against the configured store:
+
+	mbop import [-format json|csv] [-actor name] <file|->
+*/
+func runImport(args []string, stdin io.Reader, stdout io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	format := fs.String("format", "", "json or csv, guessed from the file extension when empty")
+	actor := fs.String("actor", "admin-import", "who to record in the registrations' history")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: mbop import [-format json|csv] [-actor name] <file|->")
+	}
+
+	path := fs.Arg(0)
+	in := stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	if *format == "" {
+		*format = string(store.BulkFormatJSON)
+		if strings.EqualFold(filepath.Ext(path), ".csv") {
+			*format = string(store.BulkFormatCSV)
+		}
+	}
+
+	rows, err := store.ParseBulkRegistrations(in, store.BulkFormat(*format))
+	if err != nil {
+		return err
+	}
+
+	results, ok, err := handlers.ValidateImport(rows)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		printImportErrors(stdout, results)
+		return store.ErrImportFailed
+	}
+
+	results, err = store.GetStore().Import(context.Background(), rows, *actor)
+	printImportErrors(stdout, results)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "imported %d registrations\n", len(results))
+	return nil
+}
+
+func printImportErrors(w io.Writer, results []store.ImportResult) {
+	for _, res := range results {
+		if res.Error != "" {
+			fmt.Fprintf(w, "row %d (%s): %s\n", res.Row, res.UID, res.Error)
+		}
+	}
+}
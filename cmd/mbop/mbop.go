@@ -1,9 +1,12 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -12,6 +15,7 @@ import (
 	l "github.com/redhatinsights/mbop/internal/logger"
 	"github.com/redhatinsights/mbop/internal/middleware"
 	"github.com/redhatinsights/mbop/internal/service/mailer"
+	"github.com/redhatinsights/mbop/internal/service/outbox"
 	"github.com/redhatinsights/mbop/internal/store"
 	"github.com/redhatinsights/platform-go-middlewares/identity"
 )
@@ -23,10 +27,85 @@ func main() {
 		panic(err)
 	}
 
+	// migrate runs before the store is set up, setting it up would first
+	// migrate the database to the latest version
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:], os.Stdout); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	if err := store.SetupStore(); err != nil {
 		panic(err)
 	}
 
+	// subcommands run against the store and exit instead of serving
+	if len(os.Args) > 1 {
+		var err error
+		switch os.Args[1] {
+		case "import":
+			err = runImport(os.Args[2:], os.Stdin, os.Stdout)
+		case "snapshot":
+			err = runSnapshot(os.Args[2:], os.Stdin, os.Stdout)
+		default:
+			err = fmt.Errorf("unknown command %q", os.Args[1])
+		}
+
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	// background jobs run until we receive a shutdown signal, we wait for them
+	// before exiting so they get a chance to finish up
+	ctx, cancel := context.WithCancel(context.Background())
+	var jobs sync.WaitGroup
+
+	retention, err := time.ParseDuration(conf.RegistrationRetention)
+	if err != nil {
+		panic(err)
+	}
+	purgeInterval, err := time.ParseDuration(conf.RegistrationPurgeInterval)
+	if err != nil {
+		panic(err)
+	}
+	lastSeenInterval, err := time.ParseDuration(conf.LastSeenFlushInterval)
+	if err != nil {
+		panic(err)
+	}
+	allowlistCleanupInterval, err := time.ParseDuration(conf.AllowlistCleanupInterval)
+	if err != nil {
+		panic(err)
+	}
+	jobs.Go(func() { store.RunPurger(ctx, purgeInterval, retention) })
+	jobs.Go(func() { store.RunLastSeenFlusher(ctx, lastSeenInterval) })
+	jobs.Go(func() { store.RunAllowlistCleaner(ctx, allowlistCleanupInterval) })
+
+	// without a sink the events just stay in the outbox until one is set up
+	if conf.OutboxSink != "" {
+		dispatcher, err := outbox.NewDispatcher()
+		if err != nil {
+			panic(err)
+		}
+		outboxInterval, err := time.ParseDuration(conf.OutboxPollInterval)
+		if err != nil {
+			panic(err)
+		}
+		jobs.Go(func() { dispatcher.Run(ctx, outboxInterval) })
+	}
+
+	// a broken schema would otherwise only show up on the first registration
+	if _, err := handlers.ExtraSchema(); err != nil {
+		panic(err)
+	}
+	if _, err := handlers.TrustedProxies(); err != nil {
+		panic(err)
+	}
+
 	mux := http.NewServeMux()
 
 	withIdentity := func(h http.HandlerFunc) http.Handler {
@@ -46,15 +125,41 @@ func main() {
 
 	mux.Handle("GET /v1/registrations", withIdentity(handlers.RegistrationListHandler))
 	mux.Handle("POST /v1/registrations", withIdentity(handlers.RegistrationCreateHandler))
+	mux.Handle("PATCH /v1/registrations/{uid}", withIdentity(handlers.RegistrationUpdateHandler))
 	mux.Handle("DELETE /v1/registrations/{uid}", withIdentity(handlers.RegistrationDeleteHandler))
+	mux.Handle("GET /v1/registrations/{uid}/history", withIdentity(handlers.RegistrationHistoryHandler))
+	mux.Handle("POST /v1/registrations/{uid}/restore", withIdentity(handlers.RegistrationRestoreHandler))
+	mux.Handle("POST /v1/registrations/{uid}/rotate", withIdentity(handlers.RegistrationRotateHandler))
+	mux.Handle("POST /v1/registrations/{uid}/approve", withIdentity(handlers.RegistrationApproveHandler))
+	mux.Handle("POST /v1/registrations/{uid}/reject", withIdentity(handlers.RegistrationRejectHandler))
 	mux.Handle("GET /v1/registrations/token", withIdentity(handlers.TokenHandler))
+	mux.Handle("GET /v1/registrations/quota", withIdentity(handlers.RegistrationQuotaHandler))
+	mux.Handle("GET /v1/registrations/codes", withIdentity(handlers.EnrollmentCodeListHandler))
+	mux.Handle("POST /v1/registrations/codes", withIdentity(handlers.EnrollmentCodeCreateHandler))
+	// the enrollment code stands in for the identity
+	mux.HandleFunc("POST /v1/registrations/enroll", handlers.RegistrationEnrollHandler)
 	mux.Handle("GET /api/mbop/v1/allowlist", withIdentity(handlers.AllowlistListHandler))
+	mux.Handle("GET /api/mbop/v1/allowlist/check", withIdentity(handlers.AllowlistCheckHandler))
 	mux.Handle("POST /api/mbop/v1/allowlist", withIdentity(handlers.AllowlistCreateHandler))
 	mux.Handle("DELETE /api/mbop/v1/allowlist", withIdentity(handlers.AllowlistDeleteHandler))
 
+	withAdminKey := func(h http.HandlerFunc) http.Handler {
+		return middleware.RequireAdminKey(h)
+	}
+
+	mux.Handle("POST /api/mbop/v1/admin/registrations/import", withAdminKey(handlers.RegistrationImportHandler))
+	mux.Handle("GET /api/mbop/v1/admin/registrations/export", withAdminKey(handlers.RegistrationExportHandler))
+	mux.Handle("GET /api/mbop/v1/admin/snapshot", withAdminKey(handlers.SnapshotDumpHandler))
+	mux.Handle("POST /api/mbop/v1/admin/snapshot", withAdminKey(handlers.SnapshotRestoreHandler))
+	mux.Handle("GET /api/mbop/v1/admin/orgs/{orgID}/quota", withAdminKey(handlers.OrgQuotaHandler))
+	mux.Handle("PUT /api/mbop/v1/admin/orgs/{orgID}/quota", withAdminKey(handlers.OrgQuotaUpdateHandler))
+	mux.Handle("DELETE /api/mbop/v1/admin/orgs/{orgID}/quota", withAdminKey(handlers.OrgQuotaDeleteHandler))
+	mux.Handle("GET /api/mbop/v1/admin/orgs/{orgID}/settings", withAdminKey(handlers.OrgSettingsHandler))
+	mux.Handle("PUT /api/mbop/v1/admin/orgs/{orgID}/settings", withAdminKey(handlers.OrgSettingsUpdateHandler))
+
 	r := middleware.Logging(mux)
 
-	err := mailer.InitConfig()
+	err = mailer.InitConfig()
 	if err != nil {
 		// TODO: should we panic if the mailer module fails to init?
 		l.Log.Info("failed to init mailer module", "error", err)
@@ -93,4 +198,7 @@ func main() {
 	}
 
 	<-interrupts
+
+	cancel()
+	jobs.Wait()
 }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/redhatinsights/mbop/internal/store"
+)
+
+const migrateUsage = "usage: mbop migrate up | down <n> | goto <version> | force <version> | version"
+
+/*
+runMigrate is the `mbop migrate` subcommand, it runs the embedded migrations
+of the configured store by hand:
+
+	mbop migrate up              apply every pending migration
+	mbop migrate down <n>        roll back the last n migrations
+	mbop migrate goto <version>  migrate up or down to version
+	mbop migrate force <version> record version without running anything
+	mbop migrate version         print the applied version
+
+It runs before the store is set up, so DATABASE_AUTO_MIGRATE doesn't get a
+chance to migrate first. Versions are the same in both dialects but sqlite's
+start at 9, below that goto and force are rejected and down stops there.
+*/
+func runMigrate(args []string, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	op := args[0]
+	var arg int
+	switch op {
+	case "up", "version":
+		if len(args) != 1 {
+			return errors.New(migrateUsage)
+		}
+	case "down", "goto", "force":
+		if len(args) != 2 {
+			return errors.New(migrateUsage)
+		}
+		n, err := strconv.Atoi(args[1])
+		if err != nil {
+			return fmt.Errorf("invalid %s argument %q, needs to be a number", op, args[1])
+		}
+		arg = n
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	m, err := store.NewMigrator()
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	switch op {
+	case "up":
+		err = m.Up()
+	case "down":
+		err = m.Down(arg)
+	case "goto":
+		if arg < int(m.First()) {
+			return fmt.Errorf("goto needs a version of %d or more, the first migration", m.First())
+		}
+		err = m.Goto(uint(arg))
+	case "force":
+		err = m.Force(arg)
+	}
+	if err != nil {
+		return err
+	}
+
+	version, dirty, ok, err := m.Version()
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case !ok:
+		fmt.Fprintln(stdout, "no migrations applied")
+	case dirty:
+		fmt.Fprintf(stdout, "version %d (dirty)\n", version)
+	default:
+		fmt.Fprintf(stdout, "version %d\n", version)
+	}
+
+	return nil
+}
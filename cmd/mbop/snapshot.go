@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/redhatinsights/mbop/internal/store"
+)
+
+const snapshotUsage = "usage: mbop snapshot dump [file|-] | restore [-actor name] <file|->"
+
+/*
+runSnapshot is the `mbop snapshot` subcommand, the same as the admin snapshot
+endpoints but straight against the configured store:
+
+	mbop snapshot dump [file|-]                  write every registration and allowlist block
+	mbop snapshot restore [-actor name] <file|-> load a snapshot in one transaction
+
+Dumping from one STORE_BACKEND and restoring into another moves an
+environment between backends.
+*/
+func runSnapshot(args []string, stdin io.Reader, stdout io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(snapshotUsage)
+	}
+
+	switch args[0] {
+	case "dump":
+		return dumpSnapshot(args[1:], stdout)
+	case "restore":
+		return restoreSnapshot(args[1:], stdin, stdout)
+	default:
+		return errors.New(snapshotUsage)
+	}
+}
+
+func dumpSnapshot(args []string, stdout io.Writer) error {
+	if len(args) > 1 {
+		return errors.New(snapshotUsage)
+	}
+
+	snap, err := store.GetStore().DumpSnapshot(context.Background())
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 || args[0] == "-" {
+		return snap.Write(stdout)
+	}
+
+	f, err := os.Create(args[0])
+	if err != nil {
+		return err
+	}
+	if err := snap.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "dumped %d registrations and %d allowlist blocks\n", len(snap.Registrations), len(snap.Allowlist))
+	return nil
+}
+
+func restoreSnapshot(args []string, stdin io.Reader, stdout io.Writer) error {
+	actor := "admin-snapshot"
+	if len(args) == 3 && args[0] == "-actor" {
+		actor, args = args[1], args[2:]
+	}
+	if len(args) != 1 {
+		return errors.New(snapshotUsage)
+	}
+
+	in := stdin
+	if args[0] != "-" {
+		f, err := os.Open(args[0])
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	snap, err := store.ReadSnapshot(in)
+	if err != nil {
+		return err
+	}
+
+	conflicts, err := store.GetStore().LoadSnapshot(context.Background(), snap, actor)
+	for _, c := range conflicts {
+		fmt.Fprintf(stdout, "%s %d (%s): %s\n", c.Type, c.Index, c.Key, c.Error)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "restored %d registrations and %d allowlist blocks\n", len(snap.Registrations), len(snap.Allowlist))
+	return nil
+}
@@ -42,12 +42,62 @@ type MbopConfig struct {
 
 	AllowlistEnabled bool
 	AllowlistHeader  string
+	// put the resolved client address in the allowlist 403
+	AllowlistDebug bool
+	// proxies in front of mbop, the client address is the first one in the
+	// forwarded chain that isn't one of them
+	TrustedProxies string
+	// without TrustedProxies, how far from the right of the chain the client
+	// address is
+	TrustedProxyHops int
+	ClientCertHeader string
+	AdminAPIKey      string
 	StoreBackend     string
 	DatabaseHost     string
 	DatabasePort     string
 	DatabaseUser     string
 	DatabasePassword string
 	DatabaseName     string
+	// DatabaseURL replaces the host/port/user/password/name settings above
+	DatabaseURL              string
+	DatabaseSSLMode          string
+	DatabaseSSLRootCert      string
+	DatabaseSSLCert          string
+	DatabaseSSLKey           string
+	DatabaseMaxOpenConns     int
+	DatabaseMaxIdleConns     int
+	DatabaseConnMaxLifetime  string
+	DatabaseStatementTimeout string
+	// per-query timeout for the sql stores, 0 disables it
+	DatabaseQueryTimeout string
+	// run pending migrations when the store is set up
+	DatabaseAutoMigrate bool
+	SQLitePath          string
+
+	RegistrationRetention     string
+	RegistrationPurgeInterval string
+	LastSeenFlushInterval     string
+	// how often expired allowlist blocks are deleted
+	AllowlistCleanupInterval string
+	// default max live registrations per org, 0 is unlimited
+	RegistrationQuota int
+	// how long an enrollment code can be redeemed for, also the longest a
+	// caller can ask for
+	EnrollmentCodeTTL string
+	// json schema registration extras have to match, empty accepts anything
+	RegistrationExtraSchema string
+
+	// where change events are delivered to, empty leaves them in the outbox
+	OutboxSink           string
+	OutboxWebhookURL     string
+	OutboxWebhookSecret  string
+	OutboxWebhookTimeout string
+	OutboxFile           string
+	OutboxPollInterval   string
+	OutboxBatchSize      int
+	OutboxLease          string
+	OutboxRetryBackoff   string
+	OutboxMaxBackoff     string
 
 	Port    string
 	TLSPort string
@@ -64,10 +114,17 @@ func Get() *MbopConfig {
 
 	disableCatchAll, _ := strconv.ParseBool(fetchWithDefault("DISABLE_CATCHALL", "false"))
 	allowlistEnabled, _ := strconv.ParseBool(fetchWithDefault("ALLOWLIST_ENABLED", "false"))
+	allowlistDebug, _ := strconv.ParseBool(fetchWithDefault("ALLOWLIST_DEBUG", "false"))
 	debug, _ := strconv.ParseBool(fetchWithDefault("DEBUG", "false"))
+	autoMigrate, _ := strconv.ParseBool(fetchWithDefault("DATABASE_AUTO_MIGRATE", "true"))
 	certDir := fetchWithDefault("CERT_DIR", "/certs")
 	keyCloakTimeout, _ := strconv.ParseInt(fetchWithDefault("KEYCLOAK_TIMEOUT", "60"), 0, 64)
 	userServiceTimeout, _ := strconv.ParseInt(fetchWithDefault("KEYCLOAK_USER_SERVICE_TIMEOUT", "60"), 0, 64)
+	dbMaxOpenConns, _ := strconv.ParseInt(fetchWithDefault("DATABASE_MAX_OPEN_CONNS", "20"), 0, 64)
+	dbMaxIdleConns, _ := strconv.ParseInt(fetchWithDefault("DATABASE_MAX_IDLE_CONNS", "5"), 0, 64)
+	registrationQuota, _ := strconv.ParseInt(fetchWithDefault("REGISTRATION_QUOTA", "0"), 0, 64)
+	outboxBatchSize, _ := strconv.ParseInt(fetchWithDefault("OUTBOX_BATCH_SIZE", "100"), 0, 64)
+	trustedProxyHops, _ := strconv.ParseInt(fetchWithDefault("TRUSTED_PROXY_HOPS", "1"), 0, 64)
 
 	var tls bool
 	_, err := os.Stat(certDir + "/tls.crt")
@@ -87,14 +144,50 @@ func Get() *MbopConfig {
 		SESSecretKey:    fetchWithDefault("SES_SECRET_KEY", ""),
 		DisableCatchall: disableCatchAll,
 
-		DatabaseHost:     fetchWithDefault("DATABASE_HOST", "localhost"),
-		DatabasePort:     fetchWithDefault("DATABASE_PORT", "5432"),
-		DatabaseUser:     fetchWithDefault("DATABASE_USER", "postgres"),
-		DatabasePassword: fetchWithDefault("DATABASE_PASSWORD", ""),
-		DatabaseName:     fetchWithDefault("DATABASE_NAME", "mbop"),
-		StoreBackend:     fetchWithDefault("STORE_BACKEND", "memory"),
-		AllowlistEnabled: allowlistEnabled,
-		AllowlistHeader:  fetchWithDefault("ALLOWLIST_HEADER", "x-forwarded-for"),
+		DatabaseHost:             fetchWithDefault("DATABASE_HOST", "localhost"),
+		DatabasePort:             fetchWithDefault("DATABASE_PORT", "5432"),
+		DatabaseUser:             fetchWithDefault("DATABASE_USER", "postgres"),
+		DatabasePassword:         fetchWithDefault("DATABASE_PASSWORD", ""),
+		DatabaseName:             fetchWithDefault("DATABASE_NAME", "mbop"),
+		DatabaseURL:              fetchWithDefault("DATABASE_URL", ""),
+		DatabaseSSLMode:          fetchWithDefault("DATABASE_SSLMODE", "prefer"),
+		DatabaseSSLRootCert:      fetchWithDefault("DATABASE_SSLROOTCERT", ""),
+		DatabaseSSLCert:          fetchWithDefault("DATABASE_SSLCERT", ""),
+		DatabaseSSLKey:           fetchWithDefault("DATABASE_SSLKEY", ""),
+		DatabaseMaxOpenConns:     int(dbMaxOpenConns),
+		DatabaseMaxIdleConns:     int(dbMaxIdleConns),
+		DatabaseConnMaxLifetime:  fetchWithDefault("DATABASE_CONN_MAX_LIFETIME", "30m"),
+		DatabaseStatementTimeout: fetchWithDefault("DATABASE_STATEMENT_TIMEOUT", "0"),
+		DatabaseAutoMigrate:      autoMigrate,
+		SQLitePath:               fetchWithDefault("SQLITE_PATH", "mbop.db"),
+		DatabaseQueryTimeout:     fetchWithDefault("DATABASE_QUERY_TIMEOUT", "5s"),
+		StoreBackend:             fetchWithDefault("STORE_BACKEND", "memory"),
+		AllowlistEnabled:         allowlistEnabled,
+		AllowlistHeader:          fetchWithDefault("ALLOWLIST_HEADER", "x-forwarded-for"),
+		AllowlistDebug:           allowlistDebug,
+		TrustedProxies:           fetchWithDefault("TRUSTED_PROXIES", ""),
+		TrustedProxyHops:         int(trustedProxyHops),
+		ClientCertHeader:         fetchWithDefault("CLIENT_CERT_HEADER", "x-rh-certauth-cert"),
+		AdminAPIKey:              fetchWithDefault("ADMIN_API_KEY", ""),
+
+		RegistrationRetention:     fetchWithDefault("REGISTRATION_RETENTION", "720h"),
+		RegistrationPurgeInterval: fetchWithDefault("REGISTRATION_PURGE_INTERVAL", "1h"),
+		LastSeenFlushInterval:     fetchWithDefault("LAST_SEEN_FLUSH_INTERVAL", "30s"),
+		AllowlistCleanupInterval:  fetchWithDefault("ALLOWLIST_CLEANUP_INTERVAL", "1h"),
+		RegistrationQuota:         int(registrationQuota),
+		EnrollmentCodeTTL:         fetchWithDefault("ENROLLMENT_CODE_TTL", "1h"),
+		RegistrationExtraSchema:   fetchWithDefault("REGISTRATION_EXTRA_SCHEMA", ""),
+
+		OutboxSink:           fetchWithDefault("OUTBOX_SINK", ""),
+		OutboxWebhookURL:     fetchWithDefault("OUTBOX_WEBHOOK_URL", ""),
+		OutboxWebhookSecret:  fetchWithDefault("OUTBOX_WEBHOOK_SECRET", ""),
+		OutboxWebhookTimeout: fetchWithDefault("OUTBOX_WEBHOOK_TIMEOUT", "10s"),
+		OutboxFile:           fetchWithDefault("OUTBOX_FILE", "-"),
+		OutboxPollInterval:   fetchWithDefault("OUTBOX_POLL_INTERVAL", "5s"),
+		OutboxBatchSize:      int(outboxBatchSize),
+		OutboxLease:          fetchWithDefault("OUTBOX_LEASE", "5m"),
+		OutboxRetryBackoff:   fetchWithDefault("OUTBOX_RETRY_BACKOFF", "5s"),
+		OutboxMaxBackoff:     fetchWithDefault("OUTBOX_MAX_BACKOFF", "1h"),
 
 		CognitoAppClientID:     fetchWithDefault("COGNITO_APP_CLIENT_ID", ""),
 		CognitoAppClientSecret: fetchWithDefault("COGNITO_APP_CLIENT_SECRET", ""),
@@ -3,8 +3,9 @@ package handlers
 import (
 	"encoding/json"
 	"errors"
-	"net"
+	"fmt"
 	"net/http"
+	"net/netip"
 	"strings"
 	"time"
 
@@ -14,13 +15,50 @@ import (
 )
 
 type allowlistCreateRequest struct {
-	IPBlock string `json:"ip_block"`
+	IPBlock     string  `json:"ip_block"`
+	ExpiresAt   *string `json:"expires_at,omitempty"`
+	Description string  `json:"description,omitempty"`
 }
 
 type allowListResponse struct {
-	IPBlock   string    `json:"ip_block"`
-	OrgID     string    `json:"org_id"`
-	CreatedAt time.Time `json:"created_at"`
+	IPBlock     string     `json:"ip_block"`
+	OrgID       string     `json:"org_id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Description string     `json:"description,omitempty"`
+	CreatedBy   string     `json:"created_by,omitempty"`
+}
+
+type allowlistCheckResponse struct {
+	IP         string                       `json:"ip"`
+	Allowed    bool                         `json:"allowed"`
+	Matched    *allowListResponse           `json:"matched,omitempty"`
+	Candidates []allowlistCandidateResponse `json:"candidates"`
+}
+
+type allowlistCandidateResponse struct {
+	allowListResponse
+	CommonBits int  `json:"common_bits"`
+	Expired    bool `json:"expired,omitempty"`
+}
+
+// allowlistEntryResponse is a listed block, expired ones are listed (and
+// counted) until the cleaner deletes them but don't match anymore
+type allowlistEntryResponse struct {
+	allowListResponse
+	Expired bool `json:"expired,omitempty"`
+}
+
+type allowlistCollection struct {
+	Allowlist []allowlistEntryResponse `json:"allowlist"`
+	Meta      allowlistMeta            `json:"meta"`
+}
+
+type allowlistMeta struct {
+	Count  int              `json:"count"`
+	Limit  int              `json:"limit"`
+	Offset int              `json:"offset"`
+	Links  *paginationLinks `json:"links,omitempty"`
 }
 
 func AllowlistCreateHandler(w http.ResponseWriter, r *http.Request) {
@@ -37,21 +75,38 @@ func AllowlistCreateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if !strings.Contains(createReq.IPBlock, "/") {
-		createReq.IPBlock += "/32"
+	block := &store.AllowlistBlock{
+		IPBlock:     createReq.IPBlock,
+		OrgID:       id.Identity.OrgID,
+		Description: createReq.Description,
+		CreatedBy:   id.Identity.User.Username,
 	}
 
-	_, _, err = net.ParseCIDR(createReq.IPBlock)
-	if err != nil {
-		do400(w, "invalid IP block, needs to be an IPv4 range or single IP")
-		return
+	if createReq.ExpiresAt != nil {
+		expiresAt, err := time.Parse(time.RFC3339, *createReq.ExpiresAt)
+		if err != nil || !expiresAt.After(time.Now()) {
+			do400(w, "[expires_at] must be an RFC3339 timestamp in the future")
+			return
+		}
+		block.ExpiresAt = &expiresAt
 	}
 
 	db := store.GetStore()
 
-	err = db.AllowAddress(&store.AllowlistBlock{IPBlock: createReq.IPBlock, OrgID: id.Identity.OrgID})
+	// the store keeps blocks in canonical form, so the same network written
+	// differently is still a duplicate
+	err = db.AllowAddress(r.Context(), block)
 	if err != nil {
-		do500(w, "error storing address: "+err.Error())
+		if errors.Is(err, store.ErrInvalidIPBlock) {
+			do400(w, "invalid IP block, needs to be an IPv4 or IPv6 range or single IP")
+			return
+		}
+		if errors.Is(err, store.ErrAddressAlreadyAllowListed) {
+			doError(w, "ip block already allowlisted", 409)
+			return
+		}
+
+		doStoreError(w, "error storing address: ", err)
 		return
 	}
 
@@ -73,14 +128,23 @@ func AllowlistDeleteHandler(w http.ResponseWriter, r *http.Request) {
 
 	db := store.GetStore()
 
-	err := db.DenyAddress(&store.AllowlistBlock{IPBlock: block, OrgID: id.Identity.OrgID})
+	// blocks are stored normalized, but sqlite can still have ones added before
+	// that, which are only found the way they were written
+	normalized, err := store.NormalizeIPBlock(block)
+	if err != nil {
+		normalized = block
+	}
+	err = db.DenyAddress(r.Context(), &store.AllowlistBlock{IPBlock: normalized, OrgID: id.Identity.OrgID})
+	if errors.Is(err, store.ErrAddressNotAllowListed) && normalized != block {
+		err = db.DenyAddress(r.Context(), &store.AllowlistBlock{IPBlock: block, OrgID: id.Identity.OrgID})
+	}
 	if err != nil {
 		if errors.Is(err, store.ErrAddressNotAllowListed) {
 			doError(w, "ip not allowlisted", 404)
 			return
 		}
 
-		do500(w, "error deleting addressaddress: %w"+err.Error())
+		doStoreError(w, "error deleting address: ", err)
 		return
 	}
 
@@ -94,25 +158,153 @@ func AllowlistListHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// without any pagination parameters the whole allowlist is returned as a
+	// bare array, the way it always has been
+	params := r.URL.Query()
+	paginated := params.Has("limit") || params.Has("offset") || params.Has("cursor")
+
+	var q store.AllowlistQuery
+	if paginated {
+		var err error
+		q, err = getAllowlistQuery(r)
+		if err != nil {
+			do400(w, err.Error())
+			return
+		}
+	}
+
+	limit := q.Limit
+	if paginated {
+		q.Limit++
+	}
+
 	db := store.GetStore()
 
-	addrs, err := db.AllowedAddresses(id.Identity.OrgID)
+	addrs, count, err := db.AllowedAddresses(r.Context(), id.Identity.OrgID, q)
 	if err != nil {
-		do500(w, "error listing addresses: %w"+err.Error())
+		doStoreError(w, "error listing addresses: ", err)
 		return
 	}
 
-	out := make([]allowListResponse, len(addrs))
-	for i, addr := range addrs {
-		out[i] = allowListResponse{
-			IPBlock:   addr.IPBlock,
-			OrgID:     addr.OrgID,
-			CreatedAt: addr.CreatedAt,
+	hasMore := paginated && len(addrs) > limit
+	if hasMore {
+		if q.Cursor != nil && q.Cursor.Backward {
+			addrs = addrs[1:]
+		} else {
+			addrs = addrs[:limit]
+		}
+	}
+
+	now := time.Now()
+	out := make([]allowlistEntryResponse, len(addrs))
+	for i := range addrs {
+		out[i] = allowlistEntryResponse{
+			allowListResponse: newAllowlistResponse(&addrs[i]),
+			Expired:           addrs[i].Expired(now),
 		}
 	}
 
-	err = json.NewEncoder(w).Encode(out)
+	if !paginated {
+		err = json.NewEncoder(w).Encode(out)
+		if err != nil {
+			l.Log.Info("failed to encode response", "error", err)
+		}
+		return
+	}
+
+	sendJSON(w, &allowlistCollection{
+		Allowlist: out,
+		Meta: allowlistMeta{
+			Count:  count,
+			Limit:  limit,
+			Offset: q.Offset,
+			Links:  getPageLinks(r, q.Cursor, q.Offset, hasMore, allowlistCursor(addrs, 0), allowlistCursor(addrs, len(addrs)-1)),
+		},
+	})
+}
+
+// AllowlistCheckHandler explains whether an address would be allowed to
+// register in the admin's org, and which block allowed it or came closest
+func AllowlistCheckHandler(w http.ResponseWriter, r *http.Request) {
+	id := identity.Get(r.Context())
+	if !id.Identity.User.OrgAdmin {
+		doError(w, "user must be org admin to check addresses against the allowlist", 403)
+		return
+	}
+
+	ip := r.URL.Query().Get("ip")
+	if ip == "" {
+		do400(w, "need address in query in the form `/api/mbop/v1/allowlist/check?ip={ip}`")
+		return
+	}
+
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil || addr.Zone() != "" {
+		do400(w, "[ip] must be an IPv4 or IPv6 address")
+		return
+	}
+
+	check, err := store.CheckIP(r.Context(), store.GetStore(), addr, id.Identity.OrgID)
 	if err != nil {
-		l.Log.Info("failed to encode response", "error", err)
+		doStoreError(w, "error checking address: ", err)
+		return
+	}
+
+	out := allowlistCheckResponse{
+		IP:         check.IP,
+		Allowed:    check.Allowed,
+		Candidates: make([]allowlistCandidateResponse, len(check.Candidates)),
+	}
+	if check.Matched != nil {
+		matched := newAllowlistResponse(check.Matched)
+		out.Matched = &matched
+	}
+	for i := range check.Candidates {
+		c := &check.Candidates[i]
+		out.Candidates[i] = allowlistCandidateResponse{
+			allowListResponse: newAllowlistResponse(&c.AllowlistBlock),
+			CommonBits:        c.CommonBits,
+			Expired:           c.Expired,
+		}
+	}
+
+	sendJSON(w, &out)
+}
+
+func newAllowlistResponse(b *store.AllowlistBlock) allowListResponse {
+	return allowListResponse{
+		IPBlock:     b.IPBlock,
+		OrgID:       b.OrgID,
+		CreatedAt:   b.CreatedAt,
+		ExpiresAt:   b.ExpiresAt,
+		Description: b.Description,
+		CreatedBy:   b.CreatedBy,
+	}
+}
+
+func getAllowlistQuery(r *http.Request) (store.AllowlistQuery, error) {
+	var q store.AllowlistQuery
+
+	limit, err := getLimit(r)
+	if err != nil {
+		return q, err
+	}
+	offset, err := getOffset(r)
+	if err != nil {
+		return q, err
+	}
+	if limit < 0 || offset < 0 {
+		return q, fmt.Errorf("limit and offset cannot be negative")
+	}
+	q.Limit, q.Offset = limit, offset
+
+	q.Cursor, err = getCursor(r)
+	return q, err
+}
+
+func allowlistCursor(addrs []store.AllowlistBlock, i int) *store.Cursor {
+	if i < 0 || i >= len(addrs) {
+		return nil
 	}
+	return &store.Cursor{CreatedAt: addrs[i].CreatedAt, Key: addrs[i].IPBlock}
 }
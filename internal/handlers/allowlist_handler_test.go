@@ -0,0 +1,307 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/mbop/internal/config"
+	"github.com/redhatinsights/mbop/internal/logger"
+	"github.com/redhatinsights/mbop/internal/store"
+	"github.com/redhatinsights/platform-go-middlewares/identity"
+	"github.com/stretchr/testify/suite"
+)
+
+type AllowlistTestSuite struct {
+	suite.Suite
+	rec   *httptest.ResponseRecorder
+	store store.Store
+}
+
+func (suite *AllowlistTestSuite) SetupSuite() {
+	_ = logger.Init()
+	config.Reset()
+	os.Setenv("STORE_BACKEND", "memory")
+}
+
+func (suite *AllowlistTestSuite) BeforeTest(_, _ string) {
+	suite.rec = httptest.NewRecorder()
+	suite.Nil(store.SetupStore())
+
+	suite.store = store.GetStore()
+	store.GetStore = func() store.Store { return suite.store }
+
+	for _, block := range []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24"} {
+		suite.Nil(suite.store.AllowAddress(context.Background(), &store.AllowlistBlock{IPBlock: block, OrgID: "1234"}))
+	}
+}
+
+func TestAllowlistEndpoint(t *testing.T) {
+	suite.Run(t, new(AllowlistTestSuite))
+}
+
+func (suite *AllowlistTestSuite) list(url string) (int, string) {
+	suite.rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+		User:  identity.User{OrgAdmin: true, Username: "foobar"},
+		OrgID: "1234",
+	}}))
+
+	AllowlistListHandler(suite.rec, req)
+
+	//nolint:bodyclose
+	rsp := suite.rec.Result()
+	body, _ := io.ReadAll(rsp.Body)
+	return rsp.StatusCode, string(body)
+}
+
+func (suite *AllowlistTestSuite) TestListUnpaginated() {
+	status, body := suite.list("http://foobar/api/mbop/v1/allowlist")
+	suite.Equal(http.StatusOK, status)
+
+	var out []allowlistEntryResponse
+	suite.Nil(json.Unmarshal([]byte(body), &out))
+	suite.Len(out, 3)
+}
+
+func (suite *AllowlistTestSuite) TestListExpired() {
+	past := time.Now().Add(-time.Minute)
+	suite.Nil(suite.store.AllowAddress(context.Background(), &store.AllowlistBlock{IPBlock: "10.0.3.0/24", OrgID: "1234", ExpiresAt: &past}))
+
+	status, body := suite.list("http://foobar/api/mbop/v1/allowlist?limit=10")
+	suite.Equal(http.StatusOK, status)
+	suite.Contains(body, `"expired":true`)
+
+	// still counted until the cleaner deletes it, but marked as not matching
+	var out allowlistCollection
+	suite.Nil(json.Unmarshal([]byte(body), &out))
+	suite.Equal(4, out.Meta.Count)
+	for _, b := range out.Allowlist {
+		suite.Equal(b.IPBlock == "10.0.3.0/24", b.Expired, b.IPBlock)
+	}
+}
+
+func (suite *AllowlistTestSuite) TestListPaginated() {
+	status, body := suite.list("http://foobar/api/mbop/v1/allowlist?limit=2")
+	suite.Equal(http.StatusOK, status)
+
+	var first allowlistCollection
+	suite.Nil(json.Unmarshal([]byte(body), &first))
+	suite.Equal(3, first.Meta.Count)
+	suite.Equal(2, first.Meta.Limit)
+	suite.Equal([]string{"10.0.0.0/24", "10.0.1.0/24"}, []string{first.Allowlist[0].IPBlock, first.Allowlist[1].IPBlock})
+	suite.NotNil(first.Meta.Links)
+	suite.Empty(first.Meta.Links.Prev)
+
+	status, body = suite.list("http://foobar" + first.Meta.Links.Next)
+	suite.Equal(http.StatusOK, status)
+
+	var second allowlistCollection
+	suite.Nil(json.Unmarshal([]byte(body), &second))
+	suite.Len(second.Allowlist, 1)
+	suite.Equal("10.0.2.0/24", second.Allowlist[0].IPBlock)
+	suite.Empty(second.Meta.Links.Next)
+	suite.NotEmpty(second.Meta.Links.Prev)
+}
+
+func (suite *AllowlistTestSuite) TestListBadCursor() {
+	status, body := suite.list("http://foobar/api/mbop/v1/allowlist?cursor=garbage")
+	suite.Equal(http.StatusBadRequest, status)
+	suite.Equal("{\"message\":\"invalid cursor\"}", body)
+}
+
+func (suite *AllowlistTestSuite) adminRequest(method, url, body string) *http.Request {
+	return httptest.NewRequest(method, url, strings.NewReader(body)).
+		WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+			User:  identity.User{OrgAdmin: true, Username: "foobar"},
+			OrgID: "1234",
+		}}))
+}
+
+func (suite *AllowlistTestSuite) create(block string) (int, string) {
+	return suite.createWith(`{"ip_block": "` + block + `"}`)
+}
+
+func (suite *AllowlistTestSuite) createWith(reqBody string) (int, string) {
+	suite.rec = httptest.NewRecorder()
+	AllowlistCreateHandler(suite.rec, suite.adminRequest(http.MethodPost, "http://foobar/api/mbop/v1/allowlist", reqBody))
+
+	//nolint:bodyclose
+	rsp := suite.rec.Result()
+	body, _ := io.ReadAll(rsp.Body)
+	return rsp.StatusCode, string(body)
+}
+
+func (suite *AllowlistTestSuite) TestCreateNormalizes() {
+	for block, stored := range map[string]string{
+		"192.168.1.7":      "192.168.1.7/32",
+		"172.16.5.5/16":    "172.16.0.0/16",
+		"2001:db8::1":      "2001:db8::1/128",
+		"2001:db8:1::1/48": "2001:db8:1::/48",
+	} {
+		status, _ := suite.create(block)
+		suite.Equal(http.StatusCreated, status, block)
+
+		found := false
+		addrs, _, err := suite.store.AllowedAddresses(context.Background(), "1234", store.AllowlistQuery{})
+		suite.Nil(err)
+		for _, a := range addrs {
+			found = found || a.IPBlock == stored
+		}
+		suite.True(found, stored)
+	}
+
+	// the same network written differently is a duplicate
+	status, _ := suite.create("10.0.0.1/24")
+	suite.Equal(http.StatusConflict, status)
+
+	allowed, err := suite.store.AllowedIP(context.Background(), "::ffff:172.16.200.1", "1234")
+	suite.Nil(err)
+	suite.True(allowed)
+}
+
+func (suite *AllowlistTestSuite) TestCreateInvalid() {
+	for _, block := range []string{"", "10.0.0.1/33", "nope", "2001:db8::/129"} {
+		status, body := suite.create(block)
+		suite.Equal(http.StatusBadRequest, status, block)
+		suite.Equal(`{"message":"invalid IP block, needs to be an IPv4 or IPv6 range or single IP"}`, body)
+	}
+}
+
+func (suite *AllowlistTestSuite) TestCreateWithExpiry() {
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	status, _ := suite.createWith(`{"ip_block": "192.168.1.0/24", "expires_at": "` + expiresAt.Format(time.RFC3339) + `", "description": "office"}`)
+	suite.Equal(http.StatusCreated, status)
+
+	status, body := suite.list("http://foobar/api/mbop/v1/allowlist")
+	suite.Equal(http.StatusOK, status)
+
+	var out []allowListResponse
+	suite.Nil(json.Unmarshal([]byte(body), &out))
+	suite.Len(out, 4)
+	suite.Equal("192.168.1.0/24", out[3].IPBlock)
+	suite.NotNil(out[3].ExpiresAt)
+	suite.True(expiresAt.Equal(*out[3].ExpiresAt))
+	suite.Equal("office", out[3].Description)
+	suite.Equal("foobar", out[3].CreatedBy)
+
+	// blocks without them leave them out
+	suite.NotContains(body[:strings.Index(body, "}")], "expires_at")
+
+	allowed, err := suite.store.AllowedIP(context.Background(), "192.168.1.7", "1234")
+	suite.Nil(err)
+	suite.True(allowed)
+}
+
+func (suite *AllowlistTestSuite) TestCreateBadExpiry() {
+	past := time.Now().Add(-time.Hour).Format(time.RFC3339)
+	for _, expiresAt := range []string{past, "tomorrow", "2030-01-01"} {
+		status, body := suite.createWith(`{"ip_block": "192.168.1.0/24", "expires_at": "` + expiresAt + `"}`)
+		suite.Equal(http.StatusBadRequest, status, expiresAt)
+		suite.Equal(`{"message":"[expires_at] must be an RFC3339 timestamp in the future"}`, body)
+	}
+
+	addrs, _, err := suite.store.AllowedAddresses(context.Background(), "1234", store.AllowlistQuery{})
+	suite.Nil(err)
+	suite.Len(addrs, 3)
+}
+
+func (suite *AllowlistTestSuite) TestDeleteNormalizes() {
+	suite.Nil(suite.store.AllowAddress(context.Background(), &store.AllowlistBlock{IPBlock: "2001:db8::/32", OrgID: "1234"}))
+	suite.Nil(suite.store.AllowAddress(context.Background(), &store.AllowlistBlock{IPBlock: "192.168.1.0/24", OrgID: "1234"}))
+
+	for _, block := range []string{"2001:DB8::1/32", "192.168.1.1/24", "10.0.0.5/24"} {
+		suite.rec = httptest.NewRecorder()
+		AllowlistDeleteHandler(suite.rec, suite.adminRequest(http.MethodDelete, "http://foobar/api/mbop/v1/allowlist?block="+url.QueryEscape(block), ""))
+
+		//nolint:bodyclose
+		suite.Equal(http.StatusNoContent, suite.rec.Result().StatusCode, block)
+	}
+
+	addrs, _, err := suite.store.AllowedAddresses(context.Background(), "1234", store.AllowlistQuery{})
+	suite.Nil(err)
+	suite.Len(addrs, 2)
+}
+
+func (suite *AllowlistTestSuite) check(ip string) (int, string) {
+	suite.rec = httptest.NewRecorder()
+	AllowlistCheckHandler(suite.rec, suite.adminRequest(http.MethodGet, "http://foobar/api/mbop/v1/allowlist/check?ip="+url.QueryEscape(ip), ""))
+
+	//nolint:bodyclose
+	rsp := suite.rec.Result()
+	body, _ := io.ReadAll(rsp.Body)
+	return rsp.StatusCode, string(body)
+}
+
+func (suite *AllowlistTestSuite) TestCheck() {
+	suite.Nil(suite.store.AllowAddress(context.Background(), &store.AllowlistBlock{IPBlock: "192.168.0.0/16", OrgID: "system"}))
+
+	status, body := suite.check("10.0.1.7")
+	suite.Equal(http.StatusOK, status)
+
+	var out allowlistCheckResponse
+	suite.Nil(json.Unmarshal([]byte(body), &out))
+	suite.True(out.Allowed)
+	suite.Equal("10.0.1.0/24", out.Matched.IPBlock)
+	suite.Equal("1234", out.Matched.OrgID)
+	suite.Empty(out.Candidates)
+
+	status, body = suite.check("::ffff:192.168.3.4")
+	suite.Equal(http.StatusOK, status)
+
+	out = allowlistCheckResponse{}
+	suite.Nil(json.Unmarshal([]byte(body), &out))
+	suite.True(out.Allowed)
+	suite.Equal("192.168.3.4", out.IP)
+	suite.Equal("system", out.Matched.OrgID)
+}
+
+func (suite *AllowlistTestSuite) TestCheckNotAllowed() {
+	status, body := suite.check("10.0.3.7")
+	suite.Equal(http.StatusOK, status)
+
+	var out allowlistCheckResponse
+	suite.Nil(json.Unmarshal([]byte(body), &out))
+	suite.False(out.Allowed)
+	suite.Nil(out.Matched)
+	suite.Len(out.Candidates, 3)
+	suite.Equal("10.0.2.0/24", out.Candidates[0].IPBlock)
+	suite.Equal(23, out.Candidates[0].CommonBits)
+	suite.Equal(22, out.Candidates[1].CommonBits)
+	suite.Equal(22, out.Candidates[2].CommonBits)
+
+	// nothing of the same family to compare with
+	status, body = suite.check("2001:db8::1")
+	suite.Equal(http.StatusOK, status)
+	suite.Contains(body, `"candidates":[]`)
+}
+
+func (suite *AllowlistTestSuite) TestCheckBadRequest() {
+	for ip, msg := range map[string]string{
+		"":             "need address in query in the form `/api/mbop/v1/allowlist/check?ip={ip}`",
+		"10.0.0.0/24":  "[ip] must be an IPv4 or IPv6 address",
+		"nope":         "[ip] must be an IPv4 or IPv6 address",
+		"fe80::1%eth0": "[ip] must be an IPv4 or IPv6 address",
+	} {
+		status, body := suite.check(ip)
+		suite.Equal(http.StatusBadRequest, status, ip)
+		suite.Contains(body, msg, ip)
+	}
+
+	suite.rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://foobar/api/mbop/v1/allowlist/check?ip=10.0.0.1", nil).
+		WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+			User:  identity.User{Username: "foobar"},
+			OrgID: "1234",
+		}}))
+	AllowlistCheckHandler(suite.rec, req)
+	suite.Equal(http.StatusForbidden, suite.rec.Code)
+}
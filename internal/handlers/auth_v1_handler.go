@@ -42,16 +42,37 @@ func AuthV1Handler(w http.ResponseWriter, r *http.Request) {
 
 		db := store.GetStore()
 
-		reg, err := db.FindByUID(gatewayCN)
+		reg, err := db.FindByUID(r.Context(), gatewayCN)
 		if err != nil {
 			if errors.Is(err, store.ErrRegistrationNotFound) {
 				doError(w, err.Error(), 401)
 			} else {
-				do500(w, "failed to search for registration: "+err.Error())
+				doStoreError(w, "failed to search for registration: ", err)
 			}
 			return
 		}
 
+		switch reg.Status {
+		case store.RegistrationPending:
+			doError(w, "registration is pending approval", 403)
+			return
+		case store.RegistrationRejected:
+			doError(w, "registration was rejected", 403)
+			return
+		}
+
+		// registrations with a pinned certificate only accept that exact
+		// certificate, not just any certificate issued with the same CN
+		if reg.Certificate != nil {
+			cert, err := getClientCert(r.Header.Get(config.Get().ClientCertHeader))
+			if err != nil || certificateInfo(cert).Fingerprint != reg.Certificate.Fingerprint {
+				doError(w, "client certificate does not match the certificate pinned to the registration", 401)
+				return
+			}
+		}
+
+		store.RecordLastSeen(reg.UID)
+
 		sendJSON(w, AuthV1Response{
 			Mechanism: "cert",
 			User: User{
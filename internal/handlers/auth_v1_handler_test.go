@@ -1,11 +1,13 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"testing"
 
 	"github.com/redhatinsights/mbop/internal/config"
 	"github.com/redhatinsights/mbop/internal/logger"
@@ -23,6 +25,12 @@ func (suite *AuthV1TestSuite) SetupSuite() {
 	_ = logger.Init()
 	config.Reset()
 	os.Setenv("STORE_BACKEND", "memory")
+	// cert auth is only served by the non-catchall users modules
+	config.Get().UsersModule = mockModule
+}
+
+func (suite *AuthV1TestSuite) TearDownSuite() {
+	config.Reset()
 }
 
 func (suite *AuthV1TestSuite) BeforeTest(_, _ string) {
@@ -38,6 +46,10 @@ func (suite *AuthV1TestSuite) AfterTest(_, _ string) {
 	suite.rec.Result().Body.Close()
 }
 
+func TestAuthV1Endpoint(t *testing.T) {
+	suite.Run(t, new(AuthV1TestSuite))
+}
+
 func (suite *AuthV1TestSuite) TestV1AuthNotFound() {
 	req := httptest.NewRequest(http.MethodGet, "http://foobar/v1/auth", nil)
 	req.Header.Set(CertHeader, "/CN=1234")
@@ -48,7 +60,7 @@ func (suite *AuthV1TestSuite) TestV1AuthNotFound() {
 }
 
 func (suite *AuthV1TestSuite) TestV1AuthSuccess() {
-	_, err := suite.store.Create(&store.Registration{OrgID: "12345", UID: "1234"})
+	_, err := suite.store.Create(context.Background(), &store.Registration{OrgID: "12345", UID: "1234"})
 	suite.Nil(err)
 
 	req := httptest.NewRequest(http.MethodGet, "http://foobar/v1/auth", nil)
@@ -73,3 +85,103 @@ func (suite *AuthV1TestSuite) TestV1AuthSuccess() {
 	suite.Equal(true, resp.User.IsOrgAdmin)
 	suite.Equal("system", resp.User.Type)
 }
+
+func (suite *AuthV1TestSuite) TestV1AuthPinnedCertificate() {
+	header := newTestClientCert(suite.T(), "1234")
+	cert, err := getClientCert(header)
+	suite.Nil(err)
+
+	_, err = suite.store.Create(context.Background(), &store.Registration{OrgID: "12345", UID: "1234", Certificate: certificateInfo(cert)})
+	suite.Nil(err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar/v1/auth", nil)
+	req.Header.Set(CertHeader, "/CN=1234")
+	req.Header.Set("x-rh-certauth-cert", header)
+	AuthV1Handler(suite.rec, req)
+
+	//nolint:bodyclose
+	suite.Equal(http.StatusOK, suite.rec.Result().StatusCode)
+}
+
+func (suite *AuthV1TestSuite) TestV1AuthPinnedCertificateMismatch() {
+	cert, err := getClientCert(newTestClientCert(suite.T(), "1234"))
+	suite.Nil(err)
+
+	_, err = suite.store.Create(context.Background(), &store.Registration{OrgID: "12345", UID: "1234", Certificate: certificateInfo(cert)})
+	suite.Nil(err)
+
+	// same CN, different certificate
+	req := httptest.NewRequest(http.MethodGet, "http://foobar/v1/auth", nil)
+	req.Header.Set(CertHeader, "/CN=1234")
+	req.Header.Set("x-rh-certauth-cert", newTestClientCert(suite.T(), "1234"))
+	AuthV1Handler(suite.rec, req)
+
+	//nolint:bodyclose
+	suite.Equal(http.StatusUnauthorized, suite.rec.Result().StatusCode)
+}
+
+func (suite *AuthV1TestSuite) TestV1AuthPinnedCertificateMissing() {
+	cert, err := getClientCert(newTestClientCert(suite.T(), "1234"))
+	suite.Nil(err)
+
+	_, err = suite.store.Create(context.Background(), &store.Registration{OrgID: "12345", UID: "1234", Certificate: certificateInfo(cert)})
+	suite.Nil(err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar/v1/auth", nil)
+	req.Header.Set(CertHeader, "/CN=1234")
+	AuthV1Handler(suite.rec, req)
+
+	//nolint:bodyclose
+	suite.Equal(http.StatusUnauthorized, suite.rec.Result().StatusCode)
+}
+
+func (suite *AuthV1TestSuite) TestV1AuthRecordsLastSeen() {
+	_, err := suite.store.Create(context.Background(), &store.Registration{OrgID: "12345", UID: "1234"})
+	suite.Nil(err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar/v1/auth", nil)
+	req.Header.Set(CertHeader, "/CN=1234")
+	AuthV1Handler(suite.rec, req)
+
+	//nolint:bodyclose
+	suite.Equal(http.StatusOK, suite.rec.Result().StatusCode)
+
+	// nothing is written until the batch is flushed
+	reg, err := suite.store.FindByUID(context.Background(), "1234")
+	suite.Nil(err)
+	suite.Nil(reg.LastSeenAt)
+
+	suite.Nil(store.FlushLastSeen(context.Background()))
+
+	reg, err = suite.store.FindByUID(context.Background(), "1234")
+	suite.Nil(err)
+	suite.NotNil(reg.LastSeenAt)
+}
+
+func (suite *AuthV1TestSuite) TestV1AuthPending() {
+	_, err := suite.store.Create(context.Background(), &store.Registration{OrgID: "12345", UID: "1234", Status: store.RegistrationPending})
+	suite.Nil(err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar/v1/auth", nil)
+	req.Header.Set(CertHeader, "/CN=1234")
+	AuthV1Handler(suite.rec, req)
+
+	//nolint:bodyclose
+	suite.Equal(http.StatusForbidden, suite.rec.Result().StatusCode)
+	suite.Equal(`{"message":"registration is pending approval"}`, suite.rec.Body.String())
+}
+
+func (suite *AuthV1TestSuite) TestV1AuthRejected() {
+	_, err := suite.store.Create(context.Background(), &store.Registration{OrgID: "12345", UID: "1234", Status: store.RegistrationPending})
+	suite.Nil(err)
+	_, err = suite.store.Review(context.Background(), "12345", "1234", store.RegistrationRejected, "admin")
+	suite.Nil(err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar/v1/auth", nil)
+	req.Header.Set(CertHeader, "/CN=1234")
+	AuthV1Handler(suite.rec, req)
+
+	//nolint:bodyclose
+	suite.Equal(http.StatusForbidden, suite.rec.Result().StatusCode)
+	suite.Equal(`{"message":"registration was rejected"}`, suite.rec.Body.String())
+}
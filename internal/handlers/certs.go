@@ -1,14 +1,28 @@
 package handlers
 
 import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"net/http"
+	"net/url"
 	"regexp"
+
+	"github.com/redhatinsights/mbop/internal/config"
+	"github.com/redhatinsights/mbop/internal/store"
 )
 
 const CertHeader = "x-rh-certauth-cn"
 
 var cnMatcher = regexp.MustCompile(`/CN=(.*)$`)
 
+// returned when the forwarded client certificate header isn't set at all, so
+// callers can tell "no cert" apart from "bad cert"
+var errNoClientCert = errors.New("client certificate header not present")
+
 func getCertCN(header string) (string, error) {
 	if header == "" || !cnMatcher.MatchString(header) {
 		return "", fmt.Errorf("[x-rh-certauth-cn] header not present")
@@ -17,3 +31,58 @@ func getCertCN(header string) (string, error) {
 	parts := cnMatcher.FindAllStringSubmatch(header, 1)
 	return parts[0][1], nil
 }
+
+// getClientCert parses the PEM encoded client certificate forwarded by the
+// gateway, the PEM may be url-escaped (as nginx's $ssl_client_escaped_cert is)
+// since newlines can't be sent in a header.
+func getClientCert(header string) (*x509.Certificate, error) {
+	if header == "" {
+		return nil, errNoClientCert
+	}
+
+	// PathUnescape rather than QueryUnescape, a literal `+` is valid base64
+	unescaped, err := url.PathUnescape(header)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unescape client certificate: %w", err)
+	}
+
+	block, _ := pem.Decode([]byte(unescaped))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("client certificate is not a PEM encoded certificate")
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse client certificate: %w", err)
+	}
+
+	return cert, nil
+}
+
+// certificateInfo is what gets pinned to a registration for a certificate
+func certificateInfo(cert *x509.Certificate) *store.Certificate {
+	sum := sha256.Sum256(cert.Raw)
+	return &store.Certificate{
+		Fingerprint: hex.EncodeToString(sum[:]),
+		Serial:      cert.SerialNumber.Text(16),
+		NotAfter:    cert.NotAfter.UTC(),
+	}
+}
+
+// clientCertificateFor returns the certificate to pin for a satellite with the
+// given CN, or nil when the gateway didn't forward one.
+func clientCertificateFor(r *http.Request, cn string) (*store.Certificate, error) {
+	cert, err := getClientCert(r.Header.Get(config.Get().ClientCertHeader))
+	if err != nil {
+		if errors.Is(err, errNoClientCert) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if cert.Subject.CommonName != cn {
+		return nil, fmt.Errorf("client certificate CN does not match uid")
+	}
+
+	return certificateInfo(cert), nil
+}
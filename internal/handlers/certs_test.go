@@ -0,0 +1,69 @@
+package handlers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestClientCert generates a self-signed certificate for the CN, returning
+// it url-escaped the way the gateway forwards it.
+func newTestClientCert(t *testing.T, cn string) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatalf("failed to generate serial: %v", err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	return url.PathEscape(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+}
+
+func TestGetClientCert(t *testing.T) {
+	header := newTestClientCert(t, "abc1234")
+
+	cert, err := getClientCert(header)
+	assert.Nil(t, err)
+	assert.Equal(t, "abc1234", cert.Subject.CommonName)
+
+	info := certificateInfo(cert)
+	assert.Len(t, info.Fingerprint, 64)
+	assert.Equal(t, cert.SerialNumber.Text(16), info.Serial)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), info.NotAfter, time.Minute)
+}
+
+func TestGetClientCertMissing(t *testing.T) {
+	_, err := getClientCert("")
+	assert.ErrorIs(t, err, errNoClientCert)
+}
+
+func TestGetClientCertNotPEM(t *testing.T) {
+	_, err := getClientCert("not-a-certificate")
+	assert.EqualError(t, err, "client certificate is not a PEM encoded certificate")
+}
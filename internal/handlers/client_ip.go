@@ -0,0 +1,214 @@
+package handlers
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/redhatinsights/mbop/internal/config"
+	l "github.com/redhatinsights/mbop/internal/logger"
+	"github.com/redhatinsights/mbop/internal/store"
+)
+
+// like the extra schema, the proxies are parsed once for each distinct config
+// value
+var trustedProxies struct {
+	sync.Mutex
+	source   string
+	prefixes []netip.Prefix
+}
+
+// TrustedProxies parses TRUSTED_PROXIES, a comma separated list of the CIDR
+// blocks or addresses of the proxies in front of mbop
+func TrustedProxies() ([]netip.Prefix, error) {
+	source := config.Get().TrustedProxies
+
+	trustedProxies.Lock()
+	defer trustedProxies.Unlock()
+
+	if trustedProxies.prefixes != nil && trustedProxies.source == source {
+		return trustedProxies.prefixes, nil
+	}
+
+	prefixes := make([]netip.Prefix, 0)
+	for _, entry := range strings.Split(source, ",") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		block, err := store.NormalizeIPBlock(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		prefixes = append(prefixes, netip.MustParsePrefix(block))
+	}
+
+	trustedProxies.source, trustedProxies.prefixes = source, prefixes
+	return prefixes, nil
+}
+
+/*
+clientIP works out the address of the client from the ALLOWLIST_HEADER chain,
+a Forwarded header (RFC 7239) when it's named that and an X-Forwarded-For
+style comma separated list otherwise. Each proxy appends the address it got
+the request from, so the chain is read from the right:
+
+  - with TRUSTED_PROXIES set, the connection's own address is added to the end
+    and the client is the rightmost address that isn't a trusted proxy, or the
+    connection's address when every hop is one
+  - otherwise the client is TRUSTED_PROXY_HOPS from the right, the default of 1
+    being whatever the proxy right in front of mbop saw
+
+Anything further left can be sent by the client itself and is never used.
+Without the header, or with fewer entries than hops, it's the connection's
+address. An entry that isn't an address comes back as is, which no allowlist
+block matches.
+*/
+func clientIP(r *http.Request) (string, error) {
+	header := config.Get().AllowlistHeader
+	remote := remoteIP(r.RemoteAddr)
+
+	var chain []string
+	if strings.EqualFold(header, "forwarded") {
+		chain = parseForwarded(r.Header.Values(header))
+	} else {
+		chain = parseForwardedFor(r.Header.Values(header))
+	}
+
+	proxies, err := TrustedProxies()
+	if err != nil {
+		return "", err
+	}
+
+	if len(proxies) > 0 {
+		chain = append(chain, remote)
+		for i := len(chain) - 1; i >= 0; i-- {
+			addr, err := netip.ParseAddr(chain[i])
+			if err != nil || !trusted(proxies, addr) {
+				return chain[i], nil
+			}
+		}
+		// a proxy's own request, e.g. a health check, any address further
+		// left than the connection's could have been sent by anyone
+		return remote, nil
+	}
+
+	hops := config.Get().TrustedProxyHops
+	if hops <= 0 || len(chain) < hops {
+		return remote, nil
+	}
+	return chain[len(chain)-hops], nil
+}
+
+func trusted(proxies []netip.Prefix, addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, p := range proxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseForwardedFor splits X-Forwarded-For values, a header can be sent more
+// than once and the lines are one list
+func parseForwardedFor(values []string) []string {
+	var chain []string
+	for _, v := range values {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		for _, entry := range strings.Split(v, ",") {
+			chain = append(chain, stripPort(strings.TrimSpace(entry)))
+		}
+	}
+	return chain
+}
+
+// parseForwarded takes the for= of every element of Forwarded values, e.g.
+// `for=192.0.2.60;proto=http, for="[2001:db8::17]:4711"`. An element without
+// one, or with `unknown` or an obfuscated identifier, is still a hop and stays
+// in the chain as is.
+func parseForwarded(values []string) []string {
+	var chain []string
+	for _, v := range values {
+		if strings.TrimSpace(v) == "" {
+			continue
+		}
+		for _, element := range splitQuoted(v, ',') {
+			node := ""
+			for _, pair := range splitQuoted(element, ';') {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(strings.TrimSpace(key), "for") {
+					node = strings.Trim(strings.TrimSpace(value), `"`)
+				}
+			}
+			chain = append(chain, stripPort(node))
+		}
+	}
+	return chain
+}
+
+// splitQuoted splits s on sep outside of double quotes
+func splitQuoted(s string, sep rune) []string {
+	var parts []string
+	quoted, start := false, 0
+	for i, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// stripPort turns `1.2.3.4:80`, `[2001:db8::1]:80` and `[2001:db8::1]` into
+// the bare address, anything else is left alone
+func stripPort(node string) string {
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(node, "["), "]")
+}
+
+func remoteIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// checkAllowlist resolves the client's address and checks it against orgID's
+// allowlist, writing the error response when it isn't allowed
+func checkAllowlist(w http.ResponseWriter, r *http.Request, db store.Store, orgID string) bool {
+	ip, err := clientIP(r)
+	if err != nil {
+		do500(w, "failed to resolve client address: "+err.Error())
+		return false
+	}
+
+	allowed, err := db.AllowedIP(r.Context(), ip, orgID)
+	if err != nil {
+		doStoreError(w, "error listing ip addresses: ", err)
+		return false
+	}
+
+	l.Log.Info("Checked allowlist", "org_id", orgID, "client_ip", ip, "remote_addr", r.RemoteAddr, "allowed", allowed)
+	if !allowed {
+		msg := "address is not allowlisted"
+		// the resolved address is only for debugging a proxy setup, it's
+		// otherwise not handed back to whoever sent the request
+		if config.Get().AllowlistDebug {
+			msg += ", resolved client address " + strconv.Quote(ip)
+		}
+		doError(w, msg, 403)
+		return false
+	}
+	return true
+}
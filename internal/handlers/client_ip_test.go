@@ -0,0 +1,164 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/redhatinsights/mbop/internal/config"
+	"github.com/redhatinsights/mbop/internal/logger"
+	"github.com/redhatinsights/mbop/internal/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func withClientIPConfig(t *testing.T, env map[string]string) {
+	t.Helper()
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	config.Reset()
+	t.Cleanup(config.Reset)
+}
+
+func forwardedRequest(remoteAddr, header string, values ...string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "http://foobar/v1/registrations", nil)
+	req.RemoteAddr = remoteAddr
+	for _, v := range values {
+		req.Header.Add(header, v)
+	}
+	return req
+}
+
+func TestClientIPHops(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		hops   string
+		values []string
+		want   string
+	}{
+		{"single address", "1", []string{"1.2.3.4"}, "1.2.3.4"},
+		{"rightmost by default", "1", []string{"6.6.6.6, 1.2.3.4"}, "1.2.3.4"},
+		{"two hops", "2", []string{"1.2.3.4, 10.0.0.5"}, "1.2.3.4"},
+		{"spoofed prefix", "2", []string{"6.6.6.6, 1.2.3.4, 10.0.0.5"}, "1.2.3.4"},
+		{"repeated header", "2", []string{"1.2.3.4", "10.0.0.5"}, "1.2.3.4"},
+		{"ports", "2", []string{"1.2.3.4:5678, [2001:db8::1]:80"}, "1.2.3.4"},
+		{"bare ipv6", "1", []string{"2001:db8::1"}, "2001:db8::1"},
+		{"fewer entries than hops", "3", []string{"1.2.3.4, 10.0.0.5"}, "192.0.2.1"},
+		{"no header", "1", nil, "192.0.2.1"},
+		{"empty header", "1", []string{""}, "192.0.2.1"},
+		{"no hops", "0", []string{"1.2.3.4"}, "192.0.2.1"},
+		{"garbage", "1", []string{"nope"}, "nope"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withClientIPConfig(t, map[string]string{"TRUSTED_PROXY_HOPS": tc.hops})
+
+			ip, err := clientIP(forwardedRequest("192.0.2.1:4321", "x-forwarded-for", tc.values...))
+			assert.Nil(t, err)
+			assert.Equal(t, tc.want, ip)
+		})
+	}
+}
+
+func TestClientIPTrustedProxies(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		remote string
+		values []string
+		want   string
+	}{
+		{"skips proxies", "10.0.0.9:80", []string{"6.6.6.6, 1.2.3.4, 10.0.0.5"}, "1.2.3.4"},
+		{"untrusted connection", "192.0.2.1:80", []string{"1.2.3.4"}, "192.0.2.1"},
+		{"ipv6 proxies", "[2001:db8::9]:80", []string{"1.2.3.4, 2001:db8::5"}, "1.2.3.4"},
+		{"mapped proxy", "[::ffff:10.0.0.9]:80", []string{"1.2.3.4"}, "1.2.3.4"},
+		{"no header", "10.0.0.9:80", nil, "10.0.0.9"},
+		{"only proxies", "10.0.0.9:80", []string{"10.0.0.1, 10.0.0.5"}, "10.0.0.9"},
+		{"garbage before the proxies", "10.0.0.9:80", []string{"1.2.3.4, nope, 10.0.0.5"}, "nope"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withClientIPConfig(t, map[string]string{"TRUSTED_PROXIES": "10.0.0.0/24, 2001:db8::/32"})
+
+			ip, err := clientIP(forwardedRequest(tc.remote, "x-forwarded-for", tc.values...))
+			assert.Nil(t, err)
+			assert.Equal(t, tc.want, ip)
+		})
+	}
+}
+
+func TestClientIPForwarded(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		values []string
+		want   string
+	}{
+		{"for", []string{"for=1.2.3.4;proto=https, for=10.0.0.5"}, "1.2.3.4"},
+		{"quoted ipv6 with port", []string{`for="[2001:db8:cafe::17]:4711", for=10.0.0.5`}, "2001:db8:cafe::17"},
+		{"case and spacing", []string{"By=10.0.0.1; For=1.2.3.4 ,for=10.0.0.5"}, "1.2.3.4"},
+		{"quoted separators", []string{`for=1.2.3.4;ext="a,b;c", for=10.0.0.5`}, "1.2.3.4"},
+		{"repeated header", []string{"for=1.2.3.4", "for=10.0.0.5"}, "1.2.3.4"},
+		{"unknown", []string{"for=unknown, for=10.0.0.5"}, "unknown"},
+		{"no for", []string{"proto=https, for=10.0.0.5"}, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withClientIPConfig(t, map[string]string{
+				"ALLOWLIST_HEADER": "Forwarded",
+				"TRUSTED_PROXIES":  "10.0.0.0/24",
+			})
+
+			ip, err := clientIP(forwardedRequest("10.0.0.9:80", "forwarded", tc.values...))
+			assert.Nil(t, err)
+			assert.Equal(t, tc.want, ip)
+		})
+	}
+}
+
+func TestTrustedProxiesInvalid(t *testing.T) {
+	withClientIPConfig(t, map[string]string{"TRUSTED_PROXIES": "10.0.0.0/24, nope"})
+
+	_, err := TrustedProxies()
+	assert.ErrorContains(t, err, `invalid trusted proxy " nope"`)
+
+	_, err = clientIP(forwardedRequest("10.0.0.9:80", "x-forwarded-for", "1.2.3.4"))
+	assert.Error(t, err)
+}
+
+func TestCheckAllowlist(t *testing.T) {
+	_ = logger.Init()
+	withClientIPConfig(t, map[string]string{
+		"STORE_BACKEND":   "memory",
+		"TRUSTED_PROXIES": "10.0.0.0/24",
+	})
+	assert.Nil(t, store.SetupStore())
+	db := store.GetStore()
+	assert.Nil(t, db.AllowAddress(context.Background(), &store.AllowlistBlock{IPBlock: "1.2.3.0/24", OrgID: "1234"}))
+
+	for values, want := range map[string]int{
+		"1.2.3.4, 10.0.0.5": 0,
+		"1.2.3.4, 6.6.6.6":  403,
+		"6.6.6.6, 1.2.3.4":  0,
+		"1.2.3.4, nope":     403,
+	} {
+		rec := httptest.NewRecorder()
+		allowed := checkAllowlist(rec, forwardedRequest("10.0.0.9:80", "x-forwarded-for", values), db, "1234")
+		assert.Equal(t, want == 0, allowed, values)
+		if want != 0 {
+			assert.Equal(t, want, rec.Code, values)
+			assert.Contains(t, rec.Body.String(), "address is not allowlisted", values)
+		}
+	}
+}
+
+func TestCheckAllowlistDebug(t *testing.T) {
+	_ = logger.Init()
+	withClientIPConfig(t, map[string]string{
+		"STORE_BACKEND":   "memory",
+		"TRUSTED_PROXIES": "10.0.0.0/24",
+		"ALLOWLIST_DEBUG": "true",
+	})
+	assert.Nil(t, store.SetupStore())
+
+	rec := httptest.NewRecorder()
+	assert.False(t, checkAllowlist(rec, forwardedRequest("10.0.0.9:80", "x-forwarded-for", "6.6.6.6, 1.2.3.4"), store.GetStore(), "1234"))
+	assert.Equal(t, 403, rec.Code)
+	assert.Equal(t, `{"message":"address is not allowlisted, resolved client address \"1.2.3.4\""}`, rec.Body.String())
+}
@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/redhatinsights/mbop/internal/config"
+	"github.com/redhatinsights/mbop/internal/store"
+	"github.com/redhatinsights/platform-go-middlewares/identity"
+)
+
+type enrollmentCodeCreateRequest struct {
+	TTL string `json:"ttl,omitempty"`
+}
+
+type enrollmentCodeCollection struct {
+	Codes []enrollmentCodeResponse `json:"codes"`
+	Meta  enrollmentCodeMeta       `json:"meta"`
+}
+
+type enrollmentCodeMeta struct {
+	Count int `json:"count"`
+}
+
+type enrollmentCodeResponse struct {
+	ID string `json:"id"`
+	// only ever set in the response to creating it
+	Code      string     `json:"code,omitempty"`
+	OrgID     string     `json:"org_id"`
+	Username  string     `json:"username"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	UsedBy    string     `json:"used_by,omitempty"`
+}
+
+type registrationEnrollRequest struct {
+	Code        *string `json:"code,omitempty"`
+	UID         *string `json:"uid,omitempty"`
+	DisplayName *string `json:"display_name,omitempty"`
+}
+
+func newEnrollmentCodeResponse(c *store.EnrollmentCode) enrollmentCodeResponse {
+	return enrollmentCodeResponse{
+		ID:        c.ID,
+		OrgID:     c.OrgID,
+		Username:  c.Username,
+		CreatedAt: c.CreatedAt,
+		ExpiresAt: c.ExpiresAt,
+		UsedAt:    c.UsedAt,
+		UsedBy:    c.UsedBy,
+	}
+}
+
+// hashEnrollmentCode is what codes are stored and looked up by, they're random
+// enough that a plain sha256 does
+func hashEnrollmentCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func EnrollmentCodeListHandler(w http.ResponseWriter, r *http.Request) {
+	id := identity.Get(r.Context())
+	if !id.Identity.User.OrgAdmin {
+		doError(w, "user must be org admin to list enrollment codes", 403)
+		return
+	}
+
+	codes, err := store.GetStore().EnrollmentCodes(r.Context(), id.Identity.OrgID)
+	if err != nil {
+		doStoreError(w, "error listing enrollment codes: ", err)
+		return
+	}
+
+	out := make([]enrollmentCodeResponse, len(codes))
+	for i := range codes {
+		out[i] = newEnrollmentCodeResponse(&codes[i])
+	}
+
+	sendJSON(w, &enrollmentCodeCollection{Codes: out, Meta: enrollmentCodeMeta{Count: len(out)}})
+}
+
+// EnrollmentCodeCreateHandler creates a single-use code for the admin's org,
+// the code is in the response and can't be read back afterwards
+func EnrollmentCodeCreateHandler(w http.ResponseWriter, r *http.Request) {
+	id := identity.Get(r.Context())
+	if !id.Identity.User.OrgAdmin {
+		doError(w, "user must be org admin to create enrollment codes", 403)
+		return
+	}
+	if id.Identity.OrgID == "" {
+		do400(w, "[org_id] not present in identity header")
+		return
+	}
+	if id.Identity.User.Username == "" {
+		do400(w, "[username] not present in identity header")
+		return
+	}
+
+	maxTTL, err := time.ParseDuration(config.Get().EnrollmentCodeTTL)
+	if err != nil {
+		do500(w, "Error reading enrollment code TTL")
+		return
+	}
+
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		do500(w, "failed to read body bytes: "+err.Error())
+		return
+	}
+
+	// the body is optional, without one the code lasts as long as it can
+	var body enrollmentCodeCreateRequest
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &body); err != nil {
+			do400(w, "invalid body, need a json object with an optional [ttl]")
+			return
+		}
+	}
+
+	ttl := maxTTL
+	if body.TTL != "" {
+		ttl, err = time.ParseDuration(body.TTL)
+		if err != nil || ttl <= 0 || ttl > maxTTL {
+			do400(w, "[ttl] must be a positive duration of at most "+maxTTL.String())
+			return
+		}
+	}
+
+	code := rand.Text()
+	c := &store.EnrollmentCode{
+		OrgID:     id.Identity.OrgID,
+		Username:  id.Identity.User.Username,
+		ExpiresAt: time.Now().Add(ttl),
+	}
+	if err := store.GetStore().CreateEnrollmentCode(r.Context(), c, hashEnrollmentCode(code)); err != nil {
+		doStoreError(w, "failed to create enrollment code: ", err)
+		return
+	}
+
+	rsp := newEnrollmentCodeResponse(c)
+	rsp.Code = code
+	sendJSONWithStatusCode(w, rsp, 201)
+}
+
+// RegistrationEnrollHandler registers a satellite with an enrollment code in
+// place of an org admin's identity, the registration goes to the code's org
+// and creator
+func RegistrationEnrollHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := io.ReadAll(r.Body)
+	if err != nil {
+		do500(w, "failed to read body bytes: "+err.Error())
+		return
+	}
+
+	var body registrationEnrollRequest
+	err = json.Unmarshal(b, &body)
+	if err != nil {
+		do400(w, "invalid body, need a json object with [code], [uid] and [display_name] to enroll satellite")
+		return
+	}
+
+	if body.Code == nil || *body.Code == "" {
+		do400(w, "required parameter [code] not found in body")
+		return
+	}
+
+	if body.UID == nil || *body.UID == "" {
+		do400(w, "required parameter [uid] not found in body")
+		return
+	}
+
+	if body.DisplayName == nil || *body.DisplayName == "" {
+		do400(w, "required parameter [display_name] not found in body")
+		return
+	}
+
+	gatewayCN, err := getCertCN(r.Header.Get(CertHeader))
+	if err != nil {
+		do400(w, err.Error())
+		return
+	}
+
+	if gatewayCN != *body.UID {
+		do400(w, "x-rh-certauth-cn does not match uid")
+		return
+	}
+
+	cert, err := clientCertificateFor(r, gatewayCN)
+	if err != nil {
+		do400(w, err.Error())
+		return
+	}
+
+	db := store.GetStore()
+	codeHash := hashEnrollmentCode(*body.Code)
+
+	// the code says which org's allowlist applies
+	code, err := db.FindEnrollmentCode(r.Context(), codeHash)
+	if err != nil {
+		if errors.Is(err, store.ErrEnrollmentCodeInvalid) {
+			doError(w, err.Error(), 403)
+		} else {
+			doStoreError(w, "failed to find enrollment code: ", err)
+		}
+		return
+	}
+
+	if config.Get().AllowlistEnabled && !checkAllowlist(w, r, db, code.OrgID) {
+		return
+	}
+
+	status, err := newRegistrationStatus(r, db, code.OrgID)
+	if err != nil {
+		doStoreError(w, "failed to get org settings: ", err)
+		return
+	}
+
+	_, err = db.Enroll(r.Context(), &store.Registration{
+		UID:         *body.UID,
+		DisplayName: *body.DisplayName,
+		Certificate: cert,
+		Status:      status,
+	}, codeHash, config.Get().RegistrationQuota)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrEnrollmentCodeInvalid):
+			doError(w, err.Error(), 403)
+		case errors.Is(err, store.ErrRegistrationAlreadyExists{}):
+			doError(w, err.Error(), 409)
+		case errors.Is(err, store.ErrQuotaExceeded{}):
+			doError(w, err.Error()+" for this org", 403)
+		default:
+			doStoreError(w, "failed to enroll registration: ", err)
+		}
+		return
+	}
+
+	sendJSONWithStatusCode(w, newResponse(registeredMessage(status)), 201)
+}
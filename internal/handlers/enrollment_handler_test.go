@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/mbop/internal/config"
+	"github.com/redhatinsights/mbop/internal/logger"
+	"github.com/redhatinsights/mbop/internal/store"
+	"github.com/redhatinsights/platform-go-middlewares/identity"
+	"github.com/stretchr/testify/suite"
+)
+
+type EnrollmentTestSuite struct {
+	suite.Suite
+	rec   *httptest.ResponseRecorder
+	store store.Store
+}
+
+func (suite *EnrollmentTestSuite) SetupSuite() {
+	_ = logger.Init()
+	config.Reset()
+	os.Setenv("STORE_BACKEND", "memory")
+}
+
+func (suite *EnrollmentTestSuite) BeforeTest(_, _ string) {
+	suite.rec = httptest.NewRecorder()
+	suite.Nil(store.SetupStore())
+
+	suite.store = store.GetStore()
+	store.GetStore = func() store.Store { return suite.store }
+}
+
+func TestEnrollmentEndpoints(t *testing.T) {
+	suite.Run(t, new(EnrollmentTestSuite))
+}
+
+func (suite *EnrollmentTestSuite) result() (int, string) {
+	//nolint:bodyclose
+	rsp := suite.rec.Result()
+	body, _ := io.ReadAll(rsp.Body)
+	return rsp.StatusCode, string(body)
+}
+
+func (suite *EnrollmentTestSuite) adminRequest(method, body string) *http.Request {
+	return httptest.NewRequest(method, "http://foobar/registrations/codes", strings.NewReader(body)).
+		WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+			User:  identity.User{OrgAdmin: true, Username: "foobar"},
+			OrgID: "1234",
+		}}))
+}
+
+func (suite *EnrollmentTestSuite) createCode(body string) enrollmentCodeResponse {
+	suite.rec = httptest.NewRecorder()
+	EnrollmentCodeCreateHandler(suite.rec, suite.adminRequest(http.MethodPost, body))
+
+	status, rspBody := suite.result()
+	suite.Equal(http.StatusCreated, status)
+
+	var rsp enrollmentCodeResponse
+	suite.Nil(json.Unmarshal([]byte(rspBody), &rsp))
+	return rsp
+}
+
+func (suite *EnrollmentTestSuite) enroll(code, uid string) (int, string) {
+	suite.rec = httptest.NewRecorder()
+	body := `{"code": "` + code + `", "uid": "` + uid + `", "display_name": "` + uid + `"}`
+	req := httptest.NewRequest(http.MethodPost, "http://foobar/registrations/enroll", strings.NewReader(body))
+	req.Header.Set("x-rh-certauth-cn", "/CN="+uid)
+
+	RegistrationEnrollHandler(suite.rec, req)
+	return suite.result()
+}
+
+func (suite *EnrollmentTestSuite) TestEnroll() {
+	code := suite.createCode("")
+	suite.NotEmpty(code.Code)
+	suite.Equal("foobar", code.Username)
+	suite.WithinDuration(time.Now().Add(time.Hour), code.ExpiresAt, time.Minute)
+
+	status, _ := suite.enroll(code.Code, "abc")
+	suite.Equal(http.StatusCreated, status)
+
+	found, err := suite.store.FindByUID(context.Background(), "abc")
+	suite.Nil(err)
+	suite.Equal("1234", found.OrgID)
+	suite.Equal("foobar", found.Username)
+
+	// single use
+	status, body := suite.enroll(code.Code, "def")
+	suite.Equal(http.StatusForbidden, status)
+	suite.Equal(`{"message":"enrollment code is invalid, expired or already used"}`, body)
+
+	suite.rec = httptest.NewRecorder()
+	EnrollmentCodeListHandler(suite.rec, suite.adminRequest(http.MethodGet, ""))
+	status, body = suite.result()
+	suite.Equal(http.StatusOK, status)
+	suite.NotContains(body, code.Code)
+
+	var list enrollmentCodeCollection
+	suite.Nil(json.Unmarshal([]byte(body), &list))
+	suite.Equal(1, list.Meta.Count)
+	suite.Equal("abc", list.Codes[0].UsedBy)
+	suite.NotNil(list.Codes[0].UsedAt)
+}
+
+func (suite *EnrollmentTestSuite) TestEnrollBadCode() {
+	status, _ := suite.enroll("not-a-code", "abc")
+	suite.Equal(http.StatusForbidden, status)
+}
+
+func (suite *EnrollmentTestSuite) TestEnrollCNMismatch() {
+	code := suite.createCode("")
+
+	suite.rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "http://foobar/registrations/enroll",
+		strings.NewReader(`{"code": "`+code.Code+`", "uid": "abc", "display_name": "abc"}`))
+	req.Header.Set("x-rh-certauth-cn", "/CN=def")
+	RegistrationEnrollHandler(suite.rec, req)
+
+	status, body := suite.result()
+	suite.Equal(http.StatusBadRequest, status)
+	suite.Equal(`{"message":"x-rh-certauth-cn does not match uid"}`, body)
+
+	// and the code is still good
+	status, _ = suite.enroll(code.Code, "abc")
+	suite.Equal(http.StatusCreated, status)
+}
+
+func (suite *EnrollmentTestSuite) TestCreateCodeTTL() {
+	code := suite.createCode(`{"ttl": "5m"}`)
+	suite.WithinDuration(time.Now().Add(5*time.Minute), code.ExpiresAt, time.Minute)
+
+	for _, body := range []string{`{"ttl": "2h"}`, `{"ttl": "-5m"}`, `{"ttl": "soon"}`, `{`} {
+		suite.rec = httptest.NewRecorder()
+		EnrollmentCodeCreateHandler(suite.rec, suite.adminRequest(http.MethodPost, body))
+
+		status, _ := suite.result()
+		suite.Equal(http.StatusBadRequest, status, body)
+	}
+}
+
+func (suite *EnrollmentTestSuite) TestCreateCodeNotAdmin() {
+	req := httptest.NewRequest(http.MethodPost, "http://foobar/registrations/codes", nil).
+		WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+			User:  identity.User{Username: "foobar"},
+			OrgID: "1234",
+		}}))
+	EnrollmentCodeCreateHandler(suite.rec, req)
+
+	status, body := suite.result()
+	suite.Equal(http.StatusForbidden, status)
+	suite.Equal(`{"message":"user must be org admin to create enrollment codes"}`, body)
+}
@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/redhatinsights/mbop/internal/config"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// the schema is compiled once for each distinct config value, config is only
+// ever reset in tests
+var extraSchema struct {
+	sync.Mutex
+	source string
+	schema *jsonschema.Schema
+}
+
+// ExtraSchema compiles the json schema registration extras are validated
+// against, nil when none is configured
+func ExtraSchema() (*jsonschema.Schema, error) {
+	source := config.Get().RegistrationExtraSchema
+	if source == "" {
+		return nil, nil
+	}
+
+	extraSchema.Lock()
+	defer extraSchema.Unlock()
+
+	if extraSchema.schema != nil && extraSchema.source == source {
+		return extraSchema.schema, nil
+	}
+
+	doc, err := jsonschema.UnmarshalJSON(strings.NewReader(source))
+	if err != nil {
+		return nil, fmt.Errorf("invalid registration extra schema: %w", err)
+	}
+
+	c := jsonschema.NewCompiler()
+	if err := c.AddResource("extra.json", doc); err != nil {
+		return nil, fmt.Errorf("invalid registration extra schema: %w", err)
+	}
+	schema, err := c.Compile("extra.json")
+	if err != nil {
+		return nil, fmt.Errorf("invalid registration extra schema: %w", err)
+	}
+
+	extraSchema.source, extraSchema.schema = source, schema
+	return schema, nil
+}
+
+// validateExtra checks extra against the configured schema, the returned
+// message lists every violation and is meant for the caller
+func validateExtra(extra map[string]any) (string, error) {
+	schema, err := ExtraSchema()
+	if err != nil || schema == nil {
+		return "", err
+	}
+
+	// the schema sees the same thing an empty extra is stored as
+	if extra == nil {
+		extra = map[string]any{}
+	}
+
+	err = schema.Validate(extra)
+	if err == nil {
+		return "", nil
+	}
+
+	var verr *jsonschema.ValidationError
+	if !errors.As(err, &verr) {
+		return "", err
+	}
+
+	var problems []string
+	for _, unit := range verr.BasicOutput().Errors {
+		if unit.Error == nil {
+			continue
+		}
+		location := unit.InstanceLocation
+		if location == "" {
+			location = "/"
+		}
+		problems = append(problems, fmt.Sprintf("at '%s': %s", location, unit.Error))
+	}
+
+	return "[extra] does not match the schema: " + strings.Join(problems, "; "), nil
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
@@ -10,6 +11,7 @@ import (
 
 	l "github.com/redhatinsights/mbop/internal/logger"
 	"github.com/redhatinsights/mbop/internal/models"
+	"github.com/redhatinsights/mbop/internal/store"
 )
 
 var (
@@ -46,6 +48,19 @@ func do404(w http.ResponseWriter, msg string) {
 	doError(w, msg, 404)
 }
 
+// doStoreError responds to a failed store call, the database timing out is a
+// 504 and it being unreachable a 503 so they aren't mistaken for bugs
+func doStoreError(w http.ResponseWriter, msg string, err error) {
+	switch {
+	case errors.Is(err, store.ErrStoreTimeout):
+		doError(w, msg+err.Error(), http.StatusGatewayTimeout)
+	case errors.Is(err, store.ErrStoreUnavailable):
+		doError(w, msg+err.Error(), http.StatusServiceUnavailable)
+	default:
+		do500(w, msg+err.Error())
+	}
+}
+
 func doError(w http.ResponseWriter, msg string, code int) {
 	l.Log.Info("Error during request", "error", msg, "status", code)
 	sendJSONWithStatusCode(w, newResponse(msg), code)
@@ -235,3 +250,63 @@ func getOffset(r *http.Request) (int, error) {
 
 	return offset, nil
 }
+
+// paginationLinks holds the relative urls of the pages around the current
+// one, missing when there's no such page
+type paginationLinks struct {
+	Next string `json:"next,omitempty"`
+	Prev string `json:"prev,omitempty"`
+}
+
+func getCursor(r *http.Request) (*store.Cursor, error) {
+	raw := r.URL.Query().Get("cursor")
+	if raw == "" {
+		return nil, nil
+	}
+
+	if r.URL.Query().Get("offset") != "" {
+		return nil, fmt.Errorf("cursor and offset cannot be used together")
+	}
+
+	c, err := store.DecodeCursor(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return c, nil
+}
+
+/*
+getPageLinks builds the next/prev links for a keyset page. The page was
+fetched with one row more than the limit so hasMore tells whether the page
+is followed by another one in the direction it was read in, first and last
+are the positions of the first and last row that are actually returned.
+*/
+func getPageLinks(r *http.Request, cursor *store.Cursor, offset int, hasMore bool, first, last *store.Cursor) *paginationLinks {
+	if first == nil || last == nil {
+		return nil
+	}
+
+	backward := cursor != nil && cursor.Backward
+
+	var links paginationLinks
+	if backward || hasMore {
+		last.Backward = false
+		links.Next = pageURL(r, last)
+	}
+	if (backward && hasMore) || (!backward && (cursor != nil || offset > 0)) {
+		first.Backward = true
+		links.Prev = pageURL(r, first)
+	}
+
+	if links.Next == "" && links.Prev == "" {
+		return nil
+	}
+	return &links
+}
+
+func pageURL(r *http.Request, c *store.Cursor) string {
+	q := r.URL.Query()
+	q.Del("offset")
+	q.Set("cursor", c.Encode())
+	return r.URL.Path + "?" + q.Encode()
+}
@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/redhatinsights/mbop/internal/store"
+)
+
+type orgSettingsResponse struct {
+	OrgID           string `json:"org_id"`
+	RequireApproval bool   `json:"require_approval"`
+}
+
+type orgSettingsUpdateRequest struct {
+	RequireApproval *bool `json:"require_approval"`
+}
+
+func OrgSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	orgID := r.PathValue("orgID")
+
+	settings, err := store.GetStore().OrgSettings(r.Context(), orgID)
+	if err != nil {
+		doStoreError(w, "failed to get org settings: ", err)
+		return
+	}
+
+	sendJSON(w, orgSettingsResponse{OrgID: settings.OrgID, RequireApproval: settings.RequireApproval})
+}
+
+// OrgSettingsUpdateHandler changes an org's settings, turning approval on only
+// affects registrations made from then on
+func OrgSettingsUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	orgID := r.PathValue("orgID")
+
+	var body orgSettingsUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		do400(w, "invalid body, need a json object with [require_approval]")
+		return
+	}
+	if body.RequireApproval == nil {
+		do400(w, "required parameter [require_approval] not found in body")
+		return
+	}
+
+	settings := &store.OrgSettings{OrgID: orgID, RequireApproval: *body.RequireApproval}
+	if err := store.GetStore().SetOrgSettings(r.Context(), settings); err != nil {
+		doStoreError(w, "failed to set org settings: ", err)
+		return
+	}
+
+	sendJSON(w, orgSettingsResponse{OrgID: settings.OrgID, RequireApproval: settings.RequireApproval})
+}
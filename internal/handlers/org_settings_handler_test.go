@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/redhatinsights/mbop/internal/config"
+	"github.com/redhatinsights/mbop/internal/logger"
+	"github.com/redhatinsights/mbop/internal/store"
+	"github.com/stretchr/testify/suite"
+)
+
+type OrgSettingsTestSuite struct {
+	suite.Suite
+	rec   *httptest.ResponseRecorder
+	store store.Store
+}
+
+func (suite *OrgSettingsTestSuite) SetupSuite() {
+	_ = logger.Init()
+	config.Reset()
+	os.Setenv("STORE_BACKEND", "memory")
+}
+
+func (suite *OrgSettingsTestSuite) BeforeTest(_, _ string) {
+	suite.rec = httptest.NewRecorder()
+	suite.Nil(store.SetupStore())
+
+	suite.store = store.GetStore()
+	store.GetStore = func() store.Store { return suite.store }
+}
+
+func TestOrgSettingsEndpoints(t *testing.T) {
+	suite.Run(t, new(OrgSettingsTestSuite))
+}
+
+func (suite *OrgSettingsTestSuite) result() (int, string) {
+	//nolint:bodyclose
+	rsp := suite.rec.Result()
+	body, _ := io.ReadAll(rsp.Body)
+	return rsp.StatusCode, string(body)
+}
+
+func (suite *OrgSettingsTestSuite) TestUpdateSettings() {
+	req := httptest.NewRequest(http.MethodGet, "http://foobar/api/mbop/v1/admin/orgs/1234/settings", nil)
+	req.SetPathValue("orgID", "1234")
+	OrgSettingsHandler(suite.rec, req)
+	status, body := suite.result()
+	suite.Equal(http.StatusOK, status)
+	suite.JSONEq(`{"org_id":"1234","require_approval":false}`, body)
+
+	suite.rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPut, "http://foobar/api/mbop/v1/admin/orgs/1234/settings", strings.NewReader(`{"require_approval": true}`))
+	req.SetPathValue("orgID", "1234")
+	OrgSettingsUpdateHandler(suite.rec, req)
+	status, body = suite.result()
+	suite.Equal(http.StatusOK, status)
+	suite.JSONEq(`{"org_id":"1234","require_approval":true}`, body)
+}
+
+func (suite *OrgSettingsTestSuite) TestBadUpdate() {
+	for _, body := range []string{`{`, `{}`, `{"require_approval": "yes"}`} {
+		suite.rec = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, "http://foobar/api/mbop/v1/admin/orgs/1234/settings", strings.NewReader(body))
+		req.SetPathValue("orgID", "1234")
+		OrgSettingsUpdateHandler(suite.rec, req)
+
+		status, _ := suite.result()
+		suite.Equal(http.StatusBadRequest, status, body)
+	}
+}
@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/redhatinsights/mbop/internal/config"
+	"github.com/redhatinsights/mbop/internal/store"
+	"github.com/redhatinsights/platform-go-middlewares/identity"
+)
+
+type quotaResponse struct {
+	OrgID string `json:"org_id"`
+	// null when the org can register as many as it likes
+	Limit     *int `json:"limit"`
+	Used      int  `json:"used"`
+	Remaining *int `json:"remaining"`
+	// whether the limit is the org's own instead of the default
+	Override bool `json:"override"`
+}
+
+type quotaUpdateRequest struct {
+	MaxRegistrations *int `json:"max_registrations"`
+}
+
+func newQuotaResponse(q *store.Quota) *quotaResponse {
+	rsp := &quotaResponse{OrgID: q.OrgID, Limit: q.Limit, Used: q.Used, Override: q.Override}
+	if q.Limit != nil {
+		remaining := max(*q.Limit-q.Used, 0)
+		rsp.Remaining = &remaining
+	}
+	return rsp
+}
+
+// RegistrationQuotaHandler shows the caller's org how many registrations it
+// has against how many it may have
+func RegistrationQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	id := identity.Get(r.Context())
+
+	q, err := store.GetStore().Quota(r.Context(), id.Identity.OrgID, config.Get().RegistrationQuota)
+	if err != nil {
+		doStoreError(w, "failed to get quota: ", err)
+		return
+	}
+
+	sendJSON(w, newQuotaResponse(q))
+}
+
+func OrgQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	orgID := r.PathValue("orgID")
+
+	q, err := store.GetStore().Quota(r.Context(), orgID, config.Get().RegistrationQuota)
+	if err != nil {
+		doStoreError(w, "failed to get quota: ", err)
+		return
+	}
+
+	sendJSON(w, newQuotaResponse(q))
+}
+
+// OrgQuotaUpdateHandler sets an org's own limit, an org already past the new
+// limit keeps its registrations but can't create more
+func OrgQuotaUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	orgID := r.PathValue("orgID")
+
+	var body quotaUpdateRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		do400(w, "invalid body, need a json object with [max_registrations]")
+		return
+	}
+	if body.MaxRegistrations == nil || *body.MaxRegistrations < 0 {
+		do400(w, "[max_registrations] needs to be 0 or more")
+		return
+	}
+
+	db := store.GetStore()
+	if err := db.SetQuotaOverride(r.Context(), orgID, body.MaxRegistrations); err != nil {
+		doStoreError(w, "failed to set quota: ", err)
+		return
+	}
+
+	q, err := db.Quota(r.Context(), orgID, config.Get().RegistrationQuota)
+	if err != nil {
+		doStoreError(w, "failed to get quota: ", err)
+		return
+	}
+
+	sendJSON(w, newQuotaResponse(q))
+}
+
+// OrgQuotaDeleteHandler removes an org's own limit, putting it back on the
+// default
+func OrgQuotaDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	orgID := r.PathValue("orgID")
+
+	if err := store.GetStore().SetQuotaOverride(r.Context(), orgID, nil); err != nil {
+		doStoreError(w, "failed to remove quota: ", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/redhatinsights/mbop/internal/config"
+	"github.com/redhatinsights/mbop/internal/logger"
+	"github.com/redhatinsights/mbop/internal/store"
+	"github.com/redhatinsights/platform-go-middlewares/identity"
+	"github.com/stretchr/testify/suite"
+)
+
+type QuotaTestSuite struct {
+	suite.Suite
+	rec   *httptest.ResponseRecorder
+	store store.Store
+}
+
+func (suite *QuotaTestSuite) SetupSuite() {
+	_ = logger.Init()
+	config.Reset()
+	os.Setenv("STORE_BACKEND", "memory")
+}
+
+func (suite *QuotaTestSuite) BeforeTest(_, _ string) {
+	suite.rec = httptest.NewRecorder()
+	suite.Nil(store.SetupStore())
+
+	suite.store = store.GetStore()
+	store.GetStore = func() store.Store { return suite.store }
+}
+
+func (suite *QuotaTestSuite) AfterTest(_, _ string) {
+	config.Reset()
+}
+
+func TestQuotaEndpoints(t *testing.T) {
+	suite.Run(t, new(QuotaTestSuite))
+}
+
+func (suite *QuotaTestSuite) result() (int, string) {
+	//nolint:bodyclose
+	rsp := suite.rec.Result()
+	body, _ := io.ReadAll(rsp.Body)
+	return rsp.StatusCode, string(body)
+}
+
+func (suite *QuotaTestSuite) create(uid string) (int, string) {
+	suite.rec = httptest.NewRecorder()
+	body := []byte(`{"uid": "` + uid + `", "display_name": "` + uid + `"}`)
+	req := httptest.NewRequest("POST", "http://foobar/registrations", bytes.NewReader(body)).
+		WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+			User:  identity.User{OrgAdmin: true, Username: "foobar"},
+			OrgID: "1234",
+		}}))
+	req.Header.Set("x-rh-certauth-cn", "/CN="+uid)
+
+	RegistrationCreateHandler(suite.rec, req)
+	return suite.result()
+}
+
+func (suite *QuotaTestSuite) usage() *quotaResponse {
+	suite.rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "http://foobar/registrations/quota", nil).
+		WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+			OrgID: "1234",
+		}}))
+
+	RegistrationQuotaHandler(suite.rec, req)
+	status, body := suite.result()
+	suite.Equal(http.StatusOK, status)
+
+	var rsp quotaResponse
+	suite.Nil(json.Unmarshal([]byte(body), &rsp))
+	return &rsp
+}
+
+func (suite *QuotaTestSuite) TestDefaultQuota() {
+	suite.T().Setenv("REGISTRATION_QUOTA", "2")
+	config.Reset()
+
+	for _, uid := range []string{"abc", "def"} {
+		status, _ := suite.create(uid)
+		suite.Equal(http.StatusCreated, status)
+	}
+
+	status, body := suite.create("ghi")
+	suite.Equal(http.StatusForbidden, status)
+	suite.Equal(`{"message":"registration quota of 2 reached for this org"}`, body)
+
+	rsp := suite.usage()
+	suite.Equal(2, *rsp.Limit)
+	suite.Equal(2, rsp.Used)
+	suite.Equal(0, *rsp.Remaining)
+	suite.False(rsp.Override)
+
+	// deleting one frees up room again
+	suite.Nil(suite.store.Delete(context.Background(), "1234", "abc", "foobar"))
+	status, _ = suite.create("ghi")
+	suite.Equal(http.StatusCreated, status)
+}
+
+func (suite *QuotaTestSuite) TestUnlimited() {
+	status, _ := suite.create("abc")
+	suite.Equal(http.StatusCreated, status)
+
+	rsp := suite.usage()
+	suite.Nil(rsp.Limit)
+	suite.Nil(rsp.Remaining)
+	suite.Equal(1, rsp.Used)
+}
+
+func (suite *QuotaTestSuite) TestOverride() {
+	req := httptest.NewRequest(http.MethodPut, "http://foobar/api/mbop/v1/admin/orgs/1234/quota", strings.NewReader(`{"max_registrations": 1}`))
+	req.SetPathValue("orgID", "1234")
+	OrgQuotaUpdateHandler(suite.rec, req)
+	status, body := suite.result()
+	suite.Equal(http.StatusOK, status)
+	suite.JSONEq(`{"org_id":"1234","limit":1,"used":0,"remaining":1,"override":true}`, body)
+
+	status, _ = suite.create("abc")
+	suite.Equal(http.StatusCreated, status)
+	status, _ = suite.create("def")
+	suite.Equal(http.StatusForbidden, status)
+
+	suite.rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodDelete, "http://foobar/api/mbop/v1/admin/orgs/1234/quota", nil)
+	req.SetPathValue("orgID", "1234")
+	OrgQuotaDeleteHandler(suite.rec, req)
+	status, _ = suite.result()
+	suite.Equal(http.StatusNoContent, status)
+
+	suite.rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "http://foobar/api/mbop/v1/admin/orgs/1234/quota", nil)
+	req.SetPathValue("orgID", "1234")
+	OrgQuotaHandler(suite.rec, req)
+	status, body = suite.result()
+	suite.Equal(http.StatusOK, status)
+	suite.JSONEq(`{"org_id":"1234","limit":null,"used":1,"remaining":null,"override":false}`, body)
+}
+
+func (suite *QuotaTestSuite) TestBadOverride() {
+	for _, body := range []string{`{`, `{}`, `{"max_registrations": -1}`} {
+		suite.rec = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPut, "http://foobar/api/mbop/v1/admin/orgs/1234/quota", strings.NewReader(body))
+		req.SetPathValue("orgID", "1234")
+		OrgQuotaUpdateHandler(suite.rec, req)
+
+		status, _ := suite.result()
+		suite.Equal(http.StatusBadRequest, status, body)
+	}
+}
@@ -0,0 +1,179 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	l "github.com/redhatinsights/mbop/internal/logger"
+	"github.com/redhatinsights/mbop/internal/store"
+)
+
+// the admin api has no identity, this is who shows up in the history
+const bulkImportActor = "admin-import"
+
+const (
+	maxImportBytes = 32 << 20
+	exportPageSize = 500
+)
+
+type registrationImportResponse struct {
+	Imported int                  `json:"imported"`
+	Results  []store.ImportResult `json:"results"`
+}
+
+func RegistrationImportHandler(w http.ResponseWriter, r *http.Request) {
+	format, err := getBulkFormat(r)
+	if err != nil {
+		do400(w, err.Error())
+		return
+	}
+
+	rows, err := store.ParseBulkRegistrations(http.MaxBytesReader(w, r.Body, maxImportBytes), format)
+	if err != nil {
+		do400(w, err.Error())
+		return
+	}
+	if len(rows) == 0 {
+		do400(w, "nothing to import")
+		return
+	}
+
+	// rows that are invalid on their own are a bad request, conflicts with
+	// what's already stored are reported by the store below
+	results, ok, err := ValidateImport(rows)
+	if err != nil {
+		do500(w, err.Error())
+		return
+	}
+	if !ok {
+		sendJSONWithStatusCode(w, &registrationImportResponse{Results: results}, http.StatusBadRequest)
+		return
+	}
+
+	db := store.GetStore()
+	results, err = db.Import(r.Context(), rows, bulkImportActor)
+	if err != nil {
+		if errors.Is(err, store.ErrImportFailed) {
+			sendJSONWithStatusCode(w, &registrationImportResponse{Results: results}, http.StatusConflict)
+			return
+		}
+
+		doStoreError(w, "failed to import registrations: ", err)
+		return
+	}
+
+	sendJSONWithStatusCode(w, &registrationImportResponse{Imported: len(results), Results: results}, http.StatusCreated)
+}
+
+// ValidateImport checks import rows on their own and against each other, and
+// their extra against REGISTRATION_EXTRA_SCHEMA, reporting an error per row
+func ValidateImport(rows []store.BulkRegistration) ([]store.ImportResult, bool, error) {
+	results, ok := store.ValidateBulkRegistrations(rows)
+	for i := range rows {
+		if results[i].Error != "" {
+			continue
+		}
+
+		problems, err := validateExtra(rows[i].Extra)
+		if err != nil {
+			return nil, false, err
+		}
+		if problems != "" {
+			results[i].Error = problems
+			ok = false
+		}
+	}
+	return results, ok, nil
+}
+
+func RegistrationExportHandler(w http.ResponseWriter, r *http.Request) {
+	orgID := r.URL.Query().Get("org_id")
+	if orgID == "" {
+		do400(w, "need org_id query param")
+		return
+	}
+
+	format, err := getBulkFormat(r)
+	if err != nil {
+		do400(w, err.Error())
+		return
+	}
+
+	db := store.GetStore()
+
+	// the first page is read before writing anything so an error can still be
+	// reported properly, after that the export is streamed page by page
+	q := store.RegistrationQuery{Limit: exportPageSize, SortBy: store.SortByCreatedAt}
+	regs, _, err := db.All(r.Context(), orgID, q)
+	if err != nil {
+		doStoreError(w, "failed to export registrations: ", err)
+		return
+	}
+
+	if format == store.BulkFormatCSV {
+		w.Header().Set("Content-Type", "text/csv")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"registrations-%s.%s\"", orgID, format))
+
+	bw, err := store.NewBulkWriter(w, format)
+	if err != nil {
+		l.Log.Error(err, "failed to start export", "org_id", orgID)
+		return
+	}
+
+	flusher, _ := w.(http.Flusher)
+	for {
+		for i := range regs {
+			if err := bw.Write(store.NewBulkRegistration(&regs[i])); err != nil {
+				l.Log.Error(err, "failed to write export", "org_id", orgID)
+				return
+			}
+		}
+		if err := bw.Flush(); err != nil {
+			l.Log.Error(err, "failed to write export", "org_id", orgID)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+
+		if len(regs) < exportPageSize {
+			break
+		}
+
+		last := regs[len(regs)-1]
+		q.Cursor = &store.Cursor{CreatedAt: last.CreatedAt, Key: last.ID}
+		regs, _, err = db.All(r.Context(), orgID, q)
+		if err != nil {
+			// too late for a status code, the truncated document is the best
+			// signal the client gets
+			l.Log.Error(err, "failed to export registrations", "org_id", orgID)
+			return
+		}
+	}
+
+	if err := bw.Close(); err != nil {
+		l.Log.Error(err, "failed to write export", "org_id", orgID)
+	}
+}
+
+// getBulkFormat picks the format from the format query param, falling back
+// to the content type and then json
+func getBulkFormat(r *http.Request) (store.BulkFormat, error) {
+	switch f := r.URL.Query().Get("format"); f {
+	case "":
+	case string(store.BulkFormatJSON), string(store.BulkFormatCSV):
+		return store.BulkFormat(f), nil
+	default:
+		return "", fmt.Errorf("format must be one of json, csv")
+	}
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		return store.BulkFormatCSV, nil
+	}
+	return store.BulkFormatJSON, nil
+}
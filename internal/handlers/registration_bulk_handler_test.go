@@ -0,0 +1,155 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/redhatinsights/mbop/internal/config"
+	"github.com/redhatinsights/mbop/internal/logger"
+	"github.com/redhatinsights/mbop/internal/store"
+	"github.com/stretchr/testify/suite"
+)
+
+type RegistrationBulkTestSuite struct {
+	suite.Suite
+	rec   *httptest.ResponseRecorder
+	store store.Store
+}
+
+func (suite *RegistrationBulkTestSuite) SetupSuite() {
+	_ = logger.Init()
+	config.Reset()
+	os.Setenv("STORE_BACKEND", "memory")
+}
+
+func (suite *RegistrationBulkTestSuite) BeforeTest(_, _ string) {
+	suite.rec = httptest.NewRecorder()
+	suite.Nil(store.SetupStore())
+
+	suite.store = store.GetStore()
+	store.GetStore = func() store.Store { return suite.store }
+}
+
+func TestRegistrationBulkEndpoints(t *testing.T) {
+	suite.Run(t, new(RegistrationBulkTestSuite))
+}
+
+func (suite *RegistrationBulkTestSuite) result() (int, string) {
+	//nolint:bodyclose
+	rsp := suite.rec.Result()
+	body, _ := io.ReadAll(rsp.Body)
+	return rsp.StatusCode, string(body)
+}
+
+func (suite *RegistrationBulkTestSuite) TestImportCSV() {
+	req := httptest.NewRequest(http.MethodPost, "http://foobar/api/mbop/v1/admin/registrations/import", strings.NewReader(
+		"org_id,uid,display_name,username,extra\n1234,abc,one,foo,\n1234,def,two,foo,\n"))
+	req.Header.Set("Content-Type", "text/csv")
+
+	RegistrationImportHandler(suite.rec, req)
+
+	status, body := suite.result()
+	suite.Equal(http.StatusCreated, status)
+
+	var rsp registrationImportResponse
+	suite.Nil(json.Unmarshal([]byte(body), &rsp))
+	suite.Equal(2, rsp.Imported)
+
+	_, count, err := suite.store.All(context.Background(), "1234", store.RegistrationQuery{Limit: 10})
+	suite.Nil(err)
+	suite.Equal(2, count)
+}
+
+func (suite *RegistrationBulkTestSuite) TestImportInvalidRows() {
+	req := httptest.NewRequest(http.MethodPost, "http://foobar/api/mbop/v1/admin/registrations/import", strings.NewReader(
+		`[{"org_id": "1234", "uid": "abc", "display_name": "one"}, {"org_id": "1234", "display_name": "two"}]`))
+
+	RegistrationImportHandler(suite.rec, req)
+
+	status, body := suite.result()
+	suite.Equal(http.StatusBadRequest, status)
+
+	var rsp registrationImportResponse
+	suite.Nil(json.Unmarshal([]byte(body), &rsp))
+	suite.Equal(0, rsp.Imported)
+	suite.Equal("missing uid", rsp.Results[1].Error)
+}
+
+func (suite *RegistrationBulkTestSuite) TestImportConflict() {
+	_, err := suite.store.Create(context.Background(), &store.Registration{OrgID: "1234", UID: "abc", DisplayName: "one"})
+	suite.Nil(err)
+
+	req := httptest.NewRequest(http.MethodPost, "http://foobar/api/mbop/v1/admin/registrations/import", strings.NewReader(
+		`[{"org_id": "1234", "uid": "abc", "display_name": "other"}, {"org_id": "1234", "uid": "def", "display_name": "two"}]`))
+
+	RegistrationImportHandler(suite.rec, req)
+
+	status, body := suite.result()
+	suite.Equal(http.StatusConflict, status)
+
+	var rsp registrationImportResponse
+	suite.Nil(json.Unmarshal([]byte(body), &rsp))
+	suite.NotEmpty(rsp.Results[0].Error)
+	suite.Empty(rsp.Results[1].Error)
+
+	_, err = suite.store.Find(context.Background(), "1234", "def")
+	suite.ErrorIs(err, store.ErrRegistrationNotFound)
+}
+
+func (suite *RegistrationBulkTestSuite) TestImportExtraSchema() {
+	suite.T().Setenv("REGISTRATION_EXTRA_SCHEMA", testExtraSchema)
+	config.Reset()
+	suite.T().Cleanup(config.Reset)
+
+	req := httptest.NewRequest(http.MethodPost, "http://foobar/api/mbop/v1/admin/registrations/import", strings.NewReader(
+		`[{"org_id": "1234", "uid": "abc", "display_name": "one", "extra": {"location": "rdu"}},
+		  {"org_id": "1234", "uid": "def", "display_name": "two", "extra": {"environment": "dev"}}]`))
+
+	RegistrationImportHandler(suite.rec, req)
+
+	status, body := suite.result()
+	suite.Equal(http.StatusBadRequest, status)
+
+	var rsp registrationImportResponse
+	suite.Nil(json.Unmarshal([]byte(body), &rsp))
+	suite.Equal(0, rsp.Imported)
+	suite.Empty(rsp.Results[0].Error)
+	suite.Equal("[extra] does not match the schema: at '/': missing property 'location'; at '/environment': value must be one of 'prod', 'stage'", rsp.Results[1].Error)
+
+	_, err := suite.store.Find(context.Background(), "1234", "abc")
+	suite.ErrorIs(err, store.ErrRegistrationNotFound)
+}
+
+func (suite *RegistrationBulkTestSuite) TestExport() {
+	for _, uid := range []string{"abc", "def"} {
+		_, err := suite.store.Create(context.Background(), &store.Registration{OrgID: "1234", UID: uid, DisplayName: uid, Username: "foo"})
+		suite.Nil(err)
+	}
+	_, err := suite.store.Create(context.Background(), &store.Registration{OrgID: "5678", UID: "other", DisplayName: "other"})
+	suite.Nil(err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar/api/mbop/v1/admin/registrations/export?org_id=1234&format=csv", nil)
+
+	RegistrationExportHandler(suite.rec, req)
+
+	status, body := suite.result()
+	suite.Equal(http.StatusOK, status)
+	suite.Equal("text/csv", suite.rec.Header().Get("Content-Type"))
+	suite.Equal("org_id,uid,display_name,username,extra\n1234,abc,abc,foo,\n1234,def,def,foo,\n", body)
+}
+
+func (suite *RegistrationBulkTestSuite) TestExportNoOrg() {
+	req := httptest.NewRequest(http.MethodGet, "http://foobar/api/mbop/v1/admin/registrations/export", nil)
+
+	RegistrationExportHandler(suite.rec, req)
+
+	status, body := suite.result()
+	suite.Equal(http.StatusBadRequest, status)
+	suite.Equal("{\"message\":\"need org_id query param\"}", body)
+}
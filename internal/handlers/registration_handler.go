@@ -3,8 +3,12 @@ package handlers
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
+	"maps"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/redhatinsights/mbop/internal/config"
@@ -13,8 +17,14 @@ import (
 )
 
 type registationCreateRequest struct {
-	UID         *string `json:"uid,omitempty"`
-	DisplayName *string `json:"display_name,omitempty"`
+	UID         *string        `json:"uid,omitempty"`
+	DisplayName *string        `json:"display_name,omitempty"`
+	Extra       map[string]any `json:"extra,omitempty"`
+}
+
+type registrationUpdateRequest struct {
+	DisplayName *string                 `json:"display_name,omitempty"`
+	Extra       *map[string]interface{} `json:"extra,omitempty"`
 }
 
 type registrationCollection struct {
@@ -23,14 +33,44 @@ type registrationCollection struct {
 }
 
 type registrationResponse struct {
-	UID         string    `json:"uid"`
-	DisplayName string    `json:"display_name"`
-	Username    string    `json:"username"`
-	CreatedAt   time.Time `json:"created_at"`
+	UID         string               `json:"uid"`
+	DisplayName string               `json:"display_name"`
+	Username    string               `json:"username"`
+	Extra       map[string]any       `json:"extra,omitempty"`
+	Certificate *certificateResponse `json:"certificate,omitempty"`
+	CreatedAt   time.Time            `json:"created_at"`
+	LastSeenAt  *time.Time           `json:"last_seen_at"`
+	Status      string               `json:"status"`
+	ReviewedBy  string               `json:"reviewed_by,omitempty"`
+	ReviewedAt  *time.Time           `json:"reviewed_at,omitempty"`
+}
+
+type certificateResponse struct {
+	Fingerprint string    `json:"fingerprint"`
+	Serial      string    `json:"serial"`
+	NotAfter    time.Time `json:"not_after"`
 }
 
 type registrationMeta struct {
-	Count int `json:"count"`
+	Count  int              `json:"count"`
+	Limit  int              `json:"limit"`
+	Offset int              `json:"offset"`
+	Links  *paginationLinks `json:"links,omitempty"`
+}
+
+type registrationHistoryCollection struct {
+	Events []registrationEventResponse `json:"events"`
+	Meta   registrationMeta            `json:"meta"`
+}
+
+type registrationEventResponse struct {
+	Type      string                `json:"type"`
+	Actor     string                `json:"actor"`
+	OrgID     string                `json:"org_id"`
+	UID       string                `json:"uid"`
+	Before    *registrationResponse `json:"before"`
+	After     *registrationResponse `json:"after"`
+	CreatedAt time.Time             `json:"created_at"`
 }
 
 func RegistrationListHandler(w http.ResponseWriter, r *http.Request) {
@@ -40,56 +80,203 @@ func RegistrationListHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	limit, err := getLimit(r)
-	if err != nil {
-		do400(w, err.Error())
-		return
-	}
-	offset, err := getOffset(r)
+	q, err := getRegistrationQuery(r)
 	if err != nil {
 		do400(w, err.Error())
 		return
 	}
 
+	// reading one more row than asked for tells whether there's another page
+	limit := q.Limit
+	q.Limit++
+
 	db := store.GetStore()
-	regs, count, err := db.All(id.Identity.OrgID, limit, offset)
+	regs, count, err := db.All(r.Context(), id.Identity.OrgID, q)
 	if err != nil {
-		do500(w, err.Error())
+		if errors.Is(err, store.ErrInvalidCursor) {
+			do400(w, "invalid cursor")
+			return
+		}
+		doStoreError(w, "error listing registrations: ", err)
 		return
 	}
 
+	hasMore := len(regs) > limit
+	if hasMore {
+		// a backward page ends at the cursor, so the extra row is the first one
+		if q.Cursor != nil && q.Cursor.Backward {
+			regs = regs[1:]
+		} else {
+			regs = regs[:limit]
+		}
+	}
+
 	out := make([]registrationResponse, len(regs))
 	for i := range regs {
-		out[i] = registrationResponse{
-			UID:         regs[i].UID,
-			DisplayName: regs[i].DisplayName,
-			Username:    regs[i].Username,
-			CreatedAt:   regs[i].CreatedAt,
-		}
+		out[i] = newRegistrationResponse(&regs[i])
+	}
+
+	// cursors are only handed out for the created_at order they're keyed on
+	var links *paginationLinks
+	if q.SortBy == "" || q.SortBy == store.SortByCreatedAt {
+		links = getPageLinks(r, q.Cursor, q.Offset, hasMore, registrationCursor(regs, 0), registrationCursor(regs, len(regs)-1))
 	}
 
 	sendJSON(w, &registrationCollection{
 		Registrations: out,
 		Meta: registrationMeta{
-			Count: count,
+			Count:  count,
+			Limit:  limit,
+			Offset: q.Offset,
+			Links:  links,
 		},
 	})
 }
 
+func registrationCursor(regs []store.Registration, i int) *store.Cursor {
+	if i < 0 || i >= len(regs) {
+		return nil
+	}
+	return &store.Cursor{CreatedAt: regs[i].CreatedAt, Key: regs[i].ID}
+}
+
+// getRegistrationQuery parses the filtering, sorting and pagination query
+// parameters for listing registrations
+func getRegistrationQuery(r *http.Request) (store.RegistrationQuery, error) {
+	params := r.URL.Query()
+	q := store.RegistrationQuery{
+		Search:   params.Get("search"),
+		Username: params.Get("username"),
+	}
+
+	for _, param := range slices.Sorted(maps.Keys(params)) {
+		key, ok := strings.CutPrefix(param, "extra.")
+		if !ok {
+			continue
+		}
+		values := params[param]
+		if key == "" {
+			return q, fmt.Errorf("extra filters need a key, e.g. extra.env=prod")
+		}
+		if len(values) > 1 {
+			return q, fmt.Errorf("%s can only be given once", param)
+		}
+		if q.Extra == nil {
+			q.Extra = make(map[string]string)
+		}
+		q.Extra[key] = values[0]
+	}
+
+	limit, err := getLimit(r)
+	if err != nil {
+		return q, err
+	}
+	offset, err := getOffset(r)
+	if err != nil {
+		return q, err
+	}
+	if limit < 0 || offset < 0 {
+		return q, fmt.Errorf("limit and offset cannot be negative")
+	}
+	q.Limit, q.Offset = limit, offset
+
+	q.Cursor, err = getCursor(r)
+	if err != nil {
+		return q, err
+	}
+
+	if staleFor := params.Get("stale_for"); staleFor != "" {
+		d, err := time.ParseDuration(staleFor)
+		if err != nil || d <= 0 {
+			return q, fmt.Errorf("stale_for must be a positive duration, e.g. 720h")
+		}
+
+		since := time.Now().Add(-d)
+		q.NotSeenSince = &since
+	}
+
+	for param, dest := range map[string]**time.Time{
+		"created_after":  &q.CreatedAfter,
+		"created_before": &q.CreatedBefore,
+	} {
+		if v := params.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return q, fmt.Errorf("%s must be an RFC3339 timestamp", param)
+			}
+			*dest = &t
+		}
+	}
+
+	if sortBy := params.Get("sort_by"); sortBy != "" {
+		if !slices.Contains(store.RegistrationSortFields, store.RegistrationSortField(sortBy)) {
+			return q, fmt.Errorf("sort_by must be one of %s", joinValues(store.RegistrationSortFields))
+		}
+		q.SortBy = store.RegistrationSortField(sortBy)
+	}
+
+	if status := params.Get("status"); status != "" {
+		if !slices.Contains(store.RegistrationStatuses, store.RegistrationStatus(status)) {
+			return q, fmt.Errorf("status must be one of %s", joinValues(store.RegistrationStatuses))
+		}
+		q.Status = store.RegistrationStatus(status)
+	}
+
+	switch params.Get("sort_order") {
+	case "", "asc":
+	case "desc":
+		q.SortDesc = true
+	default:
+		return q, fmt.Errorf("sort_order must be one of asc, desc")
+	}
+
+	// sort_order alone still applies to the default created_at sort
+	if q.SortBy == "" && params.Get("sort_order") != "" {
+		q.SortBy = store.SortByCreatedAt
+	}
+
+	if q.Cursor != nil && q.SortBy != "" && q.SortBy != store.SortByCreatedAt {
+		return q, fmt.Errorf("cursor can only be used when sorting by created_at")
+	}
+
+	return q, nil
+}
+
+func joinValues[T ~string](values []T) string {
+	out := make([]string, len(values))
+	for i := range values {
+		out[i] = string(values[i])
+	}
+	return strings.Join(out, ", ")
+}
+
+// newRegistrationStatus is the status a new registration in the org starts
+// out with, pending when the org requires approval
+func newRegistrationStatus(r *http.Request, db store.Store, orgID string) (store.RegistrationStatus, error) {
+	settings, err := db.OrgSettings(r.Context(), orgID)
+	if err != nil {
+		return "", err
+	}
+	if settings.RequireApproval {
+		return store.RegistrationPending, nil
+	}
+	return store.RegistrationActive, nil
+}
+
+// registeredMessage is the response to creating a registration
+func registeredMessage(status store.RegistrationStatus) string {
+	if status == store.RegistrationPending {
+		return "Successfully registered, pending approval"
+	}
+	return "Successfully registered"
+}
+
 func RegistrationCreateHandler(w http.ResponseWriter, r *http.Request) {
 	id := identity.Get(r.Context())
 	db := store.GetStore()
 
-	if config.Get().AllowlistEnabled {
-		allowed, err := db.AllowedIP(r.Header.Get(config.Get().AllowlistHeader), id.Identity.OrgID)
-		if err != nil {
-			do500(w, "error listing ip addresses: "+err.Error())
-			return
-		}
-		if !allowed {
-			doError(w, "address is not allowlisted", 403)
-			return
-		}
+	if config.Get().AllowlistEnabled && !checkAllowlist(w, r, db, id.Identity.OrgID) {
+		return
 	}
 
 	b, err := io.ReadAll(r.Body)
@@ -119,6 +306,16 @@ func RegistrationCreateHandler(w http.ResponseWriter, r *http.Request) {
 		doError(w, "user must be org admin to register satellite", 403)
 		return
 	}
+
+	problems, err := validateExtra(body.Extra)
+	if err != nil {
+		do500(w, err.Error())
+		return
+	}
+	if problems != "" {
+		do400(w, problems)
+		return
+	}
 	if id.Identity.User.Username == "" {
 		do400(w, "[username] not present in identity header")
 		return
@@ -135,22 +332,39 @@ func RegistrationCreateHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = db.Create(&store.Registration{
+	cert, err := clientCertificateFor(r, gatewayCN)
+	if err != nil {
+		do400(w, err.Error())
+		return
+	}
+
+	status, err := newRegistrationStatus(r, db, id.Identity.OrgID)
+	if err != nil {
+		doStoreError(w, "failed to get org settings: ", err)
+		return
+	}
+
+	_, err = db.CreateWithinQuota(r.Context(), &store.Registration{
 		OrgID:       id.Identity.OrgID,
 		Username:    id.Identity.User.Username,
 		UID:         *body.UID,
 		DisplayName: *body.DisplayName,
-	})
+		Extra:       body.Extra,
+		Certificate: cert,
+		Status:      status,
+	}, config.Get().RegistrationQuota)
 	if err != nil {
 		if errors.Is(err, store.ErrRegistrationAlreadyExists{}) {
 			doError(w, err.Error(), 409)
+		} else if errors.Is(err, store.ErrQuotaExceeded{}) {
+			doError(w, err.Error()+" for this org", 403)
 		} else {
-			do500(w, "failed to create registration: "+err.Error())
+			doStoreError(w, "failed to create registration: ", err)
 		}
 		return
 	}
 
-	sendJSONWithStatusCode(w, newResponse("Successfully registered"), 201)
+	sendJSONWithStatusCode(w, newResponse(registeredMessage(status)), 201)
 }
 
 func RegistrationDeleteHandler(w http.ResponseWriter, r *http.Request) {
@@ -167,15 +381,358 @@ func RegistrationDeleteHandler(w http.ResponseWriter, r *http.Request) {
 
 	db := store.GetStore()
 
-	err := db.Delete(id.Identity.OrgID, uid)
+	err := db.Delete(r.Context(), id.Identity.OrgID, uid, id.Identity.User.Username)
 	if err != nil {
 		if errors.Is(err, store.ErrRegistrationNotFound) {
 			do404(w, err.Error())
 		} else {
-			do500(w, "error deleting registration: "+err.Error())
+			doStoreError(w, "error deleting registration: ", err)
 		}
 		return
 	}
 
 	w.WriteHeader(204)
 }
+
+func RegistrationUpdateHandler(w http.ResponseWriter, r *http.Request) {
+	uid := r.PathValue("uid")
+	if uid == "" {
+		do400(w, "invalid uid passed in path")
+		return
+	}
+
+	id := identity.Get(r.Context())
+	if !id.Identity.User.OrgAdmin {
+		doError(w, "user must be org admin to update registration", 403)
+		return
+	}
+
+	var body registrationUpdateRequest
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		do400(w, "invalid body, need a json object with [display_name] and/or [extra] to update registration")
+		return
+	}
+
+	if body.DisplayName == nil && body.Extra == nil {
+		do400(w, "nothing to update, need at least one of [display_name] or [extra] in body")
+		return
+	}
+
+	if body.DisplayName != nil && *body.DisplayName == "" {
+		do400(w, "parameter [display_name] cannot be empty")
+		return
+	}
+
+	db := store.GetStore()
+
+	if body.Extra != nil {
+		if !validateExtraUpdate(w, r, db, id.Identity.OrgID, uid, *body.Extra) {
+			return
+		}
+	}
+
+	reg := &store.Registration{OrgID: id.Identity.OrgID, UID: uid}
+	err = db.Update(r.Context(), reg, &store.RegistrationUpdate{
+		DisplayName: body.DisplayName,
+		Extra:       body.Extra,
+	}, id.Identity.User.Username)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrRegistrationNotFound):
+			do404(w, err.Error())
+		case errors.Is(err, store.ErrRegistrationAlreadyExists{}):
+			doError(w, err.Error(), 409)
+		default:
+			doStoreError(w, "error updating registration: ", err)
+		}
+		return
+	}
+
+	updated, err := db.Find(r.Context(), id.Identity.OrgID, uid)
+	if err != nil {
+		doStoreError(w, "error fetching updated registration: ", err)
+		return
+	}
+
+	sendJSON(w, newRegistrationResponse(updated))
+}
+
+// validateExtraUpdate validates what extra will be once the update is merged
+// into it, writing the response and returning false when it isn't valid
+func validateExtraUpdate(w http.ResponseWriter, r *http.Request, db store.Store, orgID, uid string, update map[string]any) bool {
+	if config.Get().RegistrationExtraSchema == "" {
+		return true
+	}
+
+	existing, err := db.Find(r.Context(), orgID, uid)
+	if err != nil {
+		if errors.Is(err, store.ErrRegistrationNotFound) {
+			do404(w, err.Error())
+		} else {
+			doStoreError(w, "error finding registration: ", err)
+		}
+		return false
+	}
+
+	merged := make(map[string]any, len(existing.Extra)+len(update))
+	maps.Copy(merged, existing.Extra)
+	maps.Copy(merged, update)
+
+	problems, err := validateExtra(merged)
+	if err != nil {
+		do500(w, err.Error())
+		return false
+	}
+	if problems != "" {
+		do400(w, problems)
+		return false
+	}
+	return true
+}
+
+// RegistrationApproveHandler activates a pending registration, it has to be
+// approved by a different admin than the one that registered it
+func RegistrationApproveHandler(w http.ResponseWriter, r *http.Request) {
+	reviewRegistration(w, r, store.RegistrationActive)
+}
+
+// RegistrationRejectHandler rejects a pending registration, it stays around
+// (and can't authenticate) until it's deleted
+func RegistrationRejectHandler(w http.ResponseWriter, r *http.Request) {
+	reviewRegistration(w, r, store.RegistrationRejected)
+}
+
+func reviewRegistration(w http.ResponseWriter, r *http.Request, status store.RegistrationStatus) {
+	uid := r.PathValue("uid")
+	if uid == "" {
+		do400(w, "invalid uid passed in path")
+		return
+	}
+
+	id := identity.Get(r.Context())
+	if !id.Identity.User.OrgAdmin {
+		doError(w, "user must be org admin to review registration", 403)
+		return
+	}
+	if id.Identity.User.Username == "" {
+		do400(w, "[username] not present in identity header")
+		return
+	}
+
+	db := store.GetStore()
+
+	if status == store.RegistrationActive {
+		reg, err := db.Find(r.Context(), id.Identity.OrgID, uid)
+		if err != nil {
+			if errors.Is(err, store.ErrRegistrationNotFound) {
+				do404(w, err.Error())
+			} else {
+				doStoreError(w, "error finding registration: ", err)
+			}
+			return
+		}
+		if reg.Username == id.Identity.User.Username {
+			doError(w, "registration must be approved by a different admin than the one that registered it", 403)
+			return
+		}
+	}
+
+	reg, err := db.Review(r.Context(), id.Identity.OrgID, uid, status, id.Identity.User.Username)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrRegistrationNotFound):
+			do404(w, err.Error())
+		case errors.Is(err, store.ErrRegistrationNotPending):
+			doError(w, err.Error(), 409)
+		default:
+			doStoreError(w, "error reviewing registration: ", err)
+		}
+		return
+	}
+
+	sendJSON(w, newRegistrationResponse(reg))
+}
+
+func RegistrationRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	uid := r.PathValue("uid")
+	if uid == "" {
+		do400(w, "invalid uid passed in path")
+		return
+	}
+
+	id := identity.Get(r.Context())
+	if !id.Identity.User.OrgAdmin {
+		doError(w, "user must be org admin to restore registration", 403)
+		return
+	}
+
+	retention, err := time.ParseDuration(config.Get().RegistrationRetention)
+	if err != nil {
+		do500(w, "Error reading registration retention")
+		return
+	}
+
+	db := store.GetStore()
+
+	reg, err := db.Restore(r.Context(), id.Identity.OrgID, uid, id.Identity.User.Username, retention)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrRegistrationNotFound):
+			do404(w, "no deleted registration found within the retention window")
+		case errors.Is(err, store.ErrRegistrationAlreadyExists{}):
+			doError(w, err.Error(), 409)
+		default:
+			doStoreError(w, "error restoring registration: ", err)
+		}
+		return
+	}
+
+	sendJSON(w, newRegistrationResponse(reg))
+}
+
+// RegistrationRotateHandler re-pins a registration to a new client
+// certificate. Like registering, it has to be called by an org admin through
+// the satellite so both the CN and the new certificate are forwarded.
+func RegistrationRotateHandler(w http.ResponseWriter, r *http.Request) {
+	uid := r.PathValue("uid")
+	if uid == "" {
+		do400(w, "invalid uid passed in path")
+		return
+	}
+
+	id := identity.Get(r.Context())
+	if !id.Identity.User.OrgAdmin {
+		doError(w, "user must be org admin to rotate certificate", 403)
+		return
+	}
+
+	gatewayCN, err := getCertCN(r.Header.Get(CertHeader))
+	if err != nil {
+		do400(w, err.Error())
+		return
+	}
+
+	if gatewayCN != uid {
+		do400(w, "x-rh-certauth-cn does not match uid")
+		return
+	}
+
+	cert, err := clientCertificateFor(r, gatewayCN)
+	if err != nil {
+		do400(w, err.Error())
+		return
+	}
+	if cert == nil {
+		do400(w, "["+config.Get().ClientCertHeader+"] header not present")
+		return
+	}
+
+	db := store.GetStore()
+
+	err = db.Update(r.Context(),
+		&store.Registration{OrgID: id.Identity.OrgID, UID: uid},
+		&store.RegistrationUpdate{Certificate: cert},
+		id.Identity.User.Username,
+	)
+	if err != nil {
+		if errors.Is(err, store.ErrRegistrationNotFound) {
+			do404(w, err.Error())
+		} else {
+			doStoreError(w, "error rotating certificate: ", err)
+		}
+		return
+	}
+
+	updated, err := db.Find(r.Context(), id.Identity.OrgID, uid)
+	if err != nil {
+		doStoreError(w, "error fetching updated registration: ", err)
+		return
+	}
+
+	sendJSON(w, newRegistrationResponse(updated))
+}
+
+func RegistrationHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	uid := r.PathValue("uid")
+	if uid == "" {
+		do400(w, "invalid uid passed in path")
+		return
+	}
+
+	id := identity.Get(r.Context())
+	if !id.Identity.User.OrgAdmin {
+		doError(w, "user must be org admin to view registration history", 403)
+		return
+	}
+
+	db := store.GetStore()
+
+	events, err := db.History(r.Context(), id.Identity.OrgID, uid)
+	if err != nil {
+		doStoreError(w, "error listing registration history: ", err)
+		return
+	}
+
+	// registrations created before history was recorded have no events, so
+	// only 404 if there is nothing registered either.
+	if len(events) == 0 {
+		_, err := db.Find(r.Context(), id.Identity.OrgID, uid)
+		if err != nil {
+			if errors.Is(err, store.ErrRegistrationNotFound) {
+				do404(w, err.Error())
+			} else {
+				doStoreError(w, "failed to search for registration: ", err)
+			}
+			return
+		}
+	}
+
+	out := make([]registrationEventResponse, len(events))
+	for i, e := range events {
+		out[i] = registrationEventResponse{
+			Type:      string(e.Type),
+			Actor:     e.Actor,
+			OrgID:     e.OrgID,
+			UID:       e.UID,
+			CreatedAt: e.CreatedAt,
+		}
+		if e.Before != nil {
+			before := newRegistrationResponse(e.Before)
+			out[i].Before = &before
+		}
+		if e.After != nil {
+			after := newRegistrationResponse(e.After)
+			out[i].After = &after
+		}
+	}
+
+	sendJSON(w, &registrationHistoryCollection{
+		Events: out,
+		Meta: registrationMeta{
+			Count: len(out),
+		},
+	})
+}
+
+func newRegistrationResponse(r *store.Registration) registrationResponse {
+	out := registrationResponse{
+		UID:         r.UID,
+		DisplayName: r.DisplayName,
+		Username:    r.Username,
+		Extra:       r.Extra,
+		CreatedAt:   r.CreatedAt,
+		LastSeenAt:  r.LastSeenAt,
+		Status:      string(r.Status),
+		ReviewedBy:  r.ReviewedBy,
+		ReviewedAt:  r.ReviewedAt,
+	}
+	if r.Certificate != nil {
+		out.Certificate = &certificateResponse{
+			Fingerprint: r.Certificate.Fingerprint,
+			Serial:      r.Certificate.Serial,
+			NotAfter:    r.Certificate.NotAfter,
+		}
+	}
+	return out
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -92,7 +94,7 @@ func (suite *RegistrationTestSuite) TestBadBodyCreate() {
 }
 
 func (suite *RegistrationTestSuite) TestNotOrgAdminCreate() {
-	_, err := suite.store.Create(&store.Registration{UID: "abc1234"})
+	_, err := suite.store.Create(context.Background(), &store.Registration{UID: "abc1234"})
 	suite.Nil(err)
 
 	body := []byte(`{"uid": "abc1234", "display_name": "foobar"}`)
@@ -110,7 +112,7 @@ func (suite *RegistrationTestSuite) TestNotOrgAdminCreate() {
 }
 
 func (suite *RegistrationTestSuite) TestNoUsernameCreate() {
-	_, err := suite.store.Create(&store.Registration{UID: "abc1234"})
+	_, err := suite.store.Create(context.Background(), &store.Registration{UID: "abc1234"})
 	suite.Nil(err)
 
 	body := []byte(`{"uid": "abc1234", "display_name": "foobar"}`)
@@ -128,7 +130,7 @@ func (suite *RegistrationTestSuite) TestNoUsernameCreate() {
 }
 
 func (suite *RegistrationTestSuite) TestNoGatewayCNCreate() {
-	_, err := suite.store.Create(&store.Registration{UID: "abc1234"})
+	_, err := suite.store.Create(context.Background(), &store.Registration{UID: "abc1234"})
 	suite.Nil(err)
 
 	body := []byte(`{"uid": "abc1234", "display_name": "foobar"}`)
@@ -146,7 +148,7 @@ func (suite *RegistrationTestSuite) TestNoGatewayCNCreate() {
 }
 
 func (suite *RegistrationTestSuite) TestNotMatchingCNCreate() {
-	_, err := suite.store.Create(&store.Registration{UID: "abc1234"})
+	_, err := suite.store.Create(context.Background(), &store.Registration{UID: "abc1234"})
 	suite.Nil(err)
 
 	body := []byte(`{"uid": "abc1234", "display_name": "foobar"}`)
@@ -165,7 +167,7 @@ func (suite *RegistrationTestSuite) TestNotMatchingCNCreate() {
 }
 
 func (suite *RegistrationTestSuite) TestExistingRegistrationCreate() {
-	_, err := suite.store.Create(&store.Registration{UID: "abc1234", OrgID: "1234"})
+	_, err := suite.store.Create(context.Background(), &store.Registration{UID: "abc1234", OrgID: "1234"})
 	suite.Nil(err)
 
 	body := []byte(`{"uid": "abc1234", "display_name": "foobar"}`)
@@ -184,7 +186,7 @@ func (suite *RegistrationTestSuite) TestExistingRegistrationCreate() {
 }
 
 func (suite *RegistrationTestSuite) TestExistingUidCreate() {
-	_, err := suite.store.Create(&store.Registration{UID: "abc1234", OrgID: "2345"})
+	_, err := suite.store.Create(context.Background(), &store.Registration{UID: "abc1234", OrgID: "2345"})
 	suite.Nil(err)
 
 	body := []byte(`{"uid": "abc1234", "display_name": "foobar"}`)
@@ -238,7 +240,7 @@ func (suite *RegistrationTestSuite) TestSuccessfulRegistrationCreateOtherUIDForm
 }
 
 func (suite *RegistrationTestSuite) TestSuccessfulRegistrationDelete() {
-	_, err := suite.store.Create(&store.Registration{UID: "abc1234", OrgID: "1234"})
+	_, err := suite.store.Create(context.Background(), &store.Registration{UID: "abc1234", OrgID: "1234"})
 	suite.Nil(err)
 
 	req := httptest.NewRequest(http.MethodDelete, "http://foobar/registrations/abc1234", nil)
@@ -257,7 +259,7 @@ func (suite *RegistrationTestSuite) TestSuccessfulRegistrationDelete() {
 }
 
 func (suite *RegistrationTestSuite) TestNotOrgAdminDelete() {
-	_, err := suite.store.Create(&store.Registration{UID: "abc1234", OrgID: "1234"})
+	_, err := suite.store.Create(context.Background(), &store.Registration{UID: "abc1234", OrgID: "1234"})
 	suite.Nil(err)
 
 	req := httptest.NewRequest(http.MethodDelete, "http://foobar/registrations/abc1234", nil)
@@ -292,7 +294,7 @@ func (suite *RegistrationTestSuite) TestRegistrationNotFoundDelete() {
 }
 
 func (suite *RegistrationTestSuite) TestRegistrationList() {
-	_, err := suite.store.Create(&store.Registration{
+	_, err := suite.store.Create(context.Background(), &store.Registration{
 		UID:         "abc1234",
 		Username:    "foobar",
 		OrgID:       "1234",
@@ -329,9 +331,737 @@ func (suite *RegistrationTestSuite) TestRegistrationList() {
 	suite.WithinDuration(time.Now(), t, 5*time.Second)
 }
 
+func (suite *RegistrationTestSuite) TestSuccessfulRegistrationUpdate() {
+	_, err := suite.store.Create(context.Background(), &store.Registration{
+		UID:         "abc1234",
+		OrgID:       "1234",
+		DisplayName: "before",
+		Extra:       map[string]any{"location": "rdu"},
+	})
+	suite.Nil(err)
+
+	body := []byte(`{"display_name": "after", "extra": {"environment": "prod"}}`)
+	req := httptest.NewRequest(http.MethodPatch, "http://foobar/registrations/abc1234", bytes.NewReader(body))
+	req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+		User:  identity.User{OrgAdmin: true, Username: "foobar"},
+		OrgID: "1234",
+	}}))
+	req.SetPathValue("uid", "abc1234")
+
+	RegistrationUpdateHandler(suite.rec, req)
+
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusOK, status)
+
+	var rsp registrationResponse
+	suite.Nil(json.Unmarshal([]byte(rspBody), &rsp))
+	suite.Equal("after", rsp.DisplayName)
+	suite.Equal(map[string]any{"location": "rdu", "environment": "prod"}, rsp.Extra)
+
+	reg, err := suite.store.Find(context.Background(), "1234", "abc1234")
+	suite.Nil(err)
+	suite.Equal("after", reg.DisplayName)
+}
+
+func (suite *RegistrationTestSuite) TestDuplicateDisplayNameUpdate() {
+	_, err := suite.store.Create(context.Background(), &store.Registration{UID: "abc1234", OrgID: "1234", DisplayName: "one"})
+	suite.Nil(err)
+	_, err = suite.store.Create(context.Background(), &store.Registration{UID: "abc2345", OrgID: "1234", DisplayName: "two"})
+	suite.Nil(err)
+
+	body := []byte(`{"display_name": "two"}`)
+	req := httptest.NewRequest(http.MethodPatch, "http://foobar/registrations/abc1234", bytes.NewReader(body))
+	req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+		User:  identity.User{OrgAdmin: true, Username: "foobar"},
+		OrgID: "1234",
+	}}))
+	req.SetPathValue("uid", "abc1234")
+
+	RegistrationUpdateHandler(suite.rec, req)
+
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusConflict, status)
+	suite.Equal("{\"message\":\"existing registration found: display_name already exists\"}", rspBody)
+}
+
+func (suite *RegistrationTestSuite) TestEmptyBodyUpdate() {
+	body := []byte(`{}`)
+	req := httptest.NewRequest(http.MethodPatch, "http://foobar/registrations/abc1234", bytes.NewReader(body))
+	req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+		User:  identity.User{OrgAdmin: true, Username: "foobar"},
+		OrgID: "1234",
+	}}))
+	req.SetPathValue("uid", "abc1234")
+
+	RegistrationUpdateHandler(suite.rec, req)
+
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusBadRequest, status)
+	suite.Equal("{\"message\":\"nothing to update, need at least one of [display_name] or [extra] in body\"}", rspBody)
+}
+
+func (suite *RegistrationTestSuite) TestNotOrgAdminUpdate() {
+	body := []byte(`{"display_name": "after"}`)
+	req := httptest.NewRequest(http.MethodPatch, "http://foobar/registrations/abc1234", bytes.NewReader(body))
+	req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+		User:  identity.User{OrgAdmin: false, Username: "foobar"},
+		OrgID: "1234",
+	}}))
+	req.SetPathValue("uid", "abc1234")
+
+	RegistrationUpdateHandler(suite.rec, req)
+
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusForbidden, status)
+	suite.Equal("{\"message\":\"user must be org admin to update registration\"}", rspBody)
+}
+
+func (suite *RegistrationTestSuite) TestRegistrationNotFoundUpdate() {
+	_, err := suite.store.Create(context.Background(), &store.Registration{UID: "abc1234", OrgID: "2345", DisplayName: "other org"})
+	suite.Nil(err)
+
+	body := []byte(`{"display_name": "after"}`)
+	req := httptest.NewRequest(http.MethodPatch, "http://foobar/registrations/abc1234", bytes.NewReader(body))
+	req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+		User:  identity.User{OrgAdmin: true, Username: "foobar"},
+		OrgID: "1234",
+	}}))
+	req.SetPathValue("uid", "abc1234")
+
+	RegistrationUpdateHandler(suite.rec, req)
+
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusNotFound, status)
+	suite.Equal("{\"message\":\"registration not found\"}", rspBody)
+}
+
+func (suite *RegistrationTestSuite) TestRegistrationHistory() {
+	r := &store.Registration{UID: "abc1234", OrgID: "1234", DisplayName: "one", Username: "creator"}
+	_, err := suite.store.Create(context.Background(), r)
+	suite.Nil(err)
+	suite.Nil(suite.store.Delete(context.Background(), "1234", "abc1234", "deleter"))
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar/registrations/abc1234/history", nil)
+	req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+		User:  identity.User{OrgAdmin: true, Username: "foobar"},
+		OrgID: "1234",
+	}}))
+	req.SetPathValue("uid", "abc1234")
+
+	RegistrationHistoryHandler(suite.rec, req)
+
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusOK, status)
+
+	var body registrationHistoryCollection
+	suite.Nil(json.Unmarshal([]byte(rspBody), &body))
+	suite.Equal(2, body.Meta.Count)
+
+	suite.Equal("create", body.Events[0].Type)
+	suite.Equal("creator", body.Events[0].Actor)
+	suite.Nil(body.Events[0].Before)
+	suite.Equal("one", body.Events[0].After.DisplayName)
+
+	suite.Equal("delete", body.Events[1].Type)
+	suite.Equal("deleter", body.Events[1].Actor)
+	suite.Equal("one", body.Events[1].Before.DisplayName)
+	suite.Nil(body.Events[1].After)
+}
+
+func (suite *RegistrationTestSuite) TestRegistrationHistoryOtherOrg() {
+	_, err := suite.store.Create(context.Background(), &store.Registration{UID: "abc1234", OrgID: "2345", DisplayName: "one"})
+	suite.Nil(err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar/registrations/abc1234/history", nil)
+	req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+		User:  identity.User{OrgAdmin: true, Username: "foobar"},
+		OrgID: "1234",
+	}}))
+	req.SetPathValue("uid", "abc1234")
+
+	RegistrationHistoryHandler(suite.rec, req)
+
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusNotFound, status)
+	suite.Equal("{\"message\":\"registration not found\"}", rspBody)
+}
+
+func (suite *RegistrationTestSuite) TestNotOrgAdminHistory() {
+	req := httptest.NewRequest(http.MethodGet, "http://foobar/registrations/abc1234/history", nil)
+	req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+		User:  identity.User{OrgAdmin: false, Username: "foobar"},
+		OrgID: "1234",
+	}}))
+	req.SetPathValue("uid", "abc1234")
+
+	RegistrationHistoryHandler(suite.rec, req)
+
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusForbidden, status)
+	suite.Equal("{\"message\":\"user must be org admin to view registration history\"}", rspBody)
+}
+
+func (suite *RegistrationTestSuite) TestSuccessfulRegistrationRestore() {
+	_, err := suite.store.Create(context.Background(), &store.Registration{UID: "abc1234", OrgID: "1234", DisplayName: "one"})
+	suite.Nil(err)
+	suite.Nil(suite.store.Delete(context.Background(), "1234", "abc1234", "foobar"))
+
+	req := httptest.NewRequest(http.MethodPost, "http://foobar/registrations/abc1234/restore", nil)
+	req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+		User:  identity.User{OrgAdmin: true, Username: "foobar"},
+		OrgID: "1234",
+	}}))
+	req.SetPathValue("uid", "abc1234")
+
+	RegistrationRestoreHandler(suite.rec, req)
+
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusOK, status)
+
+	var rsp registrationResponse
+	suite.Nil(json.Unmarshal([]byte(rspBody), &rsp))
+	suite.Equal("abc1234", rsp.UID)
+	suite.Equal("one", rsp.DisplayName)
+
+	_, err = suite.store.FindByUID(context.Background(), "abc1234")
+	suite.Nil(err)
+}
+
+func (suite *RegistrationTestSuite) TestRegistrationNotFoundRestore() {
+	_, err := suite.store.Create(context.Background(), &store.Registration{UID: "abc1234", OrgID: "1234", DisplayName: "one"})
+	suite.Nil(err)
+
+	req := httptest.NewRequest(http.MethodPost, "http://foobar/registrations/abc1234/restore", nil)
+	req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+		User:  identity.User{OrgAdmin: true, Username: "foobar"},
+		OrgID: "1234",
+	}}))
+	req.SetPathValue("uid", "abc1234")
+
+	RegistrationRestoreHandler(suite.rec, req)
+
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusNotFound, status)
+	suite.Equal("{\"message\":\"no deleted registration found within the retention window\"}", rspBody)
+}
+
+func (suite *RegistrationTestSuite) TestRegistrationCreatePinsCertificate() {
+	body := []byte(`{"uid": "abc1234", "display_name": "foobar"}`)
+	req := httptest.NewRequest("POST", "http://foobar/registrations", bytes.NewReader(body)).
+		WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+			User:  identity.User{OrgAdmin: true, Username: "foobar"},
+			OrgID: "1234",
+		}}))
+	req.Header.Set("x-rh-certauth-cn", "/CN=abc1234")
+	req.Header.Set("x-rh-certauth-cert", newTestClientCert(suite.T(), "abc1234"))
+
+	RegistrationCreateHandler(suite.rec, req)
+
+	status, _ := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusCreated, status)
+
+	reg, err := suite.store.FindByUID(context.Background(), "abc1234")
+	suite.Nil(err)
+	suite.NotNil(reg.Certificate)
+	suite.Len(reg.Certificate.Fingerprint, 64)
+}
+
+func (suite *RegistrationTestSuite) TestRegistrationCreateCertificateCNMismatch() {
+	body := []byte(`{"uid": "abc1234", "display_name": "foobar"}`)
+	req := httptest.NewRequest("POST", "http://foobar/registrations", bytes.NewReader(body)).
+		WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+			User:  identity.User{OrgAdmin: true, Username: "foobar"},
+			OrgID: "1234",
+		}}))
+	req.Header.Set("x-rh-certauth-cn", "/CN=abc1234")
+	req.Header.Set("x-rh-certauth-cert", newTestClientCert(suite.T(), "someone-else"))
+
+	RegistrationCreateHandler(suite.rec, req)
+
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusBadRequest, status)
+	suite.Equal("{\"message\":\"client certificate CN does not match uid\"}", rspBody)
+}
+
+func (suite *RegistrationTestSuite) TestSuccessfulRegistrationRotate() {
+	_, err := suite.store.Create(context.Background(), &store.Registration{UID: "abc1234", OrgID: "1234", DisplayName: "one"})
+	suite.Nil(err)
+
+	req := httptest.NewRequest(http.MethodPost, "http://foobar/registrations/abc1234/rotate", nil)
+	req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+		User:  identity.User{OrgAdmin: true, Username: "foobar"},
+		OrgID: "1234",
+	}}))
+	req.SetPathValue("uid", "abc1234")
+	req.Header.Set("x-rh-certauth-cn", "/CN=abc1234")
+	req.Header.Set("x-rh-certauth-cert", newTestClientCert(suite.T(), "abc1234"))
+
+	RegistrationRotateHandler(suite.rec, req)
+
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusOK, status)
+
+	var rsp registrationResponse
+	suite.Nil(json.Unmarshal([]byte(rspBody), &rsp))
+	suite.NotNil(rsp.Certificate)
+
+	reg, err := suite.store.FindByUID(context.Background(), "abc1234")
+	suite.Nil(err)
+	suite.Equal(rsp.Certificate.Fingerprint, reg.Certificate.Fingerprint)
+}
+
+func (suite *RegistrationTestSuite) TestNoCertificateRotate() {
+	_, err := suite.store.Create(context.Background(), &store.Registration{UID: "abc1234", OrgID: "1234", DisplayName: "one"})
+	suite.Nil(err)
+
+	req := httptest.NewRequest(http.MethodPost, "http://foobar/registrations/abc1234/rotate", nil)
+	req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+		User:  identity.User{OrgAdmin: true, Username: "foobar"},
+		OrgID: "1234",
+	}}))
+	req.SetPathValue("uid", "abc1234")
+	req.Header.Set("x-rh-certauth-cn", "/CN=abc1234")
+
+	RegistrationRotateHandler(suite.rec, req)
+
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusBadRequest, status)
+	suite.Equal("{\"message\":\"[x-rh-certauth-cert] header not present\"}", rspBody)
+}
+
+func (suite *RegistrationTestSuite) TestRegistrationListStaleFor() {
+	for _, uid := range []string{"recent", "stale"} {
+		_, err := suite.store.Create(context.Background(), &store.Registration{UID: uid, OrgID: "1234", DisplayName: uid})
+		suite.Nil(err)
+	}
+	suite.Nil(suite.store.UpdateLastSeen(context.Background(), map[string]time.Time{"recent": time.Now()}))
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar/registrations?stale_for=720h", nil)
+	req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+		User:  identity.User{OrgAdmin: true, Username: "foobar"},
+		OrgID: "1234",
+	}}))
+
+	RegistrationListHandler(suite.rec, req)
+
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusOK, status)
+
+	var body registrationCollection
+	suite.Nil(json.Unmarshal([]byte(rspBody), &body))
+	suite.Equal(1, body.Meta.Count)
+	suite.Equal("stale", body.Registrations[0].UID)
+	suite.Nil(body.Registrations[0].LastSeenAt)
+}
+
+func (suite *RegistrationTestSuite) TestRegistrationListBadStaleFor() {
+	req := httptest.NewRequest(http.MethodGet, "http://foobar/registrations?stale_for=a-while", nil)
+	req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+		User:  identity.User{OrgAdmin: true, Username: "foobar"},
+		OrgID: "1234",
+	}}))
+
+	RegistrationListHandler(suite.rec, req)
+
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusBadRequest, status)
+	suite.Equal("{\"message\":\"stale_for must be a positive duration, e.g. 720h\"}", rspBody)
+}
+
 func statusAndBodyFromReq(suite *RegistrationTestSuite) (int, string) {
 	//nolint:bodyclose
 	rsp := suite.rec.Result()
 	body, _ := io.ReadAll(rsp.Body)
 	return rsp.StatusCode, string(body)
 }
+
+func (suite *RegistrationTestSuite) TestRegistrationListFilterAndSort() {
+	for _, r := range []store.Registration{
+		{UID: "abc", OrgID: "1234", Username: "alice", DisplayName: "charlie server"},
+		{UID: "def", OrgID: "1234", Username: "alice", DisplayName: "alpha server"},
+		{UID: "ghi", OrgID: "1234", Username: "bob", DisplayName: "bravo server"},
+	} {
+		_, err := suite.store.Create(context.Background(), &r)
+		suite.Nil(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar/registrations?search=server&username=alice&sort_by=display_name&limit=1&offset=1", nil)
+	req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+		User:  identity.User{OrgAdmin: true, Username: "foobar"},
+		OrgID: "1234",
+	}}))
+
+	RegistrationListHandler(suite.rec, req)
+
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusOK, status)
+
+	var body registrationCollection
+	suite.Nil(json.Unmarshal([]byte(rspBody), &body))
+	suite.Equal(2, body.Meta.Count)
+	suite.Equal(1, body.Meta.Limit)
+	suite.Equal(1, body.Meta.Offset)
+	suite.Len(body.Registrations, 1)
+	suite.Equal("abc", body.Registrations[0].UID)
+}
+
+func (suite *RegistrationTestSuite) TestRegistrationListBadParams() {
+	tests := map[string]string{
+		"sort_by=username":          "sort_by must be one of created_at, display_name, uid",
+		"sort_order=sideways":       "sort_order must be one of asc, desc",
+		"created_after=yesterday":   "created_after must be an RFC3339 timestamp",
+		"created_before=2024-01-01": "created_before must be an RFC3339 timestamp",
+		"limit=-1":                  "limit and offset cannot be negative",
+	}
+
+	for params, msg := range tests {
+		suite.rec = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://foobar/registrations?"+params, nil)
+		req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+			User:  identity.User{OrgAdmin: true, Username: "foobar"},
+			OrgID: "1234",
+		}}))
+
+		RegistrationListHandler(suite.rec, req)
+
+		status, rspBody := statusAndBodyFromReq(suite)
+		suite.Equal(http.StatusBadRequest, status, params)
+		suite.Equal("{\"message\":\""+msg+"\"}", rspBody, params)
+	}
+}
+
+func (suite *RegistrationTestSuite) TestRegistrationListCursor() {
+	for _, uid := range []string{"one", "two", "three"} {
+		_, err := suite.store.Create(context.Background(), &store.Registration{UID: uid, OrgID: "1234", DisplayName: uid})
+		suite.Nil(err)
+	}
+
+	list := func(url string) registrationCollection {
+		suite.rec = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+			User:  identity.User{OrgAdmin: true, Username: "foobar"},
+			OrgID: "1234",
+		}}))
+
+		RegistrationListHandler(suite.rec, req)
+
+		status, rspBody := statusAndBodyFromReq(suite)
+		suite.Equal(http.StatusOK, status)
+
+		var body registrationCollection
+		suite.Nil(json.Unmarshal([]byte(rspBody), &body))
+		return body
+	}
+
+	first := list("http://foobar/api/mbop/v1/registrations?limit=2")
+	suite.Equal(3, first.Meta.Count)
+	suite.Equal([]string{"three", "two"}, []string{first.Registrations[0].UID, first.Registrations[1].UID})
+	suite.NotNil(first.Meta.Links)
+	suite.Empty(first.Meta.Links.Prev)
+	suite.Contains(first.Meta.Links.Next, "/api/mbop/v1/registrations?")
+
+	second := list("http://foobar" + first.Meta.Links.Next)
+	suite.Len(second.Registrations, 1)
+	suite.Equal("one", second.Registrations[0].UID)
+	suite.Empty(second.Meta.Links.Next)
+
+	back := list("http://foobar" + second.Meta.Links.Prev)
+	suite.Equal([]string{"three", "two"}, []string{back.Registrations[0].UID, back.Registrations[1].UID})
+	suite.Empty(back.Meta.Links.Prev)
+	suite.NotEmpty(back.Meta.Links.Next)
+}
+
+func (suite *RegistrationTestSuite) TestRegistrationListBadCursor() {
+	tests := map[string]string{
+		"cursor=garbage":                    "invalid cursor",
+		"cursor=garbage&offset=1":           "cursor and offset cannot be used together",
+		"cursor=garbage&sort_by=uid":        "invalid cursor",
+		"sort_by=uid&" + validCursorParam(): "cursor can only be used when sorting by created_at",
+	}
+
+	for params, msg := range tests {
+		suite.rec = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://foobar/registrations?"+params, nil)
+		req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+			User:  identity.User{OrgAdmin: true, Username: "foobar"},
+			OrgID: "1234",
+		}}))
+
+		RegistrationListHandler(suite.rec, req)
+
+		status, rspBody := statusAndBodyFromReq(suite)
+		suite.Equal(http.StatusBadRequest, status, params)
+		suite.Equal("{\"message\":\""+msg+"\"}", rspBody, params)
+	}
+}
+
+func validCursorParam() string {
+	c := store.Cursor{CreatedAt: time.Now(), Key: "abc"}
+	return "cursor=" + c.Encode()
+}
+
+// failingStore fails every listing with err
+type failingStore struct {
+	store.Store
+	err error
+}
+
+func (f failingStore) All(_ context.Context, _ string, _ store.RegistrationQuery) ([]store.Registration, int, error) {
+	return nil, 0, f.err
+}
+
+func (suite *RegistrationTestSuite) TestRegistrationListStoreErrors() {
+	tests := map[error]int{
+		fmt.Errorf("%w: %w", store.ErrStoreTimeout, context.DeadlineExceeded): http.StatusGatewayTimeout,
+		fmt.Errorf("%w: %w", store.ErrStoreUnavailable, context.Canceled):     http.StatusServiceUnavailable,
+		errors.New("boom"): http.StatusInternalServerError,
+	}
+
+	for err, code := range tests {
+		store.GetStore = func() store.Store { return failingStore{Store: suite.store, err: err} }
+
+		suite.rec = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://foobar/registrations", nil)
+		req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+			User:  identity.User{OrgAdmin: true, Username: "foobar"},
+			OrgID: "1234",
+		}}))
+
+		RegistrationListHandler(suite.rec, req)
+
+		status, _ := statusAndBodyFromReq(suite)
+		suite.Equal(code, status, err.Error())
+	}
+}
+
+func (suite *RegistrationTestSuite) reviewRequest(action, username string) *http.Request {
+	req := httptest.NewRequest(http.MethodPost, "http://foobar/registrations/abc1234/"+action, nil)
+	req = req.WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+		User:  identity.User{OrgAdmin: true, Username: username},
+		OrgID: "1234",
+	}}))
+	req.SetPathValue("uid", "abc1234")
+	return req
+}
+
+func (suite *RegistrationTestSuite) TestCreatePendingRegistration() {
+	suite.Nil(suite.store.SetOrgSettings(context.Background(), &store.OrgSettings{OrgID: "1234", RequireApproval: true}))
+
+	body := []byte(`{"uid": "abc1234", "display_name": "foobar"}`)
+	req := httptest.NewRequest("POST", "http://foobar/registrations", bytes.NewReader(body)).
+		WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+			User:  identity.User{OrgAdmin: true, Username: "foobar"},
+			OrgID: "1234",
+		}}))
+	req.Header.Set("x-rh-certauth-cn", "/CN=abc1234")
+
+	RegistrationCreateHandler(suite.rec, req)
+
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusCreated, status)
+	suite.Equal(`{"message":"Successfully registered, pending approval"}`, rspBody)
+
+	found, err := suite.store.FindByUID(context.Background(), "abc1234")
+	suite.Nil(err)
+	suite.Equal(store.RegistrationPending, found.Status)
+}
+
+func (suite *RegistrationTestSuite) TestApproveRegistration() {
+	_, err := suite.store.Create(context.Background(), &store.Registration{UID: "abc1234", OrgID: "1234", DisplayName: "one", Username: "foobar", Status: store.RegistrationPending})
+	suite.Nil(err)
+
+	// not by the admin that registered it
+	RegistrationApproveHandler(suite.rec, suite.reviewRequest("approve", "foobar"))
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusForbidden, status)
+	suite.Equal(`{"message":"registration must be approved by a different admin than the one that registered it"}`, rspBody)
+
+	suite.rec = httptest.NewRecorder()
+	RegistrationApproveHandler(suite.rec, suite.reviewRequest("approve", "second"))
+	status, rspBody = statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusOK, status)
+
+	var rsp registrationResponse
+	suite.Nil(json.Unmarshal([]byte(rspBody), &rsp))
+	suite.Equal("active", rsp.Status)
+	suite.Equal("second", rsp.ReviewedBy)
+	suite.NotNil(rsp.ReviewedAt)
+
+	// and only once
+	suite.rec = httptest.NewRecorder()
+	RegistrationRejectHandler(suite.rec, suite.reviewRequest("reject", "second"))
+	status, rspBody = statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusConflict, status)
+	suite.Equal(`{"message":"registration is not pending approval"}`, rspBody)
+}
+
+func (suite *RegistrationTestSuite) TestRejectRegistration() {
+	_, err := suite.store.Create(context.Background(), &store.Registration{UID: "abc1234", OrgID: "1234", DisplayName: "one", Username: "foobar", Status: store.RegistrationPending})
+	suite.Nil(err)
+
+	// withdrawing your own registration is fine
+	RegistrationRejectHandler(suite.rec, suite.reviewRequest("reject", "foobar"))
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusOK, status)
+
+	var rsp registrationResponse
+	suite.Nil(json.Unmarshal([]byte(rspBody), &rsp))
+	suite.Equal("rejected", rsp.Status)
+	suite.Equal("foobar", rsp.ReviewedBy)
+}
+
+func (suite *RegistrationTestSuite) TestReviewRegistrationNotFound() {
+	RegistrationApproveHandler(suite.rec, suite.reviewRequest("approve", "second"))
+
+	status, _ := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusNotFound, status)
+}
+
+func (suite *RegistrationTestSuite) TestRegistrationListByStatus() {
+	_, err := suite.store.Create(context.Background(), &store.Registration{UID: "abc", OrgID: "1234", DisplayName: "one", Status: store.RegistrationPending})
+	suite.Nil(err)
+	_, err = suite.store.Create(context.Background(), &store.Registration{UID: "def", OrgID: "1234", DisplayName: "two"})
+	suite.Nil(err)
+
+	req := httptest.NewRequest(http.MethodGet, "http://foobar/registrations?status=pending", nil).
+		WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+			User:  identity.User{OrgAdmin: true, Username: "foobar"},
+			OrgID: "1234",
+		}}))
+	RegistrationListHandler(suite.rec, req)
+
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusOK, status)
+
+	var rsp registrationCollection
+	suite.Nil(json.Unmarshal([]byte(rspBody), &rsp))
+	suite.Len(rsp.Registrations, 1)
+	suite.Equal("abc", rsp.Registrations[0].UID)
+
+	suite.rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "http://foobar/registrations?status=bogus", nil).WithContext(req.Context())
+	RegistrationListHandler(suite.rec, req)
+
+	status, rspBody = statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusBadRequest, status)
+	suite.Equal(`{"message":"status must be one of active, pending, rejected"}`, rspBody)
+}
+
+const testExtraSchema = `{
+	"type": "object",
+	"properties": {
+		"environment": {"enum": ["prod", "stage"]},
+		"location": {"type": "string"}
+	},
+	"required": ["location"]
+}`
+
+func (suite *RegistrationTestSuite) withExtraSchema() {
+	suite.T().Setenv("REGISTRATION_EXTRA_SCHEMA", testExtraSchema)
+	config.Reset()
+	suite.T().Cleanup(config.Reset)
+}
+
+func (suite *RegistrationTestSuite) createRequest(body string) *http.Request {
+	req := httptest.NewRequest("POST", "http://foobar/registrations", bytes.NewReader([]byte(body))).
+		WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+			User:  identity.User{OrgAdmin: true, Username: "foobar"},
+			OrgID: "1234",
+		}}))
+	req.Header.Set("x-rh-certauth-cn", "/CN=abc1234")
+	return req
+}
+
+func (suite *RegistrationTestSuite) TestRegistrationCreateWithExtra() {
+	suite.withExtraSchema()
+
+	RegistrationCreateHandler(suite.rec, suite.createRequest(`{"uid": "abc1234", "display_name": "foobar", "extra": {"environment": "dev"}}`))
+
+	status, rspBody := statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusBadRequest, status)
+	suite.Equal(`{"message":"[extra] does not match the schema: at '/': missing property 'location'; at '/environment': value must be one of 'prod', 'stage'"}`, rspBody)
+
+	suite.rec = httptest.NewRecorder()
+	RegistrationCreateHandler(suite.rec, suite.createRequest(`{"uid": "abc1234", "display_name": "foobar", "extra": {"environment": "prod", "location": "rdu"}}`))
+
+	status, _ = statusAndBodyFromReq(suite)
+	suite.Equal(http.StatusCreated, status)
+
+	reg, err := suite.store.Find(context.Background(), "1234", "abc1234")
+	suite.Nil(err)
+	suite.Equal(map[string]any{"environment": "prod", "location": "rdu"}, reg.Extra)
+}
+
+func (suite *RegistrationTestSuite) TestRegistrationUpdateExtraSchema() {
+	suite.withExtraSchema()
+
+	_, err := suite.store.Create(context.Background(), &store.Registration{
+		UID:         "abc1234",
+		OrgID:       "1234",
+		DisplayName: "before",
+		Extra:       map[string]any{"location": "rdu"},
+	})
+	suite.Nil(err)
+
+	update := func(body string) (int, string) {
+		suite.rec = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPatch, "http://foobar/registrations/abc1234", bytes.NewReader([]byte(body))).
+			WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+				User:  identity.User{OrgAdmin: true, Username: "foobar"},
+				OrgID: "1234",
+			}}))
+		req.SetPathValue("uid", "abc1234")
+
+		RegistrationUpdateHandler(suite.rec, req)
+		return statusAndBodyFromReq(suite)
+	}
+
+	// location is already there, so it isn't needed in the update
+	status, _ := update(`{"extra": {"environment": "stage"}}`)
+	suite.Equal(http.StatusOK, status)
+
+	status, rspBody := update(`{"extra": {"location": 12}}`)
+	suite.Equal(http.StatusBadRequest, status)
+	suite.Equal(`{"message":"[extra] does not match the schema: at '/location': got number, want string"}`, rspBody)
+
+	reg, err := suite.store.Find(context.Background(), "1234", "abc1234")
+	suite.Nil(err)
+	suite.Equal(map[string]any{"environment": "stage", "location": "rdu"}, reg.Extra)
+}
+
+func (suite *RegistrationTestSuite) TestRegistrationListByExtra() {
+	_, err := suite.store.Create(context.Background(), &store.Registration{UID: "abc", OrgID: "1234", DisplayName: "one", Extra: map[string]any{"environment": "prod", "location": "rdu"}})
+	suite.Nil(err)
+	_, err = suite.store.Create(context.Background(), &store.Registration{UID: "def", OrgID: "1234", DisplayName: "two", Extra: map[string]any{"environment": "prod", "location": "bos"}})
+	suite.Nil(err)
+	_, err = suite.store.Create(context.Background(), &store.Registration{UID: "ghi", OrgID: "1234", DisplayName: "three"})
+	suite.Nil(err)
+
+	list := func(query string) (int, string) {
+		suite.rec = httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "http://foobar/registrations?"+query, nil).
+			WithContext(context.WithValue(context.Background(), identity.Key, identity.XRHID{Identity: identity.Identity{
+				User:  identity.User{OrgAdmin: true, Username: "foobar"},
+				OrgID: "1234",
+			}}))
+		RegistrationListHandler(suite.rec, req)
+		return statusAndBodyFromReq(suite)
+	}
+
+	status, rspBody := list("extra.environment=prod&extra.location=bos")
+	suite.Equal(http.StatusOK, status)
+
+	var rsp registrationCollection
+	suite.Nil(json.Unmarshal([]byte(rspBody), &rsp))
+	suite.Len(rsp.Registrations, 1)
+	suite.Equal("def", rsp.Registrations[0].UID)
+
+	status, rspBody = list("extra.=prod")
+	suite.Equal(http.StatusBadRequest, status)
+	suite.Equal(`{"message":"extra filters need a key, e.g. extra.env=prod"}`, rspBody)
+
+	status, rspBody = list("extra.location=rdu&extra.location=bos")
+	suite.Equal(http.StatusBadRequest, status)
+	suite.Equal(`{"message":"extra.location can only be given once"}`, rspBody)
+}
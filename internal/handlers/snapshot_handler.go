@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	l "github.com/redhatinsights/mbop/internal/logger"
+	"github.com/redhatinsights/mbop/internal/store"
+)
+
+// the admin api has no identity, this is who shows up in the history
+const snapshotRestoreActor = "admin-snapshot"
+
+const maxSnapshotBytes = 256 << 20
+
+type snapshotRestoreResponse struct {
+	Registrations int                      `json:"registrations"`
+	Allowlist     int                      `json:"allowlist"`
+	Conflicts     []store.SnapshotConflict `json:"conflicts"`
+}
+
+func SnapshotDumpHandler(w http.ResponseWriter, r *http.Request) {
+	snap, err := store.GetStore().DumpSnapshot(r.Context())
+	if err != nil {
+		doStoreError(w, "failed to dump snapshot: ", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"mbop-snapshot-%s.json\"", snap.CreatedAt.Format("20060102T150405Z")))
+	if err := snap.Write(w); err != nil {
+		l.Log.Error(err, "failed to write snapshot")
+	}
+}
+
+func SnapshotRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	snap, err := store.ReadSnapshot(http.MaxBytesReader(w, r.Body, maxSnapshotBytes))
+	if err != nil {
+		do400(w, err.Error())
+		return
+	}
+
+	conflicts, err := store.GetStore().LoadSnapshot(r.Context(), snap, snapshotRestoreActor)
+	if err != nil {
+		switch {
+		case errors.Is(err, store.ErrSnapshotConflict):
+			sendJSONWithStatusCode(w, &snapshotRestoreResponse{Conflicts: conflicts}, http.StatusConflict)
+		case errors.Is(err, store.ErrInvalidSnapshot):
+			do400(w, err.Error())
+		default:
+			doStoreError(w, "failed to restore snapshot: ", err)
+		}
+		return
+	}
+
+	sendJSONWithStatusCode(w, &snapshotRestoreResponse{
+		Registrations: len(snap.Registrations),
+		Allowlist:     len(snap.Allowlist),
+		Conflicts:     conflicts,
+	}, http.StatusCreated)
+}
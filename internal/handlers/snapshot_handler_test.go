@@ -0,0 +1,102 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/redhatinsights/mbop/internal/config"
+	"github.com/redhatinsights/mbop/internal/logger"
+	"github.com/redhatinsights/mbop/internal/store"
+	"github.com/stretchr/testify/suite"
+)
+
+type SnapshotTestSuite struct {
+	suite.Suite
+	rec   *httptest.ResponseRecorder
+	store store.Store
+}
+
+func (suite *SnapshotTestSuite) SetupSuite() {
+	_ = logger.Init()
+	config.Reset()
+	os.Setenv("STORE_BACKEND", "memory")
+}
+
+func (suite *SnapshotTestSuite) BeforeTest(_, _ string) {
+	suite.rec = httptest.NewRecorder()
+	suite.Nil(store.SetupStore())
+
+	suite.store = store.GetStore()
+	store.GetStore = func() store.Store { return suite.store }
+}
+
+func TestSnapshotEndpoints(t *testing.T) {
+	suite.Run(t, new(SnapshotTestSuite))
+}
+
+func (suite *SnapshotTestSuite) result() (int, string) {
+	//nolint:bodyclose
+	rsp := suite.rec.Result()
+	body, _ := io.ReadAll(rsp.Body)
+	return rsp.StatusCode, string(body)
+}
+
+func (suite *SnapshotTestSuite) TestDumpAndRestore() {
+	_, err := suite.store.Create(context.Background(), &store.Registration{OrgID: "1234", UID: "abc", DisplayName: "one"})
+	suite.Nil(err)
+	suite.Nil(suite.store.AllowAddress(context.Background(), &store.AllowlistBlock{IPBlock: "10.0.0.0/8", OrgID: "1234"}))
+
+	SnapshotDumpHandler(suite.rec, httptest.NewRequest(http.MethodGet, "http://foobar/api/mbop/v1/admin/snapshot", nil))
+	status, dump := suite.result()
+	suite.Equal(http.StatusOK, status)
+	suite.Contains(suite.rec.Header().Get("Content-Disposition"), "mbop-snapshot-")
+
+	// into a fresh store
+	suite.Nil(store.SetupStore())
+	suite.store = store.GetStore()
+
+	suite.rec = httptest.NewRecorder()
+	SnapshotRestoreHandler(suite.rec, httptest.NewRequest(http.MethodPost, "http://foobar/api/mbop/v1/admin/snapshot", strings.NewReader(dump)))
+	status, body := suite.result()
+	suite.Equal(http.StatusCreated, status)
+
+	var rsp snapshotRestoreResponse
+	suite.Nil(json.Unmarshal([]byte(body), &rsp))
+	suite.Equal(1, rsp.Registrations)
+	suite.Equal(1, rsp.Allowlist)
+
+	found, err := suite.store.FindByUID(context.Background(), "abc")
+	suite.Nil(err)
+	suite.Equal("one", found.DisplayName)
+
+	// the same snapshot again conflicts with everything in it
+	suite.rec = httptest.NewRecorder()
+	SnapshotRestoreHandler(suite.rec, httptest.NewRequest(http.MethodPost, "http://foobar/api/mbop/v1/admin/snapshot", strings.NewReader(dump)))
+	status, body = suite.result()
+	suite.Equal(http.StatusConflict, status)
+	suite.Nil(json.Unmarshal([]byte(body), &rsp))
+	suite.Len(rsp.Conflicts, 2)
+}
+
+func (suite *SnapshotTestSuite) TestRestoreInvalid() {
+	tests := map[string]string{
+		`not json`:                          "invalid snapshot",
+		`{"version": 2}`:                    "unsupported version 2",
+		`{"version": 1, "allowlist": [{}]}`: "allowlist block 0 needs",
+	}
+
+	for body, msg := range tests {
+		suite.rec = httptest.NewRecorder()
+		SnapshotRestoreHandler(suite.rec, httptest.NewRequest(http.MethodPost, "http://foobar/api/mbop/v1/admin/snapshot", strings.NewReader(body)))
+
+		status, rsp := suite.result()
+		suite.Equal(http.StatusBadRequest, status, body)
+		suite.Contains(rsp, msg, body)
+	}
+}
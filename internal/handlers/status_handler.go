@@ -5,6 +5,7 @@ import (
 
 	"github.com/redhatinsights/mbop/internal/config"
 	"github.com/redhatinsights/mbop/internal/models"
+	"github.com/redhatinsights/mbop/internal/store"
 )
 
 func Status(w http.ResponseWriter, _ *http.Request) {
@@ -16,5 +17,20 @@ func Status(w http.ResponseWriter, _ *http.Request) {
 		},
 	}
 
+	if db, ok := store.GetStore().(store.PooledStore); ok {
+		stats := db.PoolStats()
+		status.Database = &models.DatabaseStatus{
+			Backend:            config.Get().StoreBackend,
+			MaxOpenConnections: stats.MaxOpenConnections,
+			OpenConnections:    stats.OpenConnections,
+			InUse:              stats.InUse,
+			Idle:               stats.Idle,
+			WaitCount:          stats.WaitCount,
+			WaitDuration:       stats.WaitDuration.String(),
+			MaxIdleClosed:      stats.MaxIdleClosed,
+			MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+		}
+	}
+
 	sendJSON(w, status)
 }
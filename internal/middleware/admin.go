@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+
+	"github.com/redhatinsights/mbop/internal/config"
+	l "github.com/redhatinsights/mbop/internal/logger"
+)
+
+// AdminKeyHeader carries the shared secret that guards the admin api
+const AdminKeyHeader = "x-mbop-admin-key"
+
+// RequireAdminKey only lets through requests presenting the configured
+// ADMIN_API_KEY, the admin api is disabled entirely while it isn't set.
+func RequireAdminKey(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := config.Get().AdminAPIKey
+		if key == "" {
+			adminError(w, "admin api is disabled", http.StatusNotFound)
+			return
+		}
+
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get(AdminKeyHeader)), []byte(key)) != 1 {
+			adminError(w, "["+AdminKeyHeader+"] header missing or invalid", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func adminError(w http.ResponseWriter, msg string, code int) {
+	l.Log.Info("Error during request", "error", msg, "status", code)
+
+	b, _ := json.Marshal(map[string]string{"message": msg})
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if _, err := w.Write(b); err != nil {
+		l.Log.Error(err, "error writing response")
+	}
+}
@@ -4,6 +4,7 @@ import "encoding/json"
 
 type Status struct {
 	ConfiguredModules ConfiguredModules `json:"configured_modules"`
+	Database          *DatabaseStatus   `json:"database,omitempty"`
 }
 
 type ConfiguredModules struct {
@@ -12,6 +13,20 @@ type ConfiguredModules struct {
 	JWT    string `json:"jwt"`
 }
 
+// DatabaseStatus is a snapshot of the store's connection pool, only present
+// for the sql backed stores
+type DatabaseStatus struct {
+	Backend            string `json:"backend"`
+	MaxOpenConnections int    `json:"max_open_connections"`
+	OpenConnections    int    `json:"open_connections"`
+	InUse              int    `json:"in_use"`
+	Idle               int    `json:"idle"`
+	WaitCount          int64  `json:"wait_count"`
+	WaitDuration       string `json:"wait_duration"`
+	MaxIdleClosed      int64  `json:"max_idle_closed"`
+	MaxLifetimeClosed  int64  `json:"max_lifetime_closed"`
+}
+
 func (s *Status) ToJSON() []byte {
 	bytes, _ := json.Marshal(s)
 	return bytes
@@ -548,7 +548,7 @@ func (m *MBOPServer) checkRegistration(w http.ResponseWriter, r *http.Request) {
 
 	db := store.GetStore()
 
-	reg, err := db.FindByUID(cnValue)
+	reg, err := db.FindByUID(r.Context(), cnValue)
 	if err != nil {
 		http.Error(w, "cn not registered in db", http.StatusForbidden)
 	} else {
@@ -1,6 +1,7 @@
 package catchall
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -93,7 +94,7 @@ func TestExampleTestSuite(t *testing.T) {
 func (suite *RegistrationTestSuite) TestGoodRegistration() {
 	suite.Nil(store.SetupStore())
 	db := store.GetStore()
-	_, err := db.Create(&store.Registration{
+	_, err := db.Create(context.Background(), &store.Registration{
 		ID:          "nark",
 		OrgID:       "12345",
 		Username:    "nark",
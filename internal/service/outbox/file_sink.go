@@ -0,0 +1,46 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/redhatinsights/mbop/internal/store"
+)
+
+// fileSink appends every event as a line of json to a file, or to stdout for
+// "-". Handy locally, or to feed a log shipper.
+type fileSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+var _ = (Sink)(&fileSink{})
+
+func newFileSink(path string) (*fileSink, error) {
+	if path == "" || path == "-" {
+		return &fileSink{w: os.Stdout}, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileSink{w: f}, nil
+}
+
+func (f *fileSink) Deliver(_ context.Context, e *store.OutboxEvent) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	_, err = f.w.Write(append(line, '\n'))
+	return err
+}
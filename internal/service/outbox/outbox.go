@@ -0,0 +1,135 @@
+package outbox
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redhatinsights/mbop/internal/config"
+	l "github.com/redhatinsights/mbop/internal/logger"
+	"github.com/redhatinsights/mbop/internal/store"
+)
+
+// Sink is somewhere change events are delivered to, an event only counts as
+// delivered once Deliver returned nil for it.
+type Sink interface {
+	Deliver(ctx context.Context, e *store.OutboxEvent) error
+}
+
+func NewSink() (Sink, error) {
+	c := config.Get()
+
+	switch c.OutboxSink {
+	case "webhook":
+		return newWebhookSink(c.OutboxWebhookURL, c.OutboxWebhookSecret, c.OutboxWebhookTimeout)
+	case "file":
+		return newFileSink(c.OutboxFile)
+	default:
+		return nil, fmt.Errorf("unsupported outbox sink %q", c.OutboxSink)
+	}
+}
+
+/*
+Dispatcher delivers the events the store wrote to the outbox, at-least-once:
+an event is marked delivered only after the sink accepted it, so a crash in
+between delivers it again once its claim's lease runs out. A failed delivery
+is retried after a backoff that doubles with every attempt, up to maxBackoff,
+without holding up the events after it.
+*/
+type Dispatcher struct {
+	sink       Sink
+	batchSize  int
+	lease      time.Duration
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+func NewDispatcher() (*Dispatcher, error) {
+	c := config.Get()
+
+	sink, err := NewSink()
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Dispatcher{sink: sink, batchSize: c.OutboxBatchSize}
+	if d.batchSize < 1 {
+		return nil, fmt.Errorf("invalid OUTBOX_BATCH_SIZE %d", c.OutboxBatchSize)
+	}
+	if d.lease, err = time.ParseDuration(c.OutboxLease); err != nil {
+		return nil, fmt.Errorf("invalid OUTBOX_LEASE: %w", err)
+	}
+	if d.backoff, err = time.ParseDuration(c.OutboxRetryBackoff); err != nil {
+		return nil, fmt.Errorf("invalid OUTBOX_RETRY_BACKOFF: %w", err)
+	}
+	if d.maxBackoff, err = time.ParseDuration(c.OutboxMaxBackoff); err != nil {
+		return nil, fmt.Errorf("invalid OUTBOX_MAX_BACKOFF: %w", err)
+	}
+
+	return d, nil
+}
+
+// Run dispatches every interval until ctx is cancelled, a full batch is
+// followed up with the next one straight away so a backlog drains quickly.
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			for ctx.Err() == nil {
+				claimed, err := d.Dispatch(ctx)
+				if err != nil {
+					l.Log.Error(err, "failed to dispatch outbox events")
+					break
+				}
+				if claimed < d.batchSize {
+					break
+				}
+			}
+		}
+	}
+}
+
+// Dispatch claims one batch of due events and delivers them, returning how
+// many were claimed. Failed deliveries are only logged and rescheduled, the
+// error is for the store failing.
+func (d *Dispatcher) Dispatch(ctx context.Context) (int, error) {
+	events, err := store.GetStore().ClaimOutbox(ctx, d.batchSize, d.lease)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range events {
+		e := &events[i]
+
+		if err := d.sink.Deliver(ctx, e); err != nil {
+			retryIn := d.retryIn(e.Attempts)
+			l.Log.Error(err, "failed to deliver outbox event", "id", e.ID, "type", e.Type, "attempts", e.Attempts+1, "retry_in", retryIn.String())
+
+			if err := store.GetStore().MarkOutboxFailed(ctx, e.ID, retryIn, err.Error()); err != nil {
+				return len(events), err
+			}
+			continue
+		}
+
+		if err := store.GetStore().MarkOutboxDelivered(ctx, e.ID); err != nil {
+			return len(events), err
+		}
+	}
+
+	return len(events), nil
+}
+
+// retryIn is the backoff after a delivery failed, attempts being the number
+// of earlier failures
+func (d *Dispatcher) retryIn(attempts int) time.Duration {
+	wait := d.backoff
+	for i := 0; i < attempts && wait < d.maxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, d.maxBackoff)
+}
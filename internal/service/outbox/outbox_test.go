@@ -0,0 +1,139 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/mbop/internal/config"
+	"github.com/redhatinsights/mbop/internal/logger"
+	"github.com/redhatinsights/mbop/internal/store"
+	"github.com/stretchr/testify/suite"
+)
+
+// fakeSink fails the first fail deliveries and records the rest
+type fakeSink struct {
+	fail      int
+	delivered []store.OutboxEvent
+}
+
+func (f *fakeSink) Deliver(_ context.Context, e *store.OutboxEvent) error {
+	if f.fail > 0 {
+		f.fail--
+		return errors.New("sink is down")
+	}
+	f.delivered = append(f.delivered, *e)
+	return nil
+}
+
+type DispatcherTestSuite struct {
+	suite.Suite
+	sink       *fakeSink
+	dispatcher *Dispatcher
+}
+
+func (suite *DispatcherTestSuite) SetupSuite() {
+	_ = logger.Init()
+	config.Reset()
+	os.Setenv("STORE_BACKEND", "memory")
+}
+
+func (suite *DispatcherTestSuite) BeforeTest(_, _ string) {
+	suite.Nil(store.SetupStore())
+
+	suite.sink = &fakeSink{}
+	// no backoff so retries are due straight away
+	suite.dispatcher = &Dispatcher{sink: suite.sink, batchSize: 10, lease: time.Hour}
+}
+
+func TestDispatcher(t *testing.T) {
+	suite.Run(t, new(DispatcherTestSuite))
+}
+
+func (suite *DispatcherTestSuite) TestDispatchDelivers() {
+	ctx := context.Background()
+	_, err := store.GetStore().Create(ctx, &store.Registration{OrgID: "1234", UID: "abc"})
+	suite.Nil(err)
+	suite.Nil(store.GetStore().AllowAddress(ctx, &store.AllowlistBlock{OrgID: "1234", IPBlock: "10.0.0.0/8"}))
+
+	claimed, err := suite.dispatcher.Dispatch(ctx)
+	suite.Nil(err)
+	suite.Equal(2, claimed)
+	suite.Len(suite.sink.delivered, 2)
+	suite.Equal(store.OutboxRegistrationCreated, suite.sink.delivered[0].Type)
+	suite.Equal(store.OutboxAllowlistAdded, suite.sink.delivered[1].Type)
+
+	// delivered events aren't claimed again
+	claimed, err = suite.dispatcher.Dispatch(ctx)
+	suite.Nil(err)
+	suite.Equal(0, claimed)
+}
+
+func (suite *DispatcherTestSuite) TestDispatchRetries() {
+	ctx := context.Background()
+	_, err := store.GetStore().Create(ctx, &store.Registration{OrgID: "1234", UID: "abc"})
+	suite.Nil(err)
+
+	suite.sink.fail = 2
+	for range 2 {
+		claimed, err := suite.dispatcher.Dispatch(ctx)
+		suite.Nil(err)
+		suite.Equal(1, claimed)
+	}
+	suite.Empty(suite.sink.delivered)
+
+	claimed, err := suite.dispatcher.Dispatch(ctx)
+	suite.Nil(err)
+	suite.Equal(1, claimed)
+	suite.Len(suite.sink.delivered, 1)
+	suite.Equal(2, suite.sink.delivered[0].Attempts)
+	suite.Equal("sink is down", suite.sink.delivered[0].LastError)
+
+	claimed, err = suite.dispatcher.Dispatch(ctx)
+	suite.Nil(err)
+	suite.Equal(0, claimed)
+}
+
+func (suite *DispatcherTestSuite) TestRetryIn() {
+	d := &Dispatcher{backoff: 5 * time.Second, maxBackoff: time.Minute}
+
+	suite.Equal(5*time.Second, d.retryIn(0))
+	suite.Equal(10*time.Second, d.retryIn(1))
+	suite.Equal(40*time.Second, d.retryIn(3))
+	suite.Equal(time.Minute, d.retryIn(4))
+	suite.Equal(time.Minute, d.retryIn(1000))
+}
+
+func (suite *DispatcherTestSuite) TestNewSink() {
+	defer config.Reset()
+
+	tests := map[string]struct {
+		env map[string]string
+		err string
+	}{
+		"unknown":         {env: map[string]string{"OUTBOX_SINK": "kafka"}, err: `unsupported outbox sink "kafka"`},
+		"webhook no url":  {env: map[string]string{"OUTBOX_SINK": "webhook", "OUTBOX_WEBHOOK_SECRET": "s"}, err: "OUTBOX_WEBHOOK_URL is required"},
+		"webhook no key":  {env: map[string]string{"OUTBOX_SINK": "webhook", "OUTBOX_WEBHOOK_URL": "http://foo"}, err: "OUTBOX_WEBHOOK_SECRET is required"},
+		"webhook":         {env: map[string]string{"OUTBOX_SINK": "webhook", "OUTBOX_WEBHOOK_URL": "http://foo", "OUTBOX_WEBHOOK_SECRET": "s"}},
+		"file to stdout":  {env: map[string]string{"OUTBOX_SINK": "file"}},
+		"file to nowhere": {env: map[string]string{"OUTBOX_SINK": "file", "OUTBOX_FILE": "/does/not/exist"}, err: "no such file"},
+	}
+
+	for name, tt := range tests {
+		suite.Run(name, func() {
+			for k, v := range tt.env {
+				suite.T().Setenv(k, v)
+			}
+			config.Reset()
+
+			_, err := NewSink()
+			if tt.err == "" {
+				suite.Nil(err)
+			} else {
+				suite.ErrorContains(err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/redhatinsights/mbop/internal/store"
+)
+
+/*
+webhookSink POSTs every event as json to a single url. The body is signed so
+the receiver can check it came from us:
+
+	X-Mbop-Timestamp: unix seconds the request was signed at
+	X-Mbop-Signature: sha256=<hex hmac-sha256 of "<timestamp>.<body>" with the secret>
+
+Any 2xx response counts as delivered.
+*/
+type webhookSink struct {
+	client *http.Client
+	url    string
+	secret []byte
+}
+
+var _ = (Sink)(&webhookSink{})
+
+func newWebhookSink(url, secret, timeout string) (*webhookSink, error) {
+	if url == "" {
+		return nil, errors.New("OUTBOX_WEBHOOK_URL is required for the webhook sink")
+	}
+	if secret == "" {
+		return nil, errors.New("OUTBOX_WEBHOOK_SECRET is required for the webhook sink")
+	}
+
+	t, err := time.ParseDuration(timeout)
+	if err != nil {
+		return nil, fmt.Errorf("invalid OUTBOX_WEBHOOK_TIMEOUT: %w", err)
+	}
+
+	return &webhookSink{client: &http.Client{Timeout: t}, url: url, secret: []byte(secret)}, nil
+}
+
+func (w *webhookSink) Deliver(ctx context.Context, e *store.OutboxEvent) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Mbop-Event-Id", strconv.FormatInt(e.ID, 10))
+	req.Header.Set("X-Mbop-Event-Type", string(e.Type))
+	req.Header.Set("X-Mbop-Timestamp", timestamp)
+	req.Header.Set("X-Mbop-Signature", "sha256="+sign(w.secret, timestamp, body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// drained so the connection can be reused
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+
+	return nil
+}
+
+func sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
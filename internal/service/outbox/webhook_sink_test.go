@@ -0,0 +1,65 @@
+package outbox
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/redhatinsights/mbop/internal/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWebhookSinkSigns(t *testing.T) {
+	var got *http.Request
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		body, _ = io.ReadAll(r.Body)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	sink, err := newWebhookSink(srv.URL, "secret", "5s")
+	assert.Nil(t, err)
+
+	e := &store.OutboxEvent{
+		ID:        42,
+		Type:      store.OutboxRegistrationCreated,
+		OrgID:     "1234",
+		Key:       "abc",
+		Payload:   json.RawMessage(`{"uid":"abc"}`),
+		CreatedAt: time.Now(),
+		Attempts:  3,
+	}
+	assert.Nil(t, sink.Deliver(context.Background(), e))
+
+	assert.Equal(t, http.MethodPost, got.Method)
+	assert.Equal(t, "42", got.Header.Get("X-Mbop-Event-Id"))
+	assert.Equal(t, "registration.created", got.Header.Get("X-Mbop-Event-Type"))
+	assert.Equal(t, "sha256="+sign([]byte("secret"), got.Header.Get("X-Mbop-Timestamp"), body), got.Header.Get("X-Mbop-Signature"))
+	assert.NotEqual(t, "sha256="+sign([]byte("other"), got.Header.Get("X-Mbop-Timestamp"), body), got.Header.Get("X-Mbop-Signature"))
+
+	var sent map[string]any
+	assert.Nil(t, json.Unmarshal(body, &sent))
+	assert.Equal(t, "abc", sent["key"])
+	assert.Equal(t, map[string]any{"uid": "abc"}, sent["payload"])
+	// delivery bookkeeping stays with us
+	assert.NotContains(t, sent, "Attempts")
+}
+
+func TestWebhookSinkFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	sink, err := newWebhookSink(srv.URL, "secret", "5s")
+	assert.Nil(t, err)
+
+	err = sink.Deliver(context.Background(), &store.OutboxEvent{ID: 1, Payload: json.RawMessage(`{}`)})
+	assert.ErrorContains(t, err, "503")
+}
@@ -0,0 +1,190 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"math/bits"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxAllowlistCandidates is how many of the closest blocks CheckIP returns when
+// nothing matched
+const maxAllowlistCandidates = 5
+
+// AllowlistCheck explains what AllowedIP decides for an address
+type AllowlistCheck struct {
+	IP      string
+	Allowed bool
+	// the most specific block that contains the address, the org's own one
+	// when a `system` block is just as specific
+	Matched *AllowlistBlock
+	// only when nothing matched, the blocks sharing the most leading bits
+	// with the address first
+	Candidates []AllowlistCandidate
+}
+
+type AllowlistCandidate struct {
+	AllowlistBlock
+	// how many leading bits of the address are in the block's network
+	CommonBits int
+	// the block contains the address but has expired
+	Expired bool
+}
+
+// NormalizeIPBlock turns an address or CIDR block into the canonical network
+// form it's stored as. A bare address becomes a single address block (/32 or
+// /128), host bits are masked off and IPv4-mapped IPv6 blocks become the IPv4
+// block they map to, so the same network is always the same string.
+func NormalizeIPBlock(block string) (string, error) {
+	block = strings.TrimSpace(block)
+
+	var prefix netip.Prefix
+	if strings.Contains(block, "/") {
+		p, err := netip.ParsePrefix(block)
+		if err != nil {
+			return "", err
+		}
+		prefix = p
+	} else {
+		addr, err := netip.ParseAddr(block)
+		if err != nil {
+			return "", err
+		}
+		if addr.Zone() != "" {
+			return "", fmt.Errorf("%s can't have a zone", block)
+		}
+		prefix = netip.PrefixFrom(addr, addr.BitLen())
+	}
+
+	if prefix.Addr().Is4In6() {
+		bits := prefix.Bits() - 96
+		if bits < 0 {
+			return "", fmt.Errorf("%s is wider than the IPv4-mapped range", block)
+		}
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), bits)
+	}
+
+	return prefix.Masked().String(), nil
+}
+
+// normalizeAllowlistBlock puts the block in canonical form before it's
+// stored, which every backend does so the same network is never two rows
+func normalizeAllowlistBlock(b *AllowlistBlock) error {
+	block, err := NormalizeIPBlock(b.IPBlock)
+	if err != nil {
+		return fmt.Errorf("%w %q: %w", ErrInvalidIPBlock, b.IPBlock, err)
+	}
+	b.IPBlock = block
+	return nil
+}
+
+// blocksContain reports whether any of the blocks contains ip, an IPv4-mapped
+// IPv6 address matches the IPv4 blocks and the other way around. An address
+// that doesn't parse or has a zone is never allowed, the same as in postgres
+// where inet has no zones. A stored block that doesn't parse is an error.
+func blocksContain(blocks []string, ip string) (bool, error) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil || addr.Zone() != "" {
+		return false, nil
+	}
+	addr = addr.Unmap()
+
+	for _, block := range blocks {
+		prefix, err := parseStoredBlock(block)
+		if err != nil {
+			return false, err
+		}
+		if prefix.Contains(addr) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// parseStoredBlock parses a block from the allowlist, including ones stored
+// before blocks were normalized
+func parseStoredBlock(block string) (netip.Prefix, error) {
+	normalized, err := NormalizeIPBlock(block)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.ParsePrefix(normalized)
+}
+
+// CheckIP works out which of orgID's blocks, or the `system` ones, allow addr
+// and if none do which were closest. It matches the way AllowedIP does, over
+// the blocks as AllowedAddresses lists them, so it works with every backend.
+func CheckIP(ctx context.Context, s AllowlistStore, addr netip.Addr, orgID string) (*AllowlistCheck, error) {
+	addr = addr.Unmap()
+
+	blocks, _, err := s.AllowedAddresses(ctx, orgID, AllowlistQuery{})
+	if err != nil {
+		return nil, err
+	}
+	if orgID != "system" {
+		system, _, err := s.AllowedAddresses(ctx, "system", AllowlistQuery{})
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, system...)
+	}
+
+	check := &AllowlistCheck{IP: addr.String(), Candidates: make([]AllowlistCandidate, 0)}
+	matchedBits := -1
+	now := time.Now()
+	for i := range blocks {
+		prefix, err := parseStoredBlock(blocks[i].IPBlock)
+		if err != nil {
+			return nil, err
+		}
+
+		contains := prefix.Contains(addr)
+		if contains && !blocks[i].Expired(now) {
+			if prefix.Bits() > matchedBits {
+				check.Matched, matchedBits = &blocks[i], prefix.Bits()
+			}
+			continue
+		}
+
+		if prefix.Addr().BitLen() != addr.BitLen() {
+			continue
+		}
+		check.Candidates = append(check.Candidates, AllowlistCandidate{
+			AllowlistBlock: blocks[i],
+			CommonBits:     min(commonBits(prefix.Addr(), addr), prefix.Bits()),
+			Expired:        contains,
+		})
+	}
+
+	check.Allowed = check.Matched != nil
+	if check.Allowed {
+		check.Candidates = check.Candidates[:0]
+		return check, nil
+	}
+
+	sort.SliceStable(check.Candidates, func(i, j int) bool {
+		return check.Candidates[i].CommonBits > check.Candidates[j].CommonBits
+	})
+	if len(check.Candidates) > maxAllowlistCandidates {
+		check.Candidates = check.Candidates[:maxAllowlistCandidates]
+	}
+	return check, nil
+}
+
+// commonBits counts the leading bits two addresses of the same family share
+func commonBits(a, b netip.Addr) int {
+	as, bs := a.AsSlice(), b.AsSlice()
+	n := 0
+	for i := range as {
+		x := as[i] ^ bs[i]
+		if x != 0 {
+			return n + bits.LeadingZeros8(x)
+		}
+		n += 8
+	}
+	return n
+}
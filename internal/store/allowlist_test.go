@@ -0,0 +1,28 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeIPBlock(t *testing.T) {
+	for block, want := range map[string]string{
+		"10.0.0.1":               "10.0.0.1/32",
+		"10.0.0.1/24":            "10.0.0.0/24",
+		" 10.0.0.0/24 ":          "10.0.0.0/24",
+		"2001:db8::1":            "2001:db8::1/128",
+		"2001:DB8::1/32":         "2001:db8::/32",
+		"::ffff:10.0.0.1":        "10.0.0.1/32",
+		"::ffff:192.168.1.7/120": "192.168.1.0/24",
+	} {
+		got, err := NormalizeIPBlock(block)
+		assert.Nil(t, err, block)
+		assert.Equal(t, want, got, block)
+	}
+
+	for _, block := range []string{"", "10.0.0.1/33", "2001:db8::/129", "::ffff:10.0.0.0/64", "10.0.0", "fe80::1%eth0"} {
+		_, err := NormalizeIPBlock(block)
+		assert.NotNil(t, err, block)
+	}
+}
@@ -0,0 +1,235 @@
+package store
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+)
+
+var ErrImportFailed = errors.New("import failed, no registrations were created")
+
+type BulkFormat string
+
+const (
+	BulkFormatJSON BulkFormat = "json"
+	BulkFormatCSV  BulkFormat = "csv"
+)
+
+// bulkColumns is the header of the csv format, in order
+var bulkColumns = []string{"org_id", "uid", "display_name", "username", "extra"}
+
+/*
+BulkRegistration is a single row of a bulk import or export, the same fields
+in both the json and csv formats. In csv Extra is a json object in its own
+column.
+*/
+type BulkRegistration struct {
+	OrgID       string                 `json:"org_id"`
+	UID         string                 `json:"uid"`
+	DisplayName string                 `json:"display_name"`
+	Username    string                 `json:"username"`
+	Extra       map[string]interface{} `json:"extra,omitempty"`
+}
+
+func (b *BulkRegistration) registration() *Registration {
+	return &Registration{
+		OrgID:       b.OrgID,
+		UID:         b.UID,
+		DisplayName: b.DisplayName,
+		Username:    b.Username,
+		Extra:       b.Extra,
+	}
+}
+
+// NewBulkRegistration converts a stored registration into an export row
+func NewBulkRegistration(r *Registration) BulkRegistration {
+	return BulkRegistration{
+		OrgID:       r.OrgID,
+		UID:         r.UID,
+		DisplayName: r.DisplayName,
+		Username:    r.Username,
+		Extra:       r.Extra,
+	}
+}
+
+// ImportResult reports what happened to a row of an import, Row is 1-based
+// and doesn't count the csv header. Error is empty for rows that were fine.
+type ImportResult struct {
+	Row   int    `json:"row"`
+	UID   string `json:"uid"`
+	Error string `json:"error,omitempty"`
+}
+
+// ParseBulkRegistrations reads every row of a bulk import
+func ParseBulkRegistrations(r io.Reader, format BulkFormat) ([]BulkRegistration, error) {
+	switch format {
+	case BulkFormatJSON:
+		var rows []BulkRegistration
+		if err := json.NewDecoder(r).Decode(&rows); err != nil {
+			return nil, fmt.Errorf("invalid json, expected an array of registrations: %w", err)
+		}
+		return rows, nil
+	case BulkFormatCSV:
+		return parseBulkCSV(r)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func parseBulkCSV(r io.Reader) ([]BulkRegistration, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = len(bulkColumns)
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid csv: %w", err)
+	}
+	if !slices.Equal(header, bulkColumns) {
+		return nil, fmt.Errorf("invalid csv header, expected %v", bulkColumns)
+	}
+
+	rows := make([]BulkRegistration, 0)
+	for {
+		record, err := cr.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid csv: %w", err)
+		}
+
+		row := BulkRegistration{
+			OrgID:       record[0],
+			UID:         record[1],
+			DisplayName: record[2],
+			Username:    record[3],
+		}
+		if record[4] != "" {
+			if err := json.Unmarshal([]byte(record[4]), &row.Extra); err != nil {
+				return nil, fmt.Errorf("invalid extra on row %d, needs to be a json object", len(rows)+1)
+			}
+		}
+
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
+
+// ValidateBulkRegistrations checks every row on its own and against the other
+// rows in the file, conflicts with stored registrations are left to the store.
+func ValidateBulkRegistrations(rows []BulkRegistration) ([]ImportResult, bool) {
+	results := make([]ImportResult, len(rows))
+	uids := make(map[string]int)
+	names := make(map[[2]string]int)
+	ok := true
+
+	for i := range rows {
+		row := &rows[i]
+		results[i] = ImportResult{Row: i + 1, UID: row.UID}
+
+		var msg string
+		switch {
+		case row.OrgID == "":
+			msg = "missing org_id"
+		case row.UID == "":
+			msg = "missing uid"
+		case row.DisplayName == "":
+			msg = "missing display_name"
+		case uids[row.UID] != 0:
+			msg = "uid already used on row " + strconv.Itoa(uids[row.UID])
+		case names[[2]string{row.OrgID, row.DisplayName}] != 0:
+			msg = "display_name already used in org on row " + strconv.Itoa(names[[2]string{row.OrgID, row.DisplayName}])
+		}
+
+		if msg != "" {
+			results[i].Error = msg
+			ok = false
+			continue
+		}
+
+		uids[row.UID] = i + 1
+		names[[2]string{row.OrgID, row.DisplayName}] = i + 1
+	}
+
+	return results, ok
+}
+
+// BulkWriter streams export rows in either format
+type BulkWriter struct {
+	w      io.Writer
+	csv    *csv.Writer
+	format BulkFormat
+	rows   int
+}
+
+func NewBulkWriter(w io.Writer, format BulkFormat) (*BulkWriter, error) {
+	bw := &BulkWriter{w: w, format: format}
+
+	switch format {
+	case BulkFormatJSON:
+		if _, err := io.WriteString(w, "["); err != nil {
+			return nil, err
+		}
+	case BulkFormatCSV:
+		bw.csv = csv.NewWriter(w)
+		if err := bw.csv.Write(bulkColumns); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+
+	return bw, nil
+}
+
+func (bw *BulkWriter) Write(row BulkRegistration) error {
+	defer func() { bw.rows++ }()
+
+	if bw.format == BulkFormatCSV {
+		extra := ""
+		if len(row.Extra) > 0 {
+			b, err := json.Marshal(row.Extra)
+			if err != nil {
+				return err
+			}
+			extra = string(b)
+		}
+		return bw.csv.Write([]string{row.OrgID, row.UID, row.DisplayName, row.Username, extra})
+	}
+
+	b, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	if bw.rows > 0 {
+		if _, err := io.WriteString(bw.w, ","); err != nil {
+			return err
+		}
+	}
+	_, err = bw.w.Write(b)
+	return err
+}
+
+// Flush pushes out whatever has been buffered so far, so long exports are
+// streamed to the client as they're read
+func (bw *BulkWriter) Flush() error {
+	if bw.csv != nil {
+		bw.csv.Flush()
+		return bw.csv.Error()
+	}
+	return nil
+}
+
+// Close finishes the document, it doesn't close the underlying writer
+func (bw *BulkWriter) Close() error {
+	if bw.format == BulkFormatCSV {
+		return bw.Flush()
+	}
+	_, err := io.WriteString(bw.w, "]\n")
+	return err
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseBulkJSON(t *testing.T) {
+	rows, err := ParseBulkRegistrations(strings.NewReader(`[
+		{"org_id": "1234", "uid": "abc", "display_name": "one", "username": "foo", "extra": {"a": "b"}},
+		{"org_id": "1234", "uid": "def", "display_name": "two"}
+	]`), BulkFormatJSON)
+	assert.Nil(t, err)
+	assert.Len(t, rows, 2)
+	assert.Equal(t, "b", rows[0].Extra["a"])
+	assert.Equal(t, "def", rows[1].UID)
+}
+
+func TestParseBulkCSV(t *testing.T) {
+	rows, err := ParseBulkRegistrations(strings.NewReader(
+		"org_id,uid,display_name,username,extra\n"+
+			"1234,abc,one,foo,\"{\"\"a\"\":\"\"b\"\"}\"\n"+
+			"1234,def,two,,\n"), BulkFormatCSV)
+	assert.Nil(t, err)
+	assert.Len(t, rows, 2)
+	assert.Equal(t, "b", rows[0].Extra["a"])
+	assert.Nil(t, rows[1].Extra)
+}
+
+func TestParseBulkCSVBadHeader(t *testing.T) {
+	_, err := ParseBulkRegistrations(strings.NewReader("uid,org_id,display_name,username,extra\n"), BulkFormatCSV)
+	assert.ErrorContains(t, err, "invalid csv header")
+}
+
+func TestValidateBulkRegistrations(t *testing.T) {
+	results, ok := ValidateBulkRegistrations([]BulkRegistration{
+		{OrgID: "1234", UID: "abc", DisplayName: "one"},
+		{OrgID: "1234", UID: "abc", DisplayName: "two"},
+		{OrgID: "1234", UID: "def", DisplayName: "one"},
+		{OrgID: "5678", UID: "ghi", DisplayName: "one"},
+		{OrgID: "1234", DisplayName: "three"},
+	})
+	assert.False(t, ok)
+	assert.Equal(t, "", results[0].Error)
+	assert.Equal(t, "uid already used on row 1", results[1].Error)
+	assert.Equal(t, "display_name already used in org on row 1", results[2].Error)
+	assert.Equal(t, "", results[3].Error)
+	assert.Equal(t, "missing uid", results[4].Error)
+}
+
+func TestBulkWriterRoundTrip(t *testing.T) {
+	rows := []BulkRegistration{
+		{OrgID: "1234", UID: "abc", DisplayName: "one, with a comma", Username: "foo", Extra: map[string]interface{}{"a": "b"}},
+		{OrgID: "1234", UID: "def", DisplayName: "two"},
+	}
+
+	for _, format := range []BulkFormat{BulkFormatJSON, BulkFormatCSV} {
+		var buf bytes.Buffer
+		bw, err := NewBulkWriter(&buf, format)
+		assert.Nil(t, err)
+		for _, row := range rows {
+			assert.Nil(t, bw.Write(row))
+		}
+		assert.Nil(t, bw.Close())
+
+		parsed, err := ParseBulkRegistrations(&buf, format)
+		assert.Nil(t, err, format)
+		assert.Equal(t, rows, parsed, format)
+	}
+}
@@ -0,0 +1,1579 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/netip"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redhatinsights/mbop/internal/config"
+	l "github.com/redhatinsights/mbop/internal/logger"
+	"github.com/stretchr/testify/suite"
+)
+
+/*
+StoreSuite is the contract every Store backend has to fulfil, run it from the
+backend's own test file with a constructor:
+
+	func TestMyStore(t *testing.T) {
+		suite.Run(t, &StoreSuite{NewStore: func(t *testing.T) Store { ... }})
+	}
+
+NewStore is called before every test and has to return an empty store, it's
+fine to hand back the same one after clearing it out.
+*/
+type StoreSuite struct {
+	suite.Suite
+	NewStore func(t *testing.T) Store
+	store    Store
+}
+
+func (suite *StoreSuite) SetupSuite() {
+	_ = l.Init()
+}
+
+func (suite *StoreSuite) SetupTest() {
+	suite.store = suite.NewStore(suite.T())
+}
+
+func (suite *StoreSuite) TestCreateWithoutExtra() {
+	r := Registration{
+		OrgID:    "1234",
+		UID:      "1234",
+		Username: "foobar",
+	}
+	id, err := suite.store.Create(context.Background(), &r)
+	suite.Nil(err, "failed to insert without extra")
+	suite.NotEqual("", id, "something funky with returning the id")
+}
+
+func (suite *StoreSuite) TestCreateWithExtra() {
+	r := Registration{
+		OrgID:    "1234",
+		Username: "foobar",
+		UID:      "1234",
+		Extra:    map[string]interface{}{"thing": true},
+	}
+	id, err := suite.store.Create(context.Background(), &r)
+	suite.Nil(err, "failed to insert")
+	suite.NotEqual("", id, "something funky with returning the id")
+}
+
+func (suite *StoreSuite) TestCreateDuplicateDisplayNameSameOrg() {
+	r := Registration{
+		OrgID:       "1234",
+		Username:    "foobar",
+		UID:         "1234",
+		DisplayName: "dupe",
+	}
+	_, err := suite.store.Create(context.Background(), &r)
+	suite.Nil(err, "failed to insert")
+
+	r2 := Registration{
+		OrgID:       "1234",
+		Username:    "foobar",
+		UID:         "2345",
+		DisplayName: "dupe",
+	}
+	_, err = suite.store.Create(context.Background(), &r2)
+	suite.Error(err, "inserted successfully even when it shouldn't have")
+}
+
+func (suite *StoreSuite) TestCreateDuplicateDisplayNameDifferentOrg() {
+	r := Registration{
+		OrgID:       "1234",
+		Username:    "foobar",
+		UID:         "1234",
+		DisplayName: "dupe",
+	}
+	_, err := suite.store.Create(context.Background(), &r)
+	suite.Nil(err, "failed to insert")
+
+	r2 := Registration{
+		OrgID:       "2345",
+		Username:    "foobar",
+		UID:         "2345",
+		DisplayName: "dupe",
+	}
+	_, err = suite.store.Create(context.Background(), &r2)
+	suite.Nil(err)
+}
+
+func (suite *StoreSuite) TestDelete() {
+	r := Registration{
+		OrgID:    "1234",
+		Username: "foobar",
+		UID:      "1234",
+		Extra:    map[string]interface{}{"thing": true},
+	}
+	_, err := suite.store.Create(context.Background(), &r)
+	suite.Nil(err, "failed to setup for deletion")
+
+	err = suite.store.Delete(context.Background(), "1234", "1234", "foobar")
+	suite.Nil(err, "failed to delete item")
+}
+
+func (suite *StoreSuite) TestDeleteNotExisting() {
+	err := suite.store.Delete(context.Background(), "1234", "1234", "foobar")
+	suite.Error(err, "failed to fail to delete item")
+}
+
+func (suite *StoreSuite) TestFindOne() {
+	r := Registration{
+		OrgID:    "1234",
+		Username: "foobar",
+		UID:      "1234",
+		Extra:    map[string]interface{}{"thing": true},
+	}
+	_, err := suite.store.Create(context.Background(), &r)
+	suite.Nil(err, "failed to insert: %v", err)
+
+	found, err := suite.store.Find(context.Background(), "1234", "1234")
+	suite.Nil(err, "failed to find one registration")
+	suite.Equal(found.UID, "1234")
+	suite.Equal(found.OrgID, "1234")
+	suite.Equal(found.Username, "foobar")
+	suite.WithinDuration(found.CreatedAt, time.Now(), 5*time.Second)
+}
+
+func (suite *StoreSuite) TestFindByUID() {
+	r := Registration{
+		OrgID:    "1234",
+		Username: "foobar",
+		UID:      "1234",
+		Extra:    map[string]interface{}{"thing": true},
+	}
+	_, err := suite.store.Create(context.Background(), &r)
+	suite.Nil(err, "failed to insert: %v", err)
+
+	found, err := suite.store.FindByUID(context.Background(), "1234")
+	suite.Nil(err, "failed to find one registration")
+	suite.Equal(found.UID, "1234")
+	suite.Equal(found.OrgID, "1234")
+	suite.Equal(found.Username, "foobar")
+	suite.WithinDuration(found.CreatedAt, time.Now(), 5*time.Second)
+}
+
+func (suite *StoreSuite) TestFindByUIDNotThere() {
+	_, err := suite.store.FindByUID(context.Background(), "1234")
+	suite.Error(err, "failed to not find one registration")
+}
+
+func (suite *StoreSuite) TestFindOneNotThere() {
+	_, err := suite.store.Find(context.Background(), "1234", "1234")
+	suite.Error(err, "failed to not find one registration")
+}
+
+func (suite *StoreSuite) TestFindAll() {
+	r := Registration{OrgID: "1234", UID: "1234", DisplayName: "one"}
+	_, err := suite.store.Create(context.Background(), &r)
+	suite.Nil(err, "failed to insert")
+
+	r.OrgID = "1234"
+	r.UID = "2345"
+	r.DisplayName = "two"
+	_, err = suite.store.Create(context.Background(), &r)
+	suite.Nil(err, "failed to insert")
+
+	_, count, err := suite.store.All(context.Background(), "1234", RegistrationQuery{})
+	suite.Nil(err, "failed to list all registrations")
+	suite.Equal(count, 2)
+}
+
+func (suite *StoreSuite) TestUpdate() {
+	r := Registration{OrgID: "1234", UID: "1234"}
+	_, err := suite.store.Create(context.Background(), &r)
+	suite.Nil(err, "failed to insert")
+
+	err = suite.store.Update(context.Background(),
+		&r,
+		&RegistrationUpdate{Extra: &map[string]interface{}{"thing": true}},
+		"foobar",
+	)
+	suite.Nil(err, "failed to update registration")
+}
+
+func (suite *StoreSuite) TestUpdateMergesExtra() {
+	r := Registration{OrgID: "1234", UID: "1234", DisplayName: "one", Extra: map[string]interface{}{"a": "b"}}
+	_, err := suite.store.Create(context.Background(), &r)
+	suite.Nil(err, "failed to insert")
+
+	name := "renamed"
+	err = suite.store.Update(context.Background(), &r, &RegistrationUpdate{
+		DisplayName: &name,
+		Extra:       &map[string]interface{}{"c": "d"},
+	}, "foobar")
+	suite.Nil(err, "failed to update registration")
+
+	found, err := suite.store.Find(context.Background(), "1234", "1234")
+	suite.Nil(err)
+	suite.Equal("renamed", found.DisplayName)
+	suite.Equal(map[string]interface{}{"a": "b", "c": "d"}, found.Extra)
+}
+
+func (suite *StoreSuite) TestUpdateDuplicateDisplayName() {
+	_, err := suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: "1234", DisplayName: "one"})
+	suite.Nil(err)
+	_, err = suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: "2345", DisplayName: "two"})
+	suite.Nil(err)
+
+	name := "two"
+	err = suite.store.Update(context.Background(), &Registration{OrgID: "1234", UID: "1234"}, &RegistrationUpdate{DisplayName: &name}, "foobar")
+	suite.ErrorIs(err, ErrRegistrationAlreadyExists{})
+}
+
+func (suite *StoreSuite) TestUpdateNotThere() {
+	name := "two"
+	err := suite.store.Update(context.Background(), &Registration{OrgID: "1234", UID: "1234"}, &RegistrationUpdate{DisplayName: &name}, "foobar")
+	suite.ErrorIs(err, ErrRegistrationNotFound)
+}
+
+func (suite *StoreSuite) TestHistory() {
+	r := Registration{OrgID: "1234", UID: "1234", DisplayName: "one", Username: "creator"}
+	_, err := suite.store.Create(context.Background(), &r)
+	suite.Nil(err, "failed to insert")
+
+	name := "two"
+	suite.Nil(suite.store.Update(context.Background(), &r, &RegistrationUpdate{DisplayName: &name}, "updater"))
+	suite.Nil(suite.store.Delete(context.Background(), "1234", "1234", "deleter"))
+
+	events, err := suite.store.History(context.Background(), "1234", "1234")
+	suite.Nil(err)
+	suite.Len(events, 3)
+
+	suite.Equal(RegistrationEventCreate, events[0].Type)
+	suite.Equal("creator", events[0].Actor)
+	suite.Nil(events[0].Before)
+	suite.Equal("one", events[0].After.DisplayName)
+
+	suite.Equal(RegistrationEventUpdate, events[1].Type)
+	suite.Equal("updater", events[1].Actor)
+	suite.Equal("one", events[1].Before.DisplayName)
+	suite.Equal("two", events[1].After.DisplayName)
+
+	suite.Equal(RegistrationEventDelete, events[2].Type)
+	suite.Equal("deleter", events[2].Actor)
+	suite.Equal("two", events[2].Before.DisplayName)
+	suite.Nil(events[2].After)
+}
+
+func (suite *StoreSuite) TestFindAllWithPagination() {
+	for i := 0; i < 10; i++ {
+		s := strconv.Itoa(i)
+		_, err := suite.store.Create(context.Background(), &Registration{
+			OrgID:       "a",
+			UID:         s,
+			DisplayName: s,
+		})
+		suite.Nil(err)
+	}
+
+	// stepping through the pages ensuring they start/end with where it's expected
+	regs, count, err := suite.store.All(context.Background(), "a", RegistrationQuery{Limit: 5})
+	suite.Nil(err)
+	suite.Equal(10, count)
+	suite.Equal(5, len(regs))
+	suite.Equal("9", regs[0].UID)
+	suite.Equal("5", regs[len(regs)-1].UID)
+
+	regs, count, err = suite.store.All(context.Background(), "a", RegistrationQuery{Limit: 5, Offset: 5})
+	suite.Nil(err)
+	suite.Equal(10, count)
+	suite.Equal(5, len(regs))
+	suite.Equal("4", regs[0].UID)
+	suite.Equal("0", regs[len(regs)-1].UID)
+
+	regs, count, err = suite.store.All(context.Background(), "a", RegistrationQuery{Limit: 5, Offset: 10})
+	suite.Nil(err)
+	suite.Equal(10, count)
+	suite.Equal(0, len(regs))
+}
+
+func (suite *StoreSuite) TestIPAllowedHappyPath() {
+	config.Reset()
+	defer config.Reset()
+	os.Setenv("ALLOWLIST_ENABLED", "true")
+	defer os.Setenv("ALLOWLIST_ENABLED", "false")
+
+	suite.Nil(suite.store.AllowAddress(context.Background(), &AllowlistBlock{
+		IPBlock: "10.0.0.1/24",
+		OrgID:   "1234",
+	}))
+
+	allowed, err := suite.store.AllowedIP(context.Background(), "10.0.0.100", "1234")
+	suite.True(allowed)
+	suite.Nil(err)
+}
+
+func (suite *StoreSuite) TestIPAllowedBadPath() {
+	config.Reset()
+	defer config.Reset()
+	os.Setenv("ALLOWLIST_ENABLED", "true")
+	defer os.Setenv("ALLOWLIST_ENABLED", "false")
+
+	suite.Nil(suite.store.AllowAddress(context.Background(), &AllowlistBlock{
+		IPBlock: "10.0.0.1/24",
+		OrgID:   "1234",
+	}))
+
+	allowed, err := suite.store.AllowedIP(context.Background(), "8.8.8.8", "1234")
+	suite.False(allowed)
+	suite.Nil(err)
+}
+
+func (suite *StoreSuite) TestIPAllowedHappyMultiple() {
+	config.Reset()
+	defer config.Reset()
+	os.Setenv("ALLOWLIST_ENABLED", "true")
+	defer os.Setenv("ALLOWLIST_ENABLED", "false")
+
+	suite.Nil(suite.store.AllowAddress(context.Background(), &AllowlistBlock{
+		IPBlock: "10.0.0.1/24",
+		OrgID:   "1234",
+	}))
+	suite.Nil(suite.store.AllowAddress(context.Background(), &AllowlistBlock{
+		IPBlock: "192.168.1.1/24",
+		OrgID:   "1234",
+	}))
+
+	for _, ip := range []string{"10.0.0.100", "192.168.1.100", "10.0.0.20", "192.168.1.20"} {
+		allowed, err := suite.store.AllowedIP(context.Background(), ip, "1234")
+		suite.True(allowed)
+		suite.Nil(err)
+	}
+}
+
+func (suite *StoreSuite) TestIPAllowedWithSystem() {
+	config.Reset()
+	defer config.Reset()
+	os.Setenv("ALLOWLIST_ENABLED", "true")
+	defer os.Setenv("ALLOWLIST_ENABLED", "false")
+
+	suite.Nil(suite.store.AllowAddress(context.Background(), &AllowlistBlock{
+		IPBlock: "10.0.0.1/24",
+		OrgID:   "1234",
+	}))
+	suite.Nil(suite.store.AllowAddress(context.Background(), &AllowlistBlock{
+		IPBlock: "192.168.1.1/24",
+		OrgID:   "system",
+	}))
+
+	for _, ip := range []string{"10.0.0.100", "192.168.1.100", "10.0.0.20", "192.168.1.20"} {
+		allowed, err := suite.store.AllowedIP(context.Background(), ip, "1234")
+		suite.True(allowed)
+		suite.Nil(err)
+	}
+}
+
+func (suite *StoreSuite) TestSingleIPCIDR() {
+	config.Reset()
+	defer config.Reset()
+	os.Setenv("ALLOWLIST_ENABLED", "true")
+	defer os.Setenv("ALLOWLIST_ENABLED", "false")
+
+	suite.Nil(suite.store.AllowAddress(context.Background(), &AllowlistBlock{
+		IPBlock: "192.168.245.100/32",
+		OrgID:   "1234",
+	}))
+
+	allowed, err := suite.store.AllowedIP(context.Background(), "192.168.245.100", "1234")
+	suite.True(allowed)
+	suite.Nil(err)
+
+	allowed, err = suite.store.AllowedIP(context.Background(), "192.168.245.101", "1234")
+	suite.False(allowed)
+	suite.Nil(err)
+}
+
+func (suite *StoreSuite) TestIPAllowedIPv6() {
+	suite.Nil(suite.store.AllowAddress(context.Background(), &AllowlistBlock{
+		IPBlock: "2001:db8::/32",
+		OrgID:   "1234",
+	}))
+	suite.Nil(suite.store.AllowAddress(context.Background(), &AllowlistBlock{
+		IPBlock: "10.0.0.0/24",
+		OrgID:   "1234",
+	}))
+	suite.Nil(suite.store.AllowAddress(context.Background(), &AllowlistBlock{
+		IPBlock: "fe80::/10",
+		OrgID:   "1234",
+	}))
+
+	// a zoned address is never allowed, not even by a block containing it
+	for ip, want := range map[string]bool{
+		"2001:db8::1":      true,
+		"2001:db8:ffff::1": true,
+		"2001:db9::1":      false,
+		"::ffff:10.0.0.7":  true,
+		"::ffff:10.0.1.7":  false,
+		"10.0.0.7":         true,
+		"2001:db8::1%eth0": false,
+		"fe80::1":          true,
+		"fe80::1%eth0":     false,
+		"fe80::1%1":        false,
+		"not-an-ip":        false,
+		"":                 false,
+	} {
+		allowed, err := suite.store.AllowedIP(context.Background(), ip, "1234")
+		suite.Nil(err)
+		suite.Equal(want, allowed, ip)
+	}
+}
+
+func (suite *StoreSuite) TestAllowAddressNormalizes() {
+	block := &AllowlistBlock{IPBlock: "::ffff:192.168.1.7/120", OrgID: "1234"}
+	suite.Nil(suite.store.AllowAddress(context.Background(), block))
+	suite.Equal("192.168.1.0/24", block.IPBlock)
+
+	allowed, err := suite.store.AllowedIP(context.Background(), "192.168.1.20", "1234")
+	suite.Nil(err)
+	suite.True(allowed)
+
+	suite.ErrorIs(suite.store.AllowAddress(context.Background(), &AllowlistBlock{IPBlock: "192.168.1.1/24", OrgID: "1234"}), ErrAddressAlreadyAllowListed)
+	suite.ErrorIs(suite.store.AllowAddress(context.Background(), &AllowlistBlock{IPBlock: "192.168.1.1/33", OrgID: "1234"}), ErrInvalidIPBlock)
+
+	blocks, _, err := suite.store.AllowedAddresses(context.Background(), "1234", AllowlistQuery{})
+	suite.Nil(err)
+	suite.Len(blocks, 1)
+	suite.Equal("192.168.1.0/24", blocks[0].IPBlock)
+
+	suite.Nil(suite.store.DenyAddress(context.Background(), &AllowlistBlock{IPBlock: "192.168.1.0/24", OrgID: "1234"}))
+}
+
+func (suite *StoreSuite) TestAllowlistExpiry() {
+	ctx := context.Background()
+	expiresAt := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	block := &AllowlistBlock{
+		IPBlock:     "10.0.0.0/24",
+		OrgID:       "1234",
+		ExpiresAt:   &expiresAt,
+		Description: "office",
+		CreatedBy:   "foo",
+	}
+	suite.Nil(suite.store.AllowAddress(ctx, block))
+
+	past := time.Now().Add(-time.Minute)
+	suite.Nil(suite.store.AllowAddress(ctx, &AllowlistBlock{IPBlock: "10.0.1.0/24", OrgID: "1234", ExpiresAt: &past}))
+	suite.Nil(suite.store.AllowAddress(ctx, &AllowlistBlock{IPBlock: "10.0.2.0/24", OrgID: "system", ExpiresAt: &past}))
+
+	for ip, want := range map[string]bool{
+		"10.0.0.7": true,
+		"10.0.1.7": false,
+		"10.0.2.7": false,
+	} {
+		allowed, err := suite.store.AllowedIP(ctx, ip, "1234")
+		suite.Nil(err)
+		suite.Equal(want, allowed, ip)
+	}
+
+	// expired blocks are still listed until they're cleaned up
+	blocks, _, err := suite.store.AllowedAddresses(ctx, "1234", AllowlistQuery{})
+	suite.Nil(err)
+	suite.Len(blocks, 2)
+	suite.Equal("10.0.0.0/24", blocks[0].IPBlock)
+	suite.NotNil(blocks[0].ExpiresAt)
+	suite.WithinDuration(expiresAt, *blocks[0].ExpiresAt, time.Microsecond)
+	suite.Equal("office", blocks[0].Description)
+	suite.Equal("foo", blocks[0].CreatedBy)
+	suite.NotNil(blocks[1].ExpiresAt)
+	suite.Empty(blocks[1].Description)
+	suite.Empty(blocks[1].CreatedBy)
+}
+
+func (suite *StoreSuite) TestCheckIP() {
+	ctx := context.Background()
+	past := time.Now().Add(-time.Minute)
+	for _, b := range []AllowlistBlock{
+		{IPBlock: "10.0.0.0/8", OrgID: "1234"},
+		{IPBlock: "10.1.2.0/24", OrgID: "system"},
+		{IPBlock: "10.1.0.0/16", OrgID: "1234"},
+		{IPBlock: "192.168.1.0/24", OrgID: "1234", ExpiresAt: &past},
+		{IPBlock: "192.168.0.0/24", OrgID: "1234"},
+		{IPBlock: "2001:db8::/32", OrgID: "1234"},
+		{IPBlock: "172.16.0.0/12", OrgID: "2345"},
+	} {
+		suite.Nil(suite.store.AllowAddress(ctx, &b))
+	}
+
+	// the most specific block wins, wherever it's from
+	check, err := CheckIP(ctx, suite.store, netip.MustParseAddr("::ffff:10.1.2.3"), "1234")
+	suite.Nil(err)
+	suite.True(check.Allowed)
+	suite.Equal("10.1.2.3", check.IP)
+	suite.Equal("10.1.2.0/24", check.Matched.IPBlock)
+	suite.Equal("system", check.Matched.OrgID)
+	suite.Empty(check.Candidates)
+
+	check, err = CheckIP(ctx, suite.store, netip.MustParseAddr("10.1.9.9"), "1234")
+	suite.Nil(err)
+	suite.Equal("10.1.0.0/16", check.Matched.IPBlock)
+
+	// expired blocks don't match but are the closest candidates, other orgs'
+	// blocks and the other address family are never candidates
+	check, err = CheckIP(ctx, suite.store, netip.MustParseAddr("192.168.1.7"), "1234")
+	suite.Nil(err)
+	suite.False(check.Allowed)
+	suite.Nil(check.Matched)
+	suite.Len(check.Candidates, 5)
+	suite.Equal("192.168.1.0/24", check.Candidates[0].IPBlock)
+	suite.Equal(24, check.Candidates[0].CommonBits)
+	suite.True(check.Candidates[0].Expired)
+	suite.Equal("192.168.0.0/24", check.Candidates[1].IPBlock)
+	suite.Equal(23, check.Candidates[1].CommonBits)
+	suite.False(check.Candidates[1].Expired)
+	for _, c := range check.Candidates {
+		suite.NotEqual("2345", c.OrgID)
+		suite.NotEqual("2001:db8::/32", c.IPBlock)
+	}
+
+	allowed, err := suite.store.AllowedIP(ctx, "192.168.1.7", "1234")
+	suite.Nil(err)
+	suite.False(allowed)
+}
+
+func (suite *StoreSuite) TestPurgeExpiredAddresses() {
+	ctx := context.Background()
+	past, future := time.Now().Add(-time.Minute), time.Now().Add(time.Hour)
+	suite.Nil(suite.store.AllowAddress(ctx, &AllowlistBlock{IPBlock: "10.0.0.0/24", OrgID: "1234"}))
+	suite.Nil(suite.store.AllowAddress(ctx, &AllowlistBlock{IPBlock: "10.0.1.0/24", OrgID: "1234", ExpiresAt: &future}))
+	suite.Nil(suite.store.AllowAddress(ctx, &AllowlistBlock{IPBlock: "10.0.2.0/24", OrgID: "1234", ExpiresAt: &past, CreatedBy: "foo"}))
+
+	// only what's claimed after this point
+	_, err := suite.store.ClaimOutbox(ctx, 100, time.Hour)
+	suite.Nil(err)
+
+	count, err := suite.store.PurgeExpiredAddresses(ctx)
+	suite.Nil(err)
+	suite.Equal(1, count)
+
+	count, err = suite.store.PurgeExpiredAddresses(ctx)
+	suite.Nil(err)
+	suite.Equal(0, count)
+
+	blocks, _, err := suite.store.AllowedAddresses(ctx, "1234", AllowlistQuery{})
+	suite.Nil(err)
+	suite.Len(blocks, 2)
+	suite.Equal("10.0.0.0/24", blocks[0].IPBlock)
+	suite.Equal("10.0.1.0/24", blocks[1].IPBlock)
+
+	events, err := suite.store.ClaimOutbox(ctx, 100, time.Hour)
+	suite.Nil(err)
+	suite.Len(events, 1)
+	suite.Equal(OutboxAllowlistRemoved, events[0].Type)
+	suite.Equal("10.0.2.0/24", events[0].Key)
+
+	var b AllowlistBlock
+	suite.Nil(json.Unmarshal(events[0].Payload, &b))
+	suite.Equal("foo", b.CreatedBy)
+	suite.NotNil(b.ExpiresAt)
+}
+
+func (suite *StoreSuite) TestDeleteIsSoft() {
+	_, err := suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: "1234", DisplayName: "one"})
+	suite.Nil(err)
+	suite.Nil(suite.store.Delete(context.Background(), "1234", "1234", "foobar"))
+
+	_, err = suite.store.Find(context.Background(), "1234", "1234")
+	suite.ErrorIs(err, ErrRegistrationNotFound)
+	_, err = suite.store.FindByUID(context.Background(), "1234")
+	suite.ErrorIs(err, ErrRegistrationNotFound)
+	_, count, err := suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 10})
+	suite.Nil(err)
+	suite.Equal(0, count)
+
+	// the same uid + display name can be registered again once deleted
+	_, err = suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: "1234", DisplayName: "one"})
+	suite.Nil(err)
+}
+
+func (suite *StoreSuite) TestRestore() {
+	_, err := suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: "1234", DisplayName: "one"})
+	suite.Nil(err)
+	suite.Nil(suite.store.Delete(context.Background(), "1234", "1234", "foobar"))
+
+	restored, err := suite.store.Restore(context.Background(), "1234", "1234", "foobar", time.Hour)
+	suite.Nil(err)
+	suite.Equal("one", restored.DisplayName)
+	suite.Nil(restored.DeletedAt)
+
+	_, err = suite.store.FindByUID(context.Background(), "1234")
+	suite.Nil(err)
+
+	events, err := suite.store.History(context.Background(), "1234", "1234")
+	suite.Nil(err)
+	suite.Equal(RegistrationEventRestore, events[len(events)-1].Type)
+}
+
+func (suite *StoreSuite) TestRestoreOutsideRetention() {
+	_, err := suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: "1234", DisplayName: "one"})
+	suite.Nil(err)
+	suite.Nil(suite.store.Delete(context.Background(), "1234", "1234", "foobar"))
+
+	_, err = suite.store.Restore(context.Background(), "1234", "1234", "foobar", 0)
+	suite.ErrorIs(err, ErrRegistrationNotFound)
+}
+
+func (suite *StoreSuite) TestRestoreConflict() {
+	_, err := suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: "1234", DisplayName: "one"})
+	suite.Nil(err)
+	suite.Nil(suite.store.Delete(context.Background(), "1234", "1234", "foobar"))
+	_, err = suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: "1234", DisplayName: "two"})
+	suite.Nil(err)
+
+	_, err = suite.store.Restore(context.Background(), "1234", "1234", "foobar", time.Hour)
+	suite.ErrorIs(err, ErrRegistrationAlreadyExists{})
+}
+
+func (suite *StoreSuite) TestPurge() {
+	_, err := suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: "1234", DisplayName: "one"})
+	suite.Nil(err)
+	_, err = suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: "2345", DisplayName: "two"})
+	suite.Nil(err)
+	suite.Nil(suite.store.Delete(context.Background(), "1234", "1234", "foobar"))
+
+	purged, err := suite.store.Purge(context.Background(), time.Hour)
+	suite.Nil(err)
+	suite.Equal(0, purged)
+
+	purged, err = suite.store.Purge(context.Background(), 0)
+	suite.Nil(err)
+	suite.Equal(1, purged)
+
+	_, err = suite.store.Restore(context.Background(), "1234", "1234", "foobar", time.Hour)
+	suite.ErrorIs(err, ErrRegistrationNotFound)
+	_, err = suite.store.Find(context.Background(), "1234", "2345")
+	suite.Nil(err)
+}
+
+func (suite *StoreSuite) TestCertificateRoundTrip() {
+	notAfter := time.Now().Add(24 * time.Hour).UTC().Truncate(time.Second)
+	r := Registration{
+		OrgID:       "1234",
+		UID:         "1234",
+		DisplayName: "one",
+		Certificate: &Certificate{Fingerprint: "abcd", Serial: "1f", NotAfter: notAfter},
+	}
+	_, err := suite.store.Create(context.Background(), &r)
+	suite.Nil(err)
+
+	found, err := suite.store.FindByUID(context.Background(), "1234")
+	suite.Nil(err)
+	suite.Equal("abcd", found.Certificate.Fingerprint)
+	suite.Equal("1f", found.Certificate.Serial)
+	suite.WithinDuration(notAfter, found.Certificate.NotAfter, time.Second)
+
+	err = suite.store.Update(context.Background(), &r, &RegistrationUpdate{Certificate: &Certificate{Fingerprint: "ef01", Serial: "20", NotAfter: notAfter}}, "foobar")
+	suite.Nil(err)
+
+	found, err = suite.store.FindByUID(context.Background(), "1234")
+	suite.Nil(err)
+	suite.Equal("ef01", found.Certificate.Fingerprint)
+}
+
+func (suite *StoreSuite) TestUpdateLastSeen() {
+	_, err := suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: "1234", DisplayName: "one"})
+	suite.Nil(err)
+	_, err = suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: "2345", DisplayName: "two"})
+	suite.Nil(err)
+
+	seen := time.Now().Add(-time.Hour)
+	suite.Nil(suite.store.UpdateLastSeen(context.Background(), map[string]time.Time{"1234": seen}))
+	// older timestamps don't move it backwards
+	suite.Nil(suite.store.UpdateLastSeen(context.Background(), map[string]time.Time{"1234": seen.Add(-time.Hour)}))
+
+	found, err := suite.store.FindByUID(context.Background(), "1234")
+	suite.Nil(err)
+	suite.WithinDuration(seen, *found.LastSeenAt, time.Second)
+
+	found, err = suite.store.FindByUID(context.Background(), "2345")
+	suite.Nil(err)
+	suite.Nil(found.LastSeenAt)
+}
+
+func (suite *StoreSuite) TestAllNotSeenSince() {
+	for _, uid := range []string{"recent", "stale", "never"} {
+		_, err := suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: uid, DisplayName: uid})
+		suite.Nil(err)
+	}
+	suite.Nil(suite.store.UpdateLastSeen(context.Background(), map[string]time.Time{
+		"recent": time.Now(),
+		"stale":  time.Now().Add(-48 * time.Hour),
+	}))
+
+	since := time.Now().Add(-24 * time.Hour)
+	regs, count, err := suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 10, NotSeenSince: &since})
+	suite.Nil(err)
+	suite.Equal(2, count)
+
+	uids := []string{regs[0].UID, regs[1].UID}
+	suite.ElementsMatch([]string{"stale", "never"}, uids)
+}
+
+func (suite *StoreSuite) TestAllSearch() {
+	for _, r := range []Registration{
+		{OrgID: "1234", UID: "abc", Username: "alice", DisplayName: "Web Server"},
+		{OrgID: "1234", UID: "def", Username: "bob", DisplayName: "db-server"},
+		{OrgID: "1234", UID: "ghi", Username: "alice", DisplayName: "100%_done"},
+	} {
+		_, err := suite.store.Create(context.Background(), &r)
+		suite.Nil(err)
+	}
+
+	regs, count, err := suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 10, Search: "SERVER"})
+	suite.Nil(err)
+	suite.Equal(2, count)
+	suite.Len(regs, 2)
+
+	_, count, err = suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 10, Search: "%_"})
+	suite.Nil(err)
+	suite.Equal(1, count)
+
+	regs, count, err = suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 10, Search: "server", Username: "alice"})
+	suite.Nil(err)
+	suite.Equal(1, count)
+	suite.Equal("abc", regs[0].UID)
+}
+
+func (suite *StoreSuite) TestAllExtra() {
+	for _, r := range []Registration{
+		{OrgID: "1234", UID: "abc", DisplayName: "abc", Extra: map[string]interface{}{"env": "prod", "site": "rdu"}},
+		{OrgID: "1234", UID: "def", DisplayName: "def", Extra: map[string]interface{}{"env": "prod", "site": "bos"}},
+		{OrgID: "1234", UID: "ghi", DisplayName: "ghi", Extra: map[string]interface{}{"env": "stage", "rack": 12.0}},
+		{OrgID: "1234", UID: "jkl", DisplayName: "jkl"},
+	} {
+		_, err := suite.store.Create(context.Background(), &r)
+		suite.Nil(err)
+	}
+
+	_, count, err := suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 10, Extra: map[string]string{"env": "prod"}})
+	suite.Nil(err)
+	suite.Equal(2, count)
+
+	regs, count, err := suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 10, Extra: map[string]string{"env": "prod", "site": "bos"}})
+	suite.Nil(err)
+	suite.Equal(1, count)
+	suite.Equal("def", regs[0].UID)
+
+	// only string values match
+	_, count, err = suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 10, Extra: map[string]string{"rack": "12"}})
+	suite.Nil(err)
+	suite.Equal(0, count)
+
+	_, count, err = suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 10, Extra: map[string]string{"owner": "ops"}})
+	suite.Nil(err)
+	suite.Equal(0, count)
+}
+
+func (suite *StoreSuite) TestAllCreatedRange() {
+	for _, uid := range []string{"abc", "def"} {
+		_, err := suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: uid, DisplayName: uid})
+		suite.Nil(err)
+	}
+
+	found, err := suite.store.Find(context.Background(), "1234", "abc")
+	suite.Nil(err)
+	suite.WithinDuration(time.Now(), found.CreatedAt, time.Minute)
+
+	// closer than any time zone offset
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Minute)
+
+	_, count, err := suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 10, CreatedAfter: &past, CreatedBefore: &future})
+	suite.Nil(err)
+	suite.Equal(2, count)
+
+	_, count, err = suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 10, CreatedAfter: &future})
+	suite.Nil(err)
+	suite.Equal(0, count)
+
+	_, count, err = suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 10, CreatedBefore: &past})
+	suite.Nil(err)
+	suite.Equal(0, count)
+}
+
+func (suite *StoreSuite) TestAllSortAndPaginate() {
+	for _, name := range []string{"charlie", "alpha", "bravo"} {
+		_, err := suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: name + "-uid", DisplayName: name})
+		suite.Nil(err)
+	}
+
+	regs, count, err := suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 2, SortBy: SortByDisplayName})
+	suite.Nil(err)
+	suite.Equal(3, count)
+	suite.Len(regs, 2)
+	suite.Equal("alpha", regs[0].DisplayName)
+	suite.Equal("bravo", regs[1].DisplayName)
+
+	regs, count, err = suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 2, Offset: 2, SortBy: SortByDisplayName})
+	suite.Nil(err)
+	suite.Equal(3, count)
+	suite.Len(regs, 1)
+	suite.Equal("charlie", regs[0].DisplayName)
+
+	regs, _, err = suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 10, SortBy: SortByUID, SortDesc: true})
+	suite.Nil(err)
+	suite.Equal("charlie-uid", regs[0].UID)
+	suite.Equal("alpha-uid", regs[2].UID)
+}
+
+func (suite *StoreSuite) TestAllCursor() {
+	for _, uid := range []string{"one", "two", "three", "four", "five"} {
+		_, err := suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: uid, DisplayName: uid})
+		suite.Nil(err)
+	}
+
+	all, _, err := suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 10})
+	suite.Nil(err)
+	suite.Len(all, 5)
+
+	cursor := &Cursor{CreatedAt: all[1].CreatedAt, Key: all[1].ID}
+	regs, count, err := suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 2, Cursor: cursor})
+	suite.Nil(err)
+	suite.Equal(5, count)
+	suite.Equal([]string{all[2].UID, all[3].UID}, []string{regs[0].UID, regs[1].UID})
+
+	cursor = &Cursor{CreatedAt: all[4].CreatedAt, Key: all[4].ID, Backward: true}
+	regs, _, err = suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 2, Cursor: cursor})
+	suite.Nil(err)
+	suite.Equal([]string{all[2].UID, all[3].UID}, []string{regs[0].UID, regs[1].UID})
+
+	cursor = &Cursor{CreatedAt: all[1].CreatedAt, Key: all[1].ID, Backward: true}
+	regs, _, err = suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 2, Cursor: cursor})
+	suite.Nil(err)
+	suite.Len(regs, 1)
+	suite.Equal(all[0].UID, regs[0].UID)
+
+	// oldest first walks the other way
+	cursor = &Cursor{CreatedAt: all[3].CreatedAt, Key: all[3].ID}
+	regs, _, err = suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 10, Cursor: cursor, SortBy: SortByCreatedAt})
+	suite.Nil(err)
+	suite.Equal([]string{all[2].UID, all[1].UID, all[0].UID}, []string{regs[0].UID, regs[1].UID, regs[2].UID})
+}
+
+func (suite *StoreSuite) TestAllowedAddressesPagination() {
+	for _, block := range []string{"10.0.0.0/24", "10.0.1.0/24", "10.0.2.0/24"} {
+		suite.Nil(suite.store.AllowAddress(context.Background(), &AllowlistBlock{IPBlock: block, OrgID: "1234"}))
+	}
+
+	all, count, err := suite.store.AllowedAddresses(context.Background(), "1234", AllowlistQuery{})
+	suite.Nil(err)
+	suite.Equal(3, count)
+	suite.Len(all, 3)
+
+	blocks, count, err := suite.store.AllowedAddresses(context.Background(), "1234", AllowlistQuery{Limit: 1, Offset: 1})
+	suite.Nil(err)
+	suite.Equal(3, count)
+	suite.Len(blocks, 1)
+	suite.Equal(all[1].IPBlock, blocks[0].IPBlock)
+
+	blocks, _, err = suite.store.AllowedAddresses(context.Background(), "1234", AllowlistQuery{Limit: 5, Cursor: &Cursor{CreatedAt: all[0].CreatedAt, Key: all[0].IPBlock}})
+	suite.Nil(err)
+	suite.Len(blocks, 2)
+	suite.Equal(all[1].IPBlock, blocks[0].IPBlock)
+
+	blocks, _, err = suite.store.AllowedAddresses(context.Background(), "1234", AllowlistQuery{Limit: 5, Cursor: &Cursor{CreatedAt: all[2].CreatedAt, Key: all[2].IPBlock, Backward: true}})
+	suite.Nil(err)
+	suite.Len(blocks, 2)
+	suite.Equal(all[0].IPBlock, blocks[0].IPBlock)
+}
+
+func (suite *StoreSuite) TestImport() {
+	results, err := suite.store.Import(context.Background(), []BulkRegistration{
+		{OrgID: "1234", UID: "abc", DisplayName: "one", Username: "foo"},
+		{OrgID: "1234", UID: "def", DisplayName: "two", Extra: map[string]interface{}{"a": "b"}},
+	}, "importer")
+	suite.Nil(err)
+	suite.Len(results, 2)
+
+	r, err := suite.store.Find(context.Background(), "1234", "def")
+	suite.Nil(err)
+	suite.Equal("two", r.DisplayName)
+	suite.Equal("b", r.Extra["a"])
+
+	events, err := suite.store.History(context.Background(), "1234", "abc")
+	suite.Nil(err)
+	suite.Len(events, 1)
+	suite.Equal("importer", events[0].Actor)
+}
+
+func (suite *StoreSuite) TestImportConflictCreatesNothing() {
+	_, err := suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: "existing", DisplayName: "taken"})
+	suite.Nil(err)
+
+	results, err := suite.store.Import(context.Background(), []BulkRegistration{
+		{OrgID: "1234", UID: "abc", DisplayName: "one"},
+		{OrgID: "1234", UID: "existing", DisplayName: "two"},
+		{OrgID: "1234", UID: "def", DisplayName: "taken"},
+	}, "importer")
+	suite.ErrorIs(err, ErrImportFailed)
+	suite.Len(results, 3)
+	suite.Empty(results[0].Error)
+	suite.NotEmpty(results[1].Error)
+	suite.NotEmpty(results[2].Error)
+
+	_, count, err := suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 10})
+	suite.Nil(err)
+	suite.Equal(1, count)
+}
+
+func (suite *StoreSuite) TestDeleteOnlyMatchesOrgAndUID() {
+	_, err := suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: "abc", DisplayName: "one"})
+	suite.Nil(err)
+	_, err = suite.store.Create(context.Background(), &Registration{OrgID: "5678", UID: "def", DisplayName: "two"})
+	suite.Nil(err)
+
+	suite.ErrorIs(suite.store.Delete(context.Background(), "1234", "def", "foobar"), ErrRegistrationNotFound)
+	suite.ErrorIs(suite.store.Delete(context.Background(), "5678", "abc", "foobar"), ErrRegistrationNotFound)
+
+	_, err = suite.store.Find(context.Background(), "1234", "abc")
+	suite.Nil(err)
+	_, err = suite.store.Find(context.Background(), "5678", "def")
+	suite.Nil(err)
+}
+
+func (suite *StoreSuite) TestDisplayNameUniquePerOrg() {
+	_, err := suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: "abc", DisplayName: "same"})
+	suite.Nil(err)
+	_, err = suite.store.Create(context.Background(), &Registration{OrgID: "5678", UID: "def", DisplayName: "same"})
+	suite.Nil(err)
+
+	_, err = suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: "ghi", DisplayName: "same"})
+	suite.ErrorIs(err, ErrRegistrationAlreadyExists{})
+}
+
+func (suite *StoreSuite) TestCreatePopulatesIDAndCreatedAt() {
+	r := Registration{OrgID: "1234", UID: "abc", DisplayName: "one"}
+	id, err := suite.store.Create(context.Background(), &r)
+	suite.Nil(err)
+	suite.NotEmpty(id)
+
+	found, err := suite.store.Find(context.Background(), "1234", "abc")
+	suite.Nil(err)
+	suite.Equal(id, found.ID)
+	suite.WithinDuration(time.Now(), found.CreatedAt, time.Minute)
+}
+
+func (suite *StoreSuite) TestFindReturnsCopy() {
+	_, err := suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: "abc", DisplayName: "one", Extra: map[string]interface{}{"a": "b"}})
+	suite.Nil(err)
+
+	found, err := suite.store.Find(context.Background(), "1234", "abc")
+	suite.Nil(err)
+	found.DisplayName = "changed"
+	found.Extra["a"] = "changed"
+
+	found, err = suite.store.Find(context.Background(), "1234", "abc")
+	suite.Nil(err)
+	suite.Equal("one", found.DisplayName)
+	suite.Equal("b", found.Extra["a"])
+}
+
+func (suite *StoreSuite) TestAllowlistPerOrg() {
+	suite.Nil(suite.store.AllowAddress(context.Background(), &AllowlistBlock{IPBlock: "10.0.0.0/24", OrgID: "1234"}))
+	suite.Nil(suite.store.AllowAddress(context.Background(), &AllowlistBlock{IPBlock: "10.0.1.0/24", OrgID: "5678"}))
+	suite.Nil(suite.store.AllowAddress(context.Background(), &AllowlistBlock{IPBlock: "10.0.2.0/24", OrgID: "system"}))
+
+	blocks, count, err := suite.store.AllowedAddresses(context.Background(), "1234", AllowlistQuery{})
+	suite.Nil(err)
+	suite.Equal(1, count)
+	suite.Equal("10.0.0.0/24", blocks[0].IPBlock)
+
+	allowed, err := suite.store.AllowedIP(context.Background(), "10.0.1.5", "1234")
+	suite.Nil(err)
+	suite.False(allowed)
+	allowed, err = suite.store.AllowedIP(context.Background(), "10.0.2.5", "1234")
+	suite.Nil(err)
+	suite.True(allowed)
+
+	suite.ErrorIs(suite.store.AllowAddress(context.Background(), &AllowlistBlock{IPBlock: "10.0.0.0/24", OrgID: "1234"}), ErrAddressAlreadyAllowListed)
+	suite.ErrorIs(suite.store.DenyAddress(context.Background(), &AllowlistBlock{IPBlock: "10.0.1.0/24", OrgID: "1234"}), ErrAddressNotAllowListed)
+}
+
+func (suite *StoreSuite) TestUpdateDisplayNameAndExtra() {
+	r := Registration{OrgID: "1234", UID: "1234", DisplayName: "one", Extra: map[string]interface{}{"a": "1"}}
+	_, err := suite.store.Create(context.Background(), &r)
+	suite.Nil(err)
+
+	name := "renamed"
+	err = suite.store.Update(context.Background(), &r, &RegistrationUpdate{
+		DisplayName: &name,
+		Extra:       &map[string]interface{}{"b": "2"},
+	}, "foobar")
+	suite.Nil(err)
+
+	found, err := suite.store.Find(context.Background(), "1234", "1234")
+	suite.Nil(err)
+	suite.Equal("renamed", found.DisplayName)
+	suite.Equal(map[string]interface{}{"a": "1", "b": "2"}, found.Extra)
+}
+
+func (suite *StoreSuite) TestAllOnlyOwnOrg() {
+	_, err := suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: "1234", DisplayName: "one"})
+	suite.Nil(err)
+	_, err = suite.store.Create(context.Background(), &Registration{OrgID: "2345", UID: "2345", DisplayName: "two"})
+	suite.Nil(err)
+
+	_, count, err := suite.store.All(context.Background(), "1234", RegistrationQuery{})
+	suite.Nil(err)
+
+	suite.Equal(count, 1)
+}
+
+func (suite *StoreSuite) TestConcurrentCreate() {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		created int
+	)
+
+	// every goroutine races for the same uid, exactly one of them can win
+	for i := range 50 {
+		wg.Go(func() {
+			_, err := suite.store.Create(context.Background(), &Registration{OrgID: "1234", UID: "abc", DisplayName: strconv.Itoa(i)})
+			if err == nil {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+			_, _, _ = suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 10})
+		})
+	}
+	wg.Wait()
+
+	suite.Equal(1, created)
+	_, count, err := suite.store.All(context.Background(), "1234", RegistrationQuery{Limit: 10})
+	suite.Nil(err)
+	suite.Equal(1, count)
+}
+
+func (suite *StoreSuite) TestSnapshotRoundTrip() {
+	ctx := context.Background()
+	notAfter := time.Now().Add(time.Hour)
+	_, err := suite.store.Create(ctx, &Registration{
+		OrgID: "1234", UID: "abc", DisplayName: "one", Username: "foo",
+		Extra:       map[string]interface{}{"a": "b"},
+		Certificate: &Certificate{Fingerprint: "ff", Serial: "01", NotAfter: notAfter},
+	})
+	suite.Nil(err)
+	_, err = suite.store.Create(ctx, &Registration{OrgID: "2345", UID: "def", DisplayName: "two"})
+	suite.Nil(err)
+	_, err = suite.store.Create(ctx, &Registration{OrgID: "2345", UID: "gone", DisplayName: "three"})
+	suite.Nil(err)
+	suite.Nil(suite.store.Delete(ctx, "2345", "gone", "foo"))
+	suite.Nil(suite.store.UpdateLastSeen(ctx, map[string]time.Time{"def": time.Now()}))
+	suite.Nil(suite.store.AllowAddress(ctx, &AllowlistBlock{IPBlock: "10.0.0.0/8", OrgID: "2345"}))
+	expiresAt := time.Now().Add(time.Hour)
+	suite.Nil(suite.store.AllowAddress(ctx, &AllowlistBlock{
+		IPBlock: "127.0.0.1/32", OrgID: "1234", ExpiresAt: &expiresAt, Description: "local", CreatedBy: "foo",
+	}))
+
+	snap, err := suite.store.DumpSnapshot(ctx)
+	suite.Nil(err)
+	suite.Equal(SnapshotVersion, snap.Version)
+	// deleted registrations aren't part of it
+	suite.Len(snap.Registrations, 2)
+	suite.Equal("abc", snap.Registrations[0].UID)
+	suite.Equal("def", snap.Registrations[1].UID)
+	suite.Len(snap.Allowlist, 2)
+	suite.Equal("1234", snap.Allowlist[0].OrgID)
+
+	// through json and into an empty store of the same kind (for postgres that
+	// is the same database emptied out, the snapshot is all that's left) and
+	// into an in-memory one
+	var buf bytes.Buffer
+	suite.Nil(snap.Write(&buf))
+	read, err := ReadSnapshot(&buf)
+	suite.Nil(err)
+
+	for _, target := range []Store{suite.NewStore(suite.T()), &inMemoryStore{}} {
+		conflicts, err := target.LoadSnapshot(ctx, read, "snapshot")
+		suite.Nil(err)
+		suite.Empty(conflicts)
+
+		restored, err := target.DumpSnapshot(ctx)
+		suite.Nil(err)
+		suite.Len(restored.Registrations, 2)
+		for i, r := range restored.Registrations {
+			want := snap.Registrations[i]
+			suite.Equal(want.ID, r.ID)
+			suite.Equal(want.UID, r.UID)
+			suite.Equal(want.DisplayName, r.DisplayName)
+			suite.Equal(want.Username, r.Username)
+			suite.WithinDuration(want.CreatedAt, r.CreatedAt, time.Microsecond)
+		}
+		suite.Equal("b", restored.Registrations[0].Extra["a"])
+		suite.Equal("ff", restored.Registrations[0].Certificate.Fingerprint)
+		suite.NotNil(restored.Registrations[1].LastSeenAt)
+		suite.Len(restored.Allowlist, 2)
+		suite.Equal("local", restored.Allowlist[0].Description)
+		suite.Equal("foo", restored.Allowlist[0].CreatedBy)
+		suite.NotNil(restored.Allowlist[0].ExpiresAt)
+		suite.WithinDuration(expiresAt, *restored.Allowlist[0].ExpiresAt, time.Microsecond)
+		suite.Nil(restored.Allowlist[1].ExpiresAt)
+
+		found, err := target.FindByUID(ctx, "abc")
+		suite.Nil(err)
+		suite.Equal("one", found.DisplayName)
+
+		history, err := target.History(ctx, "1234", "abc")
+		suite.Nil(err)
+		suite.Len(history, 1)
+		suite.Equal("snapshot", history[0].Actor)
+	}
+}
+
+func (suite *StoreSuite) TestLoadSnapshotConflicts() {
+	ctx := context.Background()
+	_, err := suite.store.Create(ctx, &Registration{OrgID: "1234", UID: "abc", DisplayName: "one"})
+	suite.Nil(err)
+	suite.Nil(suite.store.AllowAddress(ctx, &AllowlistBlock{IPBlock: "10.0.0.0/8", OrgID: "1234"}))
+
+	now := time.Now()
+	snap := newSnapshot()
+	snap.Registrations = []Registration{
+		{ID: uuid.NewString(), OrgID: "1234", UID: "abc", DisplayName: "other", CreatedAt: now},
+		{ID: uuid.NewString(), OrgID: "1234", UID: "new", DisplayName: "new", CreatedAt: now},
+		{ID: uuid.NewString(), OrgID: "1234", UID: "new2", DisplayName: "new", CreatedAt: now},
+	}
+	snap.Allowlist = []AllowlistBlock{
+		{IPBlock: "10.0.0.0/8", OrgID: "1234", CreatedAt: now},
+		{IPBlock: "10.0.0.0/8", OrgID: "2345", CreatedAt: now},
+	}
+
+	conflicts, err := suite.store.LoadSnapshot(ctx, snap, "snapshot")
+	suite.ErrorIs(err, ErrSnapshotConflict)
+	suite.Len(conflicts, 3)
+	suite.Equal(SnapshotConflict{Type: "registration", Index: 0, Key: "abc", Error: conflicts[0].Error}, conflicts[0])
+	suite.Equal(2, conflicts[1].Index)
+	suite.Equal(SnapshotConflict{Type: "allowlist", Index: 0, Key: "1234/10.0.0.0/8", Error: conflicts[2].Error}, conflicts[2])
+
+	// nothing was written
+	_, err = suite.store.FindByUID(ctx, "new")
+	suite.ErrorIs(err, ErrRegistrationNotFound)
+	_, count, err := suite.store.AllowedAddresses(ctx, "2345", AllowlistQuery{})
+	suite.Nil(err)
+	suite.Equal(0, count)
+}
+
+func (suite *StoreSuite) TestLoadSnapshotInvalid() {
+	_, err := suite.store.LoadSnapshot(context.Background(), &Snapshot{Version: 99}, "snapshot")
+	suite.ErrorIs(err, ErrInvalidSnapshot)
+
+	snap := newSnapshot()
+	snap.Registrations = []Registration{{OrgID: "1234", UID: "abc"}}
+	_, err = suite.store.LoadSnapshot(context.Background(), snap, "snapshot")
+	suite.ErrorIs(err, ErrInvalidSnapshot)
+
+	snap = newSnapshot()
+	snap.Allowlist = []AllowlistBlock{{IPBlock: "not-a-block", OrgID: "1234", CreatedAt: time.Now()}}
+	_, err = suite.store.LoadSnapshot(context.Background(), snap, "snapshot")
+	suite.ErrorIs(err, ErrInvalidSnapshot)
+	suite.ErrorIs(err, ErrInvalidIPBlock)
+}
+
+func (suite *StoreSuite) TestLoadSnapshotNormalizesBlocks() {
+	snap := newSnapshot()
+	snap.Allowlist = []AllowlistBlock{{IPBlock: "10.0.0.1/24", OrgID: "1234", CreatedAt: time.Now()}}
+	conflicts, err := suite.store.LoadSnapshot(context.Background(), snap, "snapshot")
+	suite.Nil(err)
+	suite.Empty(conflicts)
+
+	blocks, _, err := suite.store.AllowedAddresses(context.Background(), "1234", AllowlistQuery{})
+	suite.Nil(err)
+	suite.Len(blocks, 1)
+	suite.Equal("10.0.0.0/24", blocks[0].IPBlock)
+}
+
+func (suite *StoreSuite) TestOutboxRecordsChanges() {
+	ctx := context.Background()
+	_, err := suite.store.Create(ctx, &Registration{OrgID: "1234", UID: "abc", DisplayName: "one"})
+	suite.Nil(err)
+	_, err = suite.store.Import(ctx, []BulkRegistration{{OrgID: "1234", UID: "def", DisplayName: "two"}}, "admin")
+	suite.Nil(err)
+	suite.Nil(suite.store.Update(ctx, &Registration{OrgID: "1234", UID: "abc"}, &RegistrationUpdate{Extra: &map[string]interface{}{"a": "b"}}, "foo"))
+	suite.Nil(suite.store.Delete(ctx, "1234", "abc", "foo"))
+	_, err = suite.store.Restore(ctx, "1234", "abc", "foo", time.Hour)
+	suite.Nil(err)
+	suite.Nil(suite.store.AllowAddress(ctx, &AllowlistBlock{IPBlock: "10.0.0.0/8", OrgID: "1234"}))
+	suite.Nil(suite.store.DenyAddress(ctx, &AllowlistBlock{IPBlock: "10.0.0.0/8", OrgID: "1234"}))
+
+	// changes that fail don't leave an event behind
+	_, err = suite.store.Create(ctx, &Registration{OrgID: "1234", UID: "abc", DisplayName: "dupe"})
+	suite.Error(err)
+	suite.Error(suite.store.DenyAddress(ctx, &AllowlistBlock{IPBlock: "10.0.0.0/8", OrgID: "1234"}))
+
+	events, err := suite.store.ClaimOutbox(ctx, 100, time.Minute)
+	suite.Nil(err)
+	suite.Len(events, 6)
+
+	want := []struct {
+		t   OutboxEventType
+		key string
+	}{
+		{OutboxRegistrationCreated, "abc"},
+		{OutboxRegistrationCreated, "def"},
+		{OutboxRegistrationDeleted, "abc"},
+		{OutboxRegistrationRestored, "abc"},
+		{OutboxAllowlistAdded, "10.0.0.0/8"},
+		{OutboxAllowlistRemoved, "10.0.0.0/8"},
+	}
+	for i, e := range events {
+		suite.Equal(want[i].t, e.Type, i)
+		suite.Equal(want[i].key, e.Key, i)
+		suite.Equal("1234", e.OrgID)
+		suite.False(e.CreatedAt.IsZero())
+		if i > 0 {
+			suite.Greater(e.ID, events[i-1].ID)
+		}
+	}
+
+	var r Registration
+	suite.Nil(json.Unmarshal(events[3].Payload, &r))
+	suite.Equal("abc", r.UID)
+	suite.Equal("b", r.Extra["a"])
+	suite.Nil(r.DeletedAt)
+
+	var b AllowlistBlock
+	suite.Nil(json.Unmarshal(events[5].Payload, &b))
+	suite.Equal("10.0.0.0/8", b.IPBlock)
+	suite.False(b.CreatedAt.IsZero())
+}
+
+func (suite *StoreSuite) TestOutboxClaimAndRetry() {
+	ctx := context.Background()
+	for _, uid := range []string{"a", "b", "c"} {
+		_, err := suite.store.Create(ctx, &Registration{OrgID: "1234", UID: uid, DisplayName: uid})
+		suite.Nil(err)
+	}
+
+	first, err := suite.store.ClaimOutbox(ctx, 2, time.Hour)
+	suite.Nil(err)
+	suite.Len(first, 2)
+	suite.Equal("a", first[0].Key)
+	suite.Equal("b", first[1].Key)
+
+	// claimed events are held back for the lease
+	rest, err := suite.store.ClaimOutbox(ctx, 10, time.Hour)
+	suite.Nil(err)
+	suite.Len(rest, 1)
+	suite.Equal("c", rest[0].Key)
+
+	suite.Nil(suite.store.MarkOutboxDelivered(ctx, first[0].ID))
+	suite.Nil(suite.store.MarkOutboxFailed(ctx, first[1].ID, 0, "boom"))
+	suite.Nil(suite.store.MarkOutboxFailed(ctx, rest[0].ID, time.Hour, "later"))
+
+	retried, err := suite.store.ClaimOutbox(ctx, 10, 0)
+	suite.Nil(err)
+	suite.Len(retried, 1)
+	suite.Equal(first[1].ID, retried[0].ID)
+	suite.Equal(1, retried[0].Attempts)
+	suite.Equal("boom", retried[0].LastError)
+
+	// a lease of 0 makes it due again straight away, delivered ones never are
+	suite.Nil(suite.store.MarkOutboxDelivered(ctx, retried[0].ID))
+	none, err := suite.store.ClaimOutbox(ctx, 10, 0)
+	suite.Nil(err)
+	suite.Empty(none)
+}
+
+func (suite *StoreSuite) TestQuota() {
+	ctx := context.Background()
+
+	for _, uid := range []string{"a", "b"} {
+		_, err := suite.store.CreateWithinQuota(ctx, &Registration{OrgID: "1234", UID: uid, DisplayName: uid}, 2)
+		suite.Nil(err)
+	}
+	_, err := suite.store.CreateWithinQuota(ctx, &Registration{OrgID: "1234", UID: "c", DisplayName: "c"}, 2)
+	suite.ErrorIs(err, ErrQuotaExceeded{})
+	suite.Equal(ErrQuotaExceeded{Limit: 2}, err)
+
+	q, err := suite.store.Quota(ctx, "1234", 2)
+	suite.Nil(err)
+	suite.Equal(2, q.Used)
+	suite.Equal(2, *q.Limit)
+	suite.False(q.Override)
+
+	// deleted registrations and other orgs don't count
+	suite.Nil(suite.store.Delete(ctx, "1234", "b", "foo"))
+	_, err = suite.store.CreateWithinQuota(ctx, &Registration{OrgID: "1234", UID: "c", DisplayName: "c"}, 2)
+	suite.Nil(err)
+	_, err = suite.store.CreateWithinQuota(ctx, &Registration{OrgID: "2345", UID: "d", DisplayName: "d"}, 2)
+	suite.Nil(err)
+
+	// a default <= 0 is unlimited
+	q, err = suite.store.Quota(ctx, "1234", 0)
+	suite.Nil(err)
+	suite.Nil(q.Limit)
+	_, err = suite.store.CreateWithinQuota(ctx, &Registration{OrgID: "1234", UID: "e", DisplayName: "e"}, 0)
+	suite.Nil(err)
+}
+
+func (suite *StoreSuite) TestQuotaOverride() {
+	ctx := context.Background()
+	_, err := suite.store.Create(ctx, &Registration{OrgID: "1234", UID: "a", DisplayName: "a"})
+	suite.Nil(err)
+
+	three := 3
+	suite.Nil(suite.store.SetQuotaOverride(ctx, "1234", &three))
+	q, err := suite.store.Quota(ctx, "1234", 1)
+	suite.Nil(err)
+	suite.Equal(3, *q.Limit)
+	suite.Equal(1, q.Used)
+	suite.True(q.Override)
+	_, err = suite.store.CreateWithinQuota(ctx, &Registration{OrgID: "1234", UID: "b", DisplayName: "b"}, 1)
+	suite.Nil(err)
+
+	// setting it again replaces it, 0 allows nothing at all
+	zero := 0
+	suite.Nil(suite.store.SetQuotaOverride(ctx, "1234", &zero))
+	_, err = suite.store.CreateWithinQuota(ctx, &Registration{OrgID: "1234", UID: "c", DisplayName: "c"}, 100)
+	suite.Equal(ErrQuotaExceeded{Limit: 0}, err)
+
+	// removed, the org is back on the default
+	suite.Nil(suite.store.SetQuotaOverride(ctx, "1234", nil))
+	q, err = suite.store.Quota(ctx, "1234", 100)
+	suite.Nil(err)
+	suite.Equal(100, *q.Limit)
+	suite.False(q.Override)
+	suite.Nil(suite.store.SetQuotaOverride(ctx, "1234", nil))
+}
+
+func (suite *StoreSuite) TestConcurrentCreateWithinQuota() {
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		created int
+	)
+
+	for i := range 20 {
+		wg.Go(func() {
+			s := strconv.Itoa(i)
+			_, err := suite.store.CreateWithinQuota(context.Background(), &Registration{OrgID: "1234", UID: s, DisplayName: s}, 3)
+			if err == nil {
+				mu.Lock()
+				created++
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	suite.Equal(3, created)
+	q, err := suite.store.Quota(context.Background(), "1234", 3)
+	suite.Nil(err)
+	suite.Equal(3, q.Used)
+}
+
+func (suite *StoreSuite) TestEnrollmentCodes() {
+	ctx := context.Background()
+	c := &EnrollmentCode{OrgID: "1234", Username: "admin", ExpiresAt: time.Now().Add(time.Hour)}
+	suite.Nil(suite.store.CreateEnrollmentCode(ctx, c, "hash"))
+	suite.NotEmpty(c.ID)
+	suite.WithinDuration(time.Now(), c.CreatedAt, time.Minute)
+
+	expired := &EnrollmentCode{OrgID: "1234", Username: "admin", ExpiresAt: time.Now().Add(-time.Minute)}
+	suite.Nil(suite.store.CreateEnrollmentCode(ctx, expired, "expired"))
+	suite.Nil(suite.store.CreateEnrollmentCode(ctx, &EnrollmentCode{OrgID: "2345", Username: "other", ExpiresAt: time.Now().Add(time.Hour)}, "other"))
+
+	codes, err := suite.store.EnrollmentCodes(ctx, "1234")
+	suite.Nil(err)
+	suite.Len(codes, 2)
+	suite.Equal(expired.ID, codes[0].ID)
+
+	found, err := suite.store.FindEnrollmentCode(ctx, "hash")
+	suite.Nil(err)
+	suite.Equal(c.ID, found.ID)
+	suite.Equal("admin", found.Username)
+
+	_, err = suite.store.FindEnrollmentCode(ctx, "expired")
+	suite.ErrorIs(err, ErrEnrollmentCodeInvalid)
+	_, err = suite.store.FindEnrollmentCode(ctx, "nope")
+	suite.ErrorIs(err, ErrEnrollmentCodeInvalid)
+}
+
+func (suite *StoreSuite) TestEnroll() {
+	ctx := context.Background()
+	c := &EnrollmentCode{OrgID: "1234", Username: "admin", ExpiresAt: time.Now().Add(time.Hour)}
+	suite.Nil(suite.store.CreateEnrollmentCode(ctx, c, "hash"))
+
+	// a failed create doesn't use up the code
+	_, err := suite.store.Create(ctx, &Registration{OrgID: "1234", UID: "taken"})
+	suite.Nil(err)
+	_, err = suite.store.Enroll(ctx, &Registration{UID: "taken", DisplayName: "one"}, "hash", 0)
+	suite.ErrorIs(err, ErrRegistrationAlreadyExists{})
+
+	used, err := suite.store.Enroll(ctx, &Registration{OrgID: "ignored", Username: "ignored", UID: "abc", DisplayName: "one"}, "hash", 0)
+	suite.Nil(err)
+	suite.Equal(c.ID, used.ID)
+	suite.Equal("abc", used.UsedBy)
+	if suite.NotNil(used.UsedAt) {
+		suite.WithinDuration(time.Now(), *used.UsedAt, time.Minute)
+	}
+
+	found, err := suite.store.FindByUID(ctx, "abc")
+	suite.Nil(err)
+	suite.Equal("1234", found.OrgID)
+	suite.Equal("admin", found.Username)
+
+	_, err = suite.store.Enroll(ctx, &Registration{UID: "def", DisplayName: "two"}, "hash", 0)
+	suite.ErrorIs(err, ErrEnrollmentCodeInvalid)
+	_, err = suite.store.FindEnrollmentCode(ctx, "hash")
+	suite.ErrorIs(err, ErrEnrollmentCodeInvalid)
+
+	codes, err := suite.store.EnrollmentCodes(ctx, "1234")
+	suite.Nil(err)
+	suite.Equal("abc", codes[0].UsedBy)
+}
+
+func (suite *StoreSuite) TestEnrollWithinQuota() {
+	ctx := context.Background()
+	suite.Nil(suite.store.CreateEnrollmentCode(ctx, &EnrollmentCode{OrgID: "1234", Username: "admin", ExpiresAt: time.Now().Add(time.Hour)}, "hash"))
+	_, err := suite.store.Create(ctx, &Registration{OrgID: "1234", UID: "abc"})
+	suite.Nil(err)
+
+	_, err = suite.store.Enroll(ctx, &Registration{UID: "def", DisplayName: "two"}, "hash", 1)
+	suite.ErrorIs(err, ErrQuotaExceeded{})
+
+	// still good once there's room
+	_, err = suite.store.FindEnrollmentCode(ctx, "hash")
+	suite.Nil(err)
+}
+
+func (suite *StoreSuite) TestConcurrentEnroll() {
+	ctx := context.Background()
+	suite.Nil(suite.store.CreateEnrollmentCode(ctx, &EnrollmentCode{OrgID: "1234", Username: "admin", ExpiresAt: time.Now().Add(time.Hour)}, "hash"))
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		enrolled int
+	)
+
+	for i := range 10 {
+		wg.Go(func() {
+			s := strconv.Itoa(i)
+			_, err := suite.store.Enroll(ctx, &Registration{UID: s, DisplayName: s}, "hash", 0)
+			if err == nil {
+				mu.Lock()
+				enrolled++
+				mu.Unlock()
+			}
+		})
+	}
+	wg.Wait()
+
+	suite.Equal(1, enrolled)
+}
+
+func (suite *StoreSuite) TestReview() {
+	ctx := context.Background()
+	_, err := suite.store.Create(ctx, &Registration{OrgID: "1234", UID: "abc", DisplayName: "one", Username: "alice", Status: RegistrationPending})
+	suite.Nil(err)
+	_, err = suite.store.Create(ctx, &Registration{OrgID: "1234", UID: "def", DisplayName: "two", Username: "alice", Status: RegistrationPending})
+	suite.Nil(err)
+	_, err = suite.store.Create(ctx, &Registration{OrgID: "1234", UID: "ghi", DisplayName: "three"})
+	suite.Nil(err)
+
+	found, err := suite.store.FindByUID(ctx, "ghi")
+	suite.Nil(err)
+	suite.Equal(RegistrationActive, found.Status)
+
+	pending, count, err := suite.store.All(ctx, "1234", RegistrationQuery{Limit: 10, Status: RegistrationPending})
+	suite.Nil(err)
+	suite.Equal(2, count)
+	suite.Equal(RegistrationPending, pending[0].Status)
+
+	approved, err := suite.store.Review(ctx, "1234", "abc", RegistrationActive, "bob")
+	suite.Nil(err)
+	suite.Equal(RegistrationActive, approved.Status)
+	suite.Equal("bob", approved.ReviewedBy)
+	suite.NotNil(approved.ReviewedAt)
+
+	rejected, err := suite.store.Review(ctx, "1234", "def", RegistrationRejected, "bob")
+	suite.Nil(err)
+	suite.Equal(RegistrationRejected, rejected.Status)
+
+	found, err = suite.store.FindByUID(ctx, "abc")
+	suite.Nil(err)
+	suite.Equal(RegistrationActive, found.Status)
+	suite.Equal("bob", found.ReviewedBy)
+
+	// only pending ones can be reviewed
+	_, err = suite.store.Review(ctx, "1234", "abc", RegistrationRejected, "bob")
+	suite.ErrorIs(err, ErrRegistrationNotPending)
+	_, err = suite.store.Review(ctx, "1234", "ghi", RegistrationActive, "bob")
+	suite.ErrorIs(err, ErrRegistrationNotPending)
+	_, err = suite.store.Review(ctx, "2345", "abc", RegistrationActive, "bob")
+	suite.ErrorIs(err, ErrRegistrationNotFound)
+
+	history, err := suite.store.History(ctx, "1234", "abc")
+	suite.Nil(err)
+	suite.Len(history, 2)
+	suite.Equal(RegistrationEventApprove, history[1].Type)
+	suite.Equal("bob", history[1].Actor)
+	suite.Equal(RegistrationPending, history[1].Before.Status)
+	suite.Equal(RegistrationActive, history[1].After.Status)
+
+	events, err := suite.store.ClaimOutbox(ctx, 100, time.Minute)
+	suite.Nil(err)
+	suite.Len(events, 5)
+	suite.Equal(OutboxRegistrationApproved, events[3].Type)
+	suite.Equal(OutboxRegistrationRejected, events[4].Type)
+	suite.Equal("def", events[4].Key)
+}
+
+func (suite *StoreSuite) TestReviewSnapshot() {
+	ctx := context.Background()
+	_, err := suite.store.Create(ctx, &Registration{OrgID: "1234", UID: "abc", DisplayName: "one", Status: RegistrationPending})
+	suite.Nil(err)
+	_, err = suite.store.Create(ctx, &Registration{OrgID: "1234", UID: "def", DisplayName: "two", Status: RegistrationPending})
+	suite.Nil(err)
+	_, err = suite.store.Review(ctx, "1234", "def", RegistrationActive, "bob")
+	suite.Nil(err)
+
+	snap, err := suite.store.DumpSnapshot(ctx)
+	suite.Nil(err)
+
+	target := &inMemoryStore{}
+	_, err = target.LoadSnapshot(ctx, snap, "snapshot")
+	suite.Nil(err)
+
+	pending, err := target.FindByUID(ctx, "abc")
+	suite.Nil(err)
+	suite.Equal(RegistrationPending, pending.Status)
+
+	approved, err := target.FindByUID(ctx, "def")
+	suite.Nil(err)
+	suite.Equal(RegistrationActive, approved.Status)
+	suite.Equal("bob", approved.ReviewedBy)
+	suite.NotNil(approved.ReviewedAt)
+}
+
+func (suite *StoreSuite) TestOrgSettings() {
+	ctx := context.Background()
+
+	settings, err := suite.store.OrgSettings(ctx, "1234")
+	suite.Nil(err)
+	suite.Equal(&OrgSettings{OrgID: "1234"}, settings)
+
+	suite.Nil(suite.store.SetOrgSettings(ctx, &OrgSettings{OrgID: "1234", RequireApproval: true}))
+	settings, err = suite.store.OrgSettings(ctx, "1234")
+	suite.Nil(err)
+	suite.True(settings.RequireApproval)
+
+	// other orgs are left alone
+	settings, err = suite.store.OrgSettings(ctx, "2345")
+	suite.Nil(err)
+	suite.False(settings.RequireApproval)
+
+	suite.Nil(suite.store.SetOrgSettings(ctx, &OrgSettings{OrgID: "1234"}))
+	settings, err = suite.store.OrgSettings(ctx, "1234")
+	suite.Nil(err)
+	suite.False(settings.RequireApproval)
+}
@@ -0,0 +1,92 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+/*
+Cursor is a keyset position in a listing ordered by created_at with a unique
+key breaking ties, the registration ID or the allowlist ip_block.
+
+Backward cursors select the page that comes before the position instead of
+after it, the page itself is still returned in the listing's order.
+*/
+type Cursor struct {
+	CreatedAt time.Time `json:"created_at"`
+	Key       string    `json:"key"`
+	Backward  bool      `json:"backward,omitempty"`
+}
+
+// Encode returns the opaque form of the cursor handed out to clients
+func (c *Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor parses a cursor previously returned by Encode
+func DecodeCursor(s string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c Cursor
+	if err := json.Unmarshal(b, &c); err != nil || c.Key == "" || c.CreatedAt.IsZero() {
+		return nil, ErrInvalidCursor
+	}
+
+	return &c, nil
+}
+
+// after reports whether a row at (createdAt, key) comes strictly after the
+// cursor position in a listing sorted in the given direction, it mirrors the
+// row comparison used in sql.
+func (c *Cursor) after(createdAt time.Time, key string, desc bool) bool {
+	cmp := createdAt.Compare(c.CreatedAt)
+	if cmp == 0 {
+		switch {
+		case key > c.Key:
+			cmp = 1
+		case key < c.Key:
+			cmp = -1
+		}
+	}
+
+	if desc {
+		return cmp < 0
+	}
+	return cmp > 0
+}
+
+// keysetPage selects the page of an already sorted listing relative to a
+// cursor, the same way the sql backends do with a row comparison and limit.
+func keysetPage[T any](items []T, c *Cursor, limit int, desc bool, key func(*T) (time.Time, string)) []T {
+	if !c.Backward {
+		start := len(items)
+		for i := range items {
+			if createdAt, k := key(&items[i]); c.after(createdAt, k, desc) {
+				start = i
+				break
+			}
+		}
+		return paginate(items[start:], limit, 0)
+	}
+
+	// rows before the position in the listing's order are the ones after it
+	// in the reverse order, and they're always a prefix of the listing
+	end := 0
+	for i := range items {
+		if createdAt, k := key(&items[i]); !c.after(createdAt, k, !desc) {
+			break
+		}
+		end = i + 1
+	}
+
+	start := max(end-limit, 0)
+	return items[start:end]
+}
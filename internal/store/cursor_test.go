@@ -0,0 +1,25 @@
+package store
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	c := &Cursor{CreatedAt: time.Date(2024, 5, 1, 12, 0, 0, 123456000, time.UTC), Key: "10.0.0.0/24", Backward: true}
+
+	decoded, err := DecodeCursor(c.Encode())
+	assert.Nil(t, err)
+	assert.True(t, c.CreatedAt.Equal(decoded.CreatedAt))
+	assert.Equal(t, c.Key, decoded.Key)
+	assert.True(t, decoded.Backward)
+}
+
+func TestDecodeBadCursor(t *testing.T) {
+	for _, raw := range []string{"not base64!", "e30", "bm90IGpzb24"} {
+		_, err := DecodeCursor(raw)
+		assert.ErrorIs(t, err, ErrInvalidCursor, raw)
+	}
+}
@@ -2,12 +2,23 @@ package store
 
 import (
 	"errors"
+	"fmt"
 	"reflect"
 )
 
 var (
 	ErrRegistrationNotFound  = errors.New("registration not found")
 	ErrAddressNotAllowListed = errors.New("ip not registered in allowlist")
+	// returned when the ip block is already in the org's allowlist
+	ErrAddressAlreadyAllowListed = errors.New("ip already registered in allowlist")
+	// returned when adding an ip block that isn't an address or CIDR block
+	ErrInvalidIPBlock = errors.New("invalid ip block")
+	// returned for an enrollment code that doesn't exist, has expired or has
+	// already been used, on purpose without saying which
+	ErrEnrollmentCodeInvalid = errors.New("enrollment code is invalid, expired or already used")
+	// returned when approving or rejecting a registration that has already
+	// been reviewed (or never needed to be)
+	ErrRegistrationNotPending = errors.New("registration is not pending approval")
 )
 
 // error type containing information on why a registration already exists
@@ -25,3 +36,17 @@ func (e ErrRegistrationAlreadyExists) Error() string {
 func (e ErrRegistrationAlreadyExists) Is(err error) bool {
 	return reflect.TypeOf(err) == reflect.TypeOf(e)
 }
+
+// error returned when an org already has as many registrations as its quota
+// allows
+type ErrQuotaExceeded struct {
+	Limit int
+}
+
+func (e ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("registration quota of %d reached", e.Limit)
+}
+
+func (e ErrQuotaExceeded) Is(err error) bool {
+	return reflect.TypeOf(err) == reflect.TypeOf(e)
+}
@@ -1,75 +1,370 @@
 package store
 
 import (
-	"net"
+	"context"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/google/uuid"
 )
 
+// inMemoryStore keeps everything in slices behind a single lock, it's meant to
+// behave exactly like postgresStore (uniqueness, ordering, pagination) minus
+// the persistence. Everything handed out is a copy so callers can't change
+// stored records without going through the store.
 type inMemoryStore struct {
+	mu               sync.RWMutex
 	db               []Registration
+	events           []RegistrationEvent
 	allowedAddresses []AllowlistBlock
+	outbox           []outboxRow
+	quotas           map[string]int
+	codes            []enrollmentRow
+	settings         map[string]OrgSettings
+}
+
+// enrollmentRow is an EnrollmentCode along with the hash it's looked up by
+type enrollmentRow struct {
+	EnrollmentCode
+	codeHash string
+}
+
+// outboxRow is an OutboxEvent along with the columns only the store uses
+type outboxRow struct {
+	OutboxEvent
+	nextAttemptAt time.Time
+	deliveredAt   *time.Time
 }
 
-func (m *inMemoryStore) All(orgID string, _, _ int) ([]Registration, int, error) {
+func (m *inMemoryStore) All(_ context.Context, orgID string, q RegistrationQuery) ([]Registration, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	out := make([]Registration, 0)
 	for i := range m.db {
-		if m.db[i].OrgID == orgID {
-			out = append(out, m.db[i])
+		if m.db[i].OrgID == orgID && m.db[i].DeletedAt == nil && matchesQuery(&m.db[i], &q) {
+			out = append(out, *copyRegistration(&m.db[i]))
+		}
+	}
+
+	by, desc := q.order()
+	sortRegistrations(out, by, desc)
+
+	if q.Cursor != nil {
+		return keysetPage(out, q.Cursor, q.Limit, desc, registrationKey), len(out), nil
+	}
+	return paginate(out, q.Limit, q.Offset), len(out), nil
+}
+
+func registrationKey(r *Registration) (time.Time, string) {
+	return r.CreatedAt, r.ID
+}
+
+// matchesQuery mirrors the where clause built by registrationFilter
+func matchesQuery(r *Registration, q *RegistrationQuery) bool {
+	if q.Search != "" {
+		search := strings.ToLower(q.Search)
+		if !strings.Contains(strings.ToLower(r.DisplayName), search) && !strings.Contains(strings.ToLower(r.UID), search) {
+			return false
+		}
+	}
+	if q.Username != "" && r.Username != q.Username {
+		return false
+	}
+	if q.CreatedAfter != nil && !r.CreatedAt.After(*q.CreatedAfter) {
+		return false
+	}
+	if q.CreatedBefore != nil && !r.CreatedAt.Before(*q.CreatedBefore) {
+		return false
+	}
+	if q.NotSeenSince != nil && r.LastSeenAt != nil && !r.LastSeenAt.Before(*q.NotSeenSince) {
+		return false
+	}
+	if q.Status != "" && r.Status != q.Status {
+		return false
+	}
+	for k, v := range q.Extra {
+		// only string values match, the same as containment in postgres
+		if s, ok := r.Extra[k].(string); !ok || s != v {
+			return false
+		}
+	}
+	return true
+}
+
+// sortRegistrations mirrors the order by clause built by registrationOrder,
+// strings compare bytewise the same as the "C" collation.
+func sortRegistrations(regs []Registration, by RegistrationSortField, desc bool) {
+	sort.SliceStable(regs, func(i, j int) bool {
+		a, b := &regs[i], &regs[j]
+
+		var c int
+		switch by {
+		case SortByDisplayName:
+			c = strings.Compare(a.DisplayName, b.DisplayName)
+		case SortByUID:
+			c = strings.Compare(a.UID, b.UID)
+		default:
+			c = a.CreatedAt.Compare(b.CreatedAt)
+		}
+		if c == 0 {
+			c = strings.Compare(a.ID, b.ID)
+		}
+
+		if desc {
+			return c > 0
 		}
+		return c < 0
+	})
+}
+
+// paginate applies limit/offset the same way sql does
+func paginate[T any](items []T, limit, offset int) []T {
+	if offset >= len(items) {
+		return items[:0]
+	}
+	items = items[offset:]
+	if limit < len(items) {
+		items = items[:limit]
 	}
-	return out, len(out), nil
+	return items
 }
 
-func (m *inMemoryStore) Find(orgID string, uid string) (*Registration, error) {
-	for _, r := range m.db {
-		if r.OrgID == orgID && r.UID == uid {
-			return &r, nil
+func (m *inMemoryStore) Find(_ context.Context, orgID string, uid string) (*Registration, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for i := range m.db {
+		if m.db[i].OrgID == orgID && m.db[i].UID == uid && m.db[i].DeletedAt == nil {
+			return copyRegistration(&m.db[i]), nil
 		}
 	}
 
 	return nil, ErrRegistrationNotFound
 }
 
-func (m *inMemoryStore) FindByUID(uid string) (*Registration, error) {
-	for _, r := range m.db {
-		if r.UID == uid {
-			return &r, nil
+func (m *inMemoryStore) FindByUID(_ context.Context, uid string) (*Registration, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for i := range m.db {
+		if m.db[i].UID == uid && m.db[i].DeletedAt == nil {
+			return copyRegistration(&m.db[i]), nil
 		}
 	}
 
 	return nil, ErrRegistrationNotFound
 }
 
-func (m *inMemoryStore) Create(r *Registration) (string, error) {
+// conflict mirrors the partial unique indexes on registrations: uid is unique
+// across every org and display_name within an org, among live registrations
+// only. skip is an index into db to ignore, -1 for none.
+func (m *inMemoryStore) conflict(orgID, uid, displayName string, skip int) error {
 	for i := range m.db {
-		if m.db[i].UID == r.UID {
-			return "", ErrRegistrationAlreadyExists{Detail: "uid already exists"}
+		if i == skip || m.db[i].DeletedAt != nil {
+			continue
+		}
+		if uid != "" && m.db[i].UID == uid {
+			return ErrRegistrationAlreadyExists{Detail: "uid already exists"}
 		}
-		if m.db[i].DisplayName == r.DisplayName {
-			return "", ErrRegistrationAlreadyExists{Detail: "display_name already exists"}
+		if m.db[i].OrgID == orgID && m.db[i].DisplayName == displayName {
+			return ErrRegistrationAlreadyExists{Detail: "display_name already exists"}
 		}
 	}
+	return nil
+}
 
+// insert stores a copy of the registration, filling in the columns postgres
+// would default
+func (m *inMemoryStore) insert(r *Registration, actor string) error {
+	r.ID = uuid.NewString()
 	r.CreatedAt = time.Now()
-	m.db = append(m.db, *r)
-	return "", nil
-}
+	r.Status = r.status()
 
-func (m *inMemoryStore) Update(r *Registration, update *RegistrationUpdate) error {
-	r, err := m.Find(r.OrgID, r.UID)
+	e, err := newOutboxEvent(OutboxRegistrationCreated, r.OrgID, r.UID, r)
 	if err != nil {
 		return err
 	}
 
-	r.Extra = *update.Extra
+	m.db = append(m.db, *copyRegistration(r))
+	m.recordEvent(RegistrationEventCreate, actor, nil, r)
+	m.recordOutbox(e)
+	return nil
+}
+
+func (m *inMemoryStore) Create(_ context.Context, r *Registration) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.conflict(r.OrgID, r.UID, r.DisplayName, -1); err != nil {
+		return "", err
+	}
+
+	if err := m.insert(r, r.Username); err != nil {
+		return "", err
+	}
+	return r.ID, nil
+}
+
+func (m *inMemoryStore) CreateWithinQuota(_ context.Context, r *Registration, defaultLimit int) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.insertWithinQuota(r, defaultLimit); err != nil {
+		return "", err
+	}
+	return r.ID, nil
+}
+
+// insertWithinQuota needs the write lock, which is held from counting to
+// inserting
+func (m *inMemoryStore) insertWithinQuota(r *Registration, defaultLimit int) error {
+	if q := m.quota(r.OrgID, defaultLimit); q.Reached() {
+		return ErrQuotaExceeded{Limit: *q.Limit}
+	}
+
+	if err := m.conflict(r.OrgID, r.UID, r.DisplayName, -1); err != nil {
+		return err
+	}
+
+	return m.insert(r, r.Username)
+}
 
+func (m *inMemoryStore) Quota(_ context.Context, orgID string, defaultLimit int) (*Quota, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.quota(orgID, defaultLimit), nil
+}
+
+func (m *inMemoryStore) quota(orgID string, defaultLimit int) *Quota {
+	used := 0
+	for i := range m.db {
+		if m.db[i].OrgID == orgID && m.db[i].DeletedAt == nil {
+			used++
+		}
+	}
+
+	var override *int
+	if limit, ok := m.quotas[orgID]; ok {
+		override = &limit
+	}
+
+	return newQuota(orgID, used, override, defaultLimit)
+}
+
+func (m *inMemoryStore) SetQuotaOverride(_ context.Context, orgID string, limit *int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if limit == nil {
+		delete(m.quotas, orgID)
+		return nil
+	}
+
+	if m.quotas == nil {
+		m.quotas = make(map[string]int)
+	}
+	m.quotas[orgID] = *limit
 	return nil
 }
 
-func (m *inMemoryStore) Delete(orgID string, uid string) error {
+func (m *inMemoryStore) Import(_ context.Context, rows []BulkRegistration, actor string) ([]ImportResult, error) {
+	results, ok := ValidateBulkRegistrations(rows)
+	if !ok {
+		return results, ErrImportFailed
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range rows {
+		if err := m.conflict(rows[i].OrgID, rows[i].UID, rows[i].DisplayName, -1); err != nil {
+			results[i].Error = err.Error()
+			ok = false
+		}
+	}
+	if !ok {
+		return results, ErrImportFailed
+	}
+
+	db, events, outbox := m.db, m.events, m.outbox
+	for i := range rows {
+		if err := m.insert(rows[i].registration(), actor); err != nil {
+			m.db, m.events, m.outbox = db, events, outbox
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+func (m *inMemoryStore) Update(_ context.Context, r *Registration, update *RegistrationUpdate, actor string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	idx := -1
 	for i := range m.db {
-		if m.db[i].OrgID == orgID || m.db[i].UID == uid {
-			m.db = append(m.db[:i], m.db[i+1:]...)
+		if m.db[i].OrgID == r.OrgID && m.db[i].UID == r.UID && m.db[i].DeletedAt == nil {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		return ErrRegistrationNotFound
+	}
+
+	// updating the stored record in place, not a copy of it
+	existing := &m.db[idx]
+	before := copyRegistration(existing)
+
+	if update.DisplayName != nil {
+		if err := m.conflict(existing.OrgID, "", *update.DisplayName, idx); err != nil {
+			return err
+		}
+		existing.DisplayName = *update.DisplayName
+	}
+
+	if update.Extra != nil {
+		if existing.Extra == nil {
+			existing.Extra = make(map[string]interface{}, len(*update.Extra))
+		}
+		for k, v := range *update.Extra {
+			existing.Extra[k] = v
+		}
+	}
+
+	if update.Certificate != nil {
+		c := *update.Certificate
+		existing.Certificate = &c
+	}
+
+	m.recordEvent(RegistrationEventUpdate, actor, before, existing)
+	return nil
+}
+
+func (m *inMemoryStore) Delete(_ context.Context, orgID, uid, actor string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.db {
+		if m.db[i].DeletedAt != nil {
+			continue
+		}
+		if m.db[i].OrgID == orgID && m.db[i].UID == uid {
+			before := copyRegistration(&m.db[i])
+			e, err := newOutboxEvent(OutboxRegistrationDeleted, orgID, uid, before)
+			if err != nil {
+				return err
+			}
+
+			now := time.Now()
+			m.db[i].DeletedAt = &now
+			m.recordEvent(RegistrationEventDelete, actor, before, nil)
+			m.recordOutbox(e)
 			return nil
 		}
 	}
@@ -77,29 +372,560 @@ func (m *inMemoryStore) Delete(orgID string, uid string) error {
 	return ErrRegistrationNotFound
 }
 
-func (m *inMemoryStore) AllowedAddresses(_ string) ([]AllowlistBlock, error) {
-	return m.allowedAddresses, nil
+func (m *inMemoryStore) Restore(_ context.Context, orgID, uid, actor string, retention time.Duration) (*Registration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := time.Now().Add(-retention)
+
+	// the most recently deleted one wins if it was deleted more than once
+	idx := -1
+	for i := range m.db {
+		d := m.db[i].DeletedAt
+		if m.db[i].OrgID != orgID || m.db[i].UID != uid || d == nil || d.Before(cutoff) {
+			continue
+		}
+		if idx == -1 || d.After(*m.db[idx].DeletedAt) {
+			idx = i
+		}
+	}
+	if idx == -1 {
+		return nil, ErrRegistrationNotFound
+	}
+
+	if err := m.conflict(orgID, uid, m.db[idx].DisplayName, idx); err != nil {
+		return nil, err
+	}
+
+	before := copyRegistration(&m.db[idx])
+	after := copyRegistration(before)
+	after.DeletedAt = nil
+	e, err := newOutboxEvent(OutboxRegistrationRestored, orgID, uid, after)
+	if err != nil {
+		return nil, err
+	}
+
+	m.db[idx].DeletedAt = nil
+	m.recordEvent(RegistrationEventRestore, actor, before, &m.db[idx])
+	m.recordOutbox(e)
+
+	return copyRegistration(&m.db[idx]), nil
+}
+
+func (m *inMemoryStore) Review(_ context.Context, orgID, uid string, status RegistrationStatus, actor string) (*Registration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.db {
+		if m.db[i].DeletedAt != nil || m.db[i].OrgID != orgID || m.db[i].UID != uid {
+			continue
+		}
+		if m.db[i].Status != RegistrationPending {
+			return nil, ErrRegistrationNotPending
+		}
+
+		before := copyRegistration(&m.db[i])
+		after := copyRegistration(before)
+		now := time.Now()
+		after.Status, after.ReviewedBy, after.ReviewedAt = status, actor, &now
+
+		eventType, outboxType := reviewEventTypes(status)
+		e, err := newOutboxEvent(outboxType, orgID, uid, after)
+		if err != nil {
+			return nil, err
+		}
+
+		m.db[i] = *after
+		m.recordEvent(eventType, actor, before, after)
+		m.recordOutbox(e)
+		return copyRegistration(after), nil
+	}
+
+	return nil, ErrRegistrationNotFound
+}
+
+func (m *inMemoryStore) Purge(_ context.Context, retention time.Duration) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cutoff := time.Now().Add(-retention)
+
+	kept := make([]Registration, 0, len(m.db))
+	for i := range m.db {
+		if m.db[i].DeletedAt == nil || m.db[i].DeletedAt.After(cutoff) {
+			kept = append(kept, m.db[i])
+		}
+	}
+
+	purged := len(m.db) - len(kept)
+	m.db = kept
+	return purged, nil
+}
+
+func (m *inMemoryStore) UpdateLastSeen(_ context.Context, seen map[string]time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.db {
+		if m.db[i].DeletedAt != nil {
+			continue
+		}
+		t, ok := seen[m.db[i].UID]
+		if !ok {
+			continue
+		}
+		if m.db[i].LastSeenAt == nil || t.After(*m.db[i].LastSeenAt) {
+			m.db[i].LastSeenAt = &t
+		}
+	}
+	return nil
+}
+
+func (m *inMemoryStore) History(_ context.Context, orgID, uid string) ([]RegistrationEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out := make([]RegistrationEvent, 0)
+	for i := range m.events {
+		if m.events[i].OrgID == orgID && m.events[i].UID == uid {
+			e := m.events[i]
+			e.Before, e.After = copyRegistration(e.Before), copyRegistration(e.After)
+			out = append(out, e)
+		}
+	}
+	return out, nil
+}
+
+func (m *inMemoryStore) recordEvent(t RegistrationEventType, actor string, before, after *Registration) {
+	e := RegistrationEvent{
+		ID:        uuid.NewString(),
+		Type:      t,
+		Actor:     actor,
+		Before:    copyRegistration(before),
+		After:     copyRegistration(after),
+		CreatedAt: time.Now(),
+	}
+
+	// one of before/after is always set, whichever it is has the identifiers
+	if before != nil {
+		e.OrgID, e.UID = before.OrgID, before.UID
+	} else {
+		e.OrgID, e.UID = after.OrgID, after.UID
+	}
+
+	m.events = append(m.events, e)
+}
+
+// copyRegistration returns a copy that doesn't share the Extra map with the
+// original, so snapshots aren't changed by later updates.
+func copyRegistration(r *Registration) *Registration {
+	if r == nil {
+		return nil
+	}
+
+	c := *r
+	if r.DeletedAt != nil {
+		d := *r.DeletedAt
+		c.DeletedAt = &d
+	}
+	if r.LastSeenAt != nil {
+		t := *r.LastSeenAt
+		c.LastSeenAt = &t
+	}
+	if r.ReviewedAt != nil {
+		t := *r.ReviewedAt
+		c.ReviewedAt = &t
+	}
+	if r.Certificate != nil {
+		cert := *r.Certificate
+		c.Certificate = &cert
+	}
+	if r.Extra != nil {
+		c.Extra = make(map[string]interface{}, len(r.Extra))
+		for k, v := range r.Extra {
+			c.Extra[k] = v
+		}
+	}
+	return &c
+}
+
+func (m *inMemoryStore) AllowedAddresses(_ context.Context, orgID string, q AllowlistQuery) ([]AllowlistBlock, int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out := make([]AllowlistBlock, 0)
+	for i := range m.allowedAddresses {
+		if m.allowedAddresses[i].OrgID == orgID {
+			out = append(out, m.allowedAddresses[i])
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if c := out[i].CreatedAt.Compare(out[j].CreatedAt); c != 0 {
+			return c < 0
+		}
+		return out[i].IPBlock < out[j].IPBlock
+	})
+
+	limit := q.Limit
+	if limit == 0 {
+		limit = len(out)
+	}
+
+	if q.Cursor != nil {
+		return keysetPage(out, q.Cursor, limit, false, allowlistKey), len(out), nil
+	}
+	return paginate(out, limit, q.Offset), len(out), nil
+}
+
+func allowlistKey(b *AllowlistBlock) (time.Time, string) {
+	return b.CreatedAt, b.IPBlock
 }
-func (m *inMemoryStore) AllowedIP(ip, _ string) (bool, error) {
+
+func (m *inMemoryStore) AllowedIP(_ context.Context, ip, orgID string) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	now := time.Now()
+	var blocks []string
 	for _, addr := range m.allowedAddresses {
-		_, ipnet, _ := net.ParseCIDR(addr.IPBlock)
-		if ipnet.Contains(net.ParseIP(ip)) {
-			return true, nil
+		// the `system` org_id applies to every org, same as in postgres
+		if (addr.OrgID == orgID || addr.OrgID == "system") && !addr.Expired(now) {
+			blocks = append(blocks, addr.IPBlock)
 		}
 	}
-	return false, nil
+	return blocksContain(blocks, ip)
 }
-func (m *inMemoryStore) AllowAddress(ip *AllowlistBlock) error {
-	m.allowedAddresses = append(m.allowedAddresses, *ip)
+
+func (m *inMemoryStore) AllowAddress(_ context.Context, ip *AllowlistBlock) error {
+	if err := normalizeAllowlistBlock(ip); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := range m.allowedAddresses {
+		if m.allowedAddresses[i].OrgID == ip.OrgID && m.allowedAddresses[i].IPBlock == ip.IPBlock {
+			return ErrAddressAlreadyAllowListed
+		}
+	}
+
+	block := *ip
+	block.CreatedAt = time.Now()
+	if ip.ExpiresAt != nil {
+		t := *ip.ExpiresAt
+		block.ExpiresAt = &t
+	}
+	e, err := newOutboxEvent(OutboxAllowlistAdded, block.OrgID, block.IPBlock, &block)
+	if err != nil {
+		return err
+	}
+
+	ip.CreatedAt = block.CreatedAt
+	m.allowedAddresses = append(m.allowedAddresses, block)
+	m.recordOutbox(e)
 	return nil
 }
-func (m *inMemoryStore) DenyAddress(ip *AllowlistBlock) error {
+
+func (m *inMemoryStore) DenyAddress(_ context.Context, ip *AllowlistBlock) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
 	for i := range m.allowedAddresses {
 		if m.allowedAddresses[i].OrgID == ip.OrgID && m.allowedAddresses[i].IPBlock == ip.IPBlock {
+			e, err := newOutboxEvent(OutboxAllowlistRemoved, ip.OrgID, ip.IPBlock, &m.allowedAddresses[i])
+			if err != nil {
+				return err
+			}
+
 			m.allowedAddresses = append(m.allowedAddresses[:i], m.allowedAddresses[i+1:]...)
+			m.recordOutbox(e)
 			return nil
 		}
 	}
 
 	return ErrAddressNotAllowListed
 }
+
+func (m *inMemoryStore) PurgeExpiredAddresses(_ context.Context) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	kept := make([]AllowlistBlock, 0, len(m.allowedAddresses))
+	events := make([]*OutboxEvent, 0)
+	for i := range m.allowedAddresses {
+		b := &m.allowedAddresses[i]
+		if !b.Expired(now) {
+			kept = append(kept, *b)
+			continue
+		}
+
+		e, err := newOutboxEvent(OutboxAllowlistRemoved, b.OrgID, b.IPBlock, b)
+		if err != nil {
+			return 0, err
+		}
+		events = append(events, e)
+	}
+
+	m.allowedAddresses = kept
+	for _, e := range events {
+		m.recordOutbox(e)
+	}
+	return len(events), nil
+}
+
+func (m *inMemoryStore) DumpSnapshot(_ context.Context) (*Snapshot, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	snap := newSnapshot()
+	for i := range m.db {
+		if m.db[i].DeletedAt == nil {
+			snap.Registrations = append(snap.Registrations, *copyRegistration(&m.db[i]))
+		}
+	}
+	snap.Allowlist = append(snap.Allowlist, m.allowedAddresses...)
+
+	sortSnapshot(snap)
+	return snap, nil
+}
+
+func (m *inMemoryStore) LoadSnapshot(_ context.Context, snap *Snapshot, actor string) ([]SnapshotConflict, error) {
+	if err := snap.validate(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// rows are added one at a time so they're checked against each other as
+	// well, on any conflict everything goes back to how it was
+	db, events, addresses := m.db, m.events, m.allowedAddresses
+	m.db = append(make([]Registration, 0, len(db)+len(snap.Registrations)), db...)
+	m.allowedAddresses = append(make([]AllowlistBlock, 0, len(addresses)+len(snap.Allowlist)), addresses...)
+
+	conflicts := make([]SnapshotConflict, 0)
+	for i := range snap.Registrations {
+		r := copyRegistration(&snap.Registrations[i])
+		r.Status = r.status()
+
+		err := m.conflict(r.OrgID, r.UID, r.DisplayName, -1)
+		if err == nil && m.indexOfID(r.ID) != -1 {
+			err = ErrRegistrationAlreadyExists{Detail: "id already exists"}
+		}
+		if err != nil {
+			conflicts = append(conflicts, SnapshotConflict{Type: snapshotRegistration, Index: i, Key: r.UID, Error: err.Error()})
+			continue
+		}
+
+		m.db = append(m.db, *r)
+		m.recordEvent(RegistrationEventCreate, actor, nil, r)
+	}
+
+	for i := range snap.Allowlist {
+		b := snap.Allowlist[i]
+		if m.indexOfAddress(b.OrgID, b.IPBlock) != -1 {
+			conflicts = append(conflicts, SnapshotConflict{Type: snapshotAllowlist, Index: i, Key: b.OrgID + "/" + b.IPBlock, Error: ErrAddressAlreadyAllowListed.Error()})
+			continue
+		}
+		m.allowedAddresses = append(m.allowedAddresses, b)
+	}
+
+	if len(conflicts) > 0 {
+		m.db, m.events, m.allowedAddresses = db, events, addresses
+		return conflicts, ErrSnapshotConflict
+	}
+
+	return conflicts, nil
+}
+
+// indexOfID returns the index of the registration with this ID, deleted or
+// not, or -1
+func (m *inMemoryStore) indexOfID(id string) int {
+	for i := range m.db {
+		if m.db[i].ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *inMemoryStore) indexOfAddress(orgID, ipBlock string) int {
+	for i := range m.allowedAddresses {
+		if m.allowedAddresses[i].OrgID == orgID && m.allowedAddresses[i].IPBlock == ipBlock {
+			return i
+		}
+	}
+	return -1
+}
+
+// recordOutbox queues an event, the caller holds the write lock
+func (m *inMemoryStore) recordOutbox(e *OutboxEvent) {
+	now := time.Now()
+	e.ID = int64(len(m.outbox)) + 1
+	e.CreatedAt = now
+	m.outbox = append(m.outbox, outboxRow{OutboxEvent: *e, nextAttemptAt: now})
+}
+
+func (m *inMemoryStore) ClaimOutbox(_ context.Context, limit int, lease time.Duration) ([]OutboxEvent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	due := make([]*outboxRow, 0)
+	for i := range m.outbox {
+		if m.outbox[i].deliveredAt == nil && !m.outbox[i].nextAttemptAt.After(now) {
+			due = append(due, &m.outbox[i])
+		}
+	}
+
+	// same order as the sql stores: the longest due first
+	sort.SliceStable(due, func(i, j int) bool {
+		if c := due[i].nextAttemptAt.Compare(due[j].nextAttemptAt); c != 0 {
+			return c < 0
+		}
+		return due[i].ID < due[j].ID
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	out := make([]OutboxEvent, 0, len(due))
+	for _, row := range due {
+		row.nextAttemptAt = now.Add(lease)
+		e := row.OutboxEvent
+		e.Payload = slices.Clone(e.Payload)
+		out = append(out, e)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+
+	return out, nil
+}
+
+func (m *inMemoryStore) MarkOutboxDelivered(_ context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if row := m.outboxRow(id); row != nil {
+		now := time.Now()
+		row.deliveredAt = &now
+		row.LastError = ""
+	}
+	return nil
+}
+
+func (m *inMemoryStore) MarkOutboxFailed(_ context.Context, id int64, retryIn time.Duration, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if row := m.outboxRow(id); row != nil {
+		row.Attempts++
+		row.LastError = reason
+		row.nextAttemptAt = time.Now().Add(retryIn)
+	}
+	return nil
+}
+
+// outboxRow returns the stored row for an event ID, IDs are the index + 1
+func (m *inMemoryStore) outboxRow(id int64) *outboxRow {
+	if id < 1 || id > int64(len(m.outbox)) {
+		return nil
+	}
+	return &m.outbox[id-1]
+}
+
+func (m *inMemoryStore) CreateEnrollmentCode(_ context.Context, c *EnrollmentCode, codeHash string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c.ID = uuid.NewString()
+	c.CreatedAt = time.Now()
+	m.codes = append(m.codes, enrollmentRow{EnrollmentCode: *c, codeHash: codeHash})
+	return nil
+}
+
+func (m *inMemoryStore) EnrollmentCodes(_ context.Context, orgID string) ([]EnrollmentCode, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	out := make([]EnrollmentCode, 0)
+	for i := len(m.codes) - 1; i >= 0; i-- {
+		if m.codes[i].OrgID == orgID {
+			out = append(out, *copyEnrollmentCode(&m.codes[i].EnrollmentCode))
+		}
+	}
+	return out, nil
+}
+
+func (m *inMemoryStore) FindEnrollmentCode(_ context.Context, codeHash string) (*EnrollmentCode, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	row := m.redeemable(codeHash)
+	if row == nil {
+		return nil, ErrEnrollmentCodeInvalid
+	}
+	return copyEnrollmentCode(&row.EnrollmentCode), nil
+}
+
+func (m *inMemoryStore) Enroll(_ context.Context, r *Registration, codeHash string, defaultLimit int) (*EnrollmentCode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	row := m.redeemable(codeHash)
+	if row == nil {
+		return nil, ErrEnrollmentCodeInvalid
+	}
+
+	r.OrgID, r.Username = row.OrgID, row.Username
+	if err := m.insertWithinQuota(r, defaultLimit); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	row.UsedAt, row.UsedBy = &now, r.UID
+	return copyEnrollmentCode(&row.EnrollmentCode), nil
+}
+
+// redeemable finds the unused, unexpired code with the hash, nil if there's
+// none
+func (m *inMemoryStore) redeemable(codeHash string) *enrollmentRow {
+	for i := range m.codes {
+		c := &m.codes[i]
+		if c.codeHash == codeHash && c.UsedAt == nil && time.Now().Before(c.ExpiresAt) {
+			return c
+		}
+	}
+	return nil
+}
+
+func copyEnrollmentCode(c *EnrollmentCode) *EnrollmentCode {
+	out := *c
+	if c.UsedAt != nil {
+		t := *c.UsedAt
+		out.UsedAt = &t
+	}
+	return &out
+}
+
+func (m *inMemoryStore) OrgSettings(_ context.Context, orgID string) (*OrgSettings, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if settings, ok := m.settings[orgID]; ok {
+		return &settings, nil
+	}
+	return &OrgSettings{OrgID: orgID}, nil
+}
+
+func (m *inMemoryStore) SetOrgSettings(_ context.Context, s *OrgSettings) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.settings == nil {
+		m.settings = make(map[string]OrgSettings)
+	}
+	m.settings[s.OrgID] = *s
+	return nil
+}
@@ -1,24 +1,137 @@
 package store
 
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+/*
+Store is every persisted thing mbop knows about. Every method takes the
+context of the request (or job) it runs for, so a client going away or the
+query timeout cancels the query instead of leaving it running on the
+database.
+*/
 type Store interface {
 	RegistrationStore
 	AllowlistStore
+	SnapshotStore
+	OutboxStore
+	QuotaStore
+	EnrollmentStore
+	OrgSettingsStore
 }
 
 type RegistrationStore interface {
-	All(orgID string, limit, offset int) ([]Registration, int, error)
+	// All lists an org's registrations matching the query along with the total
+	// count of matches (ignoring limit/offset)
+	All(ctx context.Context, orgID string, q RegistrationQuery) ([]Registration, int, error)
 	// Find a registration that both the org ID + UID match
-	Find(orgID, uid string) (*Registration, error)
+	Find(ctx context.Context, orgID, uid string) (*Registration, error)
 	// lookup a registration by uid only
-	FindByUID(uid string) (*Registration, error)
-	Create(r *Registration) (string, error)
-	Update(r *Registration, update *RegistrationUpdate) error
-	Delete(orgID, uid string) error
+	FindByUID(ctx context.Context, uid string) (*Registration, error)
+	Create(ctx context.Context, r *Registration) (string, error)
+	// Import creates every row in one go, either all of them are created or
+	// none are (ErrImportFailed) and the results say which rows were at fault
+	Import(ctx context.Context, rows []BulkRegistration, actor string) ([]ImportResult, error)
+	// Update and Delete record the actor (the username making the change) in
+	// the registration's history
+	Update(ctx context.Context, r *Registration, update *RegistrationUpdate, actor string) error
+	// Delete only soft-deletes, the registration is hidden from every lookup
+	// but can be restored until it is purged
+	Delete(ctx context.Context, orgID, uid, actor string) error
+	// Restore the most recently deleted registration for the org ID + UID, as
+	// long as it was deleted within the retention window
+	Restore(ctx context.Context, orgID, uid, actor string, retention time.Duration) (*Registration, error)
+	// Purge hard-deletes registrations that were deleted longer than retention
+	// ago, returning how many were removed
+	Purge(ctx context.Context, retention time.Duration) (int, error)
+	// UpdateLastSeen bumps the last seen timestamp for a batch of UIDs, it
+	// never moves a timestamp backwards
+	UpdateLastSeen(ctx context.Context, seen map[string]time.Time) error
+	// History lists every recorded event for a registration, oldest first
+	History(ctx context.Context, orgID, uid string) ([]RegistrationEvent, error)
+	// Review moves a pending registration to status (active to approve it,
+	// rejected to reject it), recording actor as the reviewer. It's
+	// ErrRegistrationNotPending for one that isn't pending.
+	Review(ctx context.Context, orgID, uid string, status RegistrationStatus, actor string) (*Registration, error)
 }
 
 type AllowlistStore interface {
-	AllowedAddresses(orgID string) ([]AllowlistBlock, error)
-	AllowedIP(ip, orgID string) (bool, error)
-	AllowAddress(ip *AllowlistBlock) error
-	DenyAddress(ip *AllowlistBlock) error
+	AllowedAddresses(ctx context.Context, orgID string, q AllowlistQuery) ([]AllowlistBlock, int, error)
+	AllowedIP(ctx context.Context, ip, orgID string) (bool, error)
+	AllowAddress(ctx context.Context, ip *AllowlistBlock) error
+	DenyAddress(ctx context.Context, ip *AllowlistBlock) error
+	// PurgeExpiredAddresses deletes the blocks whose expiry has passed, each
+	// with a removed event like DenyAddress, returning how many were removed
+	PurgeExpiredAddresses(ctx context.Context) (int, error)
+}
+
+type SnapshotStore interface {
+	// DumpSnapshot reads every live registration and allowlist block of every
+	// org, registrations are ordered by created_at and blocks by org
+	DumpSnapshot(ctx context.Context) (*Snapshot, error)
+	// LoadSnapshot writes a whole snapshot in one transaction, recording actor
+	// in the registrations' history. When any row conflicts with what's stored
+	// (or another row) nothing is written, the conflicts are returned along
+	// with ErrSnapshotConflict.
+	LoadSnapshot(ctx context.Context, snap *Snapshot, actor string) ([]SnapshotConflict, error)
+}
+
+/*
+OutboxStore hands the change events written by Create, Import, Delete,
+Restore, Review, AllowAddress, DenyAddress and PurgeExpiredAddresses to the
+dispatcher. An event is pending until it is marked delivered, a claim only
+hides it for the lease so an event whose dispatcher died is picked up again
+once that runs out.
+*/
+type OutboxStore interface {
+	// ClaimOutbox returns up to limit pending events that are due, oldest
+	// first, and holds them back from other claims for lease
+	ClaimOutbox(ctx context.Context, limit int, lease time.Duration) ([]OutboxEvent, error)
+	MarkOutboxDelivered(ctx context.Context, id int64) error
+	// MarkOutboxFailed records a failed delivery, the event is due again
+	// after retryIn
+	MarkOutboxFailed(ctx context.Context, id int64, retryIn time.Duration, reason string) error
+}
+
+type QuotaStore interface {
+	// CreateWithinQuota is Create, unless the org already has as many live
+	// registrations as its quota allows in which case it's ErrQuotaExceeded.
+	// The org's override applies if it has one, defaultLimit otherwise (<= 0
+	// being unlimited). Counting and creating are atomic, concurrent creates
+	// can't overshoot the quota.
+	CreateWithinQuota(ctx context.Context, r *Registration, defaultLimit int) (string, error)
+	// Quota reports the org's limit and current usage
+	Quota(ctx context.Context, orgID string, defaultLimit int) (*Quota, error)
+	// SetQuotaOverride gives the org a limit of its own, nil removes it so the
+	// org is back on the default
+	SetQuotaOverride(ctx context.Context, orgID string, limit *int) error
+}
+
+type EnrollmentStore interface {
+	// CreateEnrollmentCode stores a code by its hash, filling in c's ID and
+	// created_at
+	CreateEnrollmentCode(ctx context.Context, c *EnrollmentCode, codeHash string) error
+	// EnrollmentCodes lists every code the org has created, newest first
+	EnrollmentCodes(ctx context.Context, orgID string) ([]EnrollmentCode, error)
+	// FindEnrollmentCode looks up a code that can still be redeemed,
+	// ErrEnrollmentCodeInvalid otherwise
+	FindEnrollmentCode(ctx context.Context, codeHash string) (*EnrollmentCode, error)
+	// Enroll redeems the code and creates r in the code's org and under its
+	// creator's username, within the org's quota like CreateWithinQuota. The
+	// code is only used up when the registration is created, and two enrolls
+	// can't redeem the same code.
+	Enroll(ctx context.Context, r *Registration, codeHash string, defaultLimit int) (*EnrollmentCode, error)
+}
+
+type OrgSettingsStore interface {
+	OrgSettings(ctx context.Context, orgID string) (*OrgSettings, error)
+	SetOrgSettings(ctx context.Context, s *OrgSettings) error
+}
+
+// PooledStore is implemented by the stores backed by a database/sql
+// connection pool, the in-memory store doesn't have one
+type PooledStore interface {
+	PoolStats() sql.DBStats
 }
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	l "github.com/redhatinsights/mbop/internal/logger"
+)
+
+// lastSeen collects the UIDs that authenticated since the last flush, so the
+// auth path only touches a map instead of writing to the store per request.
+var lastSeen = struct {
+	sync.Mutex
+	pending map[string]time.Time
+}{pending: make(map[string]time.Time)}
+
+// RecordLastSeen notes that the registration with this UID was just seen, it
+// is written to the store on the next flush.
+func RecordLastSeen(uid string) {
+	lastSeen.Lock()
+	defer lastSeen.Unlock()
+
+	lastSeen.pending[uid] = time.Now()
+}
+
+// FlushLastSeen writes every pending last seen timestamp to the store in one
+// batch. On failure the batch is put back to be retried on the next flush.
+func FlushLastSeen(ctx context.Context) error {
+	lastSeen.Lock()
+	batch := lastSeen.pending
+	lastSeen.pending = make(map[string]time.Time, len(batch))
+	lastSeen.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	err := GetStore().UpdateLastSeen(ctx, batch)
+	if err != nil {
+		lastSeen.Lock()
+		for uid, t := range batch {
+			if newer, ok := lastSeen.pending[uid]; !ok || t.After(newer) {
+				lastSeen.pending[uid] = t
+			}
+		}
+		lastSeen.Unlock()
+	}
+
+	return err
+}
+
+// RunLastSeenFlusher flushes every interval until ctx is cancelled, flushing
+// one last time on the way out so a shutdown doesn't lose the last batch.
+func RunLastSeenFlusher(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			// ctx is already done, the last flush still needs to go through
+			if err := FlushLastSeen(context.WithoutCancel(ctx)); err != nil {
+				l.Log.Error(err, "failed to flush last seen timestamps on shutdown")
+			}
+			return
+		case <-t.C:
+			if err := FlushLastSeen(ctx); err != nil {
+				l.Log.Error(err, "failed to flush last seen timestamps")
+			}
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type failingLastSeenStore struct {
+	*inMemoryStore
+}
+
+func (f failingLastSeenStore) UpdateLastSeen(_ context.Context, _ map[string]time.Time) error {
+	return errors.New("db is down")
+}
+
+func TestFlushLastSeen(t *testing.T) {
+	mem := &inMemoryStore{}
+	GetStore = func() Store { return mem }
+
+	_, err := mem.Create(context.Background(), &Registration{OrgID: "1234", UID: "1234"})
+	assert.Nil(t, err)
+
+	RecordLastSeen("1234")
+	assert.Nil(t, FlushLastSeen(context.Background()))
+
+	found, err := mem.FindByUID(context.Background(), "1234")
+	assert.Nil(t, err)
+	assert.NotNil(t, found.LastSeenAt)
+	assert.WithinDuration(t, time.Now(), *found.LastSeenAt, 5*time.Second)
+}
+
+func TestFlushLastSeenRetriesOnFailure(t *testing.T) {
+	mem := &inMemoryStore{}
+	GetStore = func() Store { return failingLastSeenStore{mem} }
+
+	_, err := mem.Create(context.Background(), &Registration{OrgID: "1234", UID: "1234"})
+	assert.Nil(t, err)
+
+	RecordLastSeen("1234")
+	assert.Error(t, FlushLastSeen(context.Background()))
+
+	// the failed batch is kept for the next flush
+	GetStore = func() Store { return mem }
+	assert.Nil(t, FlushLastSeen(context.Background()))
+
+	found, err := mem.FindByUID(context.Background(), "1234")
+	assert.Nil(t, err)
+	assert.NotNil(t, found.LastSeenAt)
+}
@@ -0,0 +1,23 @@
+-- change events for downstream services, written in the same transaction as
+-- the change itself and delivered at-least-once by the outbox dispatcher.
+-- next_attempt_at is pushed forward while an event is claimed or waiting to
+-- be retried, delivered_at is set once a sink has accepted it.
+create table if not exists public.outbox_events
+(
+    id              bigserial               not null
+        constraint outbox_events_pk
+            primary key,
+    event_type      varchar                 not null,
+    org_id          varchar                 not null,
+    key             varchar                 not null,
+    payload         jsonb                   not null,
+    created_at      timestamp default now() not null,
+    attempts        integer   default 0     not null,
+    next_attempt_at timestamp default now() not null,
+    last_error      varchar,
+    delivered_at    timestamp
+);
+
+create index if not exists outbox_events_pending_index
+    on public.outbox_events (next_attempt_at, id)
+    where delivered_at is null;
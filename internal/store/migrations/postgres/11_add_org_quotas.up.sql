@@ -0,0 +1,12 @@
+-- per-org overrides of the default registration quota, orgs without a row
+-- get the configured default
+create table if not exists public.org_quotas
+(
+    org_id            varchar                 not null
+        constraint org_quotas_pk
+            primary key,
+    max_registrations integer                 not null
+        constraint org_quotas_max_registrations_check
+            check (max_registrations >= 0),
+    updated_at        timestamp default now() not null
+);
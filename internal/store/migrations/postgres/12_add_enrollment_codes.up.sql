@@ -0,0 +1,20 @@
+-- single-use codes an org admin hands to a satellite so it can register
+-- itself, only the sha256 of the code is kept
+create table if not exists public.enrollment_codes
+(
+    id         uuid      default uuid_generate_v4() not null
+        constraint enrollment_codes_pk
+            primary key,
+    code_hash  varchar                              not null
+        constraint enrollment_codes_code_hash_key
+            unique,
+    org_id     varchar                              not null,
+    username   varchar                              not null,
+    created_at timestamp default now()              not null,
+    expires_at timestamp                            not null,
+    used_at    timestamp,
+    used_by    varchar
+);
+
+create index if not exists enrollment_codes_org_id_index
+    on public.enrollment_codes (org_id, created_at);
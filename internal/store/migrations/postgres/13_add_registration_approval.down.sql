@@ -0,0 +1,6 @@
+drop table if exists public.org_settings;
+
+alter table public.registrations
+    drop column if exists status,
+    drop column if exists reviewed_by,
+    drop column if exists reviewed_at;
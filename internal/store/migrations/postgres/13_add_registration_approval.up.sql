@@ -0,0 +1,15 @@
+-- registrations in orgs that require approval start out pending until a
+-- second admin approves or rejects them, every existing one is active
+alter table public.registrations
+    add column if not exists status      varchar default 'active' not null,
+    add column if not exists reviewed_by varchar,
+    add column if not exists reviewed_at timestamp;
+
+create table if not exists public.org_settings
+(
+    org_id           varchar                 not null
+        constraint org_settings_pk
+            primary key,
+    require_approval boolean   default false not null,
+    updated_at       timestamp default now() not null
+);
@@ -0,0 +1 @@
+drop index if exists public.registrations_extra_index;
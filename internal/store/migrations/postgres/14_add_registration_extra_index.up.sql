@@ -0,0 +1,3 @@
+-- extra.<key> filters are containment queries
+create index if not exists registrations_extra_index
+    on public.registrations using gin (extra jsonb_path_ops);
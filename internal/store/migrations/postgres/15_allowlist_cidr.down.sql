@@ -0,0 +1,7 @@
+drop index if exists public.allowlist_ip_block_index;
+
+alter table public.allowlist
+    alter column ip_block type varchar using ip_block::text;
+
+-- the entries that were moved aside are left there, putting them back could
+-- clash with the ones that were normalized
@@ -0,0 +1,77 @@
+-- entries that can't be converted to a cidr are moved here instead of failing
+-- the migration, so they can be looked at and added back by hand
+create table if not exists public.allowlist_invalid
+(
+    ip_block   varchar                 not null,
+    org_id     varchar                 not null,
+    created_at timestamp               not null,
+    reason     varchar                 not null,
+    moved_at   timestamp default now() not null
+);
+
+-- every block is rewritten in the canonical form mbop stores them in now:
+-- host bits masked off and IPv4-mapped IPv6 blocks as the IPv4 block. Blocks
+-- that don't parse, and ones that end up the same as an older block in the
+-- org, are moved to allowlist_invalid with a warning each.
+do
+$$
+    declare
+        entry      record;
+        block      inet;
+        normalized cidr;
+    begin
+        create temporary table allowlist_backfill
+        (
+            ip_block   varchar   not null,
+            org_id     varchar   not null,
+            created_at timestamp not null,
+            canonical  cidr
+        ) on commit drop;
+
+        for entry in select ip_block, org_id, created_at from public.allowlist order by created_at, ip_block loop
+            begin
+                block := trim(entry.ip_block)::inet;
+                if family(block) = 6 then
+                    if set_masklen(block, 128) <<= '::ffff:0.0.0.0/96'::inet then
+                        if masklen(block) < 96 then
+                            raise exception 'wider than the IPv4-mapped range';
+                        end if;
+                        block := set_masklen(substring(host(block) from 8)::inet, masklen(block) - 96);
+                    end if;
+                end if;
+                normalized := network(block);
+            exception
+                when others then
+                    raise warning 'allowlist entry % for org % is not a valid block: %', entry.ip_block, entry.org_id, sqlerrm;
+                    insert into public.allowlist_invalid (ip_block, org_id, created_at, reason)
+                    values (entry.ip_block, entry.org_id, entry.created_at, sqlerrm);
+                    continue;
+            end;
+
+            if exists(select 1 from allowlist_backfill b where b.org_id = entry.org_id and b.canonical = normalized) then
+                raise warning 'allowlist entry % for org % duplicates %', entry.ip_block, entry.org_id, normalized;
+                insert into public.allowlist_invalid (ip_block, org_id, created_at, reason)
+                values (entry.ip_block, entry.org_id, entry.created_at, 'duplicate of ' || normalized::text);
+                continue;
+            end if;
+
+            insert into allowlist_backfill values (entry.ip_block, entry.org_id, entry.created_at, normalized);
+        end loop;
+
+        delete from public.allowlist a
+        where not exists(select 1 from allowlist_backfill b where b.ip_block = a.ip_block and b.org_id = a.org_id);
+
+        update public.allowlist a
+        set ip_block = b.canonical::text
+        from allowlist_backfill b
+        where b.ip_block = a.ip_block
+          and b.org_id = a.org_id
+          and b.canonical::text <> a.ip_block;
+    end
+$$;
+
+alter table public.allowlist
+    alter column ip_block type cidr using ip_block::cidr;
+
+create index if not exists allowlist_ip_block_index
+    on public.allowlist using gist (ip_block inet_ops);
@@ -0,0 +1,6 @@
+drop index if exists public.allowlist_expires_at_index;
+
+alter table public.allowlist
+    drop column if exists expires_at,
+    drop column if exists description,
+    drop column if exists created_by;
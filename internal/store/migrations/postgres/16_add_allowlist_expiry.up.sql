@@ -0,0 +1,9 @@
+alter table public.allowlist
+    add column if not exists expires_at  timestamp,
+    add column if not exists description varchar,
+    add column if not exists created_by  varchar;
+
+-- the cleanup job looks for the ones that have expired
+create index if not exists allowlist_expires_at_index
+    on public.allowlist (expires_at)
+    where expires_at is not null;
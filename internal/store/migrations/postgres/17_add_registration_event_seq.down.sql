@@ -0,0 +1,6 @@
+drop index if exists public.registration_events_org_id_uid_index;
+create index if not exists registration_events_org_id_uid_index
+    on public.registration_events (org_id, uid, created_at);
+
+alter table public.registration_events
+    drop column if exists seq;
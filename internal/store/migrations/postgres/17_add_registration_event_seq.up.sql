@@ -0,0 +1,9 @@
+-- events written in the same transaction share created_at (it's now()), the
+-- sequence keeps them in the order they were written. Existing rows are
+-- numbered in whatever order postgres reads them.
+alter table public.registration_events
+    add column if not exists seq bigserial;
+
+drop index if exists public.registration_events_org_id_uid_index;
+create index if not exists registration_events_org_id_uid_index
+    on public.registration_events (org_id, uid, created_at, seq);
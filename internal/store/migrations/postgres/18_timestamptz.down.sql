@@ -0,0 +1,34 @@
+alter table public.registrations
+    alter column created_at type timestamp using created_at at time zone 'utc',
+    alter column updated_at type timestamp using updated_at at time zone 'utc',
+    alter column deleted_at type timestamp using deleted_at at time zone 'utc',
+    alter column cert_not_after type timestamp using cert_not_after at time zone 'utc',
+    alter column last_seen_at type timestamp using last_seen_at at time zone 'utc',
+    alter column reviewed_at type timestamp using reviewed_at at time zone 'utc';
+
+alter table public.registration_events
+    alter column created_at type timestamp using created_at at time zone 'utc';
+
+alter table public.allowlist
+    alter column created_at type timestamp using created_at at time zone 'utc',
+    alter column expires_at type timestamp using expires_at at time zone 'utc';
+
+alter table public.allowlist_invalid
+    alter column created_at type timestamp using created_at at time zone 'utc',
+    alter column moved_at type timestamp using moved_at at time zone 'utc';
+
+alter table public.outbox_events
+    alter column created_at type timestamp using created_at at time zone 'utc',
+    alter column next_attempt_at type timestamp using next_attempt_at at time zone 'utc',
+    alter column delivered_at type timestamp using delivered_at at time zone 'utc';
+
+alter table public.org_quotas
+    alter column updated_at type timestamp using updated_at at time zone 'utc';
+
+alter table public.enrollment_codes
+    alter column created_at type timestamp using created_at at time zone 'utc',
+    alter column expires_at type timestamp using expires_at at time zone 'utc',
+    alter column used_at type timestamp using used_at at time zone 'utc';
+
+alter table public.org_settings
+    alter column updated_at type timestamp using updated_at at time zone 'utc';
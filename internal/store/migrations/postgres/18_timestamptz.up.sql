@@ -0,0 +1,38 @@
+-- the timestamp columns hold UTC written from Go, but defaults and comparisons
+-- use now(), which is converted with the session's TimeZone. As timestamptz
+-- they're the same instant whatever the session's zone; what's already there
+-- is read as the UTC it was written as.
+alter table public.registrations
+    alter column created_at type timestamptz using created_at at time zone 'utc',
+    alter column updated_at type timestamptz using updated_at at time zone 'utc',
+    alter column deleted_at type timestamptz using deleted_at at time zone 'utc',
+    alter column cert_not_after type timestamptz using cert_not_after at time zone 'utc',
+    alter column last_seen_at type timestamptz using last_seen_at at time zone 'utc',
+    alter column reviewed_at type timestamptz using reviewed_at at time zone 'utc';
+
+alter table public.registration_events
+    alter column created_at type timestamptz using created_at at time zone 'utc';
+
+alter table public.allowlist
+    alter column created_at type timestamptz using created_at at time zone 'utc',
+    alter column expires_at type timestamptz using expires_at at time zone 'utc';
+
+alter table public.allowlist_invalid
+    alter column created_at type timestamptz using created_at at time zone 'utc',
+    alter column moved_at type timestamptz using moved_at at time zone 'utc';
+
+alter table public.outbox_events
+    alter column created_at type timestamptz using created_at at time zone 'utc',
+    alter column next_attempt_at type timestamptz using next_attempt_at at time zone 'utc',
+    alter column delivered_at type timestamptz using delivered_at at time zone 'utc';
+
+alter table public.org_quotas
+    alter column updated_at type timestamptz using updated_at at time zone 'utc';
+
+alter table public.enrollment_codes
+    alter column created_at type timestamptz using created_at at time zone 'utc',
+    alter column expires_at type timestamptz using expires_at at time zone 'utc',
+    alter column used_at type timestamptz using used_at at time zone 'utc';
+
+alter table public.org_settings
+    alter column updated_at type timestamptz using updated_at at time zone 'utc';
@@ -0,0 +1,18 @@
+-- audit trail of every mutation made to a registration, rows are never
+-- deleted along with the registration so history survives a delete.
+create table if not exists public.registration_events
+(
+    id              uuid default uuid_generate_v4() not null
+        constraint registration_events_pk
+            primary key,
+    event_type      varchar                         not null,
+    org_id          varchar                         not null,
+    uid             varchar                         not null,
+    actor           varchar,
+    before_snapshot jsonb,
+    after_snapshot  jsonb,
+    created_at      timestamp default now()         not null
+);
+
+create index if not exists registration_events_org_id_uid_index
+    on public.registration_events (org_id, uid, created_at);
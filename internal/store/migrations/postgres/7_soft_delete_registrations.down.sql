@@ -0,0 +1,20 @@
+-- soft-deleted rows would violate the old constraints, so they go first
+delete from registrations where deleted_at is not null;
+
+drop index if exists registrations_deleted_at_index;
+drop index if exists registrations_display_name_org_id_active_uindex;
+drop index if exists registrations_uid_active_uindex;
+
+create unique index if not exists registrations_org_id_uid_uindex
+    on registrations (org_id, uid);
+
+alter table registrations
+    add constraint uid_unique
+        unique (uid);
+
+alter table registrations
+    add constraint display_name_unique
+        unique (display_name, org_id);
+
+alter table registrations
+    drop column if exists deleted_at;
@@ -0,0 +1,25 @@
+alter table registrations
+    add deleted_at timestamp default null;
+
+-- uniqueness only applies to live registrations, a soft-deleted row keeps its
+-- uid/display_name around until it is purged without blocking re-registration
+alter table registrations
+    drop constraint if exists uid_unique;
+
+alter table registrations
+    drop constraint if exists display_name_unique;
+
+drop index if exists registrations_org_id_uid_uindex;
+
+create unique index if not exists registrations_uid_active_uindex
+    on registrations (uid)
+    where deleted_at is null;
+
+create unique index if not exists registrations_display_name_org_id_active_uindex
+    on registrations (display_name, org_id)
+    where deleted_at is null;
+
+-- for the purge job
+create index if not exists registrations_deleted_at_index
+    on registrations (deleted_at)
+    where deleted_at is not null;
@@ -0,0 +1,8 @@
+alter table registrations
+    drop column if exists cert_fingerprint;
+
+alter table registrations
+    drop column if exists cert_serial;
+
+alter table registrations
+    drop column if exists cert_not_after;
@@ -0,0 +1,10 @@
+-- the client certificate pinned to the registration, null for registrations
+-- made before pinning existed (those authenticate on CN alone)
+alter table registrations
+    add cert_fingerprint varchar default null;
+
+alter table registrations
+    add cert_serial varchar default null;
+
+alter table registrations
+    add cert_not_after timestamp default null;
@@ -0,0 +1,4 @@
+drop index if exists registrations_org_id_last_seen_at_index;
+
+alter table registrations
+    drop column if exists last_seen_at;
@@ -0,0 +1,7 @@
+-- last time the registration authenticated through /v1/auth, written in
+-- batches so it can lag behind by the flush interval
+alter table registrations
+    add last_seen_at timestamp default null;
+
+create index if not exists registrations_org_id_last_seen_at_index
+    on registrations (org_id, last_seen_at);
@@ -0,0 +1,19 @@
+-- see the postgres migration, payload is json text and timestamps are fixed
+-- width UTC text like everywhere else
+create table if not exists outbox_events
+(
+    id              integer not null primary key autoincrement,
+    event_type      text    not null,
+    org_id          text    not null,
+    key             text    not null,
+    payload         text    not null,
+    created_at      text    not null,
+    attempts        integer not null default 0,
+    next_attempt_at text    not null,
+    last_error      text,
+    delivered_at    text
+);
+
+create index if not exists outbox_events_pending_index
+    on outbox_events (next_attempt_at, id)
+    where delivered_at is null;
@@ -0,0 +1,6 @@
+create table if not exists org_quotas
+(
+    org_id            text    not null primary key,
+    max_registrations integer not null check (max_registrations >= 0),
+    updated_at        text    not null
+);
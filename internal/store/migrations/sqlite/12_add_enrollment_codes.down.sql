@@ -0,0 +1 @@
+drop table if exists enrollment_codes;
@@ -0,0 +1,14 @@
+create table if not exists enrollment_codes
+(
+    id         text not null primary key,
+    code_hash  text not null unique,
+    org_id     text not null,
+    username   text not null,
+    created_at text not null,
+    expires_at text not null,
+    used_at    text,
+    used_by    text
+);
+
+create index if not exists enrollment_codes_org_id_index
+    on enrollment_codes (org_id, created_at);
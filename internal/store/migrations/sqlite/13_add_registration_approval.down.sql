@@ -0,0 +1,5 @@
+drop table if exists org_settings;
+
+alter table registrations drop column reviewed_at;
+alter table registrations drop column reviewed_by;
+alter table registrations drop column status;
@@ -0,0 +1,10 @@
+alter table registrations add column status text not null default 'active';
+alter table registrations add column reviewed_by text;
+alter table registrations add column reviewed_at text;
+
+create table if not exists org_settings
+(
+    org_id           text    not null primary key,
+    require_approval integer not null default 0,
+    updated_at       text    not null
+);
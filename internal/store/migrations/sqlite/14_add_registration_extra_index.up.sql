@@ -0,0 +1,4 @@
+-- sqlite can't index arbitrary keys of a json column, extra.<key> filters
+-- scan the org's registrations instead. This keeps the version in step with
+-- postgres.
+select 1;
@@ -0,0 +1,3 @@
+-- sqlite has no cidr type, blocks stay text and are matched in Go. This keeps
+-- the version in step with postgres.
+select 1;
@@ -0,0 +1,5 @@
+drop index if exists allowlist_expires_at_index;
+
+alter table allowlist drop column created_by;
+alter table allowlist drop column description;
+alter table allowlist drop column expires_at;
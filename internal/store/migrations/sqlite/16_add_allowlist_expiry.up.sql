@@ -0,0 +1,8 @@
+alter table allowlist add column expires_at text;
+alter table allowlist add column description text;
+alter table allowlist add column created_by text;
+
+-- the cleanup job looks for the ones that have expired
+create index if not exists allowlist_expires_at_index
+    on allowlist (expires_at)
+    where expires_at is not null;
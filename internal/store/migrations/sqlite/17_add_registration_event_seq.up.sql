@@ -0,0 +1,3 @@
+-- sqlite already breaks created_at ties on the rowid. This keeps the version
+-- in step with postgres.
+select 1;
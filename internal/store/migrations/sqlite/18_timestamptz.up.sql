@@ -0,0 +1,3 @@
+-- sqlite stores timestamps as UTC text already. This keeps the version in
+-- step with postgres.
+select 1;
@@ -0,0 +1,3 @@
+drop table if exists allowlist;
+drop table if exists registration_events;
+drop table if exists registrations;
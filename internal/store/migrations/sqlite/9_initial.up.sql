@@ -0,0 +1,61 @@
+-- sqlite starts out at the same version as postgres did when it was added,
+-- so one version number means the same schema on either database. Later
+-- migrations keep the numbers in step.
+--
+-- ids are generated by mbop, extra/snapshots are json text and timestamps are
+-- fixed width UTC text that compares correctly as strings.
+create table if not exists registrations
+(
+    id               text not null primary key,
+    org_id           text not null,
+    username         text,
+    uid              text not null,
+    display_name     text,
+    extra            text not null default '{}',
+    created_at       text not null,
+    updated_at       text not null,
+    deleted_at       text,
+    cert_fingerprint text,
+    cert_serial      text,
+    cert_not_after   text,
+    last_seen_at     text
+);
+
+create unique index if not exists registrations_uid_active_uindex
+    on registrations (uid)
+    where deleted_at is null;
+
+create unique index if not exists registrations_display_name_org_id_active_uindex
+    on registrations (display_name, org_id)
+    where deleted_at is null;
+
+create index if not exists registrations_deleted_at_index
+    on registrations (deleted_at)
+    where deleted_at is not null;
+
+create index if not exists registrations_org_id_last_seen_at_index
+    on registrations (org_id, last_seen_at);
+
+create table if not exists registration_events
+(
+    id              text not null primary key,
+    event_type      text not null,
+    org_id          text not null,
+    uid             text not null,
+    actor           text,
+    before_snapshot text,
+    after_snapshot  text,
+    created_at      text not null
+);
+
+create index if not exists registration_events_org_id_uid_index
+    on registration_events (org_id, uid, created_at);
+
+-- ip_block is the CIDR as text, matching happens in mbop
+create table if not exists allowlist
+(
+    ip_block   text not null,
+    org_id     text not null,
+    created_at text not null,
+    primary key (ip_block, org_id)
+);
@@ -1,39 +1,282 @@
 package store
 
 import (
+	"database/sql"
 	"embed"
 	"errors"
 	"fmt"
+	"os"
+	"slices"
 
 	"github.com/golang-migrate/migrate/v4"
+	pgxmigrate "github.com/golang-migrate/migrate/v4/database/pgx/v5"
+	"github.com/golang-migrate/migrate/v4/database/sqlite"
 	"github.com/redhatinsights/mbop/internal/config"
 
 	// this is the iofs:// driver for go-migrate.
 	"github.com/golang-migrate/migrate/v4/source/iofs"
 )
 
+// every dialect keeps its migrations in its own directory, with version
+// numbers kept in step so a version means the same schema everywhere
+//
 //go:embed migrations
 var migrations embed.FS
 
-func migrateDatabase() error {
-	fs, err := iofs.New(migrations, "migrations")
+const (
+	dialectPostgres = "postgres"
+	dialectSQLite   = "sqlite"
+)
+
+// ErrNoMigrations is returned by NewMigrator for the in-memory store
+var ErrNoMigrations = errors.New("migrations only apply to the postgres and sqlite stores")
+
+/*
+Migrator runs the embedded migrations of the configured store by hand, for
+`mbop migrate` and deployments that set DATABASE_AUTO_MIGRATE=false. Every
+operation is a no-op (not an error) when there is nothing to change.
+*/
+type Migrator struct {
+	m        *migrate.Migrate
+	dialect  string
+	versions []uint
+}
+
+// NewMigrator connects to the database of the configured STORE_BACKEND, it
+// doesn't set up the store itself so nothing is migrated until asked to.
+func NewMigrator() (*Migrator, error) {
+	c := config.Get()
+
+	var m *migrate.Migrate
+	var err error
+
+	switch c.StoreBackend {
+	case dialectPostgres:
+		var dsn string
+		dsn, err = postgresDSN(c)
+		if err != nil {
+			return nil, err
+		}
+		m, err = newPostgresMigrate(dsn)
+	case dialectSQLite:
+		var db *sql.DB
+		db, err = openSQLite(c.SQLitePath)
+		if err != nil {
+			return nil, err
+		}
+		m, err = newSQLiteMigrate(db)
+		if err != nil {
+			db.Close()
+		}
+	default:
+		return nil, ErrNoMigrations
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := migrationVersions(c.StoreBackend)
+	if err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	return &Migrator{m: m, dialect: c.StoreBackend, versions: versions}, nil
+}
+
+// migrationVersions lists the versions embedded for dialect in order. sqlite
+// starts at 9, its first migration creates the schema postgres reached by then.
+func migrationVersions(dialect string) ([]uint, error) {
+	src, err := iofs.New(migrations, "migrations/"+dialect)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+
+	version, err := src.First()
+	if err != nil {
+		return nil, err
+	}
+
+	versions := []uint{version}
+	for {
+		version, err = src.Next(version)
+		if errors.Is(err, os.ErrNotExist) {
+			return versions, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+}
+
+// First is the dialect's first migration, anything below it doesn't exist
+func (m *Migrator) First() uint {
+	return m.versions[0]
+}
+
+// Latest is the dialect's last migration
+func (m *Migrator) Latest() uint {
+	return m.versions[len(m.versions)-1]
+}
+
+func (m *Migrator) unknownVersion(version int) error {
+	return fmt.Errorf("no %s migration %d, they go from %d to %d", m.dialect, version, m.First(), m.Latest())
+}
+
+// Up applies every pending migration
+func (m *Migrator) Up() error {
+	return ignoreNoChange(m.m.Up())
+}
+
+// Down rolls back the last n migrations
+func (m *Migrator) Down(n int) error {
+	if n < 1 {
+		return errors.New("need to roll back at least one migration")
+	}
+
+	version, _, ok, err := m.Version()
 	if err != nil {
 		return err
 	}
+	applied := 0
+	if ok {
+		applied = slices.Index(m.versions, version) + 1
+		if applied == 0 {
+			// not one of ours, left to migrate to report
+			return ignoreNoChange(m.m.Steps(-n))
+		}
+	}
+	if n > applied {
+		return fmt.Errorf("can't roll back %d migrations, only %d are applied (%s starts at version %d)", n, applied, m.dialect, m.First())
+	}
 
-	c := config.Get()
-	connStr := fmt.Sprintf("pgx5://%s:%s@%s:%s/%s?sslmode=prefer",
-		c.DatabaseUser, c.DatabasePassword, c.DatabaseHost, c.DatabasePort, c.DatabaseName)
+	return ignoreNoChange(m.m.Steps(-n))
+}
 
-	m, err := migrate.NewWithSourceInstance("iofs", fs, connStr)
+// Goto migrates up or down to exactly version, which has to be one of the
+// dialect's migrations
+func (m *Migrator) Goto(version uint) error {
+	if !slices.Contains(m.versions, version) {
+		return m.unknownVersion(int(version))
+	}
+	return ignoreNoChange(m.m.Migrate(version))
+}
+
+// Force sets the recorded version without running anything and clears the
+// dirty flag, for recovering from a migration that failed halfway. -1 means
+// no migration has been applied.
+func (m *Migrator) Force(version int) error {
+	if version != -1 && (version < 0 || !slices.Contains(m.versions, uint(version))) {
+		return m.unknownVersion(version)
+	}
+	return m.m.Force(version)
+}
+
+// Version is the currently applied migration, ok is false when none has been
+// applied yet. dirty means the last migration failed halfway.
+func (m *Migrator) Version() (version uint, dirty, ok bool, err error) {
+	version, dirty, err = m.m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return 0, false, false, nil
+	}
+	if err != nil {
+		return 0, false, false, err
+	}
+	return version, dirty, true, nil
+}
+
+// Close closes the migrator's own connection to the database
+func (m *Migrator) Close() error {
+	sourceErr, dbErr := m.m.Close()
+	return errors.Join(sourceErr, dbErr)
+}
+
+// migrateDatabase runs the postgres migrations over a connection of its own,
+// opened with the same dsn as the store so it gets the same tls settings
+func migrateDatabase(dsn string) error {
+	m, err := newPostgresMigrate(dsn)
 	if err != nil {
 		return err
 	}
+	// closes the connection as well
+	defer m.Close()
 
-	err = m.Up()
-	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+	return runMigrations(m)
+}
+
+func newPostgresMigrate(dsn string) (*migrate.Migrate, error) {
+	fs, err := iofs.New(migrations, "migrations/"+dialectPostgres)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	driver, err := pgxmigrate.WithInstance(db, &pgxmigrate.Config{})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	m, err := migrate.NewWithInstance("iofs", fs, dialectPostgres, driver)
+	if err != nil {
+		driver.Close()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func migrateSQLite(db *sql.DB) error {
+	m, err := newSQLiteMigrate(db)
+	if err != nil {
 		return err
 	}
 
+	// not closed, that would close the store's db
+	return runMigrations(m)
+}
+
+func newSQLiteMigrate(db *sql.DB) (*migrate.Migrate, error) {
+	fs, err := iofs.New(migrations, "migrations/"+dialectSQLite)
+	if err != nil {
+		return nil, err
+	}
+
+	driver, err := sqlite.WithInstance(db, &sqlite.Config{})
+	if err != nil {
+		return nil, err
+	}
+
+	return migrate.NewWithInstance("iofs", fs, dialectSQLite, driver)
+}
+
+// runMigrations migrates to the latest version at startup, or with
+// DATABASE_AUTO_MIGRATE=false only makes sure a failed migration isn't left
+// behind for the store to run against.
+func runMigrations(m *migrate.Migrate) error {
+	if !config.Get().DatabaseAutoMigrate {
+		_, dirty, err := m.Version()
+		if err != nil && !errors.Is(err, migrate.ErrNilVersion) {
+			return err
+		}
+		if dirty {
+			return errors.New("database is in a dirty migration state, fix it with `mbop migrate force`")
+		}
+		return nil
+	}
+
+	return ignoreNoChange(m.Up())
+}
+
+func ignoreNoChange(err error) error {
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return fmt.Errorf("migration failed: %w", err)
+	}
 	return nil
 }
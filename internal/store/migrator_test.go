@@ -0,0 +1,114 @@
+package store
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/redhatinsights/mbop/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestMigrator(t *testing.T) *Migrator {
+	t.Setenv("STORE_BACKEND", "sqlite")
+	t.Setenv("SQLITE_PATH", filepath.Join(t.TempDir(), "mbop.db"))
+	config.Reset()
+	t.Cleanup(config.Reset)
+
+	m, err := NewMigrator()
+	assert.Nil(t, err)
+	t.Cleanup(func() { m.Close() })
+
+	return m
+}
+
+func TestMigratorUpAndDown(t *testing.T) {
+	m := newTestMigrator(t)
+
+	_, _, ok, err := m.Version()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	assert.Nil(t, m.Up())
+	version, dirty, ok, err := m.Version()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.False(t, dirty)
+	assert.NotZero(t, version)
+
+	// nothing left to do isn't an error
+	assert.Nil(t, m.Up())
+
+	assert.Nil(t, m.Down(1))
+	previous, _, ok, err := m.Version()
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Less(t, previous, version)
+
+	assert.Error(t, m.Down(0))
+}
+
+func TestMigratorGotoAndForce(t *testing.T) {
+	m := newTestMigrator(t)
+
+	assert.Nil(t, m.Up())
+	latest, _, _, err := m.Version()
+	assert.Nil(t, err)
+
+	assert.Nil(t, m.Force(-1))
+	_, _, ok, err := m.Version()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	assert.Nil(t, m.Force(int(latest)))
+	assert.Nil(t, m.Goto(latest))
+	version, _, _, err := m.Version()
+	assert.Nil(t, err)
+	assert.Equal(t, latest, version)
+}
+
+func TestMigratorSQLiteVersions(t *testing.T) {
+	m := newTestMigrator(t)
+	assert.Equal(t, uint(9), m.First())
+
+	// sqlite has no migrations below 9
+	assert.ErrorContains(t, m.Goto(3), "no sqlite migration 3, they go from 9 to")
+	assert.ErrorContains(t, m.Force(3), "no sqlite migration 3")
+	assert.ErrorContains(t, m.Down(1), "only 0 are applied")
+
+	assert.Nil(t, m.Goto(10))
+	assert.ErrorContains(t, m.Down(3), "can't roll back 3 migrations, only 2 are applied")
+
+	assert.Nil(t, m.Down(2))
+	_, _, ok, err := m.Version()
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestNewMigratorInMemory(t *testing.T) {
+	t.Setenv("STORE_BACKEND", "memory")
+	config.Reset()
+	t.Cleanup(config.Reset)
+
+	_, err := NewMigrator()
+	assert.ErrorIs(t, err, ErrNoMigrations)
+}
+
+func TestSetupWithoutAutoMigrate(t *testing.T) {
+	t.Setenv("DATABASE_AUTO_MIGRATE", "false")
+	config.Reset()
+	t.Cleanup(config.Reset)
+
+	path := filepath.Join(t.TempDir(), "mbop.db")
+	s, err := setupSQLiteStore(path)
+	assert.Nil(t, err)
+	defer s.db.Close()
+
+	// the schema was left alone
+	var count int
+	assert.Nil(t, s.db.QueryRow(`select count(*) from sqlite_master where name = 'registrations'`).Scan(&count))
+	assert.Equal(t, 0, count)
+
+	_, err = os.Stat(path)
+	assert.Nil(t, err)
+}
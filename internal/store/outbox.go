@@ -0,0 +1,55 @@
+package store
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type OutboxEventType string
+
+const (
+	OutboxRegistrationCreated  OutboxEventType = "registration.created"
+	OutboxRegistrationDeleted  OutboxEventType = "registration.deleted"
+	OutboxRegistrationRestored OutboxEventType = "registration.restored"
+	OutboxRegistrationApproved OutboxEventType = "registration.approved"
+	OutboxRegistrationRejected OutboxEventType = "registration.rejected"
+	OutboxAllowlistAdded       OutboxEventType = "allowlist.added"
+	OutboxAllowlistRemoved     OutboxEventType = "allowlist.removed"
+)
+
+/*
+OutboxEvent is a change downstream services get told about, the store writes
+it in the same transaction as the change so an event exists if and only if
+the change was committed:
+- Key; the registration's uid, or the allowlist's ip block
+- Payload; the registration or allowlist block as json, for a delete it's
+the row as it was just before
+
+IDs only ever increase, delivery is at-least-once so consumers should use
+them to drop duplicates.
+*/
+type OutboxEvent struct {
+	ID        int64           `json:"id"`
+	Type      OutboxEventType `json:"type"`
+	OrgID     string          `json:"org_id"`
+	Key       string          `json:"key"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt time.Time       `json:"created_at"`
+	// how many deliveries have failed so far and why the last one did, these
+	// aren't part of what is delivered
+	Attempts  int    `json:"-"`
+	LastError string `json:"-"`
+}
+
+// newOutboxEvent builds the event for a change, the store fills in the ID and
+// created_at when writing it
+func newOutboxEvent(t OutboxEventType, orgID, key string, payload any) (*OutboxEvent, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal outbox payload")
+	}
+
+	return &OutboxEvent{Type: t, OrgID: orgID, Key: key, Payload: b}, nil
+}
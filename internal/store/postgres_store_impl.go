@@ -1,14 +1,19 @@
 package store
 
 import (
+	"cmp"
+	"context"
 	"database/sql"
-	"encoding/json"
-	"net"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
-	// the pgx driver for the database
-	_ "github.com/golang-migrate/migrate/v4/database/pgx/v5"
+	"github.com/google/uuid"
 	"github.com/jackc/pgx/v5/pgconn"
+	// the pgx driver for database/sql
+	_ "github.com/jackc/pgx/v5/stdlib"
 	"github.com/pkg/errors"
 	l "github.com/redhatinsights/mbop/internal/logger"
 )
@@ -17,248 +22,1001 @@ type postgresStore struct {
 	db *sql.DB
 }
 
-func (p *postgresStore) All(orgID string, limit, offset int) ([]Registration, int, error) {
-	rows, err := p.db.Query(`select
-	id, org_id, username, uid, display_name, extra, created_at
-	from registrations
-	where org_id = $1
-	order by created_at desc
-	limit $2
-	offset $3`,
-		orgID,
-		limit,
-		offset)
-	if err != nil {
-		return nil, 0, err
+func (p *postgresStore) All(ctx context.Context, orgID string, q RegistrationQuery) ([]Registration, int, error) {
+	if q.Cursor != nil {
+		if _, err := uuid.Parse(q.Cursor.Key); err != nil {
+			return nil, 0, ErrInvalidCursor
+		}
 	}
-	defer rows.Close()
+	return listRegistrations(ctx, p.db, postgresDialect, orgID, q)
+}
 
-	out := make([]Registration, 0)
-	for rows.Next() {
-		r, err := scanRegistration(rows)
-		if err != nil {
-			return nil, 0, err
-		}
-		out = append(out, *r)
+// registrationFilter builds the where clause (and its args) shared between
+// listing and counting registrations
+func registrationFilter(orgID string, q RegistrationQuery) (string, []any) {
+	where := []string{"org_id = $1", "deleted_at is null"}
+	args := []any{orgID}
+
+	if q.Search != "" {
+		args = append(args, "%"+escapeLike(q.Search)+"%")
+		where = append(where, "(display_name ilike "+placeholder(len(args))+" or uid ilike "+placeholder(len(args))+")")
+	}
+	if q.Username != "" {
+		args = append(args, q.Username)
+		where = append(where, "username = "+placeholder(len(args)))
+	}
+	if q.CreatedAfter != nil {
+		args = append(args, q.CreatedAfter.UTC())
+		where = append(where, "created_at > "+placeholder(len(args)))
+	}
+	if q.CreatedBefore != nil {
+		args = append(args, q.CreatedBefore.UTC())
+		where = append(where, "created_at < "+placeholder(len(args)))
+	}
+	if q.NotSeenSince != nil {
+		args = append(args, q.NotSeenSince.UTC())
+		where = append(where, "(last_seen_at is null or last_seen_at < "+placeholder(len(args))+")")
+	}
+	if q.Status != "" {
+		args = append(args, q.Status)
+		where = append(where, "status = "+placeholder(len(args)))
+	}
+	if len(q.Extra) > 0 {
+		args = append(args, q.Extra)
+		where = append(where, "extra @> "+placeholder(len(args))+"::jsonb")
+	}
+
+	return strings.Join(where, " and "), args
+}
+
+// registrationOrder builds the order by clause for a sort field, the field is
+// never interpolated directly so only the known columns can end up in the sql.
+// Text columns use the "C" collation so they sort bytewise like the in-memory
+// store does.
+func registrationOrder(by RegistrationSortField, desc bool) string {
+	dir := " asc"
+	if desc {
+		dir = " desc"
 	}
 
-	var count int
-	row := p.db.QueryRow(`select count(id) from registrations where org_id = $1`, orgID)
-	if err := row.Scan(&count); err != nil {
-		return nil, 0, err
+	var col string
+	switch by {
+	case SortByDisplayName:
+		col = `display_name collate "C"`
+	case SortByUID:
+		col = `uid collate "C"`
+	default:
+		col = "created_at"
 	}
 
-	return out, count, nil
+	return col + dir + ", id" + dir
 }
 
-func (p *postgresStore) Find(orgID, uid string) (*Registration, error) {
-	rows := p.db.QueryRow(
-		`select id, org_id, username, uid, display_name, extra, created_at from registrations where org_id = $1 and uid = $2 limit 1`,
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+// escapeLike escapes the wildcards in user input meant for a (i)like pattern
+func escapeLike(s string) string {
+	return likeEscaper.Replace(s)
+}
+
+func placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+func (p *postgresStore) Find(ctx context.Context, orgID, uid string) (*Registration, error) {
+	rows := p.db.QueryRowContext(ctx,
+		`select `+registrationColumns+` from registrations where org_id = $1 and uid = $2 and deleted_at is null limit 1`,
 		orgID,
 		uid,
 	)
 	return scanRegistration(rows)
 }
 
-func (p *postgresStore) FindByUID(uid string) (*Registration, error) {
-	rows := p.db.QueryRow(`select id, org_id, username, uid, display_name, extra, created_at from registrations where uid = $1 limit 1`, uid)
+func (p *postgresStore) FindByUID(ctx context.Context, uid string) (*Registration, error) {
+	rows := p.db.QueryRowContext(ctx, `select `+registrationColumns+` from registrations where uid = $1 and deleted_at is null limit 1`, uid)
 	return scanRegistration(rows)
 }
 
-func (p *postgresStore) Create(r *Registration) (string, error) {
-	res := p.db.QueryRow(
+func (p *postgresStore) Create(ctx context.Context, r *Registration) (string, error) {
+	return p.create(ctx, r, nil)
+}
+
+func (p *postgresStore) CreateWithinQuota(ctx context.Context, r *Registration, defaultLimit int) (string, error) {
+	return p.create(ctx, r, &defaultLimit)
+}
+
+// quotaLockSpace namespaces the advisory locks taken per org while creating
+// within its quota
+const quotaLockSpace = 0x6d626f70
+
+// create inserts a registration, checking the org's quota first unless
+// defaultLimit is nil
+func (p *postgresStore) create(ctx context.Context, r *Registration, defaultLimit *int) (string, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer rollback(tx)
+
+	created, err := createRegistration(ctx, tx, r, defaultLimit)
+	if err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	l.Log.Info("Created registration", "id", created.ID, "org_id", r.OrgID, "username", r.Username, "uid", r.UID, "display_name", r.DisplayName)
+	return created.ID, nil
+}
+
+// createRegistration inserts r along with its outbox event, first checking
+// the org's quota unless defaultLimit is nil
+func createRegistration(ctx context.Context, tx *sql.Tx, r *Registration, defaultLimit *int) (*Registration, error) {
+	if defaultLimit != nil {
+		// creates for the same org queue up on the lock until this transaction
+		// is done, so each one counts the registrations the others made
+		_, err := tx.ExecContext(ctx, `select pg_advisory_xact_lock($1, hashtext($2))`, quotaLockSpace, r.OrgID)
+		if err != nil {
+			return nil, err
+		}
+
+		q, err := postgresQuota(ctx, tx, r.OrgID, *defaultLimit)
+		if err != nil {
+			return nil, err
+		}
+		if q.Reached() {
+			return nil, ErrQuotaExceeded{Limit: *q.Limit}
+		}
+	}
+
+	created, err := insertRegistration(ctx, tx, r, r.Username, false)
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertOutboxEvent(ctx, tx, OutboxRegistrationCreated, created.OrgID, created.UID, created)
+	if err != nil {
+		return nil, err
+	}
+
+	return created, nil
+}
+
+// insertRegistration creates r along with its history event. The ID and
+// created_at are generated, unless fromSnapshot in which case r's own ID,
+// created_at, last_seen_at and review are kept.
+func insertRegistration(ctx context.Context, tx *sql.Tx, r *Registration, actor string, fromSnapshot bool) (*Registration, error) {
+	var id, reviewedBy *string
+	var createdAt, lastSeenAt, reviewedAt *time.Time
+	if fromSnapshot {
+		id = &r.ID
+		c := r.CreatedAt.UTC()
+		createdAt = &c
+		if r.LastSeenAt != nil {
+			t := r.LastSeenAt.UTC()
+			lastSeenAt = &t
+		}
+		if r.ReviewedAt != nil {
+			t := r.ReviewedAt.UTC()
+			reviewedBy, reviewedAt = &r.ReviewedBy, &t
+		}
+	}
+
+	fingerprint, serial, notAfter := certificateColumns(r.Certificate)
+	res := tx.QueryRowContext(ctx,
 		`insert into registrations
-		(org_id, username, uid, display_name, extra)
-		values ($1, $2, $3, $4, $5)
-		returning id`,
+		(id, org_id, username, uid, display_name, extra, cert_fingerprint, cert_serial, cert_not_after, created_at, last_seen_at,
+		status, reviewed_by, reviewed_at)
+		values (coalesce($1::uuid, uuid_generate_v4()), $2, $3, $4, $5, $6, $7, $8, $9, coalesce($10::timestamptz, now()), $11,
+		$12, $13, $14)
+		returning `+registrationColumns,
+		id,
 		r.OrgID,
 		r.Username,
 		r.UID,
 		r.DisplayName,
 		r.Extra,
+		fingerprint,
+		serial,
+		notAfter,
+		createdAt,
+		lastSeenAt,
+		r.status(),
+		reviewedBy,
+		reviewedAt,
 	)
 
-	var id string
-	err := res.Scan(&id)
+	created, err := scanRegistration(res)
 	if err != nil {
 		var pgErr *pgconn.PgError
 		// constraint violation == 23505
-		if errors.As(err, &pgErr) {
-			if pgErr.Code == "23505" {
-				return "", ErrRegistrationAlreadyExists{Detail: pgErr.Detail}
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, ErrRegistrationAlreadyExists{Detail: pgErr.Detail}
+		}
+		return nil, err
+	}
+
+	err = insertRegistrationEvent(ctx, tx, RegistrationEventCreate, actor, nil, created)
+	if err != nil {
+		return nil, err
+	}
+
+	return created, nil
+}
+
+func (p *postgresStore) Import(ctx context.Context, rows []BulkRegistration, actor string) ([]ImportResult, error) {
+	results, ok := ValidateBulkRegistrations(rows)
+	if !ok {
+		return results, ErrImportFailed
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rollback(tx)
+
+	// every row gets its own savepoint so a conflicting row doesn't abort the
+	// transaction, and we can report on all of them before rolling back
+	for i := range rows {
+		err := withSavepoint(ctx, tx, func() error {
+			created, err := insertRegistration(ctx, tx, rows[i].registration(), actor, false)
+			if err != nil {
+				return err
 			}
-		} else {
-			return "", err
+			return insertOutboxEvent(ctx, tx, OutboxRegistrationCreated, created.OrgID, created.UID, created)
+		})
+		if errors.Is(err, ErrRegistrationAlreadyExists{}) {
+			results[i].Error = err.Error()
+			ok = false
+			continue
 		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !ok {
+		return results, ErrImportFailed
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
 	}
 
-	l.Log.Info("Created registration", "id", id, "org_id", r.OrgID, "username", r.Username, "uid", r.UID, "display_name", r.DisplayName)
-	return id, nil
+	l.Log.Info("Imported registrations", "count", len(rows), "actor", actor)
+	return results, nil
 }
 
-func (p *postgresStore) Update(r *Registration, update *RegistrationUpdate) error {
-	//TODO: maybe more fields someday, not sure.
-	_, err := p.db.Exec(
-		`update registrations set extra = $1 where org_id = $2 and uid = $3`,
-		update.Extra,
+func (p *postgresStore) Update(ctx context.Context, r *Registration, update *RegistrationUpdate, actor string) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer rollback(tx)
+
+	before, err := scanRegistration(tx.QueryRowContext(ctx,
+		`select `+registrationColumns+` from registrations where org_id = $1 and uid = $2 and deleted_at is null for update`,
 		r.OrgID,
 		r.UID,
-	)
+	))
+	if err != nil {
+		return err
+	}
 
-	return err
+	// null parameters leave the column as-is, extra is merged with `||` so
+	// existing keys not present in the update are kept.
+	fingerprint, serial, notAfter := certificateColumns(update.Certificate)
+	after, err := scanRegistration(tx.QueryRowContext(ctx,
+		`update registrations set
+		display_name = coalesce($1, display_name),
+		extra = coalesce(extra, '{}'::jsonb) || coalesce($2::jsonb, '{}'::jsonb),
+		cert_fingerprint = coalesce($3, cert_fingerprint),
+		cert_serial = coalesce($4, cert_serial),
+		cert_not_after = coalesce($5, cert_not_after)
+		where id = $6
+		returning `+registrationColumns,
+		update.DisplayName,
+		update.Extra,
+		fingerprint,
+		serial,
+		notAfter,
+		before.ID,
+	))
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return ErrRegistrationAlreadyExists{Detail: pgErr.Detail}
+		}
+		return err
+	}
+
+	err = insertRegistrationEvent(ctx, tx, RegistrationEventUpdate, actor, before, after)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	l.Log.Info("Updated registration", "org_id", r.OrgID, "uid", r.UID, "actor", actor)
+	return nil
 }
 
-func (p *postgresStore) Delete(orgID, uid string) error {
-	res, err := p.db.Exec(
-		`delete from registrations where org_id = $1 and uid = $2`,
+func (p *postgresStore) Delete(ctx context.Context, orgID, uid, actor string) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer rollback(tx)
+
+	before, err := scanRegistration(tx.QueryRowContext(ctx,
+		`select `+registrationColumns+` from registrations where org_id = $1 and uid = $2 and deleted_at is null for update`,
 		orgID,
 		uid,
-	)
+	))
 	if err != nil {
 		return err
 	}
 
-	count, err := res.RowsAffected()
+	_, err = tx.ExecContext(ctx, `update registrations set deleted_at = now() where id = $1`, before.ID)
+	if err != nil {
+		return err
+	}
+
+	err = insertRegistrationEvent(ctx, tx, RegistrationEventDelete, actor, before, nil)
+	if err != nil {
+		return err
+	}
+
+	err = insertOutboxEvent(ctx, tx, OutboxRegistrationDeleted, before.OrgID, before.UID, before)
 	if err != nil {
 		return err
 	}
 
-	if count != 1 {
-		return ErrRegistrationNotFound
+	if err := tx.Commit(); err != nil {
+		return err
 	}
 
-	l.Log.Info("Deleted registration", "orgID", orgID, "uid", uid)
+	l.Log.Info("Deleted registration", "orgID", orgID, "uid", uid, "actor", actor)
 	return nil
 }
 
-// implement our own teeny scanner interface so we can use both sql.Row and/or sql.Rows
-type scanner interface {
-	Scan(dest ...any) error
+func (p *postgresStore) Review(ctx context.Context, orgID, uid string, status RegistrationStatus, actor string) (*Registration, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rollback(tx)
+
+	before, err := scanRegistration(tx.QueryRowContext(ctx,
+		`select `+registrationColumns+` from registrations where org_id = $1 and uid = $2 and deleted_at is null for update`,
+		orgID,
+		uid,
+	))
+	if err != nil {
+		return nil, err
+	}
+	if before.Status != RegistrationPending {
+		return nil, ErrRegistrationNotPending
+	}
+
+	after, err := scanRegistration(tx.QueryRowContext(ctx,
+		`update registrations set status = $2, reviewed_by = $3, reviewed_at = now()
+		where id = $1
+		returning `+registrationColumns,
+		before.ID,
+		status,
+		actor,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	eventType, outboxType := reviewEventTypes(status)
+	err = insertRegistrationEvent(ctx, tx, eventType, actor, before, after)
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertOutboxEvent(ctx, tx, outboxType, after.OrgID, after.UID, after)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	l.Log.Info("Reviewed registration", "orgID", orgID, "uid", uid, "status", status, "actor", actor)
+	return after, nil
 }
 
-func scanRegistration(row scanner) (*Registration, error) {
-	var (
-		id          string
-		orgID       string
-		username    string
-		uid         string
-		displayName string
-		extra       []byte
-		createdAt   time.Time
-	)
-	err := row.Scan(&id, &orgID, &username, &uid, &displayName, &extra, &createdAt)
+func (p *postgresStore) Restore(ctx context.Context, orgID, uid, actor string, retention time.Duration) (*Registration, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rollback(tx)
+
+	// the window is computed database side so it's against the same clock
+	// that set deleted_at
+	before, err := scanRegistration(tx.QueryRowContext(ctx,
+		`select `+registrationColumns+`
+		from registrations
+		where org_id = $1 and uid = $2
+		and deleted_at is not null
+		and deleted_at > now() - make_interval(secs => $3)
+		order by deleted_at desc
+		limit 1
+		for update`,
+		orgID,
+		uid,
+		retention.Seconds(),
+	))
 	if err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return nil, ErrRegistrationNotFound
-		}
 		return nil, err
 	}
 
-	var e map[string]any
-	if extra != nil {
-		err := json.Unmarshal(extra, &e)
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to unmarshal extra json")
+	after, err := scanRegistration(tx.QueryRowContext(ctx,
+		`update registrations set deleted_at = null where id = $1 returning `+registrationColumns,
+		before.ID,
+	))
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return nil, ErrRegistrationAlreadyExists{Detail: pgErr.Detail}
 		}
+		return nil, err
+	}
+
+	err = insertRegistrationEvent(ctx, tx, RegistrationEventRestore, actor, before, after)
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertOutboxEvent(ctx, tx, OutboxRegistrationRestored, after.OrgID, after.UID, after)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
 	}
 
-	return &Registration{
-		ID:          id,
-		OrgID:       orgID,
-		Username:    username,
-		UID:         uid,
-		DisplayName: displayName,
-		Extra:       e,
-		CreatedAt:   createdAt,
-	}, nil
+	l.Log.Info("Restored registration", "orgID", orgID, "uid", uid, "actor", actor)
+	return after, nil
 }
 
-func (p *postgresStore) AllowedIP(ip string, orgID string) (bool, error) {
-	// selecting all of the rows that are allowlisted for the current org_id
-	// AND
-	// the ones that have the special `system` org_id -> this is from the migration from terraform.
-	rows, err := p.db.Query(`select ip_block from allowlist where org_id = $1 or org_id = 'system'`, orgID)
+func (p *postgresStore) Purge(ctx context.Context, retention time.Duration) (int, error) {
+	res, err := p.db.ExecContext(ctx,
+		`delete from registrations where deleted_at is not null and deleted_at < now() - make_interval(secs => $1)`,
+		retention.Seconds(),
+	)
 	if err != nil {
-		return false, err
+		return 0, err
 	}
-	defer rows.Close()
 
-	var blocks []string
-	for rows.Next() {
-		var block string
-		err := rows.Scan(&block)
-		if err != nil {
-			return false, nil
-		}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
 
-		blocks = append(blocks, block)
+	return int(count), nil
+}
+
+func (p *postgresStore) UpdateLastSeen(ctx context.Context, seen map[string]time.Time) error {
+	uids := make([]string, 0, len(seen))
+	times := make([]time.Time, 0, len(seen))
+	for uid, t := range seen {
+		uids = append(uids, uid)
+		times = append(times, t.UTC())
 	}
 
-	// Loop over blocks and see if they contain the IP
-	for _, block := range blocks {
-		_, ipnet, err := net.ParseCIDR(block)
-		if err != nil {
-			return false, err
-		}
+	// one statement for the whole batch, greatest() ignores the null of a
+	// never-seen registration
+	_, err := p.db.ExecContext(ctx,
+		`update registrations r
+		set last_seen_at = greatest(r.last_seen_at, v.seen)
+		from unnest($1::varchar[], $2::timestamptz[]) as v(uid, seen)
+		where r.uid = v.uid and r.deleted_at is null`,
+		uids,
+		times,
+	)
+	return err
+}
 
-		// also trusting that the forwarded-for header is a "real" ip since it is set by the gateway
-		if ipnet.Contains(net.ParseIP(ip)) {
-			return true, nil
-		}
+func (p *postgresStore) History(ctx context.Context, orgID, uid string) ([]RegistrationEvent, error) {
+	return registrationHistory(ctx, p.db, postgresDialect, orgID, uid)
+}
+
+// insertRegistrationEvent writes the audit row for a mutation, it is always
+// called within the same transaction as the mutation itself.
+func insertRegistrationEvent(ctx context.Context, tx *sql.Tx, t RegistrationEventType, actor string, before, after *Registration) error {
+	row, err := newRegistrationEventRow(before, after)
+	if err != nil {
+		return err
 	}
 
-	return false, nil
+	_, err = tx.ExecContext(ctx,
+		`insert into registration_events
+		(event_type, org_id, uid, actor, before_snapshot, after_snapshot)
+		values ($1, $2, $3, $4, $5::jsonb, $6::jsonb)`,
+		t,
+		row.orgID,
+		row.uid,
+		actor,
+		row.before,
+		row.after,
+	)
+	return err
 }
 
-func (p *postgresStore) AllowAddress(ip *AllowlistBlock) error {
-	_, err := p.db.Exec(`insert into allowlist (ip_block, org_id) values ($1, $2)`, ip.IPBlock, ip.OrgID)
+// insertOutboxEvent queues a change event for the dispatcher, like the audit
+// row it is always written in the same transaction as the change.
+func insertOutboxEvent(ctx context.Context, tx *sql.Tx, t OutboxEventType, orgID, key string, payload any) error {
+	e, err := newOutboxEvent(t, orgID, key, payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`insert into outbox_events (event_type, org_id, key, payload) values ($1, $2, $3, $4::jsonb)`,
+		e.Type,
+		e.OrgID,
+		e.Key,
+		string(e.Payload),
+	)
 	return err
 }
 
-func (p *postgresStore) DenyAddress(ip *AllowlistBlock) error {
-	res, err := p.db.Exec(`delete from allowlist where ip_block=$1 and org_id=$2`, ip.IPBlock, ip.OrgID)
+// rollback is meant to be deferred right after starting a transaction, it is
+// a no-op once the transaction has been committed.
+func rollback(tx *sql.Tx) {
+	if err := tx.Rollback(); err != nil && !errors.Is(err, sql.ErrTxDone) {
+		l.Log.Error(err, "failed to rollback transaction")
+	}
+}
+
+// certificateColumns splits an optional certificate into nullable column values
+func certificateColumns(c *Certificate) (fingerprint, serial *string, notAfter *time.Time) {
+	if c == nil {
+		return nil, nil, nil
+	}
+	return &c.Fingerprint, &c.Serial, &c.NotAfter
+}
+
+// utcOrNil is an optional time in UTC, the same as every other time written
+func utcOrNil(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	u := t.UTC()
+	return &u
+}
+
+func (p *postgresStore) AllowedIP(ctx context.Context, ip string, orgID string) (bool, error) {
+	// also trusting that the forwarded-for header is a "real" ip since it is set by the gateway
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	// inet has no zones, no block contains a zoned address anyway
+	if err != nil || addr.Zone() != "" {
+		return false, nil
+	}
+
+	// the rows that are allowlisted for the current org_id AND the ones that
+	// have the special `system` org_id -> this is from the migration from
+	// terraform. IPv4-mapped addresses are unmapped since an IPv4 cidr never
+	// contains an IPv6 inet. Expired blocks are left for the cleaner.
+	var allowed bool
+	row := p.db.QueryRowContext(ctx, `select exists(select 1 from allowlist
+		where (org_id = $1 or org_id = 'system') and ip_block >>= $2::inet
+		and (expires_at is null or expires_at > now()))`, orgID, addr.Unmap().String())
+	if err := row.Scan(&allowed); err != nil {
+		return false, err
+	}
+
+	return allowed, nil
+}
+
+func (p *postgresStore) AllowAddress(ctx context.Context, ip *AllowlistBlock) error {
+	if err := normalizeAllowlistBlock(ip); err != nil {
+		return err
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	defer rollback(tx)
+
+	row := tx.QueryRowContext(ctx,
+		`insert into allowlist (ip_block, org_id, expires_at, description, created_by)
+		values ($1::cidr, $2, $3, nullif($4, ''), nullif($5, ''))
+		returning created_at`,
+		ip.IPBlock, ip.OrgID, utcOrNil(ip.ExpiresAt), ip.Description, ip.CreatedBy,
+	)
+	if err := row.Scan(&ip.CreatedAt); err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+			return ErrAddressAlreadyAllowListed
+		}
+		return err
+	}
+
+	if err := insertOutboxEvent(ctx, tx, OutboxAllowlistAdded, ip.OrgID, ip.IPBlock, ip); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
 
-	rows, err := res.RowsAffected()
+func (p *postgresStore) DenyAddress(ctx context.Context, ip *AllowlistBlock) error {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer rollback(tx)
+
+	// compared as text, a block that isn't in canonical form can't be stored
+	// and would only fail the cast
+	removed, err := scanAllowlistBlock(tx.QueryRowContext(ctx,
+		`delete from allowlist where ip_block::text=$1 and org_id=$2 returning `+allowlistColumns,
+		ip.IPBlock, ip.OrgID,
+	))
 	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrAddressNotAllowListed
+		}
 		return err
 	}
-	if rows == 0 {
-		return ErrAddressNotAllowListed
+
+	if err := insertOutboxEvent(ctx, tx, OutboxAllowlistRemoved, removed.OrgID, removed.IPBlock, removed); err != nil {
+		return err
 	}
 
-	return nil
+	return tx.Commit()
 }
 
-func (p *postgresStore) AllowedAddresses(orgID string) ([]AllowlistBlock, error) {
-	rows, err := p.db.Query(`select
-		org_id, ip_block, created_at
-		from allowlist
-		where org_id = $1`, orgID)
+func (p *postgresStore) AllowedAddresses(ctx context.Context, orgID string, q AllowlistQuery) ([]AllowlistBlock, int, error) {
+	return listAllowlist(ctx, p.db, postgresDialect, orgID, q)
+}
+
+func (p *postgresStore) PurgeExpiredAddresses(ctx context.Context) (int, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer rollback(tx)
+
+	rows, err := tx.QueryContext(ctx,
+		`delete from allowlist where expires_at is not null and expires_at <= now() returning `+allowlistColumns)
+	if err != nil {
+		return 0, err
+	}
+
+	removed, err := collectRows(rows, scanAllowlistBlock)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range removed {
+		b := &removed[i]
+		if err := insertOutboxEvent(ctx, tx, OutboxAllowlistRemoved, b.OrgID, b.IPBlock, b); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(removed), tx.Commit()
+}
+
+const allowlistColumns = `org_id, ip_block::text, created_at, expires_at, coalesce(description, ''), coalesce(created_by, '')`
+
+func (p *postgresStore) PoolStats() sql.DBStats {
+	return p.db.Stats()
+}
+
+func (p *postgresStore) DumpSnapshot(ctx context.Context) (*Snapshot, error) {
+	// registrations and the allowlist are read from the same point in time
+	tx, err := p.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer rollback(tx)
+
+	snap := newSnapshot()
+
+	rows, err := tx.QueryContext(ctx, `select `+registrationColumns+` from registrations
+		where deleted_at is null
+		order by created_at, id`)
 	if err != nil {
 		return nil, err
 	}
+	if snap.Registrations, err = collectRows(rows, scanRegistration); err != nil {
+		return nil, err
+	}
+
+	blocks, err := tx.QueryContext(ctx, `select `+allowlistColumns+` from allowlist
+		order by org_id collate "C", created_at, ip_block::text collate "C"`)
+	if err != nil {
+		return nil, err
+	}
+	if snap.Allowlist, err = collectRows(blocks, scanAllowlistBlock); err != nil {
+		return nil, err
+	}
+
+	return snap, nil
+}
 
-	addresses := make([]AllowlistBlock, 0)
-	for rows.Next() {
-		var (
-			orgID     string
-			block     string
-			createdAt time.Time
-		)
+func (p *postgresStore) LoadSnapshot(ctx context.Context, snap *Snapshot, actor string) ([]SnapshotConflict, error) {
+	if err := snap.validate(); err != nil {
+		return nil, err
+	}
 
-		err = rows.Scan(&orgID, &block, &createdAt)
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rollback(tx)
+
+	// like Import, every row gets a savepoint so all the conflicts can be
+	// reported before the whole thing is rolled back
+	conflicts := make([]SnapshotConflict, 0)
+	for i := range snap.Registrations {
+		r := &snap.Registrations[i]
+		err := withSavepoint(ctx, tx, func() error {
+			_, err := insertRegistration(ctx, tx, r, actor, true)
+			return err
+		})
+		if errors.Is(err, ErrRegistrationAlreadyExists{}) {
+			conflicts = append(conflicts, SnapshotConflict{Type: snapshotRegistration, Index: i, Key: r.UID, Error: err.Error()})
+			continue
+		}
 		if err != nil {
 			return nil, err
 		}
+	}
 
-		addresses = append(addresses, AllowlistBlock{
-			IPBlock:   block,
-			OrgID:     orgID,
-			CreatedAt: createdAt,
+	for i := range snap.Allowlist {
+		b := &snap.Allowlist[i]
+		err := withSavepoint(ctx, tx, func() error {
+			_, err := tx.ExecContext(ctx,
+				`insert into allowlist (ip_block, org_id, created_at, expires_at, description, created_by)
+				values ($1::cidr, $2, $3, $4, nullif($5, ''), nullif($6, ''))`,
+				b.IPBlock, b.OrgID, b.CreatedAt.UTC(), utcOrNil(b.ExpiresAt), b.Description, b.CreatedBy)
+			var pgErr *pgconn.PgError
+			if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+				return ErrAddressAlreadyAllowListed
+			}
+			return err
 		})
+		if errors.Is(err, ErrAddressAlreadyAllowListed) {
+			conflicts = append(conflicts, SnapshotConflict{Type: snapshotAllowlist, Index: i, Key: b.OrgID + "/" + b.IPBlock, Error: err.Error()})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return conflicts, ErrSnapshotConflict
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	l.Log.Info("Loaded snapshot", "registrations", len(snap.Registrations), "allowlist", len(snap.Allowlist), "actor", actor)
+	return conflicts, nil
+}
+
+// withSavepoint runs fn inside a savepoint, if fn fails only its own changes
+// are rolled back and the transaction carries on. It's plain sql so sqlite
+// uses it as well.
+func withSavepoint(ctx context.Context, tx *sql.Tx, fn func() error) error {
+	if _, err := tx.ExecContext(ctx, "savepoint row_savepoint"); err != nil {
+		return err
+	}
+
+	fnErr := fn()
+	if fnErr != nil {
+		if _, err := tx.ExecContext(ctx, "rollback to savepoint row_savepoint"); err != nil {
+			return err
+		}
+	}
+
+	// rolling back to a savepoint keeps it around, it's released either way
+	if _, err := tx.ExecContext(ctx, "release savepoint row_savepoint"); err != nil {
+		return err
+	}
+	return fnErr
+}
+
+func (p *postgresStore) ClaimOutbox(ctx context.Context, limit int, lease time.Duration) ([]OutboxEvent, error) {
+	// skip locked lets dispatchers on several replicas claim side by side
+	// without blocking on each other or claiming the same events
+	rows, err := p.db.QueryContext(ctx, `update outbox_events
+	set next_attempt_at = now() + make_interval(secs => $2)
+	where id in (
+		select id from outbox_events
+		where delivered_at is null and next_attempt_at <= now()
+		order by next_attempt_at, id
+		limit $1
+		for update skip locked
+	)
+	returning `+outboxEventColumns,
+		limit,
+		lease.Seconds(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := collectRows(rows, scanOutboxEvent)
+	if err != nil {
+		return nil, err
+	}
+
+	// returning doesn't keep the order of the subquery
+	slices.SortFunc(out, func(a, b OutboxEvent) int { return cmp.Compare(a.ID, b.ID) })
+	return out, nil
+}
+
+func (p *postgresStore) MarkOutboxDelivered(ctx context.Context, id int64) error {
+	_, err := p.db.ExecContext(ctx, `update outbox_events set delivered_at = now(), last_error = null where id = $1`, id)
+	return err
+}
+
+func (p *postgresStore) MarkOutboxFailed(ctx context.Context, id int64, retryIn time.Duration, reason string) error {
+	_, err := p.db.ExecContext(ctx,
+		`update outbox_events set
+		attempts = attempts + 1,
+		last_error = $2,
+		next_attempt_at = now() + make_interval(secs => $3)
+		where id = $1`,
+		id,
+		reason,
+		retryIn.Seconds(),
+	)
+	return err
+}
+
+func (p *postgresStore) Quota(ctx context.Context, orgID string, defaultLimit int) (*Quota, error) {
+	return postgresQuota(ctx, p.db, orgID, defaultLimit)
+}
+
+// rowQuerier is either the db or a transaction
+type rowQuerier interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+func postgresQuota(ctx context.Context, db rowQuerier, orgID string, defaultLimit int) (*Quota, error) {
+	var (
+		used     int
+		override sql.NullInt64
+	)
+	err := db.QueryRowContext(ctx, `select
+		(select count(id) from registrations where org_id = $1 and deleted_at is null),
+		(select max_registrations from org_quotas where org_id = $1)`,
+		orgID,
+	).Scan(&used, &override)
+	if err != nil {
+		return nil, err
+	}
+
+	return newQuota(orgID, used, nullInt(override), defaultLimit), nil
+}
+
+func nullInt(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	i := int(n.Int64)
+	return &i
+}
+
+func (p *postgresStore) SetQuotaOverride(ctx context.Context, orgID string, limit *int) error {
+	if limit == nil {
+		_, err := p.db.ExecContext(ctx, `delete from org_quotas where org_id = $1`, orgID)
+		return err
+	}
+
+	_, err := p.db.ExecContext(ctx,
+		`insert into org_quotas (org_id, max_registrations) values ($1, $2)
+		on conflict (org_id) do update set max_registrations = excluded.max_registrations, updated_at = now()`,
+		orgID,
+		*limit,
+	)
+	return err
+}
+
+func (p *postgresStore) CreateEnrollmentCode(ctx context.Context, c *EnrollmentCode, codeHash string) error {
+	return p.db.QueryRowContext(ctx,
+		`insert into enrollment_codes (code_hash, org_id, username, expires_at)
+		values ($1, $2, $3, $4)
+		returning id, created_at`,
+		codeHash, c.OrgID, c.Username, c.ExpiresAt.UTC(),
+	).Scan(&c.ID, &c.CreatedAt)
+}
+
+func (p *postgresStore) EnrollmentCodes(ctx context.Context, orgID string) ([]EnrollmentCode, error) {
+	rows, err := p.db.QueryContext(ctx,
+		`select `+enrollmentCodeColumns+` from enrollment_codes where org_id = $1 order by created_at desc, id desc`,
+		orgID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return collectRows(rows, scanEnrollmentCode)
+}
+
+func (p *postgresStore) FindEnrollmentCode(ctx context.Context, codeHash string) (*EnrollmentCode, error) {
+	c, err := scanEnrollmentCode(p.db.QueryRowContext(ctx,
+		`select `+enrollmentCodeColumns+` from enrollment_codes
+		where code_hash = $1 and used_at is null and expires_at > now()`,
+		codeHash,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrEnrollmentCodeInvalid
+	}
+	return c, err
+}
+
+func (p *postgresStore) Enroll(ctx context.Context, r *Registration, codeHash string, defaultLimit int) (*EnrollmentCode, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rollback(tx)
+
+	// the row lock makes a concurrent enroll with the same code wait for this
+	// transaction, and find the code used once it commits
+	c, err := scanEnrollmentCode(tx.QueryRowContext(ctx,
+		`update enrollment_codes set used_at = now(), used_by = $2
+		where code_hash = $1 and used_at is null and expires_at > now()
+		returning `+enrollmentCodeColumns,
+		codeHash, r.UID,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrEnrollmentCodeInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r.OrgID, r.Username = c.OrgID, c.Username
+	created, err := createRegistration(ctx, tx, r, &defaultLimit)
+	if err != nil {
+		return nil, err
 	}
-	return addresses, nil
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	l.Log.Info("Enrolled registration", "id", created.ID, "org_id", r.OrgID, "username", r.Username, "uid", r.UID, "code_id", c.ID)
+	return c, nil
+}
+
+func (p *postgresStore) OrgSettings(ctx context.Context, orgID string) (*OrgSettings, error) {
+	settings := &OrgSettings{OrgID: orgID}
+	err := p.db.QueryRowContext(ctx, `select require_approval from org_settings where org_id = $1`, orgID).
+		Scan(&settings.RequireApproval)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func (p *postgresStore) SetOrgSettings(ctx context.Context, s *OrgSettings) error {
+	_, err := p.db.ExecContext(ctx,
+		`insert into org_settings (org_id, require_approval) values ($1, $2)
+		on conflict (org_id) do update set require_approval = excluded.require_approval, updated_at = now()`,
+		s.OrgID,
+		s.RequireApproval,
+	)
+	return err
 }
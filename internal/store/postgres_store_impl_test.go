@@ -1,338 +1,156 @@
 package store
 
 import (
-	"database/sql"
+	"context"
+	"net"
+	"net/url"
 	"os"
 	"strconv"
 	"testing"
 	"time"
 
+	embeddedpostgres "github.com/fergusstrange/embedded-postgres"
 	"github.com/redhatinsights/mbop/internal/config"
 	l "github.com/redhatinsights/mbop/internal/logger"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
 
-type TestSuite struct {
-	suite.Suite
-	db    *sql.DB
-	store Store
-}
-
-func (suite *TestSuite) SetupSuite() {
+func TestPostgresStore(t *testing.T) {
 	_ = l.Init()
+	startPostgres(t)
+
 	store, err := setupPostgresStore()
 	if err != nil {
-		suite.FailNow("Failed to get postgres store", "%v", err)
+		t.Fatalf("failed to get postgres store: %v", err)
 	}
-	suite.db = store.db
-	suite.store = store
-}
+	t.Cleanup(func() { store.db.Close() })
 
-func (suite *TestSuite) TearDownSuite() {
-	// teardown after we're all done, using the same query we run before each test.
-	suite.BeforeTest("", "teardown")
-	err := suite.db.Close()
-	if err != nil {
-		suite.FailNow("Failed to close db")
-	}
-}
+	suite.Run(t, postgresStoreSuite(store))
 
-func (suite *TestSuite) BeforeTest(_, testName string) {
-	_, err := suite.db.Exec(`delete from registrations`)
-	if err != nil {
-		suite.FailNow("failed to clear out table for test", "test %v, error: %v", testName, err)
-	}
+	t.Run("HistoryWithinTransaction", func(t *testing.T) { testPostgresHistoryWithinTransaction(t, store) })
 
-	_, err = suite.db.Exec(`delete from allowlist`)
-	if err != nil {
-		suite.FailNow("failed to clear out table for test", "test %v, error: %v", testName, err)
+	// the whole suite again with sessions ahead of and behind UTC by more
+	// than any window in the tests, none of it may depend on the session
+	for _, tz := range []string{"Pacific/Kiritimati", "Pacific/Pago_Pago"} {
+		t.Run("In"+tz, func(t *testing.T) { suite.Run(t, postgresStoreSuite(postgresStoreInTimeZone(t, tz))) })
 	}
 }
 
-func TestSuiteRun(t *testing.T) {
-	suite.Run(t, new(TestSuite))
+// postgresStoreSuite runs the conformance suite against store, clearing out
+// every table ahead of each test
+func postgresStoreSuite(store *postgresStore) *StoreSuite {
+	return &StoreSuite{NewStore: func(t *testing.T) Store {
+		for _, table := range []string{"registrations", "registration_events", "allowlist", "outbox_events", "org_quotas", "enrollment_codes", "org_settings"} {
+			if _, err := store.db.Exec(`delete from ` + table); err != nil {
+				t.Fatalf("failed to clear out %s: %v", table, err)
+			}
+		}
+		// the same wrapper SetupStore puts around it
+		return withTimeout(store, 5*time.Second)
+	}}
 }
 
-func (suite *TestSuite) TestCreateWithoutExtra() {
-	r := Registration{
-		OrgID:    "1234",
-		UID:      "1234",
-		Username: "foobar",
-	}
-	id, err := suite.store.Create(&r)
-	suite.Nil(err, "failed to insert without extra")
-	suite.NotEqual("", id, "something funky with returning the id")
-}
+// postgresStoreInTimeZone connects to the test database with a session
+// TimeZone other than UTC
+func postgresStoreInTimeZone(t *testing.T, tz string) *postgresStore {
+	t.Helper()
 
-func (suite *TestSuite) TestCreateWithExtra() {
-	r := Registration{
-		OrgID:    "1234",
-		Username: "foobar",
-		UID:      "1234",
-		Extra:    map[string]interface{}{"thing": true},
+	dsn, err := postgresDSN(config.Get())
+	if err != nil {
+		t.Fatalf("failed to build dsn: %v", err)
 	}
-	id, err := suite.store.Create(&r)
-	suite.Nil(err, "failed to insert")
-	suite.NotEqual("", id, "something funky with returning the id")
-}
-
-func (suite *TestSuite) TestCreateDuplicateDisplayNameSameOrg() {
-	r := Registration{
-		OrgID:       "1234",
-		Username:    "foobar",
-		UID:         "1234",
-		DisplayName: "dupe",
+	// pgx sends unknown parameters to the server as session settings
+	db, err := openPostgres(dsn + "&timezone=" + url.QueryEscape(tz))
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
 	}
-	_, err := suite.store.Create(&r)
-	suite.Nil(err, "failed to insert")
+	t.Cleanup(func() { db.Close() })
 
-	r2 := Registration{
-		OrgID:       "1234",
-		Username:    "foobar",
-		UID:         "2345",
-		DisplayName: "dupe",
+	var got string
+	if err := db.QueryRow(`show timezone`).Scan(&got); err != nil || got != tz {
+		t.Fatalf("session timezone is %q, not %q: %v", got, tz, err)
 	}
-	_, err = suite.store.Create(&r2)
-	suite.Error(err, "inserted successfully even when it shouldn't have")
+	return &postgresStore{db: db}
 }
 
-func (suite *TestSuite) TestCreateDuplicateDisplayNameDifferentOrg() {
-	r := Registration{
-		OrgID:       "1234",
-		Username:    "foobar",
-		UID:         "1234",
-		DisplayName: "dupe",
-	}
-	_, err := suite.store.Create(&r)
-	suite.Nil(err, "failed to insert")
-
-	r2 := Registration{
-		OrgID:       "2345",
-		Username:    "foobar",
-		UID:         "2345",
-		DisplayName: "dupe",
+// events written in one transaction share created_at, they still come back in
+// the order they were written
+func testPostgresHistoryWithinTransaction(t *testing.T, store *postgresStore) {
+	ctx := context.Background()
+	tx, err := store.db.BeginTx(ctx, nil)
+	if err != nil {
+		t.Fatalf("failed to begin: %v", err)
 	}
-	_, err = suite.store.Create(&r2)
-	suite.Nil(err)
-}
+	defer rollback(tx)
 
-func (suite *TestSuite) TestDelete() {
-	r := Registration{
-		OrgID:    "1234",
-		Username: "foobar",
-		UID:      "1234",
-		Extra:    map[string]interface{}{"thing": true},
+	r := &Registration{OrgID: "1234", UID: "same-tx", DisplayName: "one"}
+	names := []string{"one", "two", "three", "four", "five"}
+	for i, name := range names {
+		before := *r
+		r.DisplayName = name
+		if err := insertRegistrationEvent(ctx, tx, RegistrationEventUpdate, strconv.Itoa(i), &before, r); err != nil {
+			t.Fatalf("failed to insert event: %v", err)
+		}
 	}
-	_, err := suite.store.Create(&r)
-	suite.Nil(err, "failed to setup for deletion")
-
-	err = suite.store.Delete("1234", "1234")
-	suite.Nil(err, "failed to delete item")
-}
-
-func (suite *TestSuite) TestDeleteNotExisting() {
-	err := suite.store.Delete("1234", "1234")
-	suite.Error(err, "failed to fail to delete item")
-}
-
-func (suite *TestSuite) TestFindOne() {
-	r := Registration{
-		OrgID:    "1234",
-		Username: "foobar",
-		UID:      "1234",
-		Extra:    map[string]interface{}{"thing": true},
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("failed to commit: %v", err)
 	}
-	_, err := suite.store.Create(&r)
-	suite.Nil(err, "failed to insert: %v", err)
 
-	found, err := suite.store.Find("1234", "1234")
-	suite.Nil(err, "failed to find one registration")
-	suite.Equal(found.UID, "1234")
-	suite.Equal(found.OrgID, "1234")
-	suite.Equal(found.Username, "foobar")
-	suite.WithinDuration(found.CreatedAt, time.Now(), 5*time.Second)
-}
-
-func (suite *TestSuite) TestFindByUID() {
-	r := Registration{
-		OrgID:    "1234",
-		Username: "foobar",
-		UID:      "1234",
-		Extra:    map[string]interface{}{"thing": true},
+	events, err := store.History(ctx, "1234", "same-tx")
+	assert.Nil(t, err)
+	assert.Len(t, events, len(names))
+	for i, e := range events {
+		assert.Equal(t, strconv.Itoa(i), e.Actor)
+		assert.Equal(t, names[i], e.After.DisplayName)
 	}
-	_, err := suite.store.Create(&r)
-	suite.Nil(err, "failed to insert: %v", err)
-
-	found, err := suite.store.FindByUID("1234")
-	suite.Nil(err, "failed to find one registration")
-	suite.Equal(found.UID, "1234")
-	suite.Equal(found.OrgID, "1234")
-	suite.Equal(found.Username, "foobar")
-	suite.WithinDuration(found.CreatedAt, time.Now(), 5*time.Second)
-}
-
-func (suite *TestSuite) TestFindByUIDNotThere() {
-	_, err := suite.store.FindByUID("1234")
-	suite.Error(err, "failed to not find one registration")
-}
-
-func (suite *TestSuite) TestFindOneNotThere() {
-	_, err := suite.store.Find("1234", "1234")
-	suite.Error(err, "failed to not find one registration")
 }
 
-func (suite *TestSuite) TestFindAll() {
-	r := Registration{OrgID: "1234", UID: "1234", DisplayName: "one"}
-	_, err := suite.store.Create(&r)
-	suite.Nil(err, "failed to insert")
-
-	r.OrgID = "1234"
-	r.UID = "2345"
-	r.DisplayName = "two"
-	_, err = suite.store.Create(&r)
-	suite.Nil(err, "failed to insert")
-
-	_, count, err := suite.store.All("1234", 0, 0)
-	suite.Nil(err, "failed to list all registrations")
-	suite.Equal(count, 2)
-}
-
-func (suite *TestSuite) TestUpdate() {
-	r := Registration{OrgID: "1234", UID: "1234"}
-	_, err := suite.store.Create(&r)
-	suite.Nil(err, "failed to insert")
-
-	err = suite.store.Update(
-		&r,
-		&RegistrationUpdate{Extra: &map[string]interface{}{"thing": true}},
-	)
-	suite.Nil(err, "failed to update registration")
-}
-
-func (suite *TestSuite) TestFindAllWithPagination() {
-	for i := 0; i < 10; i++ {
-		s := strconv.Itoa(i)
-		_, err := suite.store.Create(&Registration{
-			OrgID:       "a",
-			UID:         s,
-			DisplayName: s,
-		})
-		suite.Nil(err)
-	}
-
-	// stepping through the pages ensuring they start/end with where it's expected
-	regs, count, err := suite.store.All("a", 5, 0)
-	suite.Nil(err)
-	suite.Equal(10, count)
-	suite.Equal(5, len(regs))
-	suite.Equal("9", regs[0].UID)
-	suite.Equal("5", regs[len(regs)-1].UID)
-
-	regs, count, err = suite.store.All("a", 5, 5)
-	suite.Nil(err)
-	suite.Equal(10, count)
-	suite.Equal(5, len(regs))
-	suite.Equal("4", regs[0].UID)
-	suite.Equal("0", regs[len(regs)-1].UID)
-
-	regs, count, err = suite.store.All("a", 5, 10)
-	suite.Nil(err)
-	suite.Equal(10, count)
-	suite.Equal(0, len(regs))
-}
-
-func (suite *TestSuite) TestIPAllowedHappyPath() {
-	config.Reset()
-	defer config.Reset()
-	os.Setenv("ALLOWLIST_ENABLED", "true")
-	defer os.Setenv("ALLOWLIST_ENABLED", "false")
-
-	suite.Nil(suite.store.AllowAddress(&AllowlistBlock{
-		IPBlock: "10.0.0.1/24",
-		OrgID:   "1234",
-	}))
-
-	allowed, err := suite.store.AllowedIP("10.0.0.100", "1234")
-	suite.True(allowed)
-	suite.Nil(err)
-}
-
-func (suite *TestSuite) TestIPAllowedBadPath() {
-	config.Reset()
-	defer config.Reset()
-	os.Setenv("ALLOWLIST_ENABLED", "true")
-	defer os.Setenv("ALLOWLIST_ENABLED", "false")
-
-	suite.Nil(suite.store.AllowAddress(&AllowlistBlock{
-		IPBlock: "10.0.0.1/24",
-		OrgID:   "1234",
-	}))
-
-	allowed, err := suite.store.AllowedIP("8.8.8.8", "1234")
-	suite.False(allowed)
-	suite.Nil(err)
-}
-
-func (suite *TestSuite) TestIPAllowedHappyMultiple() {
+// startPostgres points the config at a throwaway postgres started just for the
+// test run, unless DATABASE_HOST is set in which case that database is used
+// as-is (e.g. a service container in CI).
+func startPostgres(t *testing.T) {
+	t.Helper()
 	config.Reset()
-	defer config.Reset()
-	os.Setenv("ALLOWLIST_ENABLED", "true")
-	defer os.Setenv("ALLOWLIST_ENABLED", "false")
+	t.Cleanup(config.Reset)
 
-	suite.Nil(suite.store.AllowAddress(&AllowlistBlock{
-		IPBlock: "10.0.0.1/24",
-		OrgID:   "1234",
-	}))
-	suite.Nil(suite.store.AllowAddress(&AllowlistBlock{
-		IPBlock: "192.168.1.1/24",
-		OrgID:   "1234",
-	}))
-
-	for _, ip := range []string{"10.0.0.100", "192.168.1.100", "10.0.0.20", "192.168.1.20"} {
-		allowed, err := suite.store.AllowedIP(ip, "1234")
-		suite.True(allowed)
-		suite.Nil(err)
+	if _, ok := os.LookupEnv("DATABASE_HOST"); ok {
+		return
 	}
-}
 
-func (suite *TestSuite) TestIPAllowedWithSystem() {
-	config.Reset()
-	defer config.Reset()
-	os.Setenv("ALLOWLIST_ENABLED", "true")
-	defer os.Setenv("ALLOWLIST_ENABLED", "false")
-
-	suite.Nil(suite.store.AllowAddress(&AllowlistBlock{
-		IPBlock: "10.0.0.1/24",
-		OrgID:   "1234",
-	}))
-	suite.Nil(suite.store.AllowAddress(&AllowlistBlock{
-		IPBlock: "192.168.1.1/24",
-		OrgID:   "system",
-	}))
-
-	for _, ip := range []string{"10.0.0.100", "192.168.1.100", "10.0.0.20", "192.168.1.20"} {
-		allowed, err := suite.store.AllowedIP(ip, "1234")
-		suite.True(allowed)
-		suite.Nil(err)
+	port := freePort(t)
+	pg := embeddedpostgres.NewDatabase(embeddedpostgres.DefaultConfig().
+		Port(port).
+		Database("mbop").
+		Username("postgres").
+		Password("postgres").
+		RuntimePath(t.TempDir()).
+		Logger(nil))
+	// it's downloaded on first use, offline there's nothing to test against
+	if err := pg.Start(); err != nil {
+		t.Skipf("embedded postgres isn't available, set DATABASE_HOST to use a running database: %v", err)
 	}
-}
+	t.Cleanup(func() {
+		if err := pg.Stop(); err != nil {
+			t.Errorf("failed to stop embedded postgres: %v", err)
+		}
+	})
 
-func (suite *TestSuite) TestSingleIPCIDR() {
-	config.Reset()
-	defer config.Reset()
-	os.Setenv("ALLOWLIST_ENABLED", "true")
-	defer os.Setenv("ALLOWLIST_ENABLED", "false")
+	t.Setenv("DATABASE_HOST", "localhost")
+	t.Setenv("DATABASE_PORT", strconv.Itoa(int(port)))
+	t.Setenv("DATABASE_USER", "postgres")
+	t.Setenv("DATABASE_PASSWORD", "postgres")
+	t.Setenv("DATABASE_NAME", "mbop")
+}
 
-	suite.Nil(suite.store.AllowAddress(&AllowlistBlock{
-		IPBlock: "192.168.245.100/32",
-		OrgID:   "1234",
-	}))
+func freePort(t *testing.T) uint32 {
+	t.Helper()
 
-	allowed, err := suite.store.AllowedIP("192.168.245.100", "1234")
-	suite.True(allowed)
-	suite.Nil(err)
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to find a free port: %v", err)
+	}
+	defer lis.Close()
 
-	allowed, err = suite.store.AllowedIP("192.168.245.101", "1234")
-	suite.False(allowed)
-	suite.Nil(err)
+	return uint32(lis.Addr().(*net.TCPAddr).Port)
 }
@@ -0,0 +1,57 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	l "github.com/redhatinsights/mbop/internal/logger"
+)
+
+// RunPurger hard-deletes soft-deleted registrations that are older than the
+// retention window every interval, it blocks until ctx is cancelled.
+func RunPurger(ctx context.Context, interval, retention time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			count, err := GetStore().Purge(ctx, retention)
+			if err != nil {
+				l.Log.Error(err, "failed to purge deleted registrations")
+				continue
+			}
+
+			if count > 0 {
+				l.Log.Info("Purged deleted registrations", "count", count, "retention", retention.String())
+			}
+		}
+	}
+}
+
+// RunAllowlistCleaner deletes allowlist blocks that have expired every
+// interval, it blocks until ctx is cancelled. AllowedIP already ignores them,
+// this only keeps them from piling up.
+func RunAllowlistCleaner(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			count, err := GetStore().PurgeExpiredAddresses(ctx)
+			if err != nil {
+				l.Log.Error(err, "failed to delete expired allowlist blocks")
+				continue
+			}
+
+			if count > 0 {
+				l.Log.Info("Deleted expired allowlist blocks", "count", count)
+			}
+		}
+	}
+}
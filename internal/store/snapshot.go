@@ -0,0 +1,130 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+)
+
+// SnapshotVersion is the version of the snapshot documents written by
+// DumpSnapshot, LoadSnapshot only accepts this version
+const SnapshotVersion = 1
+
+var (
+	ErrInvalidSnapshot = errors.New("invalid snapshot")
+	// returned by LoadSnapshot when anything in the snapshot conflicts with
+	// what is already stored, nothing has been written in that case
+	ErrSnapshotConflict = errors.New("snapshot conflicts with the store, nothing was restored")
+)
+
+/*
+Snapshot is every live registration and allowlist block of every org, in a
+form that any backend can load. Registrations keep their ID, created_at,
+pinned certificate and last_seen_at so a restored store is a faithful copy;
+their history is not part of it.
+*/
+type Snapshot struct {
+	Version       int              `json:"version"`
+	CreatedAt     time.Time        `json:"created_at"`
+	Registrations []Registration   `json:"registrations"`
+	Allowlist     []AllowlistBlock `json:"allowlist"`
+}
+
+// SnapshotConflict is a row of a snapshot that couldn't be restored, Type is
+// either "registration" or "allowlist" and Index the row's position in that
+// list of the snapshot
+type SnapshotConflict struct {
+	Type  string `json:"type"`
+	Index int    `json:"index"`
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+const (
+	snapshotRegistration = "registration"
+	snapshotAllowlist    = "allowlist"
+)
+
+func newSnapshot() *Snapshot {
+	return &Snapshot{
+		Version:       SnapshotVersion,
+		CreatedAt:     time.Now().UTC(),
+		Registrations: make([]Registration, 0),
+		Allowlist:     make([]AllowlistBlock, 0),
+	}
+}
+
+// ReadSnapshot decodes and validates a snapshot document
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	var snap Snapshot
+	if err := json.NewDecoder(r).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidSnapshot, err)
+	}
+
+	if err := snap.validate(); err != nil {
+		return nil, err
+	}
+
+	return &snap, nil
+}
+
+// Write encodes the snapshot document
+func (s *Snapshot) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+// validate checks the snapshot can be loaded, normalizing its allowlist blocks
+func (s *Snapshot) validate() error {
+	if s.Version != SnapshotVersion {
+		return fmt.Errorf("%w: unsupported version %d, expected %d", ErrInvalidSnapshot, s.Version, SnapshotVersion)
+	}
+
+	for i := range s.Registrations {
+		r := &s.Registrations[i]
+		if r.ID == "" || r.OrgID == "" || r.UID == "" || r.CreatedAt.IsZero() {
+			return fmt.Errorf("%w: registration %d needs an id, org_id, uid and created_at", ErrInvalidSnapshot, i)
+		}
+		if r.DeletedAt != nil {
+			return fmt.Errorf("%w: registration %d is deleted", ErrInvalidSnapshot, i)
+		}
+	}
+
+	for i := range s.Allowlist {
+		b := &s.Allowlist[i]
+		if b.IPBlock == "" || b.OrgID == "" || b.CreatedAt.IsZero() {
+			return fmt.Errorf("%w: allowlist block %d needs an ip_block, org_id and created_at", ErrInvalidSnapshot, i)
+		}
+		// restored the same way they'd be added
+		if err := normalizeAllowlistBlock(b); err != nil {
+			return fmt.Errorf("%w: allowlist block %d: %w", ErrInvalidSnapshot, i, err)
+		}
+	}
+
+	return nil
+}
+
+// sortSnapshot puts a snapshot in the order the sql backends dump it in
+func sortSnapshot(snap *Snapshot) {
+	sort.SliceStable(snap.Registrations, func(i, j int) bool {
+		a, b := &snap.Registrations[i], &snap.Registrations[j]
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c < 0
+		}
+		return a.ID < b.ID
+	})
+	sort.SliceStable(snap.Allowlist, func(i, j int) bool {
+		a, b := &snap.Allowlist[i], &snap.Allowlist[j]
+		if a.OrgID != b.OrgID {
+			return a.OrgID < b.OrgID
+		}
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c < 0
+		}
+		return a.IPBlock < b.IPBlock
+	})
+}
@@ -0,0 +1,1005 @@
+package store
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	l "github.com/redhatinsights/mbop/internal/logger"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+/*
+sqliteStore keeps everything in a single sqlite file for single-node
+deployments. The schema mirrors postgres with portable column types:
+
+  - ids are uuids generated here rather than by the database
+  - extra and the event snapshots are json text
+  - timestamps are fixed width UTC text (see sqliteTimeFormat), set from Go
+  - ip blocks are plain CIDR text matched in Go (blocksContain), where
+    postgres has a cidr column matched in sql
+
+sqlite only allows a single writer, so the pool is limited to one connection
+which also makes every transaction serializable.
+*/
+type sqliteStore struct {
+	db *sql.DB
+}
+
+// sqliteTimeFormat is fixed width so timestamps compare correctly as strings
+const sqliteTimeFormat = "2006-01-02T15:04:05.000000000Z"
+
+func sqliteTime(t time.Time) string {
+	return t.UTC().Format(sqliteTimeFormat)
+}
+
+func sqliteNullTime(t *time.Time) *string {
+	if t == nil {
+		return nil
+	}
+	s := sqliteTime(*t)
+	return &s
+}
+
+func (s *sqliteStore) All(ctx context.Context, orgID string, q RegistrationQuery) ([]Registration, int, error) {
+	return listRegistrations(ctx, s.db, sqliteDialect, orgID, q)
+}
+
+// sqliteRegistrationFilter is registrationFilter for sqlite, like is already
+// case-insensitive (for ascii) so it stands in for ilike
+func sqliteRegistrationFilter(orgID string, q RegistrationQuery) (string, []any) {
+	where := []string{"org_id = ?", "deleted_at is null"}
+	args := []any{orgID}
+
+	if q.Search != "" {
+		pattern := "%" + escapeLike(q.Search) + "%"
+		args = append(args, pattern, pattern)
+		where = append(where, `(display_name like ? escape '\' or uid like ? escape '\')`)
+	}
+	if q.Username != "" {
+		args = append(args, q.Username)
+		where = append(where, "username = ?")
+	}
+	if q.CreatedAfter != nil {
+		args = append(args, sqliteTime(*q.CreatedAfter))
+		where = append(where, "created_at > ?")
+	}
+	if q.CreatedBefore != nil {
+		args = append(args, sqliteTime(*q.CreatedBefore))
+		where = append(where, "created_at < ?")
+	}
+	if q.NotSeenSince != nil {
+		args = append(args, sqliteTime(*q.NotSeenSince))
+		where = append(where, "(last_seen_at is null or last_seen_at < ?)")
+	}
+	if q.Status != "" {
+		args = append(args, q.Status)
+		where = append(where, "status = ?")
+	}
+	// sorted so the same query always builds the same sql, the type check
+	// keeps numbers and booleans from matching their text like in postgres
+	for _, k := range slices.Sorted(maps.Keys(q.Extra)) {
+		args = append(args, k, q.Extra[k])
+		where = append(where, "exists (select 1 from json_each(extra) where key = ? and type = 'text' and value = ?)")
+	}
+
+	return strings.Join(where, " and "), args
+}
+
+// sqliteRegistrationOrder is registrationOrder for sqlite, where the default
+// binary collation already compares bytewise
+func sqliteRegistrationOrder(by RegistrationSortField, desc bool) string {
+	dir := " asc"
+	if desc {
+		dir = " desc"
+	}
+
+	var col string
+	switch by {
+	case SortByDisplayName:
+		col = "display_name"
+	case SortByUID:
+		col = "uid"
+	default:
+		col = "created_at"
+	}
+
+	return col + dir + ", id" + dir
+}
+
+func (s *sqliteStore) Find(ctx context.Context, orgID, uid string) (*Registration, error) {
+	return scanRegistration(s.db.QueryRowContext(ctx,
+		`select `+registrationColumns+` from registrations where org_id = ? and uid = ? and deleted_at is null limit 1`,
+		orgID,
+		uid,
+	))
+}
+
+func (s *sqliteStore) FindByUID(ctx context.Context, uid string) (*Registration, error) {
+	return scanRegistration(s.db.QueryRowContext(ctx,
+		`select `+registrationColumns+` from registrations where uid = ? and deleted_at is null limit 1`,
+		uid,
+	))
+}
+
+func (s *sqliteStore) Create(ctx context.Context, r *Registration) (string, error) {
+	return s.create(ctx, r, nil)
+}
+
+func (s *sqliteStore) CreateWithinQuota(ctx context.Context, r *Registration, defaultLimit int) (string, error) {
+	return s.create(ctx, r, &defaultLimit)
+}
+
+// create inserts a registration, checking the org's quota first unless
+// defaultLimit is nil. With the single connection nothing else can write
+// between the count and the insert.
+func (s *sqliteStore) create(ctx context.Context, r *Registration, defaultLimit *int) (string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer rollback(tx)
+
+	created, err := createSQLiteRegistration(ctx, tx, r, defaultLimit)
+	if err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	r.ID, r.CreatedAt = created.ID, created.CreatedAt
+	l.Log.Info("Created registration", "id", created.ID, "org_id", r.OrgID, "username", r.Username, "uid", r.UID, "display_name", r.DisplayName)
+	return created.ID, nil
+}
+
+// createSQLiteRegistration inserts r along with its outbox event, first
+// checking the org's quota unless defaultLimit is nil. There's only the one
+// connection, so nothing can create in between counting and inserting.
+func createSQLiteRegistration(ctx context.Context, tx *sql.Tx, r *Registration, defaultLimit *int) (*Registration, error) {
+	if defaultLimit != nil {
+		q, err := sqliteQuota(ctx, tx, r.OrgID, *defaultLimit)
+		if err != nil {
+			return nil, err
+		}
+		if q.Reached() {
+			return nil, ErrQuotaExceeded{Limit: *q.Limit}
+		}
+	}
+
+	created, err := insertSQLiteRegistration(ctx, tx, r, r.Username, false)
+	if err != nil {
+		return nil, err
+	}
+
+	err = insertSQLiteOutboxEvent(ctx, tx, OutboxRegistrationCreated, created.OrgID, created.UID, created)
+	if err != nil {
+		return nil, err
+	}
+
+	return created, nil
+}
+
+// insertSQLiteRegistration inserts a registration along with its create
+// event, fromSnapshot keeps r's own id, created_at, last_seen_at and review
+func insertSQLiteRegistration(ctx context.Context, tx *sql.Tx, r *Registration, actor string, fromSnapshot bool) (*Registration, error) {
+	extra, err := marshalExtra(r.Extra)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	id, createdAt := uuid.NewString(), now
+	var lastSeenAt, reviewedAt *time.Time
+	var reviewedBy *string
+	if fromSnapshot {
+		id, createdAt, lastSeenAt = r.ID, r.CreatedAt, r.LastSeenAt
+		if r.ReviewedAt != nil {
+			reviewedBy, reviewedAt = &r.ReviewedBy, r.ReviewedAt
+		}
+	}
+
+	fingerprint, serial, notAfter := certificateColumns(r.Certificate)
+	created, err := scanRegistration(tx.QueryRowContext(ctx,
+		`insert into registrations
+		(id, org_id, username, uid, display_name, extra, created_at, updated_at, cert_fingerprint, cert_serial, cert_not_after, last_seen_at,
+		status, reviewed_by, reviewed_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		returning `+registrationColumns,
+		id,
+		r.OrgID,
+		r.Username,
+		r.UID,
+		r.DisplayName,
+		extra,
+		sqliteTime(createdAt),
+		sqliteTime(now),
+		fingerprint,
+		serial,
+		sqliteNullTime(notAfter),
+		sqliteNullTime(lastSeenAt),
+		r.status(),
+		reviewedBy,
+		sqliteNullTime(reviewedAt),
+	))
+	if err != nil {
+		return nil, sqliteConflict(err)
+	}
+
+	if err := insertSQLiteRegistrationEvent(ctx, tx, RegistrationEventCreate, actor, nil, created); err != nil {
+		return nil, err
+	}
+
+	return created, nil
+}
+
+func (s *sqliteStore) Import(ctx context.Context, rows []BulkRegistration, actor string) ([]ImportResult, error) {
+	results, ok := ValidateBulkRegistrations(rows)
+	if !ok {
+		return results, ErrImportFailed
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rollback(tx)
+
+	// same as postgres, a savepoint per row lets us report on every row
+	for i := range rows {
+		err := withSavepoint(ctx, tx, func() error {
+			created, err := insertSQLiteRegistration(ctx, tx, rows[i].registration(), actor, false)
+			if err != nil {
+				return err
+			}
+			return insertSQLiteOutboxEvent(ctx, tx, OutboxRegistrationCreated, created.OrgID, created.UID, created)
+		})
+		if errors.Is(err, ErrRegistrationAlreadyExists{}) {
+			results[i].Error = err.Error()
+			ok = false
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !ok {
+		return results, ErrImportFailed
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	l.Log.Info("Imported registrations", "count", len(rows), "actor", actor)
+	return results, nil
+}
+
+func (s *sqliteStore) Update(ctx context.Context, r *Registration, update *RegistrationUpdate, actor string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer rollback(tx)
+
+	before, err := scanRegistration(tx.QueryRowContext(ctx,
+		`select `+registrationColumns+` from registrations where org_id = ? and uid = ? and deleted_at is null`,
+		r.OrgID,
+		r.UID,
+	))
+	if err != nil {
+		return err
+	}
+
+	// extra is merged here instead of with json_patch, which would drop keys
+	// that are set to null
+	merged := make(map[string]interface{}, len(before.Extra))
+	for k, v := range before.Extra {
+		merged[k] = v
+	}
+	if update.Extra != nil {
+		for k, v := range *update.Extra {
+			merged[k] = v
+		}
+	}
+	extra, err := marshalExtra(merged)
+	if err != nil {
+		return err
+	}
+
+	fingerprint, serial, notAfter := certificateColumns(update.Certificate)
+	after, err := scanRegistration(tx.QueryRowContext(ctx,
+		`update registrations set
+		display_name = coalesce(?, display_name),
+		extra = ?,
+		cert_fingerprint = coalesce(?, cert_fingerprint),
+		cert_serial = coalesce(?, cert_serial),
+		cert_not_after = coalesce(?, cert_not_after),
+		updated_at = ?
+		where id = ?
+		returning `+registrationColumns,
+		update.DisplayName,
+		extra,
+		fingerprint,
+		serial,
+		sqliteNullTime(notAfter),
+		sqliteTime(time.Now()),
+		before.ID,
+	))
+	if err != nil {
+		return sqliteConflict(err)
+	}
+
+	if err := insertSQLiteRegistrationEvent(ctx, tx, RegistrationEventUpdate, actor, before, after); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	l.Log.Info("Updated registration", "org_id", r.OrgID, "uid", r.UID, "actor", actor)
+	return nil
+}
+
+func (s *sqliteStore) Delete(ctx context.Context, orgID, uid, actor string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer rollback(tx)
+
+	before, err := scanRegistration(tx.QueryRowContext(ctx,
+		`select `+registrationColumns+` from registrations where org_id = ? and uid = ? and deleted_at is null`,
+		orgID,
+		uid,
+	))
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `update registrations set deleted_at = ? where id = ?`, sqliteTime(time.Now()), before.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := insertSQLiteRegistrationEvent(ctx, tx, RegistrationEventDelete, actor, before, nil); err != nil {
+		return err
+	}
+
+	if err := insertSQLiteOutboxEvent(ctx, tx, OutboxRegistrationDeleted, before.OrgID, before.UID, before); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	l.Log.Info("Deleted registration", "orgID", orgID, "uid", uid, "actor", actor)
+	return nil
+}
+
+func (s *sqliteStore) Review(ctx context.Context, orgID, uid string, status RegistrationStatus, actor string) (*Registration, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rollback(tx)
+
+	before, err := scanRegistration(tx.QueryRowContext(ctx,
+		`select `+registrationColumns+` from registrations where org_id = ? and uid = ? and deleted_at is null`,
+		orgID,
+		uid,
+	))
+	if err != nil {
+		return nil, err
+	}
+	if before.Status != RegistrationPending {
+		return nil, ErrRegistrationNotPending
+	}
+
+	now := sqliteTime(time.Now())
+	after, err := scanRegistration(tx.QueryRowContext(ctx,
+		`update registrations set status = ?, reviewed_by = ?, reviewed_at = ?, updated_at = ?
+		where id = ?
+		returning `+registrationColumns,
+		status,
+		actor,
+		now,
+		now,
+		before.ID,
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	eventType, outboxType := reviewEventTypes(status)
+	if err := insertSQLiteRegistrationEvent(ctx, tx, eventType, actor, before, after); err != nil {
+		return nil, err
+	}
+
+	if err := insertSQLiteOutboxEvent(ctx, tx, outboxType, after.OrgID, after.UID, after); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	l.Log.Info("Reviewed registration", "orgID", orgID, "uid", uid, "status", status, "actor", actor)
+	return after, nil
+}
+
+func (s *sqliteStore) Restore(ctx context.Context, orgID, uid, actor string, retention time.Duration) (*Registration, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rollback(tx)
+
+	before, err := scanRegistration(tx.QueryRowContext(ctx,
+		`select `+registrationColumns+`
+		from registrations
+		where org_id = ? and uid = ?
+		and deleted_at is not null
+		and deleted_at > ?
+		order by deleted_at desc
+		limit 1`,
+		orgID,
+		uid,
+		sqliteTime(time.Now().Add(-retention)),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := scanRegistration(tx.QueryRowContext(ctx,
+		`update registrations set deleted_at = null where id = ? returning `+registrationColumns,
+		before.ID,
+	))
+	if err != nil {
+		return nil, sqliteConflict(err)
+	}
+
+	if err := insertSQLiteRegistrationEvent(ctx, tx, RegistrationEventRestore, actor, before, after); err != nil {
+		return nil, err
+	}
+
+	if err := insertSQLiteOutboxEvent(ctx, tx, OutboxRegistrationRestored, after.OrgID, after.UID, after); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	l.Log.Info("Restored registration", "orgID", orgID, "uid", uid, "actor", actor)
+	return after, nil
+}
+
+func (s *sqliteStore) Purge(ctx context.Context, retention time.Duration) (int, error) {
+	res, err := s.db.ExecContext(ctx,
+		`delete from registrations where deleted_at is not null and deleted_at < ?`,
+		sqliteTime(time.Now().Add(-retention)),
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+
+	return int(count), nil
+}
+
+func (s *sqliteStore) UpdateLastSeen(ctx context.Context, seen map[string]time.Time) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer rollback(tx)
+
+	stmt, err := tx.PrepareContext(ctx, `update registrations
+		set last_seen_at = max(coalesce(last_seen_at, ''), ?)
+		where uid = ? and deleted_at is null`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for uid, t := range seen {
+		if _, err := stmt.ExecContext(ctx, sqliteTime(t), uid); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) History(ctx context.Context, orgID, uid string) ([]RegistrationEvent, error) {
+	return registrationHistory(ctx, s.db, sqliteDialect, orgID, uid)
+}
+
+// insertSQLiteRegistrationEvent is insertRegistrationEvent for sqlite, which
+// doesn't generate the id or created_at
+func insertSQLiteRegistrationEvent(ctx context.Context, tx *sql.Tx, t RegistrationEventType, actor string, before, after *Registration) error {
+	row, err := newRegistrationEventRow(before, after)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx,
+		`insert into registration_events
+		(id, event_type, org_id, uid, actor, before_snapshot, after_snapshot, created_at)
+		values (?, ?, ?, ?, ?, ?, ?, ?)`,
+		uuid.NewString(),
+		t,
+		row.orgID,
+		row.uid,
+		actor,
+		row.before,
+		row.after,
+		sqliteTime(time.Now()),
+	)
+	return err
+}
+
+// insertSQLiteOutboxEvent is insertOutboxEvent for sqlite, where created_at
+// and next_attempt_at have no default
+func insertSQLiteOutboxEvent(ctx context.Context, tx *sql.Tx, t OutboxEventType, orgID, key string, payload any) error {
+	e, err := newOutboxEvent(t, orgID, key, payload)
+	if err != nil {
+		return err
+	}
+
+	now := sqliteTime(time.Now())
+	_, err = tx.ExecContext(ctx,
+		`insert into outbox_events
+		(event_type, org_id, key, payload, created_at, next_attempt_at)
+		values (?, ?, ?, ?, ?, ?)`,
+		e.Type,
+		e.OrgID,
+		e.Key,
+		string(e.Payload),
+		now,
+		now,
+	)
+	return err
+}
+
+func marshalExtra(extra map[string]interface{}) (string, error) {
+	if extra == nil {
+		return "{}", nil
+	}
+
+	b, err := json.Marshal(extra)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to marshal extra json")
+	}
+	return string(b), nil
+}
+
+// sqliteConflict turns a unique constraint violation into
+// ErrRegistrationAlreadyExists, anything else is returned as-is
+func sqliteConflict(err error) error {
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) && (sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY) {
+		return ErrRegistrationAlreadyExists{Detail: sqliteErr.Error()}
+	}
+	return err
+}
+
+func (s *sqliteStore) AllowedAddresses(ctx context.Context, orgID string, q AllowlistQuery) ([]AllowlistBlock, int, error) {
+	return listAllowlist(ctx, s.db, sqliteDialect, orgID, q)
+}
+
+func (s *sqliteStore) AllowedIP(ctx context.Context, ip, orgID string) (bool, error) {
+	// the `system` org_id applies to every org, same as in postgres, and
+	// expired blocks are left for the cleaner
+	rows, err := s.db.QueryContext(ctx, `select ip_block from allowlist
+		where (org_id = ? or org_id = 'system') and (expires_at is null or expires_at > ?)`,
+		orgID, sqliteTime(time.Now()))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var blocks []string
+	for rows.Next() {
+		var block string
+		if err := rows.Scan(&block); err != nil {
+			return false, err
+		}
+		blocks = append(blocks, block)
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	return blocksContain(blocks, ip)
+}
+
+func (s *sqliteStore) AllowAddress(ctx context.Context, ip *AllowlistBlock) error {
+	if err := normalizeAllowlistBlock(ip); err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer rollback(tx)
+
+	now := time.Now().UTC()
+	_, err = tx.ExecContext(ctx,
+		`insert into allowlist (ip_block, org_id, created_at, expires_at, description, created_by)
+		values (?, ?, ?, ?, nullif(?, ''), nullif(?, ''))`,
+		ip.IPBlock, ip.OrgID, sqliteTime(now), sqliteNullTime(ip.ExpiresAt), ip.Description, ip.CreatedBy,
+	)
+	if err != nil {
+		var sqliteErr *sqlite.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY {
+			return ErrAddressAlreadyAllowListed
+		}
+		return err
+	}
+
+	added := *ip
+	added.CreatedAt = now
+	if err := insertSQLiteOutboxEvent(ctx, tx, OutboxAllowlistAdded, added.OrgID, added.IPBlock, &added); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	ip.CreatedAt = now
+	return nil
+}
+
+func (s *sqliteStore) DenyAddress(ctx context.Context, ip *AllowlistBlock) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer rollback(tx)
+
+	removed, err := scanAllowlistBlock(tx.QueryRowContext(ctx,
+		`delete from allowlist where ip_block = ? and org_id = ? returning `+sqliteAllowlistColumns,
+		ip.IPBlock, ip.OrgID,
+	))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrAddressNotAllowListed
+		}
+		return err
+	}
+
+	if err := insertSQLiteOutboxEvent(ctx, tx, OutboxAllowlistRemoved, removed.OrgID, removed.IPBlock, removed); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqliteStore) PurgeExpiredAddresses(ctx context.Context) (int, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer rollback(tx)
+
+	rows, err := tx.QueryContext(ctx,
+		`delete from allowlist where expires_at is not null and expires_at <= ? returning `+sqliteAllowlistColumns,
+		sqliteTime(time.Now()))
+	if err != nil {
+		return 0, err
+	}
+
+	removed, err := collectRows(rows, scanAllowlistBlock)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range removed {
+		b := &removed[i]
+		if err := insertSQLiteOutboxEvent(ctx, tx, OutboxAllowlistRemoved, b.OrgID, b.IPBlock, b); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(removed), tx.Commit()
+}
+
+const sqliteAllowlistColumns = `org_id, ip_block, created_at, expires_at, coalesce(description, ''), coalesce(created_by, '')`
+
+func (s *sqliteStore) PoolStats() sql.DBStats {
+	return s.db.Stats()
+}
+
+func (s *sqliteStore) DumpSnapshot(ctx context.Context) (*Snapshot, error) {
+	// a read transaction keeps both reads on the same snapshot of the file
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer rollback(tx)
+
+	snap := newSnapshot()
+
+	rows, err := tx.QueryContext(ctx, `select `+registrationColumns+` from registrations
+		where deleted_at is null
+		order by created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	if snap.Registrations, err = collectRows(rows, scanRegistration); err != nil {
+		return nil, err
+	}
+
+	blocks, err := tx.QueryContext(ctx, `select `+sqliteAllowlistColumns+` from allowlist
+		order by org_id, created_at, ip_block`)
+	if err != nil {
+		return nil, err
+	}
+	if snap.Allowlist, err = collectRows(blocks, scanAllowlistBlock); err != nil {
+		return nil, err
+	}
+
+	return snap, nil
+}
+
+func (s *sqliteStore) LoadSnapshot(ctx context.Context, snap *Snapshot, actor string) ([]SnapshotConflict, error) {
+	if err := snap.validate(); err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rollback(tx)
+
+	conflicts := make([]SnapshotConflict, 0)
+	for i := range snap.Registrations {
+		r := &snap.Registrations[i]
+		err := withSavepoint(ctx, tx, func() error {
+			_, err := insertSQLiteRegistration(ctx, tx, r, actor, true)
+			return err
+		})
+		if errors.Is(err, ErrRegistrationAlreadyExists{}) {
+			conflicts = append(conflicts, SnapshotConflict{Type: snapshotRegistration, Index: i, Key: r.UID, Error: err.Error()})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for i := range snap.Allowlist {
+		b := &snap.Allowlist[i]
+		err := withSavepoint(ctx, tx, func() error {
+			_, err := tx.ExecContext(ctx,
+				`insert into allowlist (ip_block, org_id, created_at, expires_at, description, created_by)
+				values (?, ?, ?, ?, nullif(?, ''), nullif(?, ''))`,
+				b.IPBlock, b.OrgID, sqliteTime(b.CreatedAt), sqliteNullTime(b.ExpiresAt), b.Description, b.CreatedBy)
+			var sqliteErr *sqlite.Error
+			if errors.As(err, &sqliteErr) && sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY {
+				return ErrAddressAlreadyAllowListed
+			}
+			return err
+		})
+		if errors.Is(err, ErrAddressAlreadyAllowListed) {
+			conflicts = append(conflicts, SnapshotConflict{Type: snapshotAllowlist, Index: i, Key: b.OrgID + "/" + b.IPBlock, Error: err.Error()})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(conflicts) > 0 {
+		return conflicts, ErrSnapshotConflict
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	l.Log.Info("Loaded snapshot", "registrations", len(snap.Registrations), "allowlist", len(snap.Allowlist), "actor", actor)
+	return conflicts, nil
+}
+
+func (s *sqliteStore) ClaimOutbox(ctx context.Context, limit int, lease time.Duration) ([]OutboxEvent, error) {
+	// with a single writer the update can't race another claim, no need for
+	// the row locking postgres does
+	now := time.Now()
+	rows, err := s.db.QueryContext(ctx, `update outbox_events
+	set next_attempt_at = ?
+	where id in (
+		select id from outbox_events
+		where delivered_at is null and next_attempt_at <= ?
+		order by next_attempt_at, id
+		limit ?
+	)
+	returning `+outboxEventColumns,
+		sqliteTime(now.Add(lease)),
+		sqliteTime(now),
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := collectRows(rows, scanOutboxEvent)
+	if err != nil {
+		return nil, err
+	}
+
+	slices.SortFunc(out, func(a, b OutboxEvent) int { return cmp.Compare(a.ID, b.ID) })
+	return out, nil
+}
+
+func (s *sqliteStore) MarkOutboxDelivered(ctx context.Context, id int64) error {
+	_, err := s.db.ExecContext(ctx, `update outbox_events set delivered_at = ?, last_error = null where id = ?`, sqliteTime(time.Now()), id)
+	return err
+}
+
+func (s *sqliteStore) MarkOutboxFailed(ctx context.Context, id int64, retryIn time.Duration, reason string) error {
+	_, err := s.db.ExecContext(ctx,
+		`update outbox_events set
+		attempts = attempts + 1,
+		last_error = ?,
+		next_attempt_at = ?
+		where id = ?`,
+		reason,
+		sqliteTime(time.Now().Add(retryIn)),
+		id,
+	)
+	return err
+}
+
+func (s *sqliteStore) Quota(ctx context.Context, orgID string, defaultLimit int) (*Quota, error) {
+	return sqliteQuota(ctx, s.db, orgID, defaultLimit)
+}
+
+func sqliteQuota(ctx context.Context, db rowQuerier, orgID string, defaultLimit int) (*Quota, error) {
+	var (
+		used     int
+		override sql.NullInt64
+	)
+	err := db.QueryRowContext(ctx, `select
+		(select count(id) from registrations where org_id = ? and deleted_at is null),
+		(select max_registrations from org_quotas where org_id = ?)`,
+		orgID,
+		orgID,
+	).Scan(&used, &override)
+	if err != nil {
+		return nil, err
+	}
+
+	return newQuota(orgID, used, nullInt(override), defaultLimit), nil
+}
+
+func (s *sqliteStore) SetQuotaOverride(ctx context.Context, orgID string, limit *int) error {
+	if limit == nil {
+		_, err := s.db.ExecContext(ctx, `delete from org_quotas where org_id = ?`, orgID)
+		return err
+	}
+
+	_, err := s.db.ExecContext(ctx,
+		`insert into org_quotas (org_id, max_registrations, updated_at) values (?, ?, ?)
+		on conflict (org_id) do update set max_registrations = excluded.max_registrations, updated_at = excluded.updated_at`,
+		orgID,
+		*limit,
+		sqliteTime(time.Now()),
+	)
+	return err
+}
+
+func (s *sqliteStore) CreateEnrollmentCode(ctx context.Context, c *EnrollmentCode, codeHash string) error {
+	id, now := uuid.NewString(), time.Now()
+	_, err := s.db.ExecContext(ctx,
+		`insert into enrollment_codes (id, code_hash, org_id, username, created_at, expires_at) values (?, ?, ?, ?, ?, ?)`,
+		id, codeHash, c.OrgID, c.Username, sqliteTime(now), sqliteTime(c.ExpiresAt),
+	)
+	if err != nil {
+		return err
+	}
+
+	c.ID, c.CreatedAt = id, now
+	return nil
+}
+
+func (s *sqliteStore) EnrollmentCodes(ctx context.Context, orgID string) ([]EnrollmentCode, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`select `+enrollmentCodeColumns+` from enrollment_codes where org_id = ? order by created_at desc, id desc`,
+		orgID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return collectRows(rows, scanEnrollmentCode)
+}
+
+func (s *sqliteStore) FindEnrollmentCode(ctx context.Context, codeHash string) (*EnrollmentCode, error) {
+	c, err := scanEnrollmentCode(s.db.QueryRowContext(ctx,
+		`select `+enrollmentCodeColumns+` from enrollment_codes
+		where code_hash = ? and used_at is null and expires_at > ?`,
+		codeHash, sqliteTime(time.Now()),
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrEnrollmentCodeInvalid
+	}
+	return c, err
+}
+
+func (s *sqliteStore) Enroll(ctx context.Context, r *Registration, codeHash string, defaultLimit int) (*EnrollmentCode, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer rollback(tx)
+
+	now := time.Now()
+	c, err := scanEnrollmentCode(tx.QueryRowContext(ctx,
+		`update enrollment_codes set used_at = ?, used_by = ?
+		where code_hash = ? and used_at is null and expires_at > ?
+		returning `+enrollmentCodeColumns,
+		sqliteTime(now), r.UID, codeHash, sqliteTime(now),
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrEnrollmentCodeInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	r.OrgID, r.Username = c.OrgID, c.Username
+	created, err := createSQLiteRegistration(ctx, tx, r, &defaultLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	r.ID, r.CreatedAt = created.ID, created.CreatedAt
+	l.Log.Info("Enrolled registration", "id", created.ID, "org_id", r.OrgID, "username", r.Username, "uid", r.UID, "code_id", c.ID)
+	return c, nil
+}
+
+func (s *sqliteStore) OrgSettings(ctx context.Context, orgID string) (*OrgSettings, error) {
+	settings := &OrgSettings{OrgID: orgID}
+	err := s.db.QueryRowContext(ctx, `select require_approval from org_settings where org_id = ?`, orgID).
+		Scan(&settings.RequireApproval)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+	return settings, nil
+}
+
+func (s *sqliteStore) SetOrgSettings(ctx context.Context, settings *OrgSettings) error {
+	_, err := s.db.ExecContext(ctx,
+		`insert into org_settings (org_id, require_approval, updated_at) values (?, ?, ?)
+		on conflict (org_id) do update set require_approval = excluded.require_approval, updated_at = excluded.updated_at`,
+		settings.OrgID,
+		settings.RequireApproval,
+		sqliteTime(time.Now()),
+	)
+	return err
+}
@@ -0,0 +1,21 @@
+package store
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	suite.Run(t, &StoreSuite{NewStore: func(t *testing.T) Store {
+		s, err := setupSQLiteStore(filepath.Join(t.TempDir(), "mbop.db"))
+		if err != nil {
+			t.Fatalf("failed to set up sqlite store: %v", err)
+		}
+		t.Cleanup(func() { s.db.Close() })
+		// the same wrapper SetupStore puts around it
+		return withTimeout(s, 5*time.Second)
+	}})
+}
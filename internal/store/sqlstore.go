@@ -0,0 +1,438 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+/*
+dialect is what differs between the postgres and sqlite stores in the code
+they share: scanning rows, the registration and allowlist listings, history
+and the audit rows. Queries that differ in more than that stay in each store.
+*/
+type dialect struct {
+	// param is the nth bind parameter, counting from 1
+	param func(n int) string
+	// time is a time as it's bound to a timestamp column
+	time func(t time.Time) any
+	// noLimit is bound as the limit to get every row
+	noLimit any
+
+	// registrationFilter and registrationOrder build the where and order by
+	// clauses of a registration listing, idParam compares a bind parameter
+	// with the id column
+	registrationFilter func(orgID string, q RegistrationQuery) (string, []any)
+	registrationOrder  func(by RegistrationSortField, desc bool) string
+	idParam            func(n int) string
+
+	// allowlistColumns are the columns scanAllowlistBlock expects and
+	// allowlistKey the ip_block as the allowlist is ordered by it
+	allowlistColumns string
+	allowlistKey     string
+
+	// eventOrder breaks created_at ties between registration events in the
+	// order they were written
+	eventOrder string
+}
+
+var postgresDialect = &dialect{
+	param:              placeholder,
+	time:               func(t time.Time) any { return t.UTC() },
+	noLimit:            nil,
+	registrationFilter: registrationFilter,
+	registrationOrder:  registrationOrder,
+	idParam:            func(n int) string { return placeholder(n) + "::uuid" },
+	allowlistColumns:   allowlistColumns,
+	allowlistKey:       `ip_block::text collate "C"`,
+	eventOrder:         "seq",
+}
+
+var sqliteDialect = &dialect{
+	param:              func(int) string { return "?" },
+	time:               func(t time.Time) any { return sqliteTime(t) },
+	noLimit:            -1,
+	registrationFilter: sqliteRegistrationFilter,
+	registrationOrder:  sqliteRegistrationOrder,
+	idParam:            func(int) string { return "?" },
+	allowlistColumns:   sqliteAllowlistColumns,
+	allowlistKey:       "ip_block",
+	eventOrder:         "rowid",
+}
+
+// limit is n as a limit, where 0 is no limit at all
+func (d *dialect) limit(n int) any {
+	if n == 0 {
+		return d.noLimit
+	}
+	return n
+}
+
+// the columns scanRegistration expects, in order
+const registrationColumns = `id, org_id, username, uid, display_name, extra, created_at, deleted_at,
+	cert_fingerprint, cert_serial, cert_not_after, last_seen_at, status, reviewed_by, reviewed_at`
+
+/*
+listRegistrations is All for either store. The cursor only narrows down the
+page, the count still covers every matching registration. A backward page is
+read in reverse from the cursor and flipped back.
+*/
+func listRegistrations(ctx context.Context, db *sql.DB, d *dialect, orgID string, q RegistrationQuery) ([]Registration, int, error) {
+	where, args := d.registrationFilter(orgID, q)
+	by, desc := q.order()
+
+	pageWhere, pageArgs, offset := where, args, q.Offset
+	if q.Cursor != nil {
+		pageArgs = append(append([]any{}, args...), d.time(q.Cursor.CreatedAt), q.Cursor.Key)
+		n := len(pageArgs) - 1
+		pageWhere += " and " + keysetCondition("created_at, id", d.param(n)+", "+d.idParam(n+1), desc, q.Cursor.Backward)
+		offset = 0
+		desc = desc != q.Cursor.Backward
+	}
+
+	n := len(pageArgs)
+	rows, err := db.QueryContext(ctx, `select `+registrationColumns+`
+		from registrations
+		where `+pageWhere+`
+		order by `+d.registrationOrder(by, desc)+`
+		limit `+d.param(n+1)+` offset `+d.param(n+2),
+		append(pageArgs, q.Limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	out, err := collectRows(rows, scanRegistration)
+	if err != nil {
+		return nil, 0, err
+	}
+	if q.Cursor != nil && q.Cursor.Backward {
+		slices.Reverse(out)
+	}
+
+	var count int
+	if err := db.QueryRowContext(ctx, `select count(id) from registrations where `+where, args...).Scan(&count); err != nil {
+		return nil, 0, err
+	}
+
+	return out, count, nil
+}
+
+// listAllowlist is AllowedAddresses for either store, paged the same way as
+// listRegistrations in created_at order
+func listAllowlist(ctx context.Context, db *sql.DB, d *dialect, orgID string, q AllowlistQuery) ([]AllowlistBlock, int, error) {
+	where, args := "org_id = "+d.param(1), []any{orgID}
+	desc, offset := false, q.Offset
+	if q.Cursor != nil {
+		args = append(args, d.time(q.Cursor.CreatedAt), q.Cursor.Key)
+		where += " and " + keysetCondition("created_at, "+d.allowlistKey, d.param(2)+", "+d.param(3), false, q.Cursor.Backward)
+		desc, offset = q.Cursor.Backward, 0
+	}
+
+	dir := " asc"
+	if desc {
+		dir = " desc"
+	}
+
+	n := len(args)
+	rows, err := db.QueryContext(ctx, `select `+d.allowlistColumns+`
+		from allowlist
+		where `+where+`
+		order by created_at`+dir+`, `+d.allowlistKey+dir+`
+		limit `+d.param(n+1)+` offset `+d.param(n+2),
+		append(args, d.limit(q.Limit), offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	addresses, err := collectRows(rows, scanAllowlistBlock)
+	if err != nil {
+		return nil, 0, err
+	}
+	if desc {
+		slices.Reverse(addresses)
+	}
+
+	var count int
+	if err := db.QueryRowContext(ctx, `select count(*) from allowlist where org_id = `+d.param(1), orgID).Scan(&count); err != nil {
+		return nil, 0, err
+	}
+
+	return addresses, count, nil
+}
+
+// keysetCondition compares the (created_at, key) columns against the cursor
+// bound to bounds, picking the rows after the cursor in a listing sorted in
+// the given direction (or before it when backward).
+func keysetCondition(columns, bounds string, desc, backward bool) string {
+	op := ">"
+	if desc != backward {
+		op = "<"
+	}
+	return "(" + columns + ") " + op + " (" + bounds + ")"
+}
+
+// registrationHistory is History for either store
+func registrationHistory(ctx context.Context, db *sql.DB, d *dialect, orgID, uid string) ([]RegistrationEvent, error) {
+	rows, err := db.QueryContext(ctx, `select
+		id, event_type, org_id, uid, actor, before_snapshot, after_snapshot, created_at
+		from registration_events
+		where org_id = `+d.param(1)+` and uid = `+d.param(2)+`
+		order by created_at asc, `+d.eventOrder+` asc`,
+		orgID,
+		uid,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return collectRows(rows, scanRegistrationEvent)
+}
+
+// registrationEventRow is a registration_events row with the snapshots
+// marshalled, the org and uid are taken from whichever snapshot there is
+type registrationEventRow struct {
+	orgID, uid    string
+	before, after *string
+}
+
+func newRegistrationEventRow(before, after *Registration) (*registrationEventRow, error) {
+	ref := after
+	if ref == nil {
+		ref = before
+	}
+
+	b, err := marshalSnapshot(before)
+	if err != nil {
+		return nil, err
+	}
+	a, err := marshalSnapshot(after)
+	if err != nil {
+		return nil, err
+	}
+
+	return &registrationEventRow{orgID: ref.OrgID, uid: ref.UID, before: b, after: a}, nil
+}
+
+// snapshots are passed as strings so a nil snapshot ends up as sql NULL
+// instead of the json `null` literal
+func marshalSnapshot(r *Registration) (*string, error) {
+	if r == nil {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal registration snapshot")
+	}
+
+	s := string(b)
+	return &s, nil
+}
+
+func unmarshalSnapshot(s sql.NullString) (*Registration, error) {
+	if !s.Valid {
+		return nil, nil
+	}
+
+	var r Registration
+	err := json.Unmarshal([]byte(s.String), &r)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal registration snapshot")
+	}
+	return &r, nil
+}
+
+// implement our own teeny scanner interface so we can use both sql.Row and/or sql.Rows
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+// collectRows scans every row and closes them
+func collectRows[T any](rows *sql.Rows, scan func(scanner) (*T, error)) ([]T, error) {
+	defer rows.Close()
+
+	out := make([]T, 0)
+	for rows.Next() {
+		v, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *v)
+	}
+	return out, rows.Err()
+}
+
+/*
+nullTime scans a timestamp column of either store, a timestamptz from
+postgres or sqliteTimeFormat text from sqlite, always as UTC. Valid is false
+for NULL.
+*/
+type nullTime struct {
+	Time  time.Time
+	Valid bool
+}
+
+func (t *nullTime) Scan(src any) error {
+	switch v := src.(type) {
+	case nil:
+		*t = nullTime{}
+	case time.Time:
+		*t = nullTime{Time: v.UTC(), Valid: true}
+	case string:
+		return t.parse(v)
+	case []byte:
+		return t.parse(string(v))
+	default:
+		return fmt.Errorf("can't scan %T as a timestamp", src)
+	}
+	return nil
+}
+
+func (t *nullTime) parse(s string) error {
+	parsed, err := time.Parse(sqliteTimeFormat, s)
+	if err != nil {
+		return errors.Wrap(err, "failed to parse timestamp")
+	}
+	*t = nullTime{Time: parsed, Valid: true}
+	return nil
+}
+
+// ptr is the time, or nil for NULL
+func (t nullTime) ptr() *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+func scanRegistration(row scanner) (*Registration, error) {
+	var (
+		id          string
+		orgID       string
+		username    sql.NullString
+		uid         string
+		displayName sql.NullString
+		extra       sql.NullString
+		createdAt   nullTime
+		deletedAt   nullTime
+		fingerprint sql.NullString
+		serial      sql.NullString
+		notAfter    nullTime
+		lastSeenAt  nullTime
+		status      string
+		reviewedBy  sql.NullString
+		reviewedAt  nullTime
+	)
+	err := row.Scan(&id, &orgID, &username, &uid, &displayName, &extra, &createdAt, &deletedAt,
+		&fingerprint, &serial, &notAfter, &lastSeenAt, &status, &reviewedBy, &reviewedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrRegistrationNotFound
+		}
+		return nil, err
+	}
+
+	var e map[string]any
+	if extra.Valid {
+		if err := json.Unmarshal([]byte(extra.String), &e); err != nil {
+			return nil, errors.Wrap(err, "failed to unmarshal extra json")
+		}
+	}
+
+	reg := &Registration{
+		ID:          id,
+		OrgID:       orgID,
+		Username:    username.String,
+		UID:         uid,
+		DisplayName: displayName.String,
+		Extra:       e,
+		CreatedAt:   createdAt.Time,
+		DeletedAt:   deletedAt.ptr(),
+		LastSeenAt:  lastSeenAt.ptr(),
+		Status:      RegistrationStatus(status),
+		ReviewedBy:  reviewedBy.String,
+		ReviewedAt:  reviewedAt.ptr(),
+	}
+	if fingerprint.Valid {
+		reg.Certificate = &Certificate{
+			Fingerprint: fingerprint.String,
+			Serial:      serial.String,
+			NotAfter:    notAfter.Time,
+		}
+	}
+
+	return reg, nil
+}
+
+func scanRegistrationEvent(row scanner) (*RegistrationEvent, error) {
+	var (
+		e             RegistrationEvent
+		actor         sql.NullString
+		before, after sql.NullString
+		createdAt     nullTime
+	)
+	err := row.Scan(&e.ID, &e.Type, &e.OrgID, &e.UID, &actor, &before, &after, &createdAt)
+	if err != nil {
+		return nil, err
+	}
+	e.Actor, e.CreatedAt = actor.String, createdAt.Time
+
+	if e.Before, err = unmarshalSnapshot(before); err != nil {
+		return nil, err
+	}
+	if e.After, err = unmarshalSnapshot(after); err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+func scanAllowlistBlock(row scanner) (*AllowlistBlock, error) {
+	var (
+		b                    AllowlistBlock
+		createdAt, expiresAt nullTime
+	)
+	err := row.Scan(&b.OrgID, &b.IPBlock, &createdAt, &expiresAt, &b.Description, &b.CreatedBy)
+	if err != nil {
+		return nil, err
+	}
+	b.CreatedAt, b.ExpiresAt = createdAt.Time, expiresAt.ptr()
+	return &b, nil
+}
+
+// the columns scanEnrollmentCode expects, in order
+const enrollmentCodeColumns = `id, org_id, username, created_at, expires_at, used_at, coalesce(used_by, '')`
+
+func scanEnrollmentCode(row scanner) (*EnrollmentCode, error) {
+	var (
+		c                            EnrollmentCode
+		createdAt, expiresAt, usedAt nullTime
+	)
+	err := row.Scan(&c.ID, &c.OrgID, &c.Username, &createdAt, &expiresAt, &usedAt, &c.UsedBy)
+	if err != nil {
+		return nil, err
+	}
+	c.CreatedAt, c.ExpiresAt, c.UsedAt = createdAt.Time, expiresAt.Time, usedAt.ptr()
+	return &c, nil
+}
+
+// the columns scanOutboxEvent expects, in order
+const outboxEventColumns = `id, event_type, org_id, key, payload, created_at, attempts, last_error`
+
+func scanOutboxEvent(row scanner) (*OutboxEvent, error) {
+	var (
+		e         OutboxEvent
+		payload   string
+		createdAt nullTime
+		lastError sql.NullString
+	)
+	err := row.Scan(&e.ID, &e.Type, &e.OrgID, &e.Key, &payload, &createdAt, &e.Attempts, &lastError)
+	if err != nil {
+		return nil, err
+	}
+	e.Payload, e.CreatedAt, e.LastError = json.RawMessage(payload), createdAt.Time, lastError.String
+	return &e, nil
+}
@@ -1,9 +1,18 @@
 package store
 
 import (
+	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
 
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/stdlib"
 	"github.com/redhatinsights/mbop/internal/config"
 )
 
@@ -15,14 +24,30 @@ var GetStore func() Store
 var mem Store
 
 func SetupStore() error {
-	switch config.Get().StoreBackend {
+	c := config.Get()
+
+	timeout, err := time.ParseDuration(c.DatabaseQueryTimeout)
+	if err != nil {
+		return fmt.Errorf("invalid DATABASE_QUERY_TIMEOUT: %w", err)
+	}
+
+	switch c.StoreBackend {
 	case "postgres":
 		pgStore, err := setupPostgresStore()
 		if err != nil {
 			return err
 		}
 
-		GetStore = func() Store { return pgStore }
+		db := withTimeout(pgStore, timeout)
+		GetStore = func() Store { return db }
+	case "sqlite":
+		sqStore, err := setupSQLiteStore(c.SQLitePath)
+		if err != nil {
+			return err
+		}
+
+		db := withTimeout(sqStore, timeout)
+		GetStore = func() Store { return db }
 	case "memory":
 		mem = &inMemoryStore{}
 		GetStore = func() Store { return mem }
@@ -34,10 +59,17 @@ func SetupStore() error {
 func setupPostgresStore() (*postgresStore, error) {
 	c := config.Get()
 
-	connStr := fmt.Sprintf("postgres://%s:%s@%s:%s/%s?sslmode=prefer",
-		c.DatabaseUser, c.DatabasePassword, c.DatabaseHost, c.DatabasePort, c.DatabaseName)
+	dsn, err := postgresDSN(c)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := openPostgres(dsn)
+	if err != nil {
+		return nil, err
+	}
 
-	db, err := sql.Open("pgx", connStr)
+	err = configurePool(db, c)
 	if err != nil {
 		return nil, err
 	}
@@ -47,10 +79,125 @@ func setupPostgresStore() (*postgresStore, error) {
 		return nil, err
 	}
 
-	err = migrateDatabase()
+	err = migrateDatabase(dsn)
 	if err != nil {
 		return nil, err
 	}
 
 	return &postgresStore{db: db}, nil
 }
+
+// openPostgres opens a pool that scans timestamptz in UTC, like the other
+// stores hand times back, instead of the process's local zone
+func openPostgres(dsn string) (*sql.DB, error) {
+	c, err := pgx.ParseConfig(dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	return stdlib.OpenDB(*c, stdlib.OptionAfterConnect(func(_ context.Context, conn *pgx.Conn) error {
+		conn.TypeMap().RegisterType(&pgtype.Type{
+			Name:  "timestamptz",
+			OID:   pgtype.TimestamptzOID,
+			Codec: &pgtype.TimestamptzCodec{ScanLocation: time.UTC},
+		})
+		return nil
+	})), nil
+}
+
+/*
+postgresDSN builds the connection string used by both the store and the
+migrator, either from DATABASE_URL or the individual DATABASE_* settings.
+
+The sslmode/cert settings and the statement timeout are added on top, but
+anything DATABASE_URL already sets takes precedence.
+*/
+func postgresDSN(c *config.MbopConfig) (string, error) {
+	var u *url.URL
+
+	if c.DatabaseURL != "" {
+		parsed, err := url.Parse(c.DatabaseURL)
+		if err != nil || (parsed.Scheme != "postgres" && parsed.Scheme != "postgresql") {
+			return "", errors.New("invalid DATABASE_URL, needs to be a postgres:// url")
+		}
+		u = parsed
+	} else {
+		u = &url.URL{
+			Scheme: "postgres",
+			User:   url.UserPassword(c.DatabaseUser, c.DatabasePassword),
+			Host:   net.JoinHostPort(c.DatabaseHost, c.DatabasePort),
+			Path:   "/" + c.DatabaseName,
+		}
+	}
+
+	statementTimeout, err := time.ParseDuration(c.DatabaseStatementTimeout)
+	if err != nil {
+		return "", fmt.Errorf("invalid DATABASE_STATEMENT_TIMEOUT: %w", err)
+	}
+
+	q := u.Query()
+	set := func(key, value string) {
+		if value != "" && !q.Has(key) {
+			q.Set(key, value)
+		}
+	}
+
+	set("sslmode", c.DatabaseSSLMode)
+	set("sslrootcert", c.DatabaseSSLRootCert)
+	set("sslcert", c.DatabaseSSLCert)
+	set("sslkey", c.DatabaseSSLKey)
+	if statementTimeout > 0 {
+		// pgx sends unknown parameters to the server as session settings
+		set("statement_timeout", strconv.FormatInt(statementTimeout.Milliseconds(), 10))
+	}
+
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}
+
+func configurePool(db *sql.DB, c *config.MbopConfig) error {
+	lifetime, err := time.ParseDuration(c.DatabaseConnMaxLifetime)
+	if err != nil {
+		return fmt.Errorf("invalid DATABASE_CONN_MAX_LIFETIME: %w", err)
+	}
+
+	db.SetMaxOpenConns(c.DatabaseMaxOpenConns)
+	db.SetMaxIdleConns(c.DatabaseMaxIdleConns)
+	db.SetConnMaxLifetime(lifetime)
+
+	return nil
+}
+
+func setupSQLiteStore(path string) (*sqliteStore, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = migrateSQLite(db)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqliteStore{db: db}, nil
+}
+
+func openSQLite(path string) (*sql.DB, error) {
+	// foreign keys aren't used, but WAL + a busy timeout keep the occasional
+	// reader (e.g. a backup) from failing writes
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite has a single writer, one connection serializes everything
+	db.SetMaxOpenConns(1)
+
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
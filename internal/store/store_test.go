@@ -0,0 +1,66 @@
+package store
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/redhatinsights/mbop/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPostgresDSN(t *testing.T) {
+	c := &config.MbopConfig{
+		DatabaseHost:             "db.example.com",
+		DatabasePort:             "5432",
+		DatabaseUser:             "mbop",
+		DatabasePassword:         "p@ss/word",
+		DatabaseName:             "mbop",
+		DatabaseSSLMode:          "verify-full",
+		DatabaseSSLRootCert:      "/certs/ca.pem",
+		DatabaseSSLCert:          "/certs/client.pem",
+		DatabaseSSLKey:           "/certs/client.key",
+		DatabaseStatementTimeout: "30s",
+	}
+
+	dsn, err := postgresDSN(c)
+	assert.Nil(t, err)
+
+	u, err := url.Parse(dsn)
+	assert.Nil(t, err)
+	assert.Equal(t, "db.example.com:5432", u.Host)
+	assert.Equal(t, "/mbop", u.Path)
+	password, _ := u.User.Password()
+	assert.Equal(t, "p@ss/word", password)
+	assert.Equal(t, "verify-full", u.Query().Get("sslmode"))
+	assert.Equal(t, "/certs/ca.pem", u.Query().Get("sslrootcert"))
+	assert.Equal(t, "/certs/client.pem", u.Query().Get("sslcert"))
+	assert.Equal(t, "/certs/client.key", u.Query().Get("sslkey"))
+	assert.Equal(t, "30000", u.Query().Get("statement_timeout"))
+}
+
+func TestPostgresDSNFromURL(t *testing.T) {
+	c := &config.MbopConfig{
+		DatabaseHost:             "ignored",
+		DatabaseURL:              "postgres://mbop@db.example.com/mbop?sslmode=disable",
+		DatabaseSSLMode:          "prefer",
+		DatabaseStatementTimeout: "0",
+	}
+
+	dsn, err := postgresDSN(c)
+	assert.Nil(t, err)
+
+	u, err := url.Parse(dsn)
+	assert.Nil(t, err)
+	assert.Equal(t, "db.example.com", u.Host)
+	// the url's own settings win
+	assert.Equal(t, "disable", u.Query().Get("sslmode"))
+	assert.False(t, u.Query().Has("statement_timeout"))
+}
+
+func TestPostgresDSNInvalid(t *testing.T) {
+	_, err := postgresDSN(&config.MbopConfig{DatabaseURL: "host=db user=mbop", DatabaseStatementTimeout: "0"})
+	assert.Error(t, err)
+
+	_, err = postgresDSN(&config.MbopConfig{DatabaseStatementTimeout: "soon"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,307 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+var (
+	// ErrStoreTimeout is returned when a query ran past the query timeout
+	ErrStoreTimeout = errors.New("store query timed out")
+	// ErrStoreUnavailable is returned when the database can't be reached or
+	// the caller gave up on the query
+	ErrStoreUnavailable = errors.New("store unavailable")
+)
+
+// storeError tags driver errors that aren't the caller's fault so handlers can
+// tell them apart from everything else, other errors are returned as is.
+func storeError(err error) error {
+	var connectErr *pgconn.ConnectError
+	var netErr net.Error
+	var sqliteErr *sqlite.Error
+
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("%w: %w", ErrStoreTimeout, err)
+	case errors.Is(err, context.Canceled),
+		errors.Is(err, driver.ErrBadConn),
+		errors.Is(err, sql.ErrConnDone),
+		errors.As(err, &connectErr),
+		errors.As(err, &netErr),
+		errors.As(err, &sqliteErr) && sqliteErr.Code()&0xff == sqlite3.SQLITE_BUSY:
+		return fmt.Errorf("%w: %w", ErrStoreUnavailable, err)
+	}
+
+	return err
+}
+
+/*
+timeoutStore wraps a sql backed store, every call gets at most timeout to run
+(on top of whatever deadline the caller's context already has) and errors from
+the database are passed through storeError.
+*/
+type timeoutStore struct {
+	next    Store
+	timeout time.Duration
+}
+
+func withTimeout(s Store, timeout time.Duration) Store {
+	return &timeoutStore{next: s, timeout: timeout}
+}
+
+func (t *timeoutStore) PoolStats() sql.DBStats {
+	if s, ok := t.next.(PooledStore); ok {
+		return s.PoolStats()
+	}
+	return sql.DBStats{}
+}
+
+func (t *timeoutStore) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if t.timeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, t.timeout)
+}
+
+func (t *timeoutStore) All(ctx context.Context, orgID string, q RegistrationQuery) ([]Registration, int, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	regs, count, err := t.next.All(ctx, orgID, q)
+	return regs, count, storeError(err)
+}
+
+func (t *timeoutStore) Find(ctx context.Context, orgID, uid string) (*Registration, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	r, err := t.next.Find(ctx, orgID, uid)
+	return r, storeError(err)
+}
+
+func (t *timeoutStore) FindByUID(ctx context.Context, uid string) (*Registration, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	r, err := t.next.FindByUID(ctx, uid)
+	return r, storeError(err)
+}
+
+func (t *timeoutStore) Create(ctx context.Context, r *Registration) (string, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	id, err := t.next.Create(ctx, r)
+	return id, storeError(err)
+}
+
+func (t *timeoutStore) Update(ctx context.Context, r *Registration, update *RegistrationUpdate, actor string) error {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	return storeError(t.next.Update(ctx, r, update, actor))
+}
+
+func (t *timeoutStore) Delete(ctx context.Context, orgID, uid, actor string) error {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	return storeError(t.next.Delete(ctx, orgID, uid, actor))
+}
+
+func (t *timeoutStore) Restore(ctx context.Context, orgID, uid, actor string, retention time.Duration) (*Registration, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	r, err := t.next.Restore(ctx, orgID, uid, actor, retention)
+	return r, storeError(err)
+}
+
+func (t *timeoutStore) Purge(ctx context.Context, retention time.Duration) (int, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	count, err := t.next.Purge(ctx, retention)
+	return count, storeError(err)
+}
+
+func (t *timeoutStore) UpdateLastSeen(ctx context.Context, seen map[string]time.Time) error {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	return storeError(t.next.UpdateLastSeen(ctx, seen))
+}
+
+func (t *timeoutStore) History(ctx context.Context, orgID, uid string) ([]RegistrationEvent, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	events, err := t.next.History(ctx, orgID, uid)
+	return events, storeError(err)
+}
+
+func (t *timeoutStore) Review(ctx context.Context, orgID, uid string, status RegistrationStatus, actor string) (*Registration, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	r, err := t.next.Review(ctx, orgID, uid, status, actor)
+	return r, storeError(err)
+}
+
+func (t *timeoutStore) AllowedAddresses(ctx context.Context, orgID string, q AllowlistQuery) ([]AllowlistBlock, int, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	blocks, count, err := t.next.AllowedAddresses(ctx, orgID, q)
+	return blocks, count, storeError(err)
+}
+
+func (t *timeoutStore) AllowedIP(ctx context.Context, ip, orgID string) (bool, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	allowed, err := t.next.AllowedIP(ctx, ip, orgID)
+	return allowed, storeError(err)
+}
+
+func (t *timeoutStore) AllowAddress(ctx context.Context, ip *AllowlistBlock) error {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	return storeError(t.next.AllowAddress(ctx, ip))
+}
+
+func (t *timeoutStore) DenyAddress(ctx context.Context, ip *AllowlistBlock) error {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	return storeError(t.next.DenyAddress(ctx, ip))
+}
+
+func (t *timeoutStore) PurgeExpiredAddresses(ctx context.Context) (int, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	count, err := t.next.PurgeExpiredAddresses(ctx)
+	return count, storeError(err)
+}
+
+// imports and snapshots read or write everything in one go, they're bounded
+// by the caller's context only instead of the per-query timeout
+
+func (t *timeoutStore) Import(ctx context.Context, rows []BulkRegistration, actor string) ([]ImportResult, error) {
+	results, err := t.next.Import(ctx, rows, actor)
+	return results, storeError(err)
+}
+
+func (t *timeoutStore) DumpSnapshot(ctx context.Context) (*Snapshot, error) {
+	snap, err := t.next.DumpSnapshot(ctx)
+	return snap, storeError(err)
+}
+
+func (t *timeoutStore) LoadSnapshot(ctx context.Context, snap *Snapshot, actor string) ([]SnapshotConflict, error) {
+	conflicts, err := t.next.LoadSnapshot(ctx, snap, actor)
+	return conflicts, storeError(err)
+}
+
+func (t *timeoutStore) ClaimOutbox(ctx context.Context, limit int, lease time.Duration) ([]OutboxEvent, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	events, err := t.next.ClaimOutbox(ctx, limit, lease)
+	return events, storeError(err)
+}
+
+func (t *timeoutStore) MarkOutboxDelivered(ctx context.Context, id int64) error {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	return storeError(t.next.MarkOutboxDelivered(ctx, id))
+}
+
+func (t *timeoutStore) MarkOutboxFailed(ctx context.Context, id int64, retryIn time.Duration, reason string) error {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	return storeError(t.next.MarkOutboxFailed(ctx, id, retryIn, reason))
+}
+
+func (t *timeoutStore) CreateWithinQuota(ctx context.Context, r *Registration, defaultLimit int) (string, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	id, err := t.next.CreateWithinQuota(ctx, r, defaultLimit)
+	return id, storeError(err)
+}
+
+func (t *timeoutStore) Quota(ctx context.Context, orgID string, defaultLimit int) (*Quota, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	q, err := t.next.Quota(ctx, orgID, defaultLimit)
+	return q, storeError(err)
+}
+
+func (t *timeoutStore) SetQuotaOverride(ctx context.Context, orgID string, limit *int) error {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	return storeError(t.next.SetQuotaOverride(ctx, orgID, limit))
+}
+
+func (t *timeoutStore) CreateEnrollmentCode(ctx context.Context, c *EnrollmentCode, codeHash string) error {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	return storeError(t.next.CreateEnrollmentCode(ctx, c, codeHash))
+}
+
+func (t *timeoutStore) EnrollmentCodes(ctx context.Context, orgID string) ([]EnrollmentCode, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	codes, err := t.next.EnrollmentCodes(ctx, orgID)
+	return codes, storeError(err)
+}
+
+func (t *timeoutStore) FindEnrollmentCode(ctx context.Context, codeHash string) (*EnrollmentCode, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	c, err := t.next.FindEnrollmentCode(ctx, codeHash)
+	return c, storeError(err)
+}
+
+func (t *timeoutStore) Enroll(ctx context.Context, r *Registration, codeHash string, defaultLimit int) (*EnrollmentCode, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	c, err := t.next.Enroll(ctx, r, codeHash, defaultLimit)
+	return c, storeError(err)
+}
+
+func (t *timeoutStore) OrgSettings(ctx context.Context, orgID string) (*OrgSettings, error) {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	settings, err := t.next.OrgSettings(ctx, orgID)
+	return settings, storeError(err)
+}
+
+func (t *timeoutStore) SetOrgSettings(ctx context.Context, s *OrgSettings) error {
+	ctx, cancel := t.context(ctx)
+	defer cancel()
+
+	return storeError(t.next.SetOrgSettings(ctx, s))
+}
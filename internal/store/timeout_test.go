@@ -0,0 +1,85 @@
+package store
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// slowStore never answers Find, it just waits for the caller to give up
+type slowStore struct {
+	*inMemoryStore
+}
+
+func (s slowStore) Find(ctx context.Context, _, _ string) (*Registration, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestTimeoutStoreTimesOut(t *testing.T) {
+	db := withTimeout(slowStore{&inMemoryStore{}}, 10*time.Millisecond)
+
+	_, err := db.Find(context.Background(), "1234", "1234")
+	assert.ErrorIs(t, err, ErrStoreTimeout)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+// Import takes longer than the query timeout but finishes unless the
+// caller gives up
+func (s slowStore) Import(ctx context.Context, _ []BulkRegistration, _ string) ([]ImportResult, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(50 * time.Millisecond):
+		return []ImportResult{}, nil
+	}
+}
+
+func TestTimeoutStoreImportIsNotLimited(t *testing.T) {
+	db := withTimeout(slowStore{&inMemoryStore{}}, 10*time.Millisecond)
+
+	_, err := db.Import(context.Background(), nil, "admin")
+	assert.Nil(t, err)
+}
+
+func TestTimeoutStoreCancelled(t *testing.T) {
+	db := withTimeout(slowStore{&inMemoryStore{}}, time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := db.Find(ctx, "1234", "1234")
+	assert.ErrorIs(t, err, ErrStoreUnavailable)
+}
+
+func TestTimeoutStorePassesOtherErrors(t *testing.T) {
+	db := withTimeout(&inMemoryStore{}, time.Minute)
+
+	_, err := db.Find(context.Background(), "1234", "1234")
+	assert.ErrorIs(t, err, ErrRegistrationNotFound)
+	assert.NotErrorIs(t, err, ErrStoreUnavailable)
+	assert.NotErrorIs(t, err, ErrStoreTimeout)
+}
+
+func TestStoreErrorBadConnection(t *testing.T) {
+	err := storeError(driver.ErrBadConn)
+	assert.ErrorIs(t, err, ErrStoreUnavailable)
+
+	assert.Nil(t, storeError(nil))
+	assert.Equal(t, "boom", storeError(errors.New("boom")).Error())
+}
+
+func TestTimeoutStorePoolStats(t *testing.T) {
+	s, err := setupSQLiteStore(filepath.Join(t.TempDir(), "mbop.db"))
+	assert.Nil(t, err)
+	defer s.db.Close()
+
+	db, ok := withTimeout(s, time.Minute).(PooledStore)
+	assert.True(t, ok)
+	assert.Equal(t, 1, db.PoolStats().MaxOpenConnections)
+}
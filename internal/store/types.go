@@ -10,23 +10,226 @@ Registration represents an instance of a satellite that is registered via:
 
 ID is a generated UUID
 Extra is just a jsonb column if we want to store some extra metadata someday
+DeletedAt is set when the registration has been soft-deleted, it can be
+restored until it is purged
+Certificate is the client certificate pinned at registration (or rotation)
+time, nil for registrations made before pinning
+LastSeenAt is the last time the satellite authenticated, nil if it never has
+Status is pending until approved for orgs that require approval, active
+otherwise. ReviewedBy/ReviewedAt are the admin that approved or rejected it
+and when.
 */
 type Registration struct {
-	ID          string
-	OrgID       string
-	Username    string
-	UID         string
-	DisplayName string
-	Extra       map[string]interface{}
-	CreatedAt   time.Time
+	ID          string                 `json:"id"`
+	OrgID       string                 `json:"org_id"`
+	Username    string                 `json:"username"`
+	UID         string                 `json:"uid"`
+	DisplayName string                 `json:"display_name"`
+	Extra       map[string]interface{} `json:"extra"`
+	CreatedAt   time.Time              `json:"created_at"`
+	DeletedAt   *time.Time             `json:"deleted_at,omitempty"`
+	Certificate *Certificate           `json:"certificate,omitempty"`
+	LastSeenAt  *time.Time             `json:"last_seen_at,omitempty"`
+	Status      RegistrationStatus     `json:"status,omitempty"`
+	ReviewedBy  string                 `json:"reviewed_by,omitempty"`
+	ReviewedAt  *time.Time             `json:"reviewed_at,omitempty"`
 }
 
+type RegistrationStatus string
+
+const (
+	RegistrationActive   RegistrationStatus = "active"
+	RegistrationPending  RegistrationStatus = "pending"
+	RegistrationRejected RegistrationStatus = "rejected"
+)
+
+// RegistrationStatuses lists the statuses registrations can be filtered by
+var RegistrationStatuses = []RegistrationStatus{RegistrationActive, RegistrationPending, RegistrationRejected}
+
+// status is what a new registration is stored with, registrations made
+// without one (and snapshots from before approval existed) are active
+func (r *Registration) status() RegistrationStatus {
+	if r.Status == "" {
+		return RegistrationActive
+	}
+	return r.Status
+}
+
+// RegistrationQuery narrows down and orders the registrations listed for an
+// org, every backend has to return the same rows in the same order for it.
+type RegistrationQuery struct {
+	Limit  int
+	Offset int
+	// case-insensitive substring match on either display_name or uid
+	Search string
+	// exact match on the username that registered it
+	Username      string
+	CreatedAfter  *time.Time
+	CreatedBefore *time.Time
+	// only registrations that haven't been seen since this time, including
+	// ones that have never been seen
+	NotSeenSince *time.Time
+	Status       RegistrationStatus
+	// top-level keys of extra whose value has to be exactly the given string
+	Extra map[string]string
+	// ties are broken by ID in the same direction, with no SortBy at all the
+	// order is newest first
+	SortBy   RegistrationSortField
+	SortDesc bool
+	// keyset position to page from instead of Offset, only valid when
+	// sorting by created_at
+	Cursor *Cursor
+}
+
+// order returns the effective sort field and direction
+func (q *RegistrationQuery) order() (RegistrationSortField, bool) {
+	if q.SortBy == "" {
+		return SortByCreatedAt, true
+	}
+	return q.SortBy, q.SortDesc
+}
+
+// AllowlistQuery pages through an org's allowlist, ordered by created_at and
+// then ip_block. A zero Limit returns every block.
+type AllowlistQuery struct {
+	Limit  int
+	Offset int
+	// keyset position to page from instead of Offset
+	Cursor *Cursor
+}
+
+type RegistrationSortField string
+
+const (
+	SortByCreatedAt   RegistrationSortField = "created_at"
+	SortByDisplayName RegistrationSortField = "display_name"
+	SortByUID         RegistrationSortField = "uid"
+)
+
+// RegistrationSortFields lists the fields registrations can be sorted by
+var RegistrationSortFields = []RegistrationSortField{SortByCreatedAt, SortByDisplayName, SortByUID}
+
+// Certificate identifies the exact client certificate a satellite registered
+// with, Fingerprint is the hex encoded sha256 of the DER bytes.
+type Certificate struct {
+	Fingerprint string    `json:"fingerprint"`
+	Serial      string    `json:"serial"`
+	NotAfter    time.Time `json:"not_after"`
+}
+
+// RegistrationUpdate holds the fields that can be changed on an existing
+// registration, nil fields are left untouched. Extra is merged into the
+// existing metadata rather than replacing it.
 type RegistrationUpdate struct {
-	Extra *map[string]interface{}
+	DisplayName *string
+	Extra       *map[string]interface{}
+	// replaces the pinned certificate, used when rotating
+	Certificate *Certificate
+}
+
+type RegistrationEventType string
+
+const (
+	RegistrationEventCreate  RegistrationEventType = "create"
+	RegistrationEventUpdate  RegistrationEventType = "update"
+	RegistrationEventDelete  RegistrationEventType = "delete"
+	RegistrationEventRestore RegistrationEventType = "restore"
+	RegistrationEventApprove RegistrationEventType = "approve"
+	RegistrationEventReject  RegistrationEventType = "reject"
+)
+
+/*
+RegistrationEvent is an audit record written by the store for every mutation
+of a registration:
+- Actor; the username (from x-rh-identity) that made the change
+- Before/After; snapshots of the registration, Before is nil on create and
+After is nil on delete
+*/
+type RegistrationEvent struct {
+	ID        string
+	Type      RegistrationEventType
+	OrgID     string
+	UID       string
+	Actor     string
+	Before    *Registration
+	After     *Registration
+	CreatedAt time.Time
 }
 
 type AllowlistBlock struct {
-	IPBlock   string
+	IPBlock   string    `json:"ip_block"`
+	OrgID     string    `json:"org_id"`
+	CreatedAt time.Time `json:"created_at"`
+	// the block stops applying after this and is cleaned up, nil never expires
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+	Description string     `json:"description,omitempty"`
+	// username that added the block, empty for ones added before it was
+	// recorded or through the admin api
+	CreatedBy string `json:"created_by,omitempty"`
+}
+
+// Expired reports whether the block no longer applies at now, it stays stored
+// until the cleaner deletes it
+func (b *AllowlistBlock) Expired(now time.Time) bool {
+	return b.ExpiresAt != nil && !b.ExpiresAt.After(now)
+}
+
+// Quota is how many live registrations an org may have next to how many it
+// has. Limit is nil when it's unlimited, Override is set when the limit is the
+// org's own rather than the configured default.
+type Quota struct {
+	OrgID    string
+	Limit    *int
+	Used     int
+	Override bool
+}
+
+// newQuota picks the org's override over the default, a default <= 0 is
+// unlimited
+func newQuota(orgID string, used int, override *int, defaultLimit int) *Quota {
+	q := &Quota{OrgID: orgID, Used: used, Limit: override, Override: override != nil}
+	if q.Limit == nil && defaultLimit > 0 {
+		q.Limit = &defaultLimit
+	}
+	return q
+}
+
+// Reached is true once there's no room for another registration
+func (q *Quota) Reached() bool {
+	return q.Limit != nil && q.Used >= *q.Limit
+}
+
+/*
+EnrollmentCode lets a satellite register itself without an org admin's
+identity:
+- OrgID/Username; the org and admin that created it, the registration made
+with it gets both
+- UsedAt/UsedBy; set once it's been redeemed, UsedBy being the satellite's UID
+The code itself is never stored, only its sha256.
+*/
+type EnrollmentCode struct {
+	ID        string
 	OrgID     string
+	Username  string
 	CreatedAt time.Time
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	UsedBy    string
+}
+
+// OrgSettings are the per-org switches, an org without any stored gets the
+// zero value
+type OrgSettings struct {
+	OrgID string
+	// new registrations are pending until another admin approves them
+	RequireApproval bool
+}
+
+// reviewEventTypes are the history and outbox events for approving (moving
+// to active) or rejecting a pending registration
+func reviewEventTypes(status RegistrationStatus) (RegistrationEventType, OutboxEventType) {
+	if status == RegistrationActive {
+		return RegistrationEventApprove, OutboxRegistrationApproved
+	}
+	return RegistrationEventReject, OutboxRegistrationRejected
 }